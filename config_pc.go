@@ -14,4 +14,20 @@ const xv11_serial = "/dev/ttyUSB0"
 const xv11_pwm = "21"
 const xv11_stby = "20"
 
+const rplidar_serial = "/dev/ttyUSB0"
+const ydlidar_serial = "/dev/ttyUSB0"
+const hokuyo_addr = "/dev/ttyACM0" // serial port or "host:port"
+
+// lidar devices: the name, type, port, motor pins and mounting in the robot frame
+// x, y: meters forward and left of the robot centre
+// yaw: degrees from the robot x-axis to the lidar zero angle
+// cw: lidar angles increase clockwise
+// express: rplidar express scan mode (otherwise standard scans)
+// polled, encoding: hokuyo single scans (GD/GS) and 2 or 3 character range encoding
+var lidar_devices = []lidar_device{
+	{name: "lidar0", kind: "xv11", port: xv11_serial, pwm: xv11_pwm, stby: xv11_stby},
+	// a rear facing scanner
+	// {name: "lidar1", kind: "xv11", port: "/dev/ttyUSB1", pwm: "19", stby: "26", x: -0.15, yaw: 180},
+}
+
 //-----------------------------------------------------------------------------
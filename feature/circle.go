@@ -0,0 +1,135 @@
+//-----------------------------------------------------------------------------
+/*
+
+Circles
+
+A circle is fitted to the points of a cluster with the algebraic (Kasa) fit:
+
+x^2 + y^2 + a.x + b.y + c = 0
+
+is linear in (a, b, c), so it's solved by least squares. The centre is
+(-a/2, -b/2) and the radius is sqrt(a^2/4 + b^2/4 - c).
+
+The cluster is a circle if the radius is within MinRadius..MaxRadius, the rms
+distance of the points from the circle is no more than CircleRMS, and the
+centre is further from the robot than the points (the robot sees the outside
+of a post, not the inside of a curved wall).
+
+Covariance:
+The (a, b, c) covariance is s2.inv(M) where M is the normal matrix of the
+least squares problem and s2 is the variance of the algebraic residuals, but
+at least (2.r.noise)^2. The centre covariance is a quarter of the (a, b) block.
+
+*/
+//-----------------------------------------------------------------------------
+
+package feature
+
+import (
+	"fmt"
+	"math"
+)
+
+//-----------------------------------------------------------------------------
+
+// Circle is a circular feature.
+type Circle struct {
+	C   Point   // centre (meters)
+	R   float64 // radius (meters)
+	Cov Cov     // covariance of the centre
+	N   int     // number of points
+	RMS float64 // rms distance of the points from the circle (meters)
+}
+
+func (c *Circle) String() string {
+	return fmt.Sprintf("(%.3f, %.3f) radius %.3f m, %d points, rms %.1f mm, cov %s",
+		c.C.X, c.C.Y, c.R, c.N, c.RMS*1000.0, c.Cov)
+}
+
+// invert a 3x3 matrix
+func inv3(m [3][3]float64) ([3][3]float64, bool) {
+	var r [3][3]float64
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-15 {
+		return r, false
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// cofactor (j, i) for the adjugate
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			r[i][j] = (m[a][c]*m[b][d] - m[a][d]*m[b][c]) / det
+		}
+	}
+	return r, true
+}
+
+// circle fits a circle to the points of a cluster.
+func (e *Extractor) circle(pts []Point) (Circle, bool) {
+	n := len(pts)
+	if n < e.CirclePoints {
+		return Circle{}, false
+	}
+	// least squares normal equations for (a, b, c)
+	var m [3][3]float64
+	var v [3]float64
+	for _, p := range pts {
+		row := [3]float64{p.X, p.Y, 1}
+		z := -(p.X*p.X + p.Y*p.Y)
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				m[i][j] += row[i] * row[j]
+			}
+			v[i] += row[i] * z
+		}
+	}
+	mi, ok := inv3(m)
+	if !ok {
+		return Circle{}, false
+	}
+	var k [3]float64
+	for i := 0; i < 3; i++ {
+		k[i] = mi[i][0]*v[0] + mi[i][1]*v[1] + mi[i][2]*v[2]
+	}
+	cx, cy := -k[0]/2, -k[1]/2
+	r2 := cx*cx + cy*cy - k[2]
+	if r2 <= 0 {
+		return Circle{}, false
+	}
+	circle := Circle{C: Point{cx, cy}, R: math.Sqrt(r2), N: n}
+	if circle.R < e.MinRadius || circle.R > e.MaxRadius {
+		return Circle{}, false
+	}
+	// geometric and algebraic residuals
+	var ss, sz, near float64
+	for _, p := range pts {
+		d := dist(p, circle.C) - circle.R
+		ss += d * d
+		z := p.X*p.X + p.Y*p.Y + k[0]*p.X + k[1]*p.Y + k[2]
+		sz += z * z
+		near += math.Hypot(p.X, p.Y)
+	}
+	circle.RMS = math.Sqrt(ss / float64(n))
+	if circle.RMS > e.CircleRMS {
+		return Circle{}, false
+	}
+	// the robot should see the outside of the circle
+	if math.Hypot(cx, cy) <= near/float64(n) {
+		return Circle{}, false
+	}
+	// covariance
+	s2 := 2.0 * circle.R * e.Noise
+	s2 *= s2
+	if n > 3 {
+		s2 = math.Max(s2, sz/float64(n-3))
+	}
+	circle.Cov = Cov{
+		{s2 * mi[0][0] / 4, s2 * mi[0][1] / 4},
+		{s2 * mi[1][0] / 4, s2 * mi[1][1] / 4},
+	}
+	return circle, true
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,95 @@
+//-----------------------------------------------------------------------------
+/*
+
+Corners
+
+A corner is the intersection of two lines of a cluster where an end point of
+each line is within CornerDist of the intersection, and the angle between the
+lines is at least CornerAngle (so nearly parallel lines don't make a corner).
+
+The intersection p solves A.p = r where the rows of A are (cos(theta),
+sin(theta)) of each line and r is their rho values. Each line contributes
+J.C.J' to the covariance of p, where C is the (rho, theta) covariance of the
+line and J = inv(A).e . (1, -t) with e the unit vector for the line and
+t = -x.sin(theta) + y.cos(theta) at the intersection.
+
+*/
+//-----------------------------------------------------------------------------
+
+package feature
+
+import (
+	"fmt"
+	"math"
+)
+
+//-----------------------------------------------------------------------------
+
+// Corner is the intersection of two lines.
+type Corner struct {
+	P     Point   // position (meters)
+	Cov   Cov     // covariance of the position
+	Angle float64 // angle between the lines (radians)
+	L0    int     // index of the first line
+	L1    int     // index of the second line
+}
+
+func (c *Corner) String() string {
+	return fmt.Sprintf("(%.3f, %.3f) angle %.1f deg, cov %s", c.P.X, c.P.Y, c.Angle*180.0/math.Pi, c.Cov)
+}
+
+// intersect two lines, returning the corner
+func intersect(l0, l1 *Line) (Corner, bool) {
+	c0, s0 := math.Cos(l0.Theta), math.Sin(l0.Theta)
+	c1, s1 := math.Cos(l1.Theta), math.Sin(l1.Theta)
+	det := c0*s1 - s0*c1
+	if det == 0 {
+		return Corner{}, false
+	}
+	// inv(A) = [s1 -s0; -c1 c0] / det
+	inv := [2][2]float64{{s1 / det, -s0 / det}, {-c1 / det, c0 / det}}
+	p := Point{
+		X: inv[0][0]*l0.Rho + inv[0][1]*l1.Rho,
+		Y: inv[1][0]*l0.Rho + inv[1][1]*l1.Rho,
+	}
+	var cov Cov
+	for i, l := range []*Line{l0, l1} {
+		t := -p.X*math.Sin(l.Theta) + p.Y*math.Cos(l.Theta)
+		// variance of rho - t.theta
+		v := l.Cov[0][0] - 2.0*t*l.Cov[0][1] + t*t*l.Cov[1][1]
+		a, b := inv[0][i], inv[1][i]
+		cov[0][0] += a * a * v
+		cov[0][1] += a * b * v
+		cov[1][1] += b * b * v
+	}
+	cov[1][0] = cov[0][1]
+	// angle between the lines
+	angle := math.Abs(math.Asin(det))
+	return Corner{P: p, Cov: cov, Angle: angle}, true
+}
+
+// is one of the line end points within d of a point?
+func near_end(l *Line, p Point, d float64) bool {
+	return dist(l.A, p) <= d || dist(l.B, p) <= d
+}
+
+// corners returns the corners between the lines of a cluster.
+func (e *Extractor) corners(lines []Line) []Corner {
+	var corners []Corner
+	for i := range lines {
+		for j := i + 1; j < len(lines); j++ {
+			c, ok := intersect(&lines[i], &lines[j])
+			if !ok || c.Angle < e.CornerAngle {
+				continue
+			}
+			if !near_end(&lines[i], c.P, e.CornerDist) || !near_end(&lines[j], c.P, e.CornerDist) {
+				continue
+			}
+			c.L0, c.L1 = i, j
+			corners = append(corners, c)
+		}
+	}
+	return corners
+}
+
+//-----------------------------------------------------------------------------
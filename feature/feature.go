@@ -0,0 +1,264 @@
+//-----------------------------------------------------------------------------
+/*
+
+Geometric Feature Extraction
+
+Converts a 2D LIDAR scan into geometric features:
+
+* Lines: line segments fitted to the wall samples (see line.go, ransac.go)
+* Corners: the intersections of adjacent line segments (see corner.go)
+* Circles: round objects like posts and table legs (see circle.go)
+
+Each feature has a covariance so it can be used by a SLAM front end.
+
+Scans are in the robot frame (see lidar/extrinsics.go), so the features are
+in the robot frame. Distances are meters and angles are radians.
+
+Samples are split into clusters where the distance between neighbouring
+samples is more than MaxGap. Lines are found within a cluster, so a line never
+bridges a gap in the scan. A cluster with no gap all round the robot (E.g. a
+closed room) is closed, the wall at the start of the scan continues at the end.
+
+*/
+//-----------------------------------------------------------------------------
+
+package feature
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+
+	"github.com/deadsy/slamx/lidar"
+)
+
+//-----------------------------------------------------------------------------
+
+// Point is a 2D point (meters).
+type Point struct {
+	X, Y float64
+}
+
+// Cov is a 2x2 covariance matrix.
+type Cov [2][2]float64
+
+func (c Cov) String() string {
+	return fmt.Sprintf("[%.3g %.3g; %.3g %.3g]", c[0][0], c[0][1], c[1][0], c[1][1])
+}
+
+// Features are the geometric features of a scan.
+type Features struct {
+	Lines   []Line
+	Corners []Corner
+	Circles []Circle
+}
+
+//-----------------------------------------------------------------------------
+
+// Method is the line extraction method.
+type Method int
+
+const (
+	SplitMerge Method = iota // split and merge
+	RANSAC                   // random sample consensus
+)
+
+var method_names = map[Method]string{
+	SplitMerge: "splitmerge",
+	RANSAC:     "ransac",
+}
+
+func (m Method) String() string {
+	if s, ok := method_names[m]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", int(m))
+}
+
+// ParseMethod returns the line extraction method for a name (splitmerge, ransac).
+func ParseMethod(name string) (Method, error) {
+	for m, s := range method_names {
+		if s == name {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown feature method \"%s\"", name)
+}
+
+//-----------------------------------------------------------------------------
+
+const FEATURE_NOISE = 0.01               // minimum range noise (meters)
+const FEATURE_MAX_GAP = 0.2              // maximum distance between neighbouring samples (meters)
+const FEATURE_SPLIT_DIST = 0.05          // split a line at a sample further than this (meters)
+const FEATURE_MIN_POINTS = 6             // minimum points in a line
+const FEATURE_MIN_LENGTH = 0.2           // minimum line length (meters)
+const FEATURE_RANSAC_ITERATIONS = 100    // ransac candidate lines per line
+const FEATURE_RANSAC_DIST = 0.03         // ransac inlier distance (meters)
+const FEATURE_RANSAC_LINES = 20          // maximum lines found by ransac
+const FEATURE_CORNER_DIST = 0.2          // maximum distance from a line end to the corner (meters)
+const FEATURE_CORNER_ANGLE = math.Pi / 6 // minimum angle between the lines of a corner
+const FEATURE_MIN_RADIUS = 0.02          // minimum circle radius (meters)
+const FEATURE_MAX_RADIUS = 0.3           // maximum circle radius (meters)
+const FEATURE_CIRCLE_POINTS = 4          // minimum points in a circle
+const FEATURE_CIRCLE_RMS = 0.01          // maximum rms distance from the circle (meters)
+
+// Extractor extracts the geometric features of a scan.
+type Extractor struct {
+	Method       Method     // line extraction method
+	Noise        float64    // minimum range noise (meters)
+	MaxGap       float64    // maximum distance between neighbouring samples (meters)
+	SplitDist    float64    // split a line at a sample further than this (meters)
+	MinPoints    int        // minimum points in a line
+	MinLength    float64    // minimum line length (meters)
+	RansacIter   int        // ransac candidate lines per line
+	RansacDist   float64    // ransac inlier distance (meters)
+	RansacLines  int        // maximum lines found by ransac
+	CornerDist   float64    // maximum distance from a line end to the corner (meters)
+	CornerAngle  float64    // minimum angle between the lines of a corner (radians)
+	MinRadius    float64    // minimum circle radius (meters)
+	MaxRadius    float64    // maximum circle radius (meters)
+	CirclePoints int        // minimum points in a circle
+	CircleRMS    float64    // maximum rms distance from the circle (meters)
+	Rand         *rand.Rand // random source for ransac
+}
+
+// NewExtractor returns a feature extractor with the default parameters.
+func NewExtractor(method Method) *Extractor {
+	return &Extractor{
+		Method:       method,
+		Noise:        FEATURE_NOISE,
+		MaxGap:       FEATURE_MAX_GAP,
+		SplitDist:    FEATURE_SPLIT_DIST,
+		MinPoints:    FEATURE_MIN_POINTS,
+		MinLength:    FEATURE_MIN_LENGTH,
+		RansacIter:   FEATURE_RANSAC_ITERATIONS,
+		RansacDist:   FEATURE_RANSAC_DIST,
+		RansacLines:  FEATURE_RANSAC_LINES,
+		CornerDist:   FEATURE_CORNER_DIST,
+		CornerAngle:  FEATURE_CORNER_ANGLE,
+		MinRadius:    FEATURE_MIN_RADIUS,
+		MaxRadius:    FEATURE_MAX_RADIUS,
+		CirclePoints: FEATURE_CIRCLE_POINTS,
+		CircleRMS:    FEATURE_CIRCLE_RMS,
+		Rand:         rand.New(rand.NewSource(1)),
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// return the good samples of a scan as clusters of points in scan order,
+// and whether the scan is a single closed cluster
+func (e *Extractor) clusters(scan *lidar.Scan2D) ([][]Point, bool) {
+	var clusters [][]Point
+	var c []Point
+	for i := range scan.Samples {
+		s := &scan.Samples[i]
+		if !s.Good {
+			continue
+		}
+		a, d := float64(s.Angle), float64(s.Distance)
+		p := Point{d * math.Cos(a), d * math.Sin(a)}
+		if len(c) != 0 && dist(c[len(c)-1], p) > e.MaxGap {
+			clusters = append(clusters, c)
+			c = nil
+		}
+		c = append(c, p)
+	}
+	if len(c) == 0 {
+		return clusters, false
+	}
+	// join the last and first clusters if they're continuous across the end of the scan
+	if len(clusters) != 0 && dist(c[len(c)-1], clusters[0][0]) <= e.MaxGap {
+		clusters[0] = append(c, clusters[0]...)
+		return clusters, false
+	}
+	clusters = append(clusters, c)
+	closed := len(clusters) == 1 && len(c) > 2 && dist(c[len(c)-1], c[0]) <= e.MaxGap
+	return clusters, closed
+}
+
+// distance between two points
+func dist(a, b Point) float64 {
+	return math.Hypot(a.X-b.X, a.Y-b.Y)
+}
+
+// Extract returns the geometric features of a scan.
+func (e *Extractor) Extract(scan *lidar.Scan2D) *Features {
+	f := &Features{}
+	clusters, closed := e.clusters(scan)
+	for _, c := range clusters {
+		var lines []Line
+		if e.Method == RANSAC {
+			lines = e.ransac(c)
+		} else {
+			lines = e.split_merge(c, closed)
+		}
+		if len(lines) == 0 {
+			// a small cluster that isn't a line might be a post
+			if circle, ok := e.circle(c); ok {
+				f.Circles = append(f.Circles, circle)
+			}
+			continue
+		}
+		// the corner line indices are within the cluster
+		ofs := len(f.Lines)
+		for _, cr := range e.corners(lines) {
+			cr.L0 += ofs
+			cr.L1 += ofs
+			f.Corners = append(f.Corners, cr)
+		}
+		f.Lines = append(f.Lines, lines...)
+	}
+	return f
+}
+
+//-----------------------------------------------------------------------------
+
+// Rows returns the features as (name, value) rows.
+func (f *Features) Rows() [][]string {
+	rows := make([][]string, 0, len(f.Lines)+len(f.Corners)+len(f.Circles))
+	for i := range f.Lines {
+		rows = append(rows, []string{fmt.Sprintf("line %d", i), f.Lines[i].String()})
+	}
+	for i := range f.Corners {
+		rows = append(rows, []string{fmt.Sprintf("corner %d", i), f.Corners[i].String()})
+	}
+	for i := range f.Circles {
+		rows = append(rows, []string{fmt.Sprintf("circle %d", i), f.Circles[i].String()})
+	}
+	return rows
+}
+
+// WriteCSV writes the features as comma separated values.
+//
+// line,x0,y0,x1,y1,rho,theta,var_rho,cov_rho_theta,var_theta
+// corner,x,y,var_x,cov_xy,var_y
+// circle,x,y,r,var_x,cov_xy,var_y
+func (f *Features) WriteCSV(w io.Writer) error {
+	for i := range f.Lines {
+		l := &f.Lines[i]
+		_, err := fmt.Fprintf(w, "line,%g,%g,%g,%g,%g,%g,%g,%g,%g\n",
+			l.A.X, l.A.Y, l.B.X, l.B.Y, l.Rho, l.Theta, l.Cov[0][0], l.Cov[0][1], l.Cov[1][1])
+		if err != nil {
+			return err
+		}
+	}
+	for i := range f.Corners {
+		c := &f.Corners[i]
+		_, err := fmt.Fprintf(w, "corner,%g,%g,%g,%g,%g\n", c.P.X, c.P.Y, c.Cov[0][0], c.Cov[0][1], c.Cov[1][1])
+		if err != nil {
+			return err
+		}
+	}
+	for i := range f.Circles {
+		c := &f.Circles[i]
+		_, err := fmt.Fprintf(w, "circle,%g,%g,%g,%g,%g,%g\n", c.C.X, c.C.Y, c.R, c.Cov[0][0], c.Cov[0][1], c.Cov[1][1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
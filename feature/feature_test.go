@@ -0,0 +1,279 @@
+//-----------------------------------------------------------------------------
+/*
+
+Feature Extraction Tests
+
+The scans are ray cast from the robot in synthetic rooms, so the walls,
+corners and posts are known exactly. The covariance tests use point sets
+where the formulas reduce to closed forms.
+
+*/
+//-----------------------------------------------------------------------------
+
+package feature
+
+import (
+	"math"
+	"testing"
+
+	"github.com/deadsy/slamx/lidar"
+)
+
+//-----------------------------------------------------------------------------
+
+// distance along a ray from the robot to a wall of a room (x0..x1, y0..y1)
+// around the robot
+func room_range(a, x0, y0, x1, y1 float64) float64 {
+	c, s := math.Cos(a), math.Sin(a)
+	d := math.Inf(1)
+	if c > 0 {
+		d = math.Min(d, x1/c)
+	} else if c < 0 {
+		d = math.Min(d, x0/c)
+	}
+	if s > 0 {
+		d = math.Min(d, y1/s)
+	} else if s < 0 {
+		d = math.Min(d, y0/s)
+	}
+	return d
+}
+
+// distance along a ray from the robot to a post, 0 if it misses
+func post_range(a float64, post Point, r float64) float64 {
+	c, s := math.Cos(a), math.Sin(a)
+	// |t.u - p|^2 = r^2
+	b := c*post.X + s*post.Y
+	k := b*b - (post.X*post.X + post.Y*post.Y - r*r)
+	if k < 0 || b < 0 {
+		return 0
+	}
+	return b - math.Sqrt(k)
+}
+
+// scan with a sample every degree, range returns 0 for no data
+func test_scan(rng func(a float64) float64) *lidar.Scan2D {
+	scan := &lidar.Scan2D{}
+	for i := 0; i < 360; i++ {
+		a := float64(i) * math.Pi / 180.0
+		d := rng(a)
+		scan.Samples = append(scan.Samples, lidar.Sample2D{
+			Good:     d != 0,
+			Angle:    float32(a),
+			Distance: float32(d),
+		})
+	}
+	return scan
+}
+
+func near(a, b, tol float64) bool {
+	return math.Abs(a-b) <= tol
+}
+
+// find a line by its (rho, theta)
+func find_line(lines []Line, rho, theta float64) *Line {
+	for i := range lines {
+		l := &lines[i]
+		if near(l.Rho, rho, 0.01) && near(math.Abs(math.Remainder(l.Theta-theta, 2.0*math.Pi)), 0, 0.01) {
+			return l
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+// a 4 x 3 m room with the robot at (1.5, 1.2)
+func square_room(t *testing.T, method Method) {
+	scan := test_scan(func(a float64) float64 { return room_range(a, -1.5, -1.2, 2.5, 1.8) })
+	f := NewExtractor(method).Extract(scan)
+	if len(f.Lines) != 4 || len(f.Corners) != 4 || len(f.Circles) != 0 {
+		t.Fatalf("%s: %d lines, %d corners, %d circles", method, len(f.Lines), len(f.Corners), len(f.Circles))
+	}
+	walls := [][2]float64{{2.5, 0}, {1.8, math.Pi / 2}, {1.5, math.Pi}, {1.2, 3 * math.Pi / 2}}
+	for _, w := range walls {
+		if find_line(f.Lines, w[0], w[1]) == nil {
+			t.Errorf("%s: no wall at rho %.1f theta %.0f deg", method, w[0], w[1]*180.0/math.Pi)
+		}
+	}
+	corners := []Point{{2.5, 1.8}, {-1.5, 1.8}, {-1.5, -1.2}, {2.5, -1.2}}
+	for _, p := range corners {
+		found := false
+		for _, c := range f.Corners {
+			if near(c.P.X, p.X, 0.01) && near(c.P.Y, p.Y, 0.01) && near(c.Angle, math.Pi/2, 0.01) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: no corner at (%.1f, %.1f)", method, p.X, p.Y)
+		}
+	}
+}
+
+func Test_Square_Room_SplitMerge(t *testing.T) {
+	square_room(t, SplitMerge)
+}
+
+func Test_Square_Room_RANSAC(t *testing.T) {
+	square_room(t, RANSAC)
+}
+
+func Test_Post(t *testing.T) {
+	post := Point{1.0, 0.5}
+	scan := test_scan(func(a float64) float64 { return post_range(a, post, 0.1) })
+	f := NewExtractor(SplitMerge).Extract(scan)
+	if len(f.Lines) != 0 || len(f.Circles) != 1 {
+		t.Fatalf("%d lines, %d circles", len(f.Lines), len(f.Circles))
+	}
+	c := f.Circles[0]
+	if !near(c.C.X, post.X, 1e-3) || !near(c.C.Y, post.Y, 1e-3) || !near(c.R, 0.1, 1e-3) {
+		t.Errorf("circle %s", &c)
+	}
+}
+
+func Test_Split_Merge(t *testing.T) {
+	e := NewExtractor(SplitMerge)
+	// a straight wall with 1 cm ripple is a single line
+	var pts []Point
+	for i := 0; i <= 40; i++ {
+		pts = append(pts, Point{0.05 * float64(i), 1 + 0.01*float64(i%2)})
+	}
+	if lines := e.split_merge(pts, false); len(lines) != 1 {
+		t.Errorf("straight wall: %d lines", len(lines))
+	}
+	// a step: (0,1)-(1,1), (1,1)-(1,2), (1,2)-(2,2)
+	pts = nil
+	for i := 0; i < 20; i++ {
+		pts = append(pts, Point{0.05 * float64(i), 1})
+	}
+	for i := 0; i < 20; i++ {
+		pts = append(pts, Point{1, 1 + 0.05*float64(i)})
+	}
+	for i := 0; i <= 20; i++ {
+		pts = append(pts, Point{1 + 0.05*float64(i), 2})
+	}
+	lines := e.split_merge(pts, false)
+	if len(lines) != 3 {
+		t.Fatalf("step: %d lines", len(lines))
+	}
+	ends := [][2]Point{{{0, 1}, {1, 1}}, {{1, 1}, {1, 2}}, {{1, 2}, {2, 2}}}
+	for i, l := range lines {
+		if dist(l.A, ends[i][0]) > 0.06 || dist(l.B, ends[i][1]) > 0.06 {
+			t.Errorf("step line %d: %s", i, &l)
+		}
+	}
+}
+
+func Test_RANSAC(t *testing.T) {
+	e := NewExtractor(RANSAC)
+	// two collinear runs with a gap, and scattered clutter
+	var pts []Point
+	for i := 0; i < 20; i++ {
+		pts = append(pts, Point{0.05 * float64(i), 1})
+		pts = append(pts, Point{2 + 0.05*float64(i), 1})
+		pts = append(pts, Point{0.1 * float64(i), -0.5 + 0.37*float64(i%3)})
+	}
+	lines := e.ransac(pts)
+	n := 0
+	for _, l := range lines {
+		if near(l.Rho, 1, 1e-6) && near(l.Theta, math.Pi/2, 1e-6) {
+			n += 1
+		}
+	}
+	if n != 2 {
+		t.Errorf("%d of %d lines on the wall, expected 2", n, len(lines))
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_Line_Covariance(t *testing.T) {
+	// y = 1 with a +d -d -d +d pattern, so the fit is exact and the residual
+	// variance is n.d^2 / (n - 2)
+	const n, d = 20, 0.02
+	var pts []Point
+	for i := 0; i < n; i++ {
+		off := d
+		if i%4 == 1 || i%4 == 2 {
+			off = -d
+		}
+		pts = append(pts, Point{0.1 * float64(i), 1 + off})
+	}
+	l := NewExtractor(SplitMerge).fit_line(pts)
+	if !near(l.Rho, 1, 1e-9) || !near(l.Theta, math.Pi/2, 1e-9) || !near(l.RMS, d, 1e-9) {
+		t.Fatalf("line %s", &l)
+	}
+	// the centroid is at x = 0.95, so t = -0.95
+	// the spread along the line is 0.01 * sum((i - 9.5)^2) = 6.65
+	s2 := n * d * d / (n - 2)
+	spread, tc := 6.65, -0.95
+	want := Cov{
+		{s2/n + tc*tc*s2/spread, tc * s2 / spread},
+		{tc * s2 / spread, s2 / spread},
+	}
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			if !near(l.Cov[i][j], want[i][j], 1e-9) {
+				t.Errorf("covariance %s, expected %s", l.Cov, want)
+			}
+		}
+	}
+}
+
+func Test_Corner_Covariance(t *testing.T) {
+	// x = 2 and y = 1 meet at (2, 1)
+	l0 := Line{Rho: 2, Theta: 0, Cov: Cov{{0.01, 0.002}, {0.002, 0.001}}}
+	l1 := Line{Rho: 1, Theta: math.Pi / 2, Cov: Cov{{0.02, -0.001}, {-0.001, 0.0005}}}
+	c, ok := intersect(&l0, &l1)
+	if !ok || !near(c.P.X, 2, 1e-9) || !near(c.P.Y, 1, 1e-9) || !near(c.Angle, math.Pi/2, 1e-9) {
+		t.Fatalf("corner %s", &c)
+	}
+	// x only depends on l0 with t = y = 1: var(x) = 0.01 - 2(0.002) + 0.001
+	// y only depends on l1 with t = -x = -2: var(y) = 0.02 + 4(-0.001) + 4(0.0005)
+	want := Cov{{0.007, 0}, {0, 0.018}}
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			if !near(c.Cov[i][j], want[i][j], 1e-12) {
+				t.Errorf("covariance %s, expected %s", c.Cov, want)
+			}
+		}
+	}
+}
+
+func Test_Circle_Covariance(t *testing.T) {
+	// the near half of a circle at (1, 0), symmetric about the x-axis
+	cx, r := 1.0, 0.1
+	var pts []Point
+	var sy, mc float64
+	for a := 100; a <= 260; a += 10 {
+		phi := float64(a) * math.Pi / 180.0
+		pts = append(pts, Point{cx + r*math.Cos(phi), r * math.Sin(phi)})
+		sy += math.Sin(phi) * math.Sin(phi)
+		mc += math.Cos(phi)
+	}
+	mc /= float64(len(pts))
+	var sx float64
+	for _, p := range pts {
+		k := (p.X-cx)/r - mc
+		sx += k * k
+	}
+	e := NewExtractor(SplitMerge)
+	c, ok := e.circle(pts)
+	if !ok || !near(c.C.X, cx, 1e-9) || !near(c.C.Y, 0, 1e-9) || !near(c.R, r, 1e-9) {
+		t.Fatalf("circle %s", &c)
+	}
+	// with no residuals s2 = (2.r.noise)^2, and the x and y terms of the fit
+	// decouple, so var(cx) = noise^2 / sum((cos - mean)^2) and
+	// var(cy) = noise^2 / sum(sin^2)
+	s2 := e.Noise * e.Noise
+	want := Cov{{s2 / sx, 0}, {0, s2 / sy}}
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			if !near(c.Cov[i][j], want[i][j], 1e-9) {
+				t.Errorf("covariance %s, expected %s", c.Cov, want)
+			}
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
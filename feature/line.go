@@ -0,0 +1,214 @@
+//-----------------------------------------------------------------------------
+/*
+
+Line Segments
+
+A line is fitted to a set of points by total least squares: the line passes
+through the centroid along the principal axis of the points. The line is
+kept in Hessian normal form:
+
+x.cos(theta) + y.sin(theta) = rho
+
+where rho >= 0 is the distance from the robot and theta is the direction of
+the line normal. The segment end points are the projections of the first and
+last points onto the line.
+
+Covariance:
+With n points, a noise variance s2 and a spread S of the points along the
+line, the (rho, theta) covariance is:
+
+var(theta) = s2 / S
+var(rho) = s2 / n + t^2 . s2 / S
+cov(rho, theta) = t . s2 / S
+
+where t is the position of the centroid along the line. s2 is the residual
+variance of the fit, but at least the square of the range noise.
+
+Split and Merge:
+The points of a cluster are in scan order. A line is fitted to the points and
+split at the point furthest from the line while that's more than SplitDist.
+Adjacent lines are then merged if a line fitted to both of them is within
+SplitDist of all their points. For a closed cluster the last line is adjacent
+to the first.
+
+*/
+//-----------------------------------------------------------------------------
+
+package feature
+
+import (
+	"fmt"
+	"math"
+)
+
+//-----------------------------------------------------------------------------
+
+// Line is a line segment.
+type Line struct {
+	A, B  Point   // end points
+	Rho   float64 // distance of the line from the robot (meters)
+	Theta float64 // direction of the line normal (radians)
+	Cov   Cov     // covariance of (rho, theta)
+	N     int     // number of points
+	RMS   float64 // rms distance of the points from the line (meters)
+}
+
+func (l *Line) String() string {
+	return fmt.Sprintf("(%.3f, %.3f)-(%.3f, %.3f) rho %.3f m theta %.1f deg, %d points, rms %.1f mm, cov %s",
+		l.A.X, l.A.Y, l.B.X, l.B.Y, l.Rho, l.Theta*180.0/math.Pi, l.N, l.RMS*1000.0, l.Cov)
+}
+
+// Length returns the length of the line segment.
+func (l *Line) Length() float64 {
+	return dist(l.A, l.B)
+}
+
+// Dist returns the distance of a point from the (infinite) line.
+func (l *Line) Dist(p Point) float64 {
+	return math.Abs(p.X*math.Cos(l.Theta) + p.Y*math.Sin(l.Theta) - l.Rho)
+}
+
+// project a point onto the line
+func (l *Line) project(p Point) Point {
+	c, s := math.Cos(l.Theta), math.Sin(l.Theta)
+	d := p.X*c + p.Y*s - l.Rho
+	return Point{p.X - d*c, p.Y - d*s}
+}
+
+//-----------------------------------------------------------------------------
+
+// fit a line to the points by total least squares
+func (e *Extractor) fit_line(pts []Point) Line {
+	n := float64(len(pts))
+	var mx, my float64
+	for _, p := range pts {
+		mx += p.X
+		my += p.Y
+	}
+	mx /= n
+	my /= n
+	var sxx, syy, sxy float64
+	for _, p := range pts {
+		dx, dy := p.X-mx, p.Y-my
+		sxx += dx * dx
+		syy += dy * dy
+		sxy += dx * dy
+	}
+	// the normal is the minor axis of the scatter
+	theta := 0.5*math.Atan2(2.0*sxy, sxx-syy) + math.Pi/2
+	rho := mx*math.Cos(theta) + my*math.Sin(theta)
+	if rho < 0 {
+		rho = -rho
+		theta += math.Pi
+	}
+	theta = math.Mod(theta, 2.0*math.Pi)
+	if theta < 0 {
+		theta += 2.0 * math.Pi
+	}
+	l := Line{Rho: rho, Theta: theta, N: len(pts)}
+	// residuals and the spread along the line
+	c, s := math.Cos(theta), math.Sin(theta)
+	var ss, spread float64
+	for _, p := range pts {
+		d := l.Dist(p)
+		ss += d * d
+		u := -(p.X-mx)*s + (p.Y-my)*c
+		spread += u * u
+	}
+	l.RMS = math.Sqrt(ss / n)
+	// covariance
+	s2 := e.Noise * e.Noise
+	if len(pts) > 2 {
+		s2 = math.Max(s2, ss/(n-2))
+	}
+	t := -mx*s + my*c
+	if spread > 0 {
+		l.Cov[1][1] = s2 / spread
+		l.Cov[0][0] = s2/n + t*t*s2/spread
+		l.Cov[0][1] = t * s2 / spread
+		l.Cov[1][0] = l.Cov[0][1]
+	}
+	l.A = l.project(pts[0])
+	l.B = l.project(pts[len(pts)-1])
+	return l
+}
+
+// return the index and distance of the point furthest from a line
+func furthest(l *Line, pts []Point) (int, float64) {
+	idx, max := 0, 0.0
+	for i, p := range pts {
+		if d := l.Dist(p); d > max {
+			idx, max = i, d
+		}
+	}
+	return idx, max
+}
+
+// is a line good enough to keep?
+func (e *Extractor) keep(l *Line) bool {
+	return l.N >= e.MinPoints && l.Length() >= e.MinLength
+}
+
+//-----------------------------------------------------------------------------
+
+// split_merge returns the lines of a cluster found by split and merge.
+// The last point of a closed cluster is next to the first.
+func (e *Extractor) split_merge(pts []Point, closed bool) []Line {
+	// split, keeping track of the points of each line
+	var segs [][]Point
+	var split func(pts []Point)
+	split = func(pts []Point) {
+		if len(pts) < 2 {
+			return
+		}
+		l := e.fit_line(pts)
+		idx, d := furthest(&l, pts)
+		if d <= e.SplitDist || len(pts) < 3 {
+			segs = append(segs, pts)
+			return
+		}
+		if idx == 0 {
+			idx = 1
+		} else if idx == len(pts)-1 {
+			idx = len(pts) - 2
+		}
+		split(pts[:idx+1])
+		split(pts[idx:])
+	}
+	split(pts)
+	// merge adjacent collinear segments
+	var merged [][]Point
+	for _, seg := range segs {
+		if k := len(merged) - 1; k >= 0 {
+			prev := merged[k]
+			// the segments share their end point
+			both := append(append([]Point{}, prev...), seg[1:]...)
+			l := e.fit_line(both)
+			if _, d := furthest(&l, both); d <= e.SplitDist {
+				merged[k] = both
+				continue
+			}
+		}
+		merged = append(merged, seg)
+	}
+	// a closed cluster starts at an arbitrary point, so the last segment may continue into the first
+	if k := len(merged) - 1; closed && k > 0 {
+		both := append(append([]Point{}, merged[k]...), merged[0]...)
+		l := e.fit_line(both)
+		if _, d := furthest(&l, both); d <= e.SplitDist {
+			merged[0] = both
+			merged = merged[:k]
+		}
+	}
+	// fit the final lines
+	var lines []Line
+	for _, seg := range merged {
+		l := e.fit_line(seg)
+		if e.keep(&l) {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+//-----------------------------------------------------------------------------
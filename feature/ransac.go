@@ -0,0 +1,117 @@
+//-----------------------------------------------------------------------------
+/*
+
+RANSAC Line Extraction
+
+Random sample consensus finds lines in a cluster without relying on the
+order of the points, so it copes better with clutter than split and merge.
+
+A candidate line is drawn through two random points and its inliers are the
+points within RansacDist of it. The candidate with the most inliers (out of
+RansacIter candidates) is refitted to its inliers by total least squares. The
+inliers are split into runs of neighbouring points (no more than MaxGap apart)
+and each run long enough is kept as a line. The inliers are removed and the
+search repeats until no candidate has MinPoints inliers.
+
+*/
+//-----------------------------------------------------------------------------
+
+package feature
+
+import (
+	"math"
+	"sort"
+)
+
+//-----------------------------------------------------------------------------
+
+// line through two points
+func line_through(a, b Point) (Line, bool) {
+	dx, dy := b.X-a.X, b.Y-a.Y
+	n := math.Hypot(dx, dy)
+	if n == 0 {
+		return Line{}, false
+	}
+	theta := math.Atan2(dx, -dy)
+	l := Line{Theta: theta}
+	l.Rho = a.X*math.Cos(theta) + a.Y*math.Sin(theta)
+	return l, true
+}
+
+// return the indices of the points within d of a line
+func inliers(l *Line, pts []Point, d float64) []int {
+	var idx []int
+	for i, p := range pts {
+		if l.Dist(p) <= d {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// ransac returns the lines of a cluster found by random sample consensus.
+func (e *Extractor) ransac(pts []Point) []Line {
+	var lines []Line
+	pts = append([]Point{}, pts...)
+	for len(lines) < e.RansacLines && len(pts) >= e.MinPoints {
+		// find the candidate with the most inliers
+		var best []int
+		for i := 0; i < e.RansacIter; i++ {
+			a, b := e.Rand.Intn(len(pts)), e.Rand.Intn(len(pts))
+			l, ok := line_through(pts[a], pts[b])
+			if !ok {
+				continue
+			}
+			if idx := inliers(&l, pts, e.RansacDist); len(idx) > len(best) {
+				best = idx
+			}
+		}
+		if len(best) < e.MinPoints {
+			break
+		}
+		// refit to the inliers and take the inliers of the refitted line
+		in := make([]Point, len(best))
+		for i, k := range best {
+			in[i] = pts[k]
+		}
+		l := e.fit_line(in)
+		best = inliers(&l, pts, e.RansacDist)
+		if len(best) < e.MinPoints {
+			break
+		}
+		// order the inliers along the line and split them at the gaps
+		c, s := math.Cos(l.Theta), math.Sin(l.Theta)
+		along := func(p Point) float64 { return -p.X*s + p.Y*c }
+		in = in[:0]
+		for _, k := range best {
+			in = append(in, pts[k])
+		}
+		sort.Slice(in, func(i, j int) bool { return along(in[i]) < along(in[j]) })
+		start := 0
+		for i := 1; i <= len(in); i++ {
+			if i < len(in) && dist(in[i-1], in[i]) <= e.MaxGap {
+				continue
+			}
+			run := e.fit_line(in[start:i])
+			if e.keep(&run) {
+				lines = append(lines, run)
+			}
+			start = i
+		}
+		// remove the inliers
+		used := make([]bool, len(pts))
+		for _, k := range best {
+			used[k] = true
+		}
+		rest := pts[:0]
+		for i, p := range pts {
+			if !used[i] {
+				rest = append(rest, p)
+			}
+		}
+		pts = rest
+	}
+	return lines
+}
+
+//-----------------------------------------------------------------------------
@@ -13,6 +13,7 @@ package gpio
 import (
 	"fmt"
 	"log"
+	"sync"
 )
 
 // clamp a value from 0.0 to 1.0
@@ -41,7 +42,7 @@ func NewGPIO(name string) (*GPIO, error) {
 }
 
 func (g *GPIO) Close() {
-	log.Printf("%s.Close() %s", g.Name)
+	log.Printf("%s.Close()", g.Name)
 }
 
 //-----------------------------------------------------------------------------
@@ -90,6 +91,7 @@ type PWM struct {
 	gpio *GPIO
 	pin  string
 	val  float32
+	lock sync.Mutex // lock for access to val
 }
 
 // Create a new PWM device.
@@ -107,9 +109,18 @@ func (g *GPIO) NewPWM(pin string, val float32) (*PWM, error) {
 // Set the PWM value
 func (p *PWM) Set(val float32) {
 	log.Printf("%s.Set() %f\n", p.Name, val)
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	p.val = clamp(val)
 }
 
+// Get the PWM value
+func (p *PWM) Get() float32 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.val
+}
+
 // Close the PWM channel
 func (p *PWM) Close() {
 	log.Printf("%s.Close()", p.Name)
@@ -18,6 +18,7 @@ import (
 	"log"
 	"math"
 	"os"
+	"sync"
 )
 
 //-----------------------------------------------------------------------------
@@ -127,6 +128,7 @@ type PWM struct {
 	gpio *GPIO
 	pin  string
 	val  float32
+	lock sync.Mutex // lock for access to val
 }
 
 // Create a new PWM device.
@@ -144,6 +146,8 @@ func (g *GPIO) NewPWM(pin string, val float32) (*PWM, error) {
 // Set the PWM value
 func (p *PWM) Set(val float32) {
 	log.Printf("%s.Set() %f\n", p.Name, val)
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	val = normalise(val)
 	if val != 0.0 && val == p.val {
 		// no change
@@ -153,6 +157,13 @@ func (p *PWM) Set(val float32) {
 	p.gpio.write(fmt.Sprintf("%s=%.3f\n", p.pin, p.val))
 }
 
+// Get the PWM value
+func (p *PWM) Get() float32 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.val
+}
+
 // Close the PWM channel
 func (p *PWM) Close() {
 	log.Printf("%s.Close()", p.Name)
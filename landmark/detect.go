@@ -0,0 +1,189 @@
+//-----------------------------------------------------------------------------
+/*
+
+Retroreflective Landmark Detection
+
+Retroreflective tape returns far more light than ordinary surfaces, so it
+shows up in a scan as a run of adjacent samples with a high signal strength.
+
+A cluster is a run of adjacent good samples with a signal strength of at least
+MinSignal, where the range changes by no more than MaxStep between neighbours.
+Clusters with too few samples, or a width outside MinWidth..MaxWidth are
+rejected.
+
+The centre of a cluster is the signal strength weighted mean of its points.
+For flat tape that's the middle of the tape. For a reflective post it's on the
+surface of the post, not the axis.
+
+The width is the distance between the end points of the cluster plus the
+footprint of one sample, so a single sample cluster has a non-zero width.
+
+Scans are in the robot frame (see lidar/extrinsics.go), so the detections are
+robot frame positions.
+
+*/
+//-----------------------------------------------------------------------------
+
+package landmark
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/deadsy/slamx/lidar"
+)
+
+//-----------------------------------------------------------------------------
+
+const DETECT_MIN_SIGNAL = 1500 // minimum signal strength of a landmark sample
+const DETECT_MIN_SAMPLES = 2   // minimum samples in a cluster
+const DETECT_MAX_STEP = 0.1    // maximum range step between cluster samples (meters)
+const DETECT_MIN_WIDTH = 0.01  // minimum landmark width (meters)
+const DETECT_MAX_WIDTH = 0.3   // maximum landmark width (meters)
+
+// Detector finds clusters of high signal strength samples in a scan.
+type Detector struct {
+	MinSignal  float32 // minimum signal strength of a landmark sample
+	MinSamples int     // minimum samples in a cluster
+	MaxStep    float64 // maximum range step between cluster samples (meters)
+	MinWidth   float64 // minimum landmark width (meters)
+	MaxWidth   float64 // maximum landmark width (meters)
+}
+
+// NewDetector returns a detector with the default parameters.
+func NewDetector() *Detector {
+	return &Detector{
+		MinSignal:  DETECT_MIN_SIGNAL,
+		MinSamples: DETECT_MIN_SAMPLES,
+		MaxStep:    DETECT_MAX_STEP,
+		MinWidth:   DETECT_MIN_WIDTH,
+		MaxWidth:   DETECT_MAX_WIDTH,
+	}
+}
+
+func (d *Detector) String() string {
+	return fmt.Sprintf("signal >= %.0f, samples >= %d, step <= %.3f m, width %.3f..%.3f m",
+		d.MinSignal, d.MinSamples, d.MaxStep, d.MinWidth, d.MaxWidth)
+}
+
+//-----------------------------------------------------------------------------
+
+// Detection is a cluster of high signal strength samples.
+type Detection struct {
+	X, Y    float64 // centre in the robot frame (meters)
+	Range   float64 // distance to the centre (meters)
+	Bearing float64 // angle to the centre (radians, [-pi, pi))
+	Width   float64 // width of the cluster (meters)
+	Signal  float64 // mean signal strength
+	Samples int     // number of samples in the cluster
+}
+
+// wrap an angle to [-pi, pi)
+func wrap_pi(a float64) float64 {
+	return a - 2.0*math.Pi*math.Floor((a+math.Pi)/(2.0*math.Pi))
+}
+
+// is the sample a landmark sample?
+func (d *Detector) bright(s *lidar.Sample2D) bool {
+	return s.Good && s.Signal_Strength >= d.MinSignal
+}
+
+// are two adjacent landmark samples part of the same cluster?
+func (d *Detector) joined(a, b *lidar.Sample2D) bool {
+	return math.Abs(float64(a.Distance)-float64(b.Distance)) <= d.MaxStep
+}
+
+// mean angular step between the samples of a scan
+func scan_step(scan *lidar.Scan2D) float64 {
+	n := len(scan.Samples)
+	if n < 2 {
+		return 0
+	}
+	var sum float64
+	for i := 1; i < n; i++ {
+		sum += math.Abs(wrap_pi(float64(scan.Samples[i].Angle - scan.Samples[i-1].Angle)))
+	}
+	return sum / float64(n-1)
+}
+
+// build a detection from the samples of a cluster
+// step is the angular step of the scan, used for single sample clusters
+func (d *Detector) cluster(samples []*lidar.Sample2D, step float64) (Detection, bool) {
+	n := len(samples)
+	if n < d.MinSamples {
+		return Detection{}, false
+	}
+	var det Detection
+	var w, r float64
+	for _, s := range samples {
+		a, dist, ss := float64(s.Angle), float64(s.Distance), float64(s.Signal_Strength)
+		det.X += ss * dist * math.Cos(a)
+		det.Y += ss * dist * math.Sin(a)
+		w += ss
+		r += dist
+	}
+	det.X /= w
+	det.Y /= w
+	det.Range = math.Hypot(det.X, det.Y)
+	det.Bearing = math.Atan2(det.Y, det.X)
+	det.Signal = w / float64(n)
+	det.Samples = n
+	// end to end distance plus the footprint of a sample
+	first, last := samples[0], samples[n-1]
+	a0, a1 := float64(first.Angle), float64(last.Angle)
+	x0, y0 := float64(first.Distance)*math.Cos(a0), float64(first.Distance)*math.Sin(a0)
+	x1, y1 := float64(last.Distance)*math.Cos(a1), float64(last.Distance)*math.Sin(a1)
+	det.Width = math.Hypot(x1-x0, y1-y0)
+	if n > 1 {
+		step = math.Abs(wrap_pi(a1-a0)) / float64(n-1)
+	}
+	det.Width += step * r / float64(n)
+	if det.Width < d.MinWidth || det.Width > d.MaxWidth {
+		return Detection{}, false
+	}
+	return det, true
+}
+
+// Detect returns the landmark detections in a scan.
+func (d *Detector) Detect(scan *lidar.Scan2D) []Detection {
+	n := len(scan.Samples)
+	if n == 0 {
+		return nil
+	}
+	// start at a dark sample so a cluster can wrap around the end of the scan
+	start := -1
+	for i := range scan.Samples {
+		if !d.bright(&scan.Samples[i]) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		// the whole scan is bright, that's not a landmark
+		return nil
+	}
+	step := scan_step(scan)
+	var dets []Detection
+	var samples []*lidar.Sample2D
+	flush := func() {
+		if det, ok := d.cluster(samples, step); ok {
+			dets = append(dets, det)
+		}
+		samples = samples[:0]
+	}
+	// the last sample is the dark start sample, so the last cluster is flushed
+	for k := 1; k <= n; k++ {
+		s := &scan.Samples[(start+k)%n]
+		if !d.bright(s) {
+			flush()
+			continue
+		}
+		if len(samples) != 0 && !d.joined(samples[len(samples)-1], s) {
+			flush()
+		}
+		samples = append(samples, s)
+	}
+	return dets
+}
+
+//-----------------------------------------------------------------------------
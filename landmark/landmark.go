@@ -0,0 +1,186 @@
+//-----------------------------------------------------------------------------
+/*
+
+Retroreflective Landmarks
+
+Subscribes to the scans of a LIDAR, detects retroreflective landmarks in each
+scan (see detect.go), tracks them across scans (see track.go) and publishes
+the observations of the confirmed landmarks for localisation and docking.
+
+An observation is the measured (not smoothed) position of a landmark in a
+scan, tagged with the landmark id. A set of observations is published for
+every scan, even if it's empty, so consumers know when a landmark is lost.
+
+Observations are delivered latest wins: a slow consumer only sees the newest
+set of observations.
+
+*/
+//-----------------------------------------------------------------------------
+
+package landmark
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/deadsy/slamx/lidar"
+)
+
+//-----------------------------------------------------------------------------
+
+// Observation is a landmark measured in a scan.
+type Observation struct {
+	ID      int     // landmark id
+	X, Y    float64 // position in the robot frame (meters)
+	Range   float64 // distance (meters)
+	Bearing float64 // angle (radians, [-pi, pi))
+	Width   float64 // width (meters)
+	Signal  float64 // mean signal strength
+}
+
+// Observations are the landmarks observed in a scan.
+type Observations struct {
+	Device    string        // source device name
+	Seq       uint          // scan sequence number
+	TS        time.Time     // scan mid time
+	Landmarks []Observation // observed landmarks
+}
+
+//-----------------------------------------------------------------------------
+
+const LANDMARK_QUEUE = 4 // scan subscription queue depth
+
+// Landmarks detects and tracks the retroreflective landmarks seen by a LIDAR.
+type Landmarks struct {
+	Name     string               // user name for this landmark detector
+	C        <-chan *Observations // landmark observations
+	Detector *Detector            // landmark detector
+	Tracker  *Tracker             // landmark tracker
+
+	drv        lidar.Driver
+	c          chan *Observations
+	lock       sync.Mutex // lock for the detector, tracker and counters
+	scans      uint       // scans processed
+	detections uint       // landmarks detected
+	observed   uint       // confirmed landmarks observed
+	dropped    uint       // observations not read before the next ones
+}
+
+// NewLandmarks returns a landmark detector for the scans of a LIDAR.
+func NewLandmarks(name string, drv lidar.Driver) *Landmarks {
+	l := Landmarks{
+		Name:     name,
+		Detector: NewDetector(),
+		Tracker:  NewTracker(),
+		drv:      drv,
+		c:        make(chan *Observations, 1),
+	}
+	l.C = l.c
+	log.Printf("NewLandmarks() %s", l.Name)
+	return &l
+}
+
+// process a scan
+func (l *Landmarks) process(scan *lidar.Scan2D) *Observations {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ts := scan.Start.Add(scan.End.Sub(scan.Start) / 2)
+	obs := &Observations{
+		Device: scan.Device,
+		Seq:    scan.Seq,
+		TS:     ts,
+	}
+	dets := l.Detector.Detect(scan)
+	ids := l.Tracker.Update(dets, ts)
+	l.scans += 1
+	l.detections += uint(len(dets))
+	for i := range dets {
+		trk := l.Tracker.Track(ids[i])
+		if trk == nil || !trk.Confirmed {
+			continue
+		}
+		d := &dets[i]
+		obs.Landmarks = append(obs.Landmarks, Observation{
+			ID:      ids[i],
+			X:       d.X,
+			Y:       d.Y,
+			Range:   d.Range,
+			Bearing: d.Bearing,
+			Width:   d.Width,
+			Signal:  d.Signal,
+		})
+	}
+	l.observed += uint(len(obs.Landmarks))
+	return obs
+}
+
+// deliver observations latest wins
+func (l *Landmarks) deliver(obs *Observations) {
+	select {
+	case <-l.c:
+		l.lock.Lock()
+		l.dropped += 1
+		l.lock.Unlock()
+	default:
+	}
+	l.c <- obs
+}
+
+// Run the landmark detector.
+func (l *Landmarks) Run(quit <-chan bool, wg *sync.WaitGroup) {
+	log.Printf("%s.Run() enter", l.Name)
+	defer wg.Done()
+	scans := l.drv.Subscribe(l.Name, lidar.Queue, LANDMARK_QUEUE)
+	for {
+		select {
+		case <-quit:
+			scans.Unsubscribe()
+			// release any queued scans
+			for scan := range scans.C {
+				scan.Release()
+			}
+			log.Printf("%s.Run() exit", l.Name)
+			return
+		case scan := <-scans.C:
+			obs := l.process(scan)
+			scan.Release()
+			l.deliver(obs)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// Tracks returns a copy of the current landmark tracks.
+func (l *Landmarks) Tracks() []Track {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.Tracker.Tracks()
+}
+
+// SetMinSignal sets the minimum signal strength of a landmark sample.
+func (l *Landmarks) SetMinSignal(min float32) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.Detector.MinSignal = min
+}
+
+// Status returns the landmark detector status as (name, value) rows.
+func (l *Landmarks) Status() [][]string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	rows := make([][]string, 0, 8)
+	rows = append(rows, []string{"detector", l.Detector.String()})
+	t := l.Tracker
+	rows = append(rows, []string{"tracker", fmt.Sprintf("gate %.3f m, confirm %d, misses %d", t.Gate, t.Confirm, t.MaxMisses)})
+	rows = append(rows, []string{"scans", fmt.Sprintf("%d", l.scans)})
+	rows = append(rows, []string{"detections", fmt.Sprintf("%d", l.detections)})
+	rows = append(rows, []string{"observations", fmt.Sprintf("%d", l.observed)})
+	rows = append(rows, []string{"dropped", fmt.Sprintf("%d", l.dropped)})
+	rows = append(rows, []string{"tracks", fmt.Sprintf("%d (%d dropped)", len(t.tracks), t.dropped)})
+	return rows
+}
+
+//-----------------------------------------------------------------------------
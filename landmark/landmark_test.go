@@ -0,0 +1,78 @@
+//-----------------------------------------------------------------------------
+/*
+
+Landmark Detection and Tracking Tests
+
+*/
+//-----------------------------------------------------------------------------
+
+package landmark
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/deadsy/slamx/lidar"
+)
+
+//-----------------------------------------------------------------------------
+
+// a 360 sample scan at 2 m with bright samples at the given indices
+func bright_scan(bright ...int) *lidar.Scan2D {
+	scan := &lidar.Scan2D{Samples: make([]lidar.Sample2D, 360)}
+	for i := range scan.Samples {
+		scan.Samples[i] = lidar.Sample2D{
+			Angle:           float32(float64(i) * math.Pi / 180.0),
+			Distance:        2.0,
+			Good:            true,
+			Signal_Strength: 100,
+		}
+	}
+	for _, i := range bright {
+		scan.Samples[i].Signal_Strength = 3000
+	}
+	return scan
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_Detect_Width(t *testing.T) {
+	d := NewDetector()
+	d.MinSamples = 1
+	// one sample is the footprint of a 1 degree step at 2 m
+	foot := 2.0 * math.Pi / 180.0
+	for n := 1; n <= 3; n++ {
+		var idx []int
+		for i := 0; i < n; i++ {
+			idx = append(idx, 90+i)
+		}
+		dets := d.Detect(bright_scan(idx...))
+		if len(dets) != 1 {
+			t.Fatalf("%d samples: %d detections", n, len(dets))
+		}
+		// the chord between the end samples plus one footprint
+		w := 2.0*2.0*math.Sin(float64(n-1)*math.Pi/360.0) + foot
+		if math.Abs(dets[0].Width-w) > 1e-4 {
+			t.Errorf("%d samples: width %f, expected %f", n, dets[0].Width, w)
+		}
+	}
+}
+
+func Test_Track_Misses(t *testing.T) {
+	tr := NewTracker()
+	ts := time.Now()
+	det := []Detection{{X: 1.0, Y: 0.0}}
+	tr.Update(det, ts)
+	for i := 1; i <= tr.MaxMisses; i++ {
+		if len(tr.tracks) != 1 {
+			t.Fatalf("track dropped after %d misses", i-1)
+		}
+		tr.Update(nil, ts)
+	}
+	if len(tr.tracks) != 0 {
+		t.Errorf("track kept after %d misses", tr.MaxMisses)
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,180 @@
+//-----------------------------------------------------------------------------
+/*
+
+Landmark Tracking
+
+The tracker follows landmarks from scan to scan so each landmark keeps an id.
+
+Each detection is associated with the nearest track within Gate meters (each
+track takes at most one detection). Unassociated detections start new tracks.
+A track is confirmed once it has been seen Confirm times, and it's dropped
+after MaxMisses consecutive scans without a detection.
+
+Tracks are kept in the robot frame, so the gate has to allow for the robot
+motion between scans. The position and width of a track are smoothed with an
+exponential filter.
+
+*/
+//-----------------------------------------------------------------------------
+
+package landmark
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+const TRACK_GATE = 0.2     // association distance (meters)
+const TRACK_CONFIRM = 3    // detections to confirm a track
+const TRACK_MAX_MISSES = 5 // consecutive misses before a track is dropped
+const TRACK_ALPHA = 0.5    // smoothing factor for new detections
+
+// Track is a landmark followed across scans.
+type Track struct {
+	ID        int       // landmark id
+	X, Y      float64   // smoothed position in the robot frame (meters)
+	Width     float64   // smoothed width (meters)
+	Signal    float64   // smoothed signal strength
+	Hits      int       // total detections
+	Misses    int       // consecutive scans without a detection
+	Confirmed bool      // the track has been seen often enough to report
+	First     time.Time // time of the first detection
+	Last      time.Time // time of the last detection
+}
+
+func (t *Track) String() string {
+	return fmt.Sprintf("(%.3f, %.3f) m, width %.3f m, signal %.0f, %d hits", t.X, t.Y, t.Width, t.Signal, t.Hits)
+}
+
+// update a track with a detection
+func (t *Track) update(det *Detection, ts time.Time, alpha float64) {
+	t.X += alpha * (det.X - t.X)
+	t.Y += alpha * (det.Y - t.Y)
+	t.Width += alpha * (det.Width - t.Width)
+	t.Signal += alpha * (det.Signal - t.Signal)
+	t.Hits += 1
+	t.Misses = 0
+	t.Last = ts
+}
+
+//-----------------------------------------------------------------------------
+
+// Tracker associates detections with landmark tracks.
+type Tracker struct {
+	Gate      float64 // association distance (meters)
+	Confirm   int     // detections to confirm a track
+	MaxMisses int     // consecutive misses before a track is dropped
+	Alpha     float64 // smoothing factor for new detections
+
+	tracks  []*Track
+	next_id int  // id of the next new track
+	dropped uint // tracks dropped
+}
+
+// NewTracker returns a tracker with the default parameters.
+func NewTracker() *Tracker {
+	return &Tracker{
+		Gate:      TRACK_GATE,
+		Confirm:   TRACK_CONFIRM,
+		MaxMisses: TRACK_MAX_MISSES,
+		Alpha:     TRACK_ALPHA,
+	}
+}
+
+type track_pair struct {
+	track, det int
+	dist       float64
+}
+
+// Update the tracks with the detections from a scan taken at time ts.
+// It returns the track id for each detection.
+func (t *Tracker) Update(dets []Detection, ts time.Time) []int {
+	ids := make([]int, len(dets))
+	// candidate pairs within the gate, nearest first
+	var pairs []track_pair
+	for i, trk := range t.tracks {
+		for j := range dets {
+			d := math.Hypot(dets[j].X-trk.X, dets[j].Y-trk.Y)
+			if d <= t.Gate {
+				pairs = append(pairs, track_pair{i, j, d})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].dist < pairs[j].dist })
+	// greedy association
+	track_used := make([]bool, len(t.tracks))
+	det_used := make([]bool, len(dets))
+	for _, p := range pairs {
+		if track_used[p.track] || det_used[p.det] {
+			continue
+		}
+		track_used[p.track] = true
+		det_used[p.det] = true
+		trk := t.tracks[p.track]
+		trk.update(&dets[p.det], ts, t.Alpha)
+		if trk.Hits >= t.Confirm {
+			trk.Confirmed = true
+		}
+		ids[p.det] = trk.ID
+	}
+	// age the unassociated tracks
+	tracks := t.tracks[:0]
+	for i, trk := range t.tracks {
+		if !track_used[i] {
+			trk.Misses += 1
+			if trk.Misses >= t.MaxMisses {
+				t.dropped += 1
+				continue
+			}
+		}
+		tracks = append(tracks, trk)
+	}
+	t.tracks = tracks
+	// start new tracks
+	for j := range dets {
+		if det_used[j] {
+			continue
+		}
+		det := &dets[j]
+		trk := &Track{
+			ID:     t.next_id,
+			X:      det.X,
+			Y:      det.Y,
+			Width:  det.Width,
+			Signal: det.Signal,
+			Hits:   1,
+			First:  ts,
+			Last:   ts,
+		}
+		trk.Confirmed = trk.Hits >= t.Confirm
+		t.next_id += 1
+		t.tracks = append(t.tracks, trk)
+		ids[j] = trk.ID
+	}
+	return ids
+}
+
+// Track returns the track with an id, or nil if there is none.
+func (t *Tracker) Track(id int) *Track {
+	for _, trk := range t.tracks {
+		if trk.ID == id {
+			return trk
+		}
+	}
+	return nil
+}
+
+// Tracks returns a copy of the current tracks.
+func (t *Tracker) Tracks() []Track {
+	tracks := make([]Track, len(t.tracks))
+	for i, trk := range t.tracks {
+		tracks[i] = *trk
+	}
+	return tracks
+}
+
+//-----------------------------------------------------------------------------
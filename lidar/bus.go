@@ -0,0 +1,268 @@
+//-----------------------------------------------------------------------------
+/*
+
+Scan Delivery
+
+The scan bus delivers completed scans from a LIDAR driver to any number of
+subscribers without ever blocking the driver.
+
+* Latest wins: a subscriber gets the newest scan, older unread scans are dropped.
+* Queue: a subscriber gets scans in order from a bounded queue, new scans are
+  dropped when the queue is full.
+
+Scans are pooled. A published scan is shared by all the subscribers, each of
+which should call scan.Release() when it's done with it. The scan is returned
+to the pool when the last subscriber releases it, so it must not be used after
+release. Not releasing a scan is safe, it's just garbage collected.
+
+The bus filter chain is applied to each scan before it's delivered, followed
+by the conversion from the LIDAR frame to the robot frame.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+//-----------------------------------------------------------------------------
+
+// Delivery is the scan delivery mode for a subscriber.
+type Delivery int
+
+const (
+	LatestWins Delivery = iota // deliver the newest scan, drop older unread scans
+	Queue                      // deliver scans in order, drop new scans when the queue is full
+)
+
+func (d Delivery) String() string {
+	switch d {
+	case LatestWins:
+		return "latest"
+	case Queue:
+		return "queue"
+	}
+	return fmt.Sprintf("unknown(%d)", int(d))
+}
+
+//-----------------------------------------------------------------------------
+
+// Subscription is a subscriber to a scan bus.
+type Subscription struct {
+	Name string         // subscriber name
+	C    <-chan *Scan2D // scan channel
+	Mode Delivery       // delivery mode
+
+	bus       *ScanBus
+	c         chan *Scan2D
+	delivered uint // scans delivered
+	dropped   uint // scans dropped
+}
+
+// ScanBus delivers scans from a driver to subscribers.
+type ScanBus struct {
+	name      string
+	lock      sync.Mutex // lock for the subscribers and counters
+	subs      []*Subscription
+	pool      sync.Pool
+	filters   FilterChain // applied to each scan before delivery
+	mount     Extrinsics  // LIDAR mounting in the robot frame
+	deskew    PoseSource  // robot pose source for de-skewing (nil for none)
+	published uint        // scans published
+}
+
+// NewScanBus returns a new scan bus.
+func NewScanBus(name string) *ScanBus {
+	b := ScanBus{
+		name: name,
+	}
+	b.pool.New = func() interface{} {
+		return &Scan2D{}
+	}
+	return &b
+}
+
+//-----------------------------------------------------------------------------
+
+// Subscribe adds a subscriber to the bus.
+// depth is the queue length for Queue delivery, it's ignored for LatestWins.
+func (b *ScanBus) Subscribe(name string, mode Delivery, depth int) *Subscription {
+	if mode == LatestWins || depth < 1 {
+		depth = 1
+	}
+	s := &Subscription{
+		Name: name,
+		Mode: mode,
+		bus:  b,
+		c:    make(chan *Scan2D, depth),
+	}
+	s.C = s.c
+	b.lock.Lock()
+	b.subs = append(b.subs, s)
+	b.lock.Unlock()
+	log.Printf("%s: subscribe %s (%s, %d)", b.name, name, mode, depth)
+	return s
+}
+
+// Unsubscribe removes a subscriber from the bus and closes its channel.
+func (s *Subscription) Unsubscribe() {
+	b := s.bus
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i := range b.subs {
+		if b.subs[i] == s {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			close(s.c)
+			// release any unread scans
+			for scan := range s.c {
+				scan.Release()
+			}
+			log.Printf("%s: unsubscribe %s", b.name, s.Name)
+			return
+		}
+	}
+}
+
+// deliver a scan to a subscriber without blocking
+func (s *Subscription) deliver(scan *Scan2D) {
+	for {
+		select {
+		case s.c <- scan:
+			s.delivered += 1
+			return
+		default:
+		}
+		if s.Mode == Queue {
+			// the queue is full - drop the new scan
+			s.dropped += 1
+			scan.Release()
+			return
+		}
+		// drop the unread scan and try again
+		select {
+		case old := <-s.c:
+			s.dropped += 1
+			old.Release()
+		default:
+		}
+	}
+}
+
+// Counts returns the number of scans delivered to and dropped for the subscriber.
+func (s *Subscription) Counts() (delivered, dropped uint) {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+	return s.delivered, s.dropped
+}
+
+// Filters returns the filter chain for the bus.
+func (b *ScanBus) Filters() *FilterChain {
+	return &b.filters
+}
+
+// SetExtrinsics sets the LIDAR mounting used to convert scans to the robot frame.
+func (b *ScanBus) SetExtrinsics(e Extrinsics) {
+	b.lock.Lock()
+	b.mount = e
+	b.lock.Unlock()
+	log.Printf("%s: extrinsics %s", b.name, e)
+}
+
+// Extrinsics returns the LIDAR mounting used to convert scans to the robot frame.
+func (b *ScanBus) Extrinsics() Extrinsics {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.mount
+}
+
+// SetDeskew sets the robot pose source used to de-skew scans (nil for none).
+func (b *ScanBus) SetDeskew(src PoseSource) {
+	b.lock.Lock()
+	b.deskew = src
+	b.lock.Unlock()
+	log.Printf("%s: deskew %s", b.name, deskew_string(src))
+}
+
+// describe a de-skew pose source
+func deskew_string(src PoseSource) string {
+	if src == nil {
+		return "off"
+	}
+	if s, ok := src.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return "on"
+}
+
+// Publish filters a scan, converts it to the robot frame, optionally de-skews
+// it and delivers it to all subscribers.
+func (b *ScanBus) Publish(scan *Scan2D) {
+	b.filters.Apply(scan)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.mount.Apply(scan)
+	if b.deskew != nil {
+		err := deskew(scan, b.deskew, scan_mid(scan))
+		if err != nil {
+			log.Printf("%s: deskew failed %s", b.name, err)
+		}
+	}
+	b.published += 1
+	scan.bus = b
+	scan.refs = int32(len(b.subs))
+	if len(b.subs) == 0 {
+		b.pool.Put(scan)
+		return
+	}
+	for _, s := range b.subs {
+		s.deliver(scan)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// NewScan returns a scan from the pool with room for n samples.
+// The scan has no samples and zeroed metadata.
+func (b *ScanBus) NewScan(n int) *Scan2D {
+	scan := b.pool.Get().(*Scan2D)
+	samples := scan.Samples[:0]
+	if cap(samples) < n {
+		samples = make([]Sample2D, 0, n)
+	}
+	*scan = Scan2D{Samples: samples}
+	return scan
+}
+
+// Release returns a scan to the pool once every subscriber has released it.
+// The scan must not be used after it is released.
+func (scan *Scan2D) Release() {
+	if scan.bus == nil {
+		return
+	}
+	if atomic.AddInt32(&scan.refs, -1) == 0 {
+		scan.bus.pool.Put(scan)
+	}
+}
+
+// BusStatus returns the scan bus status as (name, value) rows.
+func (b *ScanBus) BusStatus() [][]string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	rows := make([][]string, 0, len(b.subs)+1)
+	rows = append(rows, []string{"scans published", fmt.Sprintf("%d", b.published)})
+	rows = append(rows, []string{"extrinsics", b.mount.String()})
+	rows = append(rows, []string{"deskew", deskew_string(b.deskew)})
+	rows = append(rows, b.filters.Status()...)
+	for _, s := range b.subs {
+		val := fmt.Sprintf("%s, %d delivered, %d dropped", s.Mode, s.delivered, s.dropped)
+		rows = append(rows, []string{"subscriber " + s.Name, val})
+	}
+	return rows
+}
+
+//-----------------------------------------------------------------------------
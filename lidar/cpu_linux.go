@@ -0,0 +1,35 @@
+//-----------------------------------------------------------------------------
+/*
+
+Thread CPU Usage
+
+A goroutine locked to its OS thread can measure the CPU time it uses with
+getrusage(RUSAGE_THREAD). This is used to measure the cost of the serial
+readers on the RPi.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"syscall"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// from linux/resource.h
+const rusage_thread = 1
+
+// thread_cpu returns the user + system cpu time used by the calling thread.
+func thread_cpu() (time.Duration, error) {
+	var ru syscall.Rusage
+	err := syscall.Getrusage(rusage_thread, &ru)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
+
+//-----------------------------------------------------------------------------
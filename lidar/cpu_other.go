@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+//-----------------------------------------------------------------------------
+/*
+
+Thread CPU Usage (non-Linux)
+
+The per-thread cpu time isn't available, so the reader cpu usage is reported
+as zero.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"errors"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// thread_cpu is not supported on this platform.
+func thread_cpu() (time.Duration, error) {
+	return 0, errors.New("thread cpu time is only supported on linux")
+}
+
+//-----------------------------------------------------------------------------
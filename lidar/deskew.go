@@ -0,0 +1,95 @@
+//-----------------------------------------------------------------------------
+/*
+
+Scan De-skewing (Motion Compensation)
+
+At 300 rpm a revolution takes 200 ms and the robot may move significantly
+during a scan. Scans are de-skewed on the scan bus after they are converted to
+the robot frame, so each sample is measured from the pose of the robot at the
+time of the sample. De-skewing re-projects every sample to the pose of the
+robot at a single reference time (the scan mid time on the bus), so the scan
+looks like it was taken instantaneously.
+
+For a sample at time t:
+point = inverse(pose(ref)) * pose(t) * (distance cos(angle), distance sin(angle))
+
+The de-skewed sample has the angle and distance of the point from the
+reference pose. Samples without good data are copied unchanged.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"math"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// Deskew returns a copy of a robot frame scan re-projected to the pose of the
+// robot at the reference time. The pose source must cover the sample times of
+// the scan.
+func Deskew(scan *Scan2D, src PoseSource, ref time.Time) (*Scan2D, error) {
+	out := *scan
+	out.bus = nil
+	out.refs = 0
+	out.Samples = make([]Sample2D, len(scan.Samples))
+	copy(out.Samples, scan.Samples)
+	err := deskew(&out, src, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// deskew re-projects the samples of a scan in place.
+// The scan is unchanged if there is an error.
+func deskew(scan *Scan2D, src PoseSource, ref time.Time) error {
+	ref_pose, err := src.Pose(ref)
+	if err != nil {
+		return err
+	}
+	inv := ref_pose.Inverse()
+
+	// get the relative poses first, so an error leaves the scan unchanged
+	// consecutive samples often have the same timestamp, so cache the pose
+	rel := make([]Pose2D, len(scan.Samples))
+	var ts time.Time
+	var r Pose2D
+	for i := range scan.Samples {
+		s := &scan.Samples[i]
+		if !s.Good || s.TS.IsZero() {
+			continue
+		}
+		if !s.TS.Equal(ts) {
+			pose, err := src.Pose(s.TS)
+			if err != nil {
+				return err
+			}
+			ts = s.TS
+			r = inv.Compose(pose)
+		}
+		rel[i] = r
+	}
+
+	for i := range scan.Samples {
+		s := &scan.Samples[i]
+		if !s.Good || s.TS.IsZero() {
+			continue
+		}
+		a, d := float64(s.Angle), float64(s.Distance)
+		x, y := rel[i].Transform(d*math.Cos(a), d*math.Sin(a))
+		angle := math.Atan2(y, x)
+		if angle < 0 {
+			angle += 2.0 * math.Pi
+		}
+		s.Angle = float32(angle)
+		s.Distance = float32(math.Hypot(x, y))
+	}
+	scan.Ref = ref
+	return nil
+}
+
+//-----------------------------------------------------------------------------
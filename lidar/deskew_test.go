@@ -0,0 +1,110 @@
+//-----------------------------------------------------------------------------
+/*
+
+De-skew Tests
+
+Scans are de-skewed on a scan bus with a constant velocity robot. The
+expected points are worked out by hand in the frame of the robot at the scan
+mid time.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// publish a scan of (time offset, angle, distance) samples with a mid time t0
+func deskew_scan(t *testing.T, src PoseSource, t0 time.Time, samples [][3]float64) *Scan2D {
+	b := NewScanBus("test")
+	b.SetDeskew(src)
+	sub := b.Subscribe("test", Queue, 1)
+	scan := b.NewScan(len(samples))
+	scan.Start = t0.Add(-time.Second)
+	scan.End = t0.Add(time.Second)
+	for _, x := range samples {
+		scan.Samples = append(scan.Samples, Sample2D{
+			Good:     x[2] != 0,
+			Angle:    float32(x[1] * math.Pi / 180.0),
+			Distance: float32(x[2]),
+			TS:       t0.Add(time.Duration(x[0] * float64(time.Second))),
+		})
+	}
+	b.Publish(scan)
+	select {
+	case scan = <-sub.C:
+	default:
+		t.Fatal("no scan delivered")
+	}
+	return scan
+}
+
+// check the (angle, distance) of the samples
+func check_samples(t *testing.T, scan *Scan2D, want [][2]float64) {
+	for i, s := range scan.Samples {
+		a := float64(s.Angle) * 180.0 / math.Pi
+		if !near(a, want[i][0], 1e-3) || !near(float64(s.Distance), want[i][1], 1e-5) {
+			t.Errorf("sample %d: angle %f distance %f, expected %f %f", i, a, s.Distance, want[i][0], want[i][1])
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_Deskew_Translation(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// 1 m/s forwards
+	src := &ConstantVelocity{VX: 1, T0: t0}
+	scan := deskew_scan(t, src, t0, [][3]float64{
+		{0, 0, 2},      // at the reference time: unchanged
+		{0.1, 90, 1},   // robot at (0.1, 0): point (0.1, 1)
+		{-0.1, 180, 1}, // robot at (-0.1, 0): point (-1.1, 0)
+		{0.1, 45, 0},   // no data: unchanged
+	})
+	check_samples(t, scan, [][2]float64{
+		{0, 2},
+		{math.Atan2(1, 0.1) * 180.0 / math.Pi, math.Sqrt(1.01)},
+		{180, 1.1},
+		{45, 0},
+	})
+	if !scan.Ref.Equal(t0) {
+		t.Errorf("reference time %s", scan.Ref)
+	}
+}
+
+func Test_Deskew_Rotation(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// 1 m/s forwards turning at 90 deg/s, after 1s the robot is at
+	// (2/pi, 2/pi) heading 90 degrees, so the sample at 0 degrees is at
+	// (2/pi, 2/pi + 1)
+	src := &ConstantVelocity{VX: 1, W: math.Pi / 2, T0: t0.Add(-5 * time.Second)}
+	scan := deskew_scan(t, src, t0, [][3]float64{
+		{1, 0, 1},
+	})
+	x, y := 2/math.Pi, 2/math.Pi+1
+	check_samples(t, scan, [][2]float64{
+		{math.Atan2(y, x) * 180.0 / math.Pi, math.Hypot(x, y)},
+	})
+}
+
+func Test_Deskew_Error(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// the history doesn't cover the scan, so it isn't de-skewed
+	h := NewPoseHistory()
+	h.Add(t0.Add(-time.Hour), Pose2D{})
+	scan := deskew_scan(t, h, t0, [][3]float64{
+		{0.1, 90, 1},
+	})
+	check_samples(t, scan, [][2]float64{{90, 1}})
+	if !scan.Ref.IsZero() {
+		t.Errorf("reference time %s", scan.Ref)
+	}
+}
+
+//-----------------------------------------------------------------------------
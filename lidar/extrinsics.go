@@ -0,0 +1,159 @@
+//-----------------------------------------------------------------------------
+/*
+
+LIDAR Mounting Extrinsics
+
+The drivers report samples in the LIDAR frame: the angle is measured from the
+LIDAR zero angle in the direction the LIDAR counts and the distance is from
+the LIDAR centre. The extrinsics describe how the LIDAR is mounted on the
+robot, and the scan bus uses them to convert each scan to the robot frame
+(x-axis forward, angles counter-clockwise, origin at the robot centre) before
+it's delivered. The conversion is applied after the filter chain, so filters
+see the samples in their measured order.
+
+Yaw Calibration:
+The zero angle of a LIDAR is hard to measure mechanically. Place the robot
+square to a straight wall, so the direction of the wall normal (from the robot
+to the wall) is known in the robot frame. The samples close to that direction
+are fit to a line and the yaw offset is corrected so that the measured wall
+normal matches the known one. The fit is done on robot frame scans, so the
+calibration can be repeated to refine the yaw.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+//-----------------------------------------------------------------------------
+
+// Extrinsics is the mounting of a LIDAR in the robot frame.
+type Extrinsics struct {
+	X, Y float64 // position of the LIDAR centre (meters)
+	Yaw  float64 // angle of the LIDAR zero angle from the robot x-axis (radians)
+	CW   bool    // LIDAR angles increase clockwise
+}
+
+func (e Extrinsics) String() string {
+	dirn := "ccw"
+	if e.CW {
+		dirn = "cw"
+	}
+	return fmt.Sprintf("x %.3f m, y %.3f m, yaw %.2f deg, %s", e.X, e.Y, e.Yaw*180.0/math.Pi, dirn)
+}
+
+// identity returns true if the extrinsics leave the samples unchanged.
+func (e Extrinsics) identity() bool {
+	return e.X == 0 && e.Y == 0 && e.Yaw == 0 && !e.CW
+}
+
+// Apply converts the samples of a scan from the LIDAR frame to the robot frame.
+// Samples without good data have their angle converted but no translation.
+func (e Extrinsics) Apply(scan *Scan2D) {
+	if e.identity() {
+		return
+	}
+	for i := range scan.Samples {
+		s := &scan.Samples[i]
+		a := float64(s.Angle)
+		if e.CW {
+			a = -a
+		}
+		a += e.Yaw
+		if s.Good && (e.X != 0 || e.Y != 0) {
+			d := float64(s.Distance)
+			x := e.X + d*math.Cos(a)
+			y := e.Y + d*math.Sin(a)
+			a = math.Atan2(y, x)
+			s.Distance = float32(math.Hypot(x, y))
+		}
+		a = math.Mod(a, 2.0*math.Pi)
+		if a < 0 {
+			a += 2.0 * math.Pi
+		}
+		s.Angle = float32(a)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// Yaw Calibration
+
+const CALIBRATE_MIN_SAMPLES = 10 // minimum number of wall samples for a fit
+
+// CalibrateYaw fits a straight wall in a robot frame scan taken with the
+// extrinsics e. normal is the known direction of the wall normal from the
+// robot (radians) and window is the angular half-width (radians) around the
+// normal used to select the wall samples. It returns the corrected yaw and the
+// rms distance (meters) of the wall samples from the fitted line.
+func CalibrateYaw(scan *Scan2D, e Extrinsics, normal, window float64) (float64, float64, error) {
+	// select the wall samples by their bearing from the LIDAR
+	var x, y []float64
+	for i := range scan.Samples {
+		s := &scan.Samples[i]
+		if !s.Good {
+			continue
+		}
+		a, d := float64(s.Angle), float64(s.Distance)
+		px, py := d*math.Cos(a), d*math.Sin(a)
+		if math.Abs(wrap_pi(math.Atan2(py-e.Y, px-e.X)-normal)) > window {
+			continue
+		}
+		x = append(x, px)
+		y = append(y, py)
+	}
+	n := float64(len(x))
+	if len(x) < CALIBRATE_MIN_SAMPLES {
+		return 0, 0, errors.New("not enough wall samples")
+	}
+	// total least squares line fit
+	var mx, my float64
+	for i := range x {
+		mx += x[i]
+		my += y[i]
+	}
+	mx /= n
+	my /= n
+	var sxx, syy, sxy float64
+	for i := range x {
+		dx, dy := x[i]-mx, y[i]-my
+		sxx += dx * dx
+		syy += dy * dy
+		sxy += dx * dy
+	}
+	// the line normal is the direction of least variance
+	phi := 0.5*math.Atan2(2.0*sxy, sxx-syy) + 0.5*math.Pi
+	nx, ny := math.Cos(phi), math.Sin(phi)
+	// point the normal from the LIDAR towards the wall
+	if nx*(mx-e.X)+ny*(my-e.Y) < 0 {
+		phi += math.Pi
+		nx, ny = -nx, -ny
+	}
+	var ss float64
+	for i := range x {
+		r := nx*(x[i]-mx) + ny*(y[i]-my)
+		ss += r * r
+	}
+	// rotating the LIDAR rotates the wall about the LIDAR centre
+	yaw := wrap_pi(e.Yaw + wrap_pi(normal-phi))
+	return yaw, math.Sqrt(ss / n), nil
+}
+
+//-----------------------------------------------------------------------------
+
+// ParseDirection returns true for a clockwise direction name (cw, ccw).
+func ParseDirection(name string) (bool, error) {
+	switch name {
+	case "cw":
+		return true, nil
+	case "ccw":
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown direction \"%s\"", name)
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,391 @@
+//-----------------------------------------------------------------------------
+/*
+
+Scan Filters
+
+A filter chain is applied to each scan by the scan bus before it's delivered
+to the subscribers. Filters reject samples by clearing the sample Good flag,
+so the samples keep their position in the scan.
+
+* range: reject samples outside a distance range
+* signal: reject samples with a low signal strength
+* tooclose: reject samples with the too close flag set
+* median: reject samples that differ from the median of their neighbours
+  (the neighbours wrap around the ends of a full 360 degree scan only)
+* veiling: reject mixed pixels at object edges
+
+Veiling:
+When the beam straddles an object edge the LIDAR returns a distance somewhere
+between the foreground and the background. These phantom points lie along
+the beam, so the line between a point and its neighbour is nearly parallel to
+the beam. We reject the farther point of any pair where the angle between
+the beam and the line joining the points is less than a threshold.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+//-----------------------------------------------------------------------------
+
+// Filter rejects samples from a scan.
+type Filter interface {
+	Name() string           // filter name
+	String() string         // filter name and parameters
+	Apply(scan *Scan2D) int // reject samples, return the number rejected
+}
+
+//-----------------------------------------------------------------------------
+// Range Filter
+
+type RangeFilter struct {
+	Min, Max float32 // distance range (meters)
+}
+
+func (f *RangeFilter) Name() string {
+	return "range"
+}
+
+func (f *RangeFilter) String() string {
+	return fmt.Sprintf("range %.3f..%.3f m", f.Min, f.Max)
+}
+
+func (f *RangeFilter) Apply(scan *Scan2D) int {
+	n := 0
+	for i := range scan.Samples {
+		s := &scan.Samples[i]
+		if s.Good && (s.Distance < f.Min || s.Distance > f.Max) {
+			s.Good = false
+			n += 1
+		}
+	}
+	return n
+}
+
+//-----------------------------------------------------------------------------
+// Signal Strength Filter
+
+type SignalFilter struct {
+	Min float32 // minimum signal strength
+}
+
+func (f *SignalFilter) Name() string {
+	return "signal"
+}
+
+func (f *SignalFilter) String() string {
+	return fmt.Sprintf("signal >= %.0f", f.Min)
+}
+
+func (f *SignalFilter) Apply(scan *Scan2D) int {
+	n := 0
+	for i := range scan.Samples {
+		s := &scan.Samples[i]
+		if s.Good && s.Signal_Strength < f.Min {
+			s.Good = false
+			n += 1
+		}
+	}
+	return n
+}
+
+//-----------------------------------------------------------------------------
+// Too Close Filter
+
+type TooCloseFilter struct{}
+
+func (f *TooCloseFilter) Name() string {
+	return "tooclose"
+}
+
+func (f *TooCloseFilter) String() string {
+	return "tooclose"
+}
+
+func (f *TooCloseFilter) Apply(scan *Scan2D) int {
+	n := 0
+	for i := range scan.Samples {
+		s := &scan.Samples[i]
+		if s.Good && s.Too_Close {
+			s.Good = false
+			n += 1
+		}
+	}
+	return n
+}
+
+//-----------------------------------------------------------------------------
+// Median Filter
+
+// full_circle returns true if the samples cover 360 degrees, i.e. the step
+// from the last sample around to the first is about one sample step.
+// Partial scans and limited field of view scans don't wrap.
+func full_circle(samples []Sample2D) bool {
+	n := len(samples)
+	if n < 2 {
+		return false
+	}
+	gap := math.Mod(float64(samples[0].Angle-samples[n-1].Angle), 2.0*math.Pi)
+	if gap < 0 {
+		gap += 2.0 * math.Pi
+	}
+	return gap < 1.5*2.0*math.Pi/float64(n)
+}
+
+type MedianFilter struct {
+	Window int     // number of samples in the window (odd)
+	MaxDev float32 // maximum deviation from the median (meters)
+
+	reject []bool
+	window []float32
+}
+
+func (f *MedianFilter) Name() string {
+	return "median"
+}
+
+func (f *MedianFilter) String() string {
+	return fmt.Sprintf("median window %d, deviation %.3f m", f.Window, f.MaxDev)
+}
+
+func (f *MedianFilter) Apply(scan *Scan2D) int {
+	samples := scan.Samples
+	k := f.Window / 2
+	if k < 1 || len(samples) < f.Window {
+		return 0
+	}
+	// the window wraps around the ends of a 360 degree scan
+	wrap := full_circle(samples)
+	// decide on all samples before rejecting any
+	f.reject = append(f.reject[:0], make([]bool, len(samples))...)
+	for i := range samples {
+		if !samples[i].Good {
+			continue
+		}
+		f.window = f.window[:0]
+		for j := i - k; j <= i+k; j++ {
+			if !wrap && (j < 0 || j >= len(samples)) {
+				continue
+			}
+			s := &samples[(j+len(samples))%len(samples)]
+			if s.Good {
+				f.window = append(f.window, s.Distance)
+			}
+		}
+		sort.Slice(f.window, func(a, b int) bool { return f.window[a] < f.window[b] })
+		median := f.window[len(f.window)/2]
+		if float32(math.Abs(float64(samples[i].Distance-median))) > f.MaxDev {
+			f.reject[i] = true
+		}
+	}
+	n := 0
+	for i := range samples {
+		if f.reject[i] {
+			samples[i].Good = false
+			n += 1
+		}
+	}
+	return n
+}
+
+//-----------------------------------------------------------------------------
+// Veiling (Mixed Pixel) Filter
+
+type VeilingFilter struct {
+	MinAngle float32 // minimum angle between the beam and the surface (radians)
+	Window   int     // number of neighbours to check on each side
+
+	reject []bool
+}
+
+func (f *VeilingFilter) Name() string {
+	return "veiling"
+}
+
+func (f *VeilingFilter) String() string {
+	return fmt.Sprintf("veiling angle %.1f deg, window %d", f.MinAngle*180.0/math.Pi, f.Window)
+}
+
+func (f *VeilingFilter) Apply(scan *Scan2D) int {
+	samples := scan.Samples
+	f.reject = append(f.reject[:0], make([]bool, len(samples))...)
+	min_angle := float64(f.MinAngle)
+	for i := range samples {
+		s0 := &samples[i]
+		if !s0.Good {
+			continue
+		}
+		for j := i + 1; j <= i+f.Window && j < len(samples); j++ {
+			s1 := &samples[j]
+			if !s1.Good {
+				continue
+			}
+			// angle between the beam to s0 and the line from s0 to s1
+			dtheta := float64(s1.Angle - s0.Angle)
+			r0, r1 := float64(s0.Distance), float64(s1.Distance)
+			angle := math.Atan2(r1*math.Sin(dtheta), r0-r1*math.Cos(dtheta))
+			angle = math.Abs(angle)
+			if angle < min_angle || angle > math.Pi-min_angle {
+				// reject the farther point
+				if r0 > r1 {
+					f.reject[i] = true
+				} else {
+					f.reject[j] = true
+				}
+			}
+		}
+	}
+	n := 0
+	for i := range samples {
+		if f.reject[i] {
+			samples[i].Good = false
+			n += 1
+		}
+	}
+	return n
+}
+
+//-----------------------------------------------------------------------------
+
+// parse float arguments
+func filter_args(args []string, n int) ([]float32, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("expected %d filter parameters", n)
+	}
+	vals := make([]float32, n)
+	for i, s := range args {
+		v, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad filter parameter \"%s\"", s)
+		}
+		vals[i] = float32(v)
+	}
+	return vals, nil
+}
+
+// NewFilter returns a filter from a type name and parameters.
+func NewFilter(kind string, args []string) (Filter, error) {
+	switch kind {
+	case "range":
+		v, err := filter_args(args, 2)
+		if err != nil {
+			return nil, err
+		}
+		if v[0] < 0 || v[0] >= v[1] {
+			return nil, errors.New("bad range")
+		}
+		return &RangeFilter{Min: v[0], Max: v[1]}, nil
+	case "signal":
+		v, err := filter_args(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &SignalFilter{Min: v[0]}, nil
+	case "tooclose":
+		_, err := filter_args(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &TooCloseFilter{}, nil
+	case "median":
+		v, err := filter_args(args, 2)
+		if err != nil {
+			return nil, err
+		}
+		if v[0] < 3 || int(v[0])%2 == 0 || v[1] <= 0 {
+			return nil, errors.New("window must be odd and >= 3, deviation must be > 0")
+		}
+		return &MedianFilter{Window: int(v[0]), MaxDev: v[1]}, nil
+	case "veiling":
+		v, err := filter_args(args, 2)
+		if err != nil {
+			return nil, err
+		}
+		if v[0] <= 0 || v[0] >= 90 || v[1] < 1 {
+			return nil, errors.New("angle must be 0..90 degrees, window must be >= 1")
+		}
+		return &VeilingFilter{MinAngle: v[0] * math.Pi / 180.0, Window: int(v[1])}, nil
+	}
+	return nil, fmt.Errorf("unknown filter type \"%s\"", kind)
+}
+
+//-----------------------------------------------------------------------------
+// Filter Chain
+
+type filter_stage struct {
+	f        Filter
+	scans    uint // scans filtered
+	rejected uint // samples rejected
+}
+
+// FilterChain applies a sequence of filters to a scan.
+type FilterChain struct {
+	lock   sync.Mutex // lock for access to the filters
+	stages []*filter_stage
+}
+
+// Add a filter to the end of the chain.
+func (c *FilterChain) Add(f Filter) {
+	c.lock.Lock()
+	c.stages = append(c.stages, &filter_stage{f: f})
+	c.lock.Unlock()
+}
+
+// Remove the filter at index i (0 is the first filter).
+func (c *FilterChain) Remove(i int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if i < 0 || i >= len(c.stages) {
+		return errors.New("bad filter index")
+	}
+	c.stages = append(c.stages[:i], c.stages[i+1:]...)
+	return nil
+}
+
+// Clear removes all filters.
+func (c *FilterChain) Clear() {
+	c.lock.Lock()
+	c.stages = nil
+	c.lock.Unlock()
+}
+
+// Apply the filters to a scan, return the number of samples rejected.
+func (c *FilterChain) Apply(scan *Scan2D) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	total := 0
+	for _, s := range c.stages {
+		n := s.f.Apply(scan)
+		s.scans += 1
+		s.rejected += uint(n)
+		total += n
+	}
+	return total
+}
+
+// Status returns the filters and their rejection counts as (name, value) rows.
+func (c *FilterChain) Status() [][]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	rows := make([][]string, 0, len(c.stages))
+	for i, s := range c.stages {
+		per_scan := 0.0
+		if s.scans != 0 {
+			per_scan = float64(s.rejected) / float64(s.scans)
+		}
+		val := fmt.Sprintf("%s (%d rejected, %.1f/scan)", s.f, s.rejected, per_scan)
+		rows = append(rows, []string{fmt.Sprintf("filter %d", i), val})
+	}
+	return rows
+}
+
+//-----------------------------------------------------------------------------
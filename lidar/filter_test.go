@@ -0,0 +1,58 @@
+//-----------------------------------------------------------------------------
+/*
+
+Scan Filter Tests
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"math"
+	"testing"
+)
+
+//-----------------------------------------------------------------------------
+
+// a scan of n samples over fov radians, all at 1 m
+func fov_scan(n int, fov float64) *Scan2D {
+	scan := &Scan2D{Samples: make([]Sample2D, n)}
+	for i := range scan.Samples {
+		scan.Samples[i] = Sample2D{
+			Angle:    float32(fov * float64(i) / float64(n)),
+			Distance: 1.0,
+			Good:     true,
+		}
+	}
+	return scan
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_Median_Wrap(t *testing.T) {
+	for _, x := range []struct {
+		fov    float64
+		reject bool
+	}{
+		{2.0 * math.Pi, true},
+		{240.0 * math.Pi / 180.0, false},
+	} {
+		scan := fov_scan(360, x.fov)
+		// sample 0 is near its right-hand neighbours and far from the others
+		s := scan.Samples
+		s[2].Distance = 3.0
+		s[len(s)-2].Distance = 3.0
+		s[len(s)-1].Distance = 3.0
+		if full_circle(s) != x.reject {
+			t.Errorf("fov %f: full circle %t", x.fov, !x.reject)
+		}
+		f := &MedianFilter{Window: 5, MaxDev: 0.5}
+		f.Apply(scan)
+		if s[0].Good == x.reject {
+			t.Errorf("fov %f: sample 0 good %t", x.fov, s[0].Good)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
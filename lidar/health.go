@@ -0,0 +1,277 @@
+//-----------------------------------------------------------------------------
+/*
+
+LIDAR Health Monitor
+
+A state machine that watches frame arrival, the checksum error rate and the
+rpm of a motor driven LIDAR, and decides whether the motor should be driven.
+
+* Idle: scanning is stopped, the motor is off
+* SpinningUp: the motor is driven until the rpm locks to the target
+* Locked: the rpm is within tolerance of the target
+* Stalled: the rpm didn't reach the target, the motor is off
+* Overspeed: the rpm exceeded the limit, the motor is off
+* NoData: no good frames are arriving, the motor is off
+* Fault: the restart attempts are exhausted, the motor is off
+
+Stalled, Overspeed and NoData are alarms. After a delay the monitor restarts
+the motor by going back to SpinningUp. The restart count is cleared once the
+rpm has been locked for a while, and when it exceeds the limit the monitor
+stays in Fault until scanning is stopped and started again.
+
+The monitor is updated periodically by the motor control loop. It doesn't
+drive the motor itself, the state says whether the motor should be on.
+
+While an experiment (autotune, characterisation) drives the motor away from
+the target rpm the lock checks are suspended. The overspeed, checksum error
+and frame arrival checks still apply.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// Health is the health state of a LIDAR.
+type Health int
+
+const (
+	Idle       Health = iota // scanning is stopped
+	SpinningUp               // waiting for the rpm to lock
+	Locked                   // rpm is locked to the target
+	Stalled                  // rpm too low
+	Overspeed                // rpm too high
+	NoData                   // no good frames
+	Fault                    // restart attempts exhausted
+)
+
+var health_names = map[Health]string{
+	Idle:       "idle",
+	SpinningUp: "spinning up",
+	Locked:     "locked",
+	Stalled:    "stalled",
+	Overspeed:  "overspeed",
+	NoData:     "no data",
+	Fault:      "fault",
+}
+
+func (h Health) String() string {
+	if s, ok := health_names[h]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", int(h))
+}
+
+// MotorOn returns true if the motor should be driven in this state.
+func (h Health) MotorOn() bool {
+	return h == SpinningUp || h == Locked
+}
+
+//-----------------------------------------------------------------------------
+
+const HEALTH_LOCK_BAND = 0.03                 // rpm lock tolerance (fraction of target)
+const HEALTH_UNLOCK_BAND = 0.10               // rpm unlock tolerance (fraction of target)
+const HEALTH_SPINUP_TIMEOUT = 5 * time.Second // time allowed to lock the rpm
+const HEALTH_NODATA_TIMEOUT = time.Second     // time allowed without a good frame
+const HEALTH_ERROR_WINDOW = time.Second       // checksum error rate measurement window
+const HEALTH_ERROR_RATE = 0.5                 // maximum fraction of bad frames
+const HEALTH_ERROR_MIN = 10                   // minimum frames in the window for an error rate
+const HEALTH_RESTART_DELAY = 2 * time.Second  // time in an alarm state before a restart
+const HEALTH_MAX_RESTARTS = 3                 // restarts before a fault
+const HEALTH_LOCK_RESET = 10 * time.Second    // time locked before the restarts are cleared
+const HEALTH_HISTORY = 16                     // number of transitions to keep
+
+// Transition is a change of health state.
+type Transition struct {
+	Time     time.Time
+	From, To Health
+	Reason   string
+}
+
+// HealthMonitor tracks the health state of a LIDAR.
+type HealthMonitor struct {
+	Name   string  // user name for this monitor
+	Target float32 // target rpm
+	Limit  float32 // overspeed limit rpm
+
+	lock       sync.Mutex // lock for access to the monitor state
+	state      Health     // current state
+	since      time.Time  // time of the last transition
+	restarts   int        // restarts since the last lock reset
+	total      uint       // total restarts
+	history    []Transition
+	good, bad  uint      // frame counts at the last update
+	last_frame time.Time // time of the last good frame
+	win_start  time.Time // start of the error rate window
+	win_good   uint      // good frames in the window
+	win_bad    uint      // bad frames in the window
+	error_rate float32   // error rate of the last window
+	experiment bool      // an experiment is driving the motor, no rpm lock checks
+}
+
+// NewHealthMonitor returns a health monitor for a target rpm and an overspeed limit.
+func NewHealthMonitor(name string, target, limit float32) *HealthMonitor {
+	return &HealthMonitor{
+		Name:   name,
+		Target: target,
+		Limit:  limit,
+		since:  time.Now(),
+	}
+}
+
+// change state
+func (h *HealthMonitor) transition(now time.Time, to Health, reason string) {
+	t := Transition{Time: now, From: h.state, To: to, Reason: reason}
+	log.Printf("%s: %s -> %s (%s)", h.Name, t.From, t.To, reason)
+	h.history = append(h.history, t)
+	if len(h.history) > HEALTH_HISTORY {
+		h.history = append(h.history[:0], h.history[len(h.history)-HEALTH_HISTORY:]...)
+	}
+	h.state = to
+	h.since = now
+}
+
+// Enable starts (true) or stops (false) the monitored LIDAR.
+func (h *HealthMonitor) Enable(on bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	now := time.Now()
+	if on && (h.state == Idle || h.state == Fault) {
+		h.restarts = 0
+		h.transition(now, SpinningUp, "started")
+	}
+	if !on && h.state != Idle {
+		h.transition(now, Idle, "stopped")
+	}
+}
+
+// Experiment suspends (true) or resumes (false) the rpm lock checks while an
+// experiment drives the motor. On resuming the rpm has to lock again.
+func (h *HealthMonitor) Experiment(on bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.experiment == on {
+		return
+	}
+	h.experiment = on
+	if !on && (h.state == Locked || h.state == SpinningUp) {
+		h.transition(time.Now(), SpinningUp, "experiment done")
+	}
+}
+
+// State returns the current health state.
+func (h *HealthMonitor) State() Health {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.state
+}
+
+// alarm state: wait and restart, or fault
+func (h *HealthMonitor) alarm(now time.Time) {
+	if now.Sub(h.since) < HEALTH_RESTART_DELAY {
+		return
+	}
+	if h.restarts >= HEALTH_MAX_RESTARTS {
+		h.transition(now, Fault, fmt.Sprintf("%d restarts failed", h.restarts))
+		return
+	}
+	h.restarts += 1
+	h.total += 1
+	h.transition(now, SpinningUp, fmt.Sprintf("restart %d", h.restarts))
+}
+
+// Update the monitor with the measured rpm and the total good and bad frame counts.
+// It returns the new health state.
+func (h *HealthMonitor) Update(now time.Time, rpm float32, good, bad uint) Health {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// frame arrival and checksum error rate
+	if good != h.good {
+		h.last_frame = now
+	}
+	h.win_good += good - h.good
+	h.win_bad += bad - h.bad
+	h.good, h.bad = good, bad
+	if now.Sub(h.win_start) >= HEALTH_ERROR_WINDOW {
+		h.error_rate = 0
+		if n := h.win_good + h.win_bad; n >= HEALTH_ERROR_MIN {
+			h.error_rate = float32(h.win_bad) / float32(n)
+		}
+		h.win_start = now
+		h.win_good = 0
+		h.win_bad = 0
+	}
+
+	// the rpm is stale without recent frames
+	fresh := now.Sub(h.last_frame) < HEALTH_NODATA_TIMEOUT
+	if !fresh {
+		rpm = 0
+	}
+	dev := (rpm - h.Target) / h.Target
+	if dev < 0 {
+		dev = -dev
+	}
+
+	switch h.state {
+	case SpinningUp, Locked:
+		if rpm > h.Limit {
+			h.transition(now, Overspeed, fmt.Sprintf("%.1f rpm > %.1f rpm", rpm, h.Limit))
+		} else if h.error_rate > HEALTH_ERROR_RATE {
+			h.transition(now, NoData, fmt.Sprintf("%.0f%% checksum errors", h.error_rate*100.0))
+			h.error_rate = 0
+		} else if h.experiment {
+			if !fresh {
+				h.transition(now, NoData, "no frames")
+			}
+		} else if h.state == SpinningUp {
+			if dev <= HEALTH_LOCK_BAND {
+				h.transition(now, Locked, fmt.Sprintf("%.1f rpm", rpm))
+			} else if now.Sub(h.since) > HEALTH_SPINUP_TIMEOUT {
+				if h.last_frame.Before(h.since) {
+					h.transition(now, NoData, "no frames")
+				} else {
+					h.transition(now, Stalled, fmt.Sprintf("%.1f rpm, target %.1f rpm", rpm, h.Target))
+				}
+			}
+		} else {
+			if !fresh {
+				h.transition(now, NoData, "no frames")
+			} else if dev > HEALTH_UNLOCK_BAND {
+				h.transition(now, SpinningUp, fmt.Sprintf("lost lock at %.1f rpm", rpm))
+			} else if h.restarts != 0 && now.Sub(h.since) > HEALTH_LOCK_RESET {
+				h.restarts = 0
+			}
+		}
+	case Stalled, Overspeed, NoData:
+		h.alarm(now)
+	}
+	return h.state
+}
+
+// Status returns the health state and transition history as (name, value) rows.
+func (h *HealthMonitor) Status() [][]string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	rows := make([][]string, 0, len(h.history)+3)
+	since := time.Since(h.since).Truncate(100 * time.Millisecond)
+	rows = append(rows, []string{"health", fmt.Sprintf("%s (for %s)", h.state, since)})
+	rows = append(rows, []string{"restarts", fmt.Sprintf("%d (%d total)", h.restarts, h.total)})
+	rows = append(rows, []string{"error rate", fmt.Sprintf("%.1f%%", h.error_rate*100.0)})
+	for i := len(h.history) - 1; i >= 0; i-- {
+		t := &h.history[i]
+		val := fmt.Sprintf("%s %s -> %s (%s)", t.Time.Format("15:04:05.000"), t.From, t.To, t.Reason)
+		rows = append(rows, []string{"transition", val})
+	}
+	return rows
+}
+
+//-----------------------------------------------------------------------------
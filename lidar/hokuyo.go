@@ -0,0 +1,663 @@
+//-----------------------------------------------------------------------------
+/*
+
+Driver for Hokuyo URG/UTM Units (SCIP 2.0 Protocol)
+
+* Query the device version, parameters and state (VV, PP, II)
+* Continuous (MD/MS) or polled single (GD/GS) scanning
+* Read the data stream from the LIDAR and repackage it as range data
+
+Connection:
+The URG series are USB CDC devices (E.g. /dev/ttyACM0), the baud rate is ignored.
+The UTM-30LX-EW and friends use TCP (E.g. 192.168.0.10:10940).
+An address of the form "host:port" is opened as a TCP connection, anything
+else is opened as a serial port.
+
+SCIP 2.0:
+Commands are single lines terminated with LF.
+Responses are a block of lines terminated with an empty line:
+
+<echo of the command> LF
+<status> <sum> LF
+[<data> <sum> LF] ...
+LF
+
+The status is 2 characters, "00" is ok, "99" is continuous scan data.
+The sum is a checksum character for the line: ((sum of bytes) & 0x3f) + 0x30
+For VV/PP/II lines of the form "KEY:VALUE;<sum>" the sum excludes the ';'.
+
+Scan data is encoded with 2 (MS/GS) or 3 (MD/GD) characters per value, each
+character carrying 6 bits: value = c - 0x30. The first data line is a
+4 character timestamp, the remaining lines are up to 64 characters of data
+that must be concatenated before decoding.
+
+Angles:
+The scan steps run counter-clockwise from AMIN to AMAX.
+Step AFRT is straight ahead and ARES steps make a full revolution.
+
+See: Hokuyo URG Series Communication Protocol Specification (SCIP 2.0)
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+const HOKUYO_TIMEOUT = 1000 * time.Millisecond // command response timeout
+const HOKUYO_POLL = 100 * time.Millisecond     // read poll period
+const HOKUYO_DATA_LINE = 64                    // max data characters per line
+
+//-----------------------------------------------------------------------------
+
+type Hokuyo struct {
+	Name      string    // user name for this device
+	Address   string    // serial port name or "host:port"
+	Encoding  int       // characters per range value (2 or 3)
+	Polled    bool      // use single scans (GD/GS) rather than continuous scans (MD/MS)
+	Ctrl      chan Ctrl // control channel
+	*ScanBus            // scan delivery
+	Version   map[string]string
+	Params    map[string]string
+	State     map[string]string
+	DMin      int     // minimum valid distance (mm)
+	DMax      int     // maximum valid distance (mm)
+	ARes      int     // steps per revolution
+	AMin      int     // first valid step
+	AMax      int     // last valid step
+	AFrt      int     // front step
+	RPM       float32 // scan rate
+	Running   bool    // is the device scanning? (written under rx_lock)
+	GoodScans uint    // good scans rx-ed
+	BadLines  uint    // bad lines rx-ed (checksum errors)
+
+	port     io.ReadWriteCloser
+	wr_lock  sync.Mutex // lock for writing to the port
+	rx_lock  sync.Mutex // lock for access to the receive state
+	rx_buf   []byte     // partial line
+	lines    []string   // lines of the current response block
+	done     []*Scan2D  // completed scans
+	seq      uint       // scan sequence number
+	last_cmd string     // last scan command sent
+	polled   bool       // a single scan response was rx-ed
+}
+
+//-----------------------------------------------------------------------------
+// SCIP 2.0 Encoding
+
+// return the checksum character of a string
+func scip_sum(s string) byte {
+	var sum byte
+	for i := 0; i < len(s); i++ {
+		sum += s[i]
+	}
+	return (sum & 0x3f) + 0x30
+}
+
+// check and strip the checksum character of a line
+func scip_check(line string) (string, bool) {
+	if len(line) < 2 {
+		return "", false
+	}
+	data := line[:len(line)-1]
+	sum := line[len(line)-1]
+	// status lines are "ss<sum>", data lines are "<data><sum>"
+	// VV/PP/II lines are "KEY:VALUE;<sum>" and the ';' is excluded
+	if scip_sum(data) == sum {
+		return data, true
+	}
+	if strings.HasSuffix(data, ";") && scip_sum(data[:len(data)-1]) == sum {
+		return data[:len(data)-1], true
+	}
+	return "", false
+}
+
+// decode an n character value
+func scip_decode(s string) int {
+	val := 0
+	for i := 0; i < len(s); i++ {
+		val = (val << 6) | int(s[i]-0x30)
+	}
+	return val
+}
+
+// encode an n character value
+func scip_encode(val, n int) string {
+	b := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		b[i] = byte(val&0x3f) + 0x30
+		val >>= 6
+	}
+	return string(b)
+}
+
+//-----------------------------------------------------------------------------
+// Commands
+
+// write a command to the device
+func (l *Hokuyo) write(cmd string) error {
+	l.wr_lock.Lock()
+	defer l.wr_lock.Unlock()
+	_, err := l.port.Write([]byte(cmd + "\n"))
+	return err
+}
+
+// read from the port with a timeout
+func (l *Hokuyo) read(buf []byte, timeout time.Duration) (int, error) {
+	if d, ok := l.port.(interface{ SetReadDeadline(time.Time) error }); ok {
+		d.SetReadDeadline(time.Now().Add(timeout))
+	}
+	n, err := l.port.Read(buf)
+	if err == io.EOF && n == 0 {
+		// serial port read timeout
+		return 0, nil
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return n, nil
+	}
+	return n, err
+}
+
+// split received bytes into lines, return any complete response blocks
+func (l *Hokuyo) rx_lines(buf []byte) [][]string {
+	var blocks [][]string
+	for _, c := range buf {
+		if c != '\n' {
+			if c != '\r' {
+				l.rx_buf = append(l.rx_buf, c)
+			}
+			continue
+		}
+		line := string(l.rx_buf)
+		l.rx_buf = l.rx_buf[:0]
+		if line == "" {
+			// end of block
+			if len(l.lines) != 0 {
+				blocks = append(blocks, l.lines)
+				l.lines = nil
+			}
+			continue
+		}
+		l.lines = append(l.lines, line)
+	}
+	return blocks
+}
+
+// send a command and read the response block
+func (l *Hokuyo) command(cmd string) ([]string, error) {
+	err := l.write(cmd)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 256)
+	deadline := time.Now().Add(HOKUYO_TIMEOUT)
+	for time.Now().Before(deadline) {
+		n, err := l.read(buf, HOKUYO_POLL)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range l.rx_lines(buf[:n]) {
+			if block[0] != cmd {
+				// not the response to this command
+				continue
+			}
+			if len(block) < 2 {
+				return nil, errors.New("no response status")
+			}
+			status, ok := scip_check(block[1])
+			if !ok {
+				return nil, errors.New("bad response status checksum")
+			}
+			if status != "00" {
+				return nil, fmt.Errorf("%s: error status %s", cmd, status)
+			}
+			return block[2:], nil
+		}
+	}
+	return nil, fmt.Errorf("%s: response timeout", cmd)
+}
+
+// send a VV/PP/II command and return the "KEY:VALUE" map
+func (l *Hokuyo) info(cmd string) (map[string]string, error) {
+	lines, err := l.command(cmd)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for _, line := range lines {
+		data, ok := scip_check(line)
+		if !ok {
+			return nil, fmt.Errorf("%s: bad checksum \"%s\"", cmd, line)
+		}
+		kv := strings.SplitN(data, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s: bad line \"%s\"", cmd, line)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// return an integer parameter
+func (l *Hokuyo) param(key string) (int, error) {
+	val, ok := l.Params[key]
+	if !ok {
+		return 0, fmt.Errorf("missing parameter %s", key)
+	}
+	// some devices append a comment, E.g. "SCAN:600;" vs "DMAX:5600 [mm]"
+	val = strings.Fields(val)[0]
+	return strconv.Atoi(val)
+}
+
+// get the device parameters
+func (l *Hokuyo) get_params() error {
+	var err error
+	l.Params, err = l.info("PP")
+	if err != nil {
+		return err
+	}
+	keys := []string{"DMIN", "DMAX", "ARES", "AMIN", "AMAX", "AFRT", "SCAN"}
+	vals := make([]int, len(keys))
+	for i, k := range keys {
+		vals[i], err = l.param(k)
+		if err != nil {
+			return err
+		}
+	}
+	l.DMin, l.DMax, l.ARes, l.AMin, l.AMax, l.AFrt = vals[0], vals[1], vals[2], vals[3], vals[4], vals[5]
+	l.RPM = float32(vals[6])
+	if l.ARes <= 0 || l.AMin > l.AMax {
+		return errors.New("bad device parameters")
+	}
+	return nil
+}
+
+// return the scan command
+func (l *Hokuyo) scan_cmd() string {
+	cmd := "MD"
+	if l.Polled {
+		cmd = "GD"
+	}
+	if l.Encoding == 2 {
+		cmd = cmd[:1] + "S"
+	}
+	cmd += fmt.Sprintf("%04d%04d01", l.AMin, l.AMax)
+	if !l.Polled {
+		// scan interval 0, unlimited number of scans
+		cmd += "000"
+	}
+	return cmd
+}
+
+//-----------------------------------------------------------------------------
+// Scan Decoding
+
+// decode a scan response block
+func (l *Hokuyo) decode_scan(block []string, ts time.Time) (*Scan2D, error) {
+	echo := block[0]
+	if len(block) < 3 {
+		return nil, errors.New("short scan response")
+	}
+	status, ok := scip_check(block[1])
+	if !ok {
+		l.BadLines += 1
+		return nil, errors.New("bad status checksum")
+	}
+	if status != "00" && status != "99" {
+		return nil, fmt.Errorf("%s: error status %s", echo[:2], status)
+	}
+	if len(echo) < 12 {
+		return nil, errors.New("bad scan echo")
+	}
+	start, err0 := strconv.Atoi(echo[2:6])
+	end, err1 := strconv.Atoi(echo[6:10])
+	cluster, err2 := strconv.Atoi(echo[10:12])
+	if err0 != nil || err1 != nil || err2 != nil || start > end {
+		return nil, errors.New("bad scan echo")
+	}
+	if cluster == 0 {
+		cluster = 1
+	}
+	enc := 3
+	if echo[1] == 'S' {
+		enc = 2
+	}
+	// timestamp
+	_, ok = scip_check(block[2])
+	if !ok {
+		l.BadLines += 1
+		return nil, errors.New("bad timestamp checksum")
+	}
+	// concatenate the data lines
+	var sb strings.Builder
+	for _, line := range block[3:] {
+		data, ok := scip_check(line)
+		if !ok {
+			l.BadLines += 1
+			return nil, errors.New("bad data checksum")
+		}
+		sb.WriteString(data)
+	}
+	data := sb.String()
+	n := (end-start)/cluster + 1
+	if len(data) != n*enc {
+		return nil, fmt.Errorf("scan data length %d, expected %d", len(data), n*enc)
+	}
+	scan := l.NewScan(n)
+	scan.Device = l.Name
+	scan.Seq = l.seq
+	scan.RPM = l.RPM
+	scan.Packets = 1
+	scan.Samples = scan.Samples[:n]
+	l.seq += 1
+	for i := range scan.Samples {
+		dist := scip_decode(data[i*enc : (i+1)*enc])
+		step := start + (i * cluster)
+		angle := 2.0 * math.Pi * float64(step-l.AFrt) / float64(l.ARes)
+		if angle < 0 {
+			angle += 2.0 * math.Pi
+		}
+		scan.Samples[i] = Sample2D{
+			Good:     dist >= l.DMin && dist <= l.DMax,
+			Angle:    float32(angle),
+			Distance: float32(dist) / 1000.0,
+			TS:       ts,
+		}
+	}
+	// the scan is sent after the last step is measured
+	scan.interpolate()
+	return scan, nil
+}
+
+// receive bytes from the device, return any completed scans
+func (l *Hokuyo) rx(buf []byte, ts time.Time) []*Scan2D {
+	l.rx_lock.Lock()
+	defer l.rx_lock.Unlock()
+	l.done = nil
+	l.polled = false
+	for _, block := range l.rx_lines(buf) {
+		cmd := block[0]
+		if len(cmd) < 2 || (cmd[:2] != "MD" && cmd[:2] != "MS" && cmd[:2] != "GD" && cmd[:2] != "GS") {
+			log.Printf("%s: response to %s", l.Name, cmd)
+			continue
+		}
+		if cmd[0] == 'G' {
+			l.polled = true
+		}
+		if len(block) == 2 {
+			// MD/MS acknowledge (or an error status)
+			status, _ := scip_check(block[1])
+			if status != "00" {
+				log.Printf("%s: %s error status %s", l.Name, cmd[:2], status)
+			}
+			continue
+		}
+		scan, err := l.decode_scan(block, ts)
+		if err != nil {
+			log.Printf("%s: %s", l.Name, err)
+			continue
+		}
+		l.GoodScans += 1
+		l.done = append(l.done, scan)
+	}
+	return l.done
+}
+
+// Read the device and process the scans
+func (l *Hokuyo) read_port(quit <-chan bool, wg *sync.WaitGroup) {
+	log.Printf("%s.read_port() enter", l.Name)
+	defer wg.Done()
+	buf := make([]byte, 4096)
+	for {
+		select {
+		case <-quit:
+			log.Printf("%s.read_port() exit", l.Name)
+			return
+		default:
+			n, err := l.read(buf, HOKUYO_POLL)
+			if err != nil {
+				log.Printf("%s: read error %s", l.Name, err)
+				time.Sleep(HOKUYO_POLL)
+				continue
+			}
+			scans := l.rx(buf[:n], time.Now())
+			for _, scan := range scans {
+				l.Publish(scan)
+			}
+			l.rx_lock.Lock()
+			cmd := l.last_cmd
+			polled := l.polled
+			l.rx_lock.Unlock()
+			if polled && cmd != "" {
+				// request the next single scan
+				l.write(cmd)
+			}
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// NewHokuyo creates a new Hokuyo device.
+// The address is a serial port name or a "host:port" TCP address.
+func NewHokuyo(name, address string) (*Hokuyo, error) {
+	l := Hokuyo{
+		Name:     name,
+		Address:  address,
+		Encoding: 3,
+	}
+	log.Printf("NewHokuyo() %s", l.Name)
+	l.Ctrl = make(chan Ctrl)
+	l.ScanBus = NewScanBus(l.Name)
+	return &l, nil
+}
+
+// NewHokuyoPort creates a new Hokuyo device on an already open connection.
+// E.g. one end of a pipe connected to a stand-in device.
+func NewHokuyoPort(name string, port io.ReadWriteCloser) (*Hokuyo, error) {
+	l, err := NewHokuyo(name, "")
+	if err != nil {
+		return nil, err
+	}
+	l.port = port
+	return l, nil
+}
+
+// Open the connection and query the device.
+func (l *Hokuyo) Open() error {
+	log.Printf("%s.Open()", l.Name)
+	if l.Encoding != 2 && l.Encoding != 3 {
+		return fmt.Errorf("bad range encoding %d (2 or 3 characters)", l.Encoding)
+	}
+	if l.port == nil {
+		var err error
+		if strings.Contains(l.Address, ":") && !strings.HasPrefix(l.Address, "/") {
+			l.port, err = net.DialTimeout("tcp", l.Address, HOKUYO_TIMEOUT)
+		} else {
+			l.port, err = open_serial(l.Address, 115200, HOKUYO_POLL)
+		}
+		if err != nil {
+			log.Printf("%s: unable to open %s", l.Name, l.Address)
+			return err
+		}
+	}
+
+	// stop any scanning in progress and enter SCIP 2.0 mode
+	l.write("QT")
+	l.write("SCIP2.0")
+	time.Sleep(HOKUYO_POLL)
+	buf := make([]byte, 4096)
+	for {
+		n, err := l.read(buf, HOKUYO_POLL)
+		if n == 0 || err != nil {
+			break
+		}
+	}
+	l.rx_buf = l.rx_buf[:0]
+	l.lines = nil
+
+	var err error
+	l.Version, err = l.info("VV")
+	if err != nil {
+		log.Printf("%s: unable to get version information", l.Name)
+		return err
+	}
+	err = l.get_params()
+	if err != nil {
+		log.Printf("%s: unable to get parameters", l.Name)
+		return err
+	}
+	l.State, err = l.info("II")
+	if err != nil {
+		// not supported by older firmware
+		log.Printf("%s: unable to get state information", l.Name)
+	}
+	log.Printf("%s: %s serial %s", l.Name, l.Version["PROD"], l.Version["SERI"])
+	log.Printf("%s: %d steps/rev, steps %d..%d, front %d", l.Name, l.ARes, l.AMin, l.AMax, l.AFrt)
+	return nil
+}
+
+func (l *Hokuyo) Close() error {
+	log.Printf("%s.Close()", l.Name)
+	if l.port == nil {
+		return nil
+	}
+	l.stop()
+	err := l.port.Close()
+	if err != nil {
+		log.Printf("%s: error closing %s", l.Name, l.Address)
+		return err
+	}
+	l.port = nil
+	return nil
+}
+
+// Start scanning.
+func (l *Hokuyo) Start() {
+	l.Ctrl <- Start
+}
+
+// Stop scanning.
+func (l *Hokuyo) Stop() {
+	l.Ctrl <- Stop
+}
+
+// Status returns the LIDAR status as (name, value) rows.
+func (l *Hokuyo) Status() [][]string {
+	mode := "continuous"
+	if l.Polled {
+		mode = "polled"
+	}
+	l.rx_lock.Lock()
+	good, bad, running := l.GoodScans, l.BadLines, l.Running
+	l.rx_lock.Unlock()
+	rows := make([][]string, 0, 10)
+	rows = append(rows, []string{"name", l.Name})
+	rows = append(rows, []string{"type", "hokuyo"})
+	rows = append(rows, []string{"address", l.Address})
+	rows = append(rows, []string{"product", l.Version["PROD"]})
+	rows = append(rows, []string{"firmware", l.Version["FIRM"]})
+	rows = append(rows, []string{"protocol", l.Version["PROT"]})
+	rows = append(rows, []string{"serial number", l.Version["SERI"]})
+	rows = append(rows, []string{"model", l.Params["MODL"]})
+	rows = append(rows, []string{"range", fmt.Sprintf("%d..%d mm", l.DMin, l.DMax)})
+	rows = append(rows, []string{"resolution", fmt.Sprintf("%d steps/rev (%.3f deg)", l.ARes, 360.0/float32(l.ARes))})
+	rows = append(rows, []string{"steps", fmt.Sprintf("%d..%d (front %d)", l.AMin, l.AMax, l.AFrt)})
+	rows = append(rows, []string{"rpm", fmt.Sprintf("%f", l.RPM)})
+	rows = append(rows, []string{"mode", fmt.Sprintf("%s, %d char encoding", mode, l.Encoding)})
+	rows = append(rows, []string{"running", fmt.Sprintf("%t", running)})
+	rows = append(rows, []string{"good scans", fmt.Sprintf("%d", good)})
+	rows = append(rows, []string{"bad lines", fmt.Sprintf("%d", bad)})
+	rows = append(rows, l.BusStatus()...)
+	return rows
+}
+
+func (l *Hokuyo) start() {
+	if l.Running {
+		log.Printf("%s.Start() already running", l.Name)
+		return
+	}
+	log.Printf("%s.Start()", l.Name)
+	// turn on the laser
+	err := l.write("BM")
+	if err != nil {
+		log.Printf("%s: unable to turn on the laser", l.Name)
+		return
+	}
+	cmd := l.scan_cmd()
+	l.rx_lock.Lock()
+	l.last_cmd = cmd
+	l.rx_lock.Unlock()
+	err = l.write(cmd)
+	if err != nil {
+		log.Printf("%s: unable to start scanning", l.Name)
+		return
+	}
+	l.rx_lock.Lock()
+	l.Running = true
+	l.rx_lock.Unlock()
+}
+
+func (l *Hokuyo) stop() {
+	if !l.Running {
+		log.Printf("%s.Stop() already stopped", l.Name)
+		return
+	}
+	log.Printf("%s.Stop()", l.Name)
+	l.rx_lock.Lock()
+	l.last_cmd = ""
+	l.Running = false
+	l.rx_lock.Unlock()
+	// stop scanning and turn off the laser
+	err := l.write("QT")
+	if err != nil {
+		log.Printf("%s: unable to stop scanning", l.Name)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func (l *Hokuyo) Process(quit <-chan bool, wg *sync.WaitGroup) {
+	log.Printf("%s.Process() enter", l.Name)
+	defer wg.Done()
+
+	lidar_wg := &sync.WaitGroup{}
+
+	// start reading
+	lidar_wg.Add(1)
+	go l.read_port(quit, lidar_wg)
+
+	for {
+		select {
+		case ctrl := <-l.Ctrl:
+			switch ctrl {
+			case Start:
+				l.start()
+			case Stop:
+				l.stop()
+			default:
+				log.Printf("%s.Process() unknown ctrl %d", l.Name, ctrl)
+			}
+		case <-quit:
+			lidar_wg.Wait()
+			l.Close()
+			log.Printf("%s.Process() exit", l.Name)
+			return
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
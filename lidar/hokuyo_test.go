@@ -0,0 +1,172 @@
+//-----------------------------------------------------------------------------
+/*
+
+Hokuyo Driver Tests
+
+The driver is run against the SCIP 2.0 stand-in device (scip_standin.go) over
+a TCP socket and over a pipe, with continuous (MD/MS) and single (GD/GS)
+scans in both range encodings.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// connect a driver to a stand-in over TCP or a pipe
+func standin_hokuyo(t *testing.T, tcp bool) (*Hokuyo, *SCIPStandIn, func()) {
+	s := NewSCIPStandIn("standin", nil)
+	if tcp {
+		ln, err := s.ListenAndServe("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			ln.Close()
+			t.Fatal(err)
+		}
+		l, err := NewHokuyoPort("hokuyo", conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l, s, func() { ln.Close() }
+	}
+	a, b := net.Pipe()
+	go s.Serve(a)
+	l, err := NewHokuyoPort("hokuyo", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, s, func() { a.Close() }
+}
+
+// run the driver and check the scans
+func hokuyo_scans(t *testing.T, tcp, polled bool, enc int) {
+	l, s, done := standin_hokuyo(t, tcp)
+	defer done()
+	l.Polled = polled
+	l.Encoding = enc
+	err := l.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.ARes != s.ARes || l.AMin != s.AMin || l.AMax != s.AMax || l.AFrt != s.AFrt || l.RPM != float32(s.RPM) {
+		t.Fatalf("parameters %d %d..%d %d %f", l.ARes, l.AMin, l.AMax, l.AFrt, l.RPM)
+	}
+	sub := l.Subscribe("test", Queue, 4)
+	quit := make(chan bool)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go l.Process(quit, wg)
+	l.Start()
+
+	n := s.AMax - s.AMin + 1
+	for i := 0; i < 3; i++ {
+		select {
+		case scan := <-sub.C:
+			if len(scan.Samples) != n {
+				t.Errorf("%d samples, expected %d", len(scan.Samples), n)
+			}
+			for k, x := range scan.Samples {
+				if !x.Good || x.Distance != 1.0 {
+					t.Errorf("sample %d: good %t distance %f", k, x.Good, x.Distance)
+					break
+				}
+			}
+			a := 2.0*math.Pi*float64(s.AMin-s.AFrt)/float64(s.ARes) + 2.0*math.Pi
+			if !near(float64(scan.Samples[0].Angle), a, 1e-5) {
+				t.Errorf("first angle %f, expected %f", scan.Samples[0].Angle, a)
+			}
+			scan.Release()
+		case <-time.After(2 * time.Second):
+			t.Fatalf("scan %d timeout", i)
+		}
+	}
+
+	l.rx_lock.Lock()
+	cmd := l.last_cmd
+	l.rx_lock.Unlock()
+	want := map[bool]string{false: "M", true: "G"}[polled] + map[int]string{2: "S", 3: "D"}[enc]
+	if cmd[:2] != want {
+		t.Errorf("scan command %s, expected %s", cmd, want)
+	}
+
+	close(quit)
+	wg.Wait()
+	sub.Unsubscribe()
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_Hokuyo_MD_TCP(t *testing.T) {
+	hokuyo_scans(t, true, false, 3)
+}
+
+func Test_Hokuyo_MS_TCP(t *testing.T) {
+	hokuyo_scans(t, true, false, 2)
+}
+
+func Test_Hokuyo_GD_Pipe(t *testing.T) {
+	hokuyo_scans(t, false, true, 3)
+}
+
+func Test_Hokuyo_GS_Pipe(t *testing.T) {
+	hokuyo_scans(t, false, true, 2)
+}
+
+func Test_Hokuyo_Encoding(t *testing.T) {
+	l, _, done := standin_hokuyo(t, false)
+	defer done()
+	l.Encoding = 4
+	if l.Open() == nil {
+		t.Error("4 character encoding accepted")
+	}
+	for _, n := range []int{2, 3} {
+		for _, v := range []int{0, 1, 63, 64, 1000, (1 << (6 * uint(n))) - 1} {
+			if x := scip_decode(scip_encode(v, n)); x != v {
+				t.Errorf("%d char encoding of %d decodes as %d", n, v, x)
+			}
+		}
+	}
+	// the example from the SCIP 2.0 specification
+	if scip_decode("1Dh") != 5432 {
+		t.Errorf("\"1Dh\" decodes as %d", scip_decode("1Dh"))
+	}
+}
+
+func Test_Hokuyo_Checksum(t *testing.T) {
+	s := NewSCIPStandIn("standin", nil)
+	c := &scip_conn{s: s, ts: time.Now()}
+	l, err := NewHokuyo("hokuyo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.ARes, l.AMin, l.AMax, l.AFrt, l.DMin, l.DMax = s.ARes, s.AMin, s.AMax, s.AFrt, s.DMin, s.DMax
+	cmd := "GD0044072501"
+	block := append([]string{cmd, "00P"}, c.scan_lines(44, 725, 1, 3)...)
+	scan, err := l.decode_scan(block, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan.Release()
+	// corrupt a data character
+	line := []byte(block[4])
+	line[10] ^= 0x01
+	block[4] = string(line)
+	_, err = l.decode_scan(block, time.Now())
+	if err == nil || l.BadLines != 1 {
+		t.Errorf("bad checksum: err %v, %d bad lines", err, l.BadLines)
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -8,19 +8,40 @@ Generic LIDAR Code
 
 package lidar
 
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
 //-----------------------------------------------------------------------------
 
 // 2D LIDAR Sample
 type Sample2D struct {
-	Good            bool    // good data in this sample
-	Too_Close       bool    // object too close
-	Angle           float32 // angle in radians
-	Distance        float32 // distance in meters
-	Signal_Strength float32 // signal strength
+	Good            bool      // good data in this sample
+	Too_Close       bool      // object too close
+	Angle           float32   // angle in radians
+	Distance        float32   // distance in meters
+	Signal_Strength float32   // signal strength
+	TS              time.Time // sample time
 }
 
 // 2D LIDAR Scan
-type Scan2D []Sample2D
+type Scan2D struct {
+	Device     string     // source device name
+	Seq        uint       // scan sequence number
+	Start      time.Time  // time of the first sample
+	End        time.Time  // time of the last sample
+	RPM        float32    // measured rpm
+	Packets    int        // number of packets received for this scan
+	Incomplete bool       // packets are missing from this scan
+	Ref        time.Time  // de-skew reference time (zero if not de-skewed)
+	Samples    []Sample2D // scan samples
+
+	bus  *ScanBus // bus pool for release
+	refs int32    // subscriber references
+}
 
 // Control Values
 type Ctrl int
@@ -30,4 +51,116 @@ const (
 	Start             // start scanning
 )
 
+// GapPolicy is what to do with a scan that is missing packets.
+type GapPolicy int
+
+const (
+	GapEmit GapPolicy = iota // emit the scan as is
+	GapMark                  // emit the scan marked as incomplete
+	GapDrop                  // drop the scan
+)
+
+var gap_policy_names = map[GapPolicy]string{
+	GapEmit: "emit",
+	GapMark: "mark",
+	GapDrop: "drop",
+}
+
+func (p GapPolicy) String() string {
+	if s, ok := gap_policy_names[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", int(p))
+}
+
+// ParseGapPolicy returns the gap policy for a name (emit, mark, drop).
+func ParseGapPolicy(name string) (GapPolicy, error) {
+	for p, s := range gap_policy_names {
+		if s == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown gap policy \"%s\"", name)
+}
+
+//-----------------------------------------------------------------------------
+// Sample Timestamps
+
+// Samples are added to a scan with the time of the packet they arrived in.
+// The last sample of a packet is taken to be measured at the packet time and
+// the earlier samples are back dated using their angle from the last sample
+// and the rotation rate.
+
+// byte_time returns the time to send one byte (8N1) at a baud rate.
+// It's used to back date packets that arrived early in a read buffer.
+func byte_time(baud int) time.Duration {
+	return time.Duration(10 * int64(time.Second) / int64(baud))
+}
+
+// interpolate the sample timestamps and set the scan start/end times.
+func (scan *Scan2D) interpolate() {
+	w := float64(scan.RPM) * 2.0 * math.Pi / 60.0
+	var pkt_ts time.Time // packet time of the current group of samples
+	var acc float64      // angle back from the last sample of the group
+	next := -1           // index of the next (later) sample in the group
+	for i := len(scan.Samples) - 1; i >= 0; i-- {
+		s := &scan.Samples[i]
+		if s.TS.IsZero() {
+			// no sample
+			continue
+		}
+		if !s.TS.Equal(pkt_ts) || next < 0 {
+			// last sample of a packet
+			pkt_ts = s.TS
+			acc = 0
+			next = i
+			continue
+		}
+		da := float64(scan.Samples[next].Angle - s.Angle)
+		if da < -math.Pi {
+			da += 2.0 * math.Pi
+		} else if da > math.Pi {
+			da -= 2.0 * math.Pi
+		}
+		if da > 0 {
+			acc += da
+		}
+		next = i
+		if w > 0 {
+			s.TS = pkt_ts.Add(-time.Duration(acc / w * float64(time.Second)))
+		}
+	}
+	scan.Start = time.Time{}
+	scan.End = time.Time{}
+	for i := range scan.Samples {
+		ts := scan.Samples[i].TS
+		if ts.IsZero() {
+			continue
+		}
+		if scan.Start.IsZero() || ts.Before(scan.Start) {
+			scan.Start = ts
+		}
+		if ts.After(scan.End) {
+			scan.End = ts
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// Driver is the interface to a 2D LIDAR device.
+type Driver interface {
+	Open() error                                                   // open the device
+	Close() error                                                  // close the device
+	Start()                                                        // start scanning
+	Stop()                                                         // stop scanning
+	Subscribe(name string, mode Delivery, depth int) *Subscription // subscribe to the scans
+	Filters() *FilterChain                                         // scan filters applied before delivery
+	SetExtrinsics(e Extrinsics)                                    // set the mounting in the robot frame
+	Extrinsics() Extrinsics                                        // get the mounting in the robot frame
+	SetDeskew(src PoseSource)                                      // set the robot pose source for de-skewing (nil for none)
+	Status() [][]string                                            // device status as (name, value) rows
+	Process(quit <-chan bool, wg *sync.WaitGroup)                  // run the device
+}
+
 //-----------------------------------------------------------------------------
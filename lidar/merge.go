@@ -0,0 +1,295 @@
+//-----------------------------------------------------------------------------
+/*
+
+Multiple LIDAR Scan Merging
+
+The merger subscribes to the scans of several LIDARs and fuses time aligned
+scans into a single set of robot frame points. The scans are already in the
+robot frame (see extrinsics.go), so merging is a matter of picking scans that
+were taken at about the same time.
+
+Alignment:
+The newest unmerged scan of each device is kept. When every device has a scan
+and they're all within MaxSkew of each other, the scans are merged. A scan
+that's too old to align with the newest scan is dropped. If a device stops
+producing scans, the others are merged without it after a timeout.
+
+All times are scan times, not the wall clock, so a replayed recording merges
+the same way as it did live. A device times out when the newest scan from any
+device is more than Timeout after its last merged scan.
+
+The reference time of a merged point set is the mid time of the newest scan.
+The points are as measured, they aren't de-skewed to the reference time.
+
+Merged point sets are delivered latest wins: a slow consumer only sees the
+newest point set.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// Point2D is a point in the robot frame.
+type Point2D struct {
+	X, Y            float32   // position (meters)
+	Signal_Strength float32   // signal strength
+	Device          int       // index of the source device
+	TS              time.Time // sample time
+}
+
+// PointSet is a set of points merged from the scans of several devices.
+type PointSet struct {
+	Seq     uint      // point set sequence number
+	Ref     time.Time // reference time
+	Devices []string  // names of the devices, indexed by Point2D.Device
+	Missing []string  // devices without an aligned scan
+	Points  []Point2D // merged points
+}
+
+//-----------------------------------------------------------------------------
+
+const MERGE_MAX_SKEW = 100 * time.Millisecond // maximum time between aligned scans
+const MERGE_TIMEOUT = 500 * time.Millisecond  // time to wait for a missing device
+const MERGE_QUEUE = 4                         // subscription queue depth
+
+type merge_input struct {
+	name     string
+	drv      Driver
+	sub      *Subscription
+	pending  *Scan2D   // newest unmerged scan
+	merged   time.Time // mid time of the last scan merged
+	received uint      // scans received
+	stale    uint      // scans dropped as too old to align
+}
+
+type merge_scan struct {
+	idx  int
+	scan *Scan2D
+}
+
+// Merger fuses the time aligned scans of several devices.
+type Merger struct {
+	Name    string           // user name for the merger
+	C       <-chan *PointSet // merged point sets
+	MaxSkew time.Duration    // maximum time between aligned scans
+	Timeout time.Duration    // time to wait for a missing device
+
+	c       chan *PointSet
+	lock    sync.Mutex // lock for the inputs and counters
+	inputs  []*merge_input
+	first   time.Time // mid time of the first scan received
+	latest  time.Time // mid time of the newest scan received
+	seq     uint      // point sets merged
+	partial uint      // point sets merged with missing devices
+	dropped uint      // point sets not read before the next one
+}
+
+// NewMerger returns a new merger.
+func NewMerger(name string) *Merger {
+	m := Merger{
+		Name:    name,
+		MaxSkew: MERGE_MAX_SKEW,
+		Timeout: MERGE_TIMEOUT,
+		c:       make(chan *PointSet, 1),
+	}
+	m.C = m.c
+	log.Printf("NewMerger() %s", m.Name)
+	return &m
+}
+
+// Add a device to the merger. Devices must be added before Run.
+func (m *Merger) Add(name string, drv Driver) {
+	m.inputs = append(m.inputs, &merge_input{name: name, drv: drv})
+}
+
+//-----------------------------------------------------------------------------
+
+// mid time of a scan
+func scan_mid(scan *Scan2D) time.Time {
+	return scan.Start.Add(scan.End.Sub(scan.Start) / 2)
+}
+
+// accept a scan from a device
+func (m *Merger) accept(idx int, scan *Scan2D) {
+	in := m.inputs[idx]
+	in.received += 1
+	t := scan_mid(scan)
+	if m.first.IsZero() {
+		m.first = t
+	}
+	if t.After(m.latest) {
+		m.latest = t
+	}
+	if in.pending != nil {
+		in.pending.Release()
+		in.stale += 1
+	}
+	in.pending = scan
+}
+
+// timeout returns true if a device has stopped producing aligned scans
+func (m *Merger) timeout(in *merge_input) bool {
+	last := in.merged
+	if last.IsZero() {
+		// nothing merged yet, wait from the first scan of any device
+		last = m.first
+	}
+	return m.latest.Sub(last) > m.Timeout
+}
+
+// merge the pending scans if they're aligned, or on a timeout
+func (m *Merger) try_merge() {
+	// find the newest pending scan
+	var newest time.Time
+	n := 0
+	for _, in := range m.inputs {
+		if in.pending != nil {
+			n += 1
+			if t := scan_mid(in.pending); t.After(newest) {
+				newest = t
+			}
+		}
+	}
+	if n == 0 {
+		return
+	}
+	// drop scans that are too old to align
+	for _, in := range m.inputs {
+		if in.pending != nil && newest.Sub(scan_mid(in.pending)) > m.MaxSkew {
+			in.pending.Release()
+			in.pending = nil
+			in.stale += 1
+		}
+	}
+	for _, in := range m.inputs {
+		if in.pending == nil && !m.timeout(in) {
+			// wait for the other devices
+			return
+		}
+	}
+	m.merge(newest)
+}
+
+// merge the pending scans into a point set
+func (m *Merger) merge(ref time.Time) {
+	ps := &PointSet{
+		Seq: m.seq,
+		Ref: ref,
+	}
+	m.seq += 1
+	for i, in := range m.inputs {
+		ps.Devices = append(ps.Devices, in.name)
+		scan := in.pending
+		if scan == nil {
+			ps.Missing = append(ps.Missing, in.name)
+			continue
+		}
+		in.pending = nil
+		in.merged = scan_mid(scan)
+		for j := range scan.Samples {
+			s := &scan.Samples[j]
+			if !s.Good {
+				continue
+			}
+			a := float64(s.Angle)
+			ps.Points = append(ps.Points, Point2D{
+				X:               s.Distance * float32(math.Cos(a)),
+				Y:               s.Distance * float32(math.Sin(a)),
+				Signal_Strength: s.Signal_Strength,
+				Device:          i,
+				TS:              s.TS,
+			})
+		}
+		scan.Release()
+	}
+	if len(ps.Missing) != 0 {
+		m.partial += 1
+	}
+	// deliver latest wins
+	select {
+	case <-m.c:
+		m.dropped += 1
+	default:
+	}
+	m.c <- ps
+}
+
+//-----------------------------------------------------------------------------
+
+// Run the merger.
+func (m *Merger) Run(quit <-chan bool, wg *sync.WaitGroup) {
+	log.Printf("%s.Run() enter", m.Name)
+	defer wg.Done()
+	// fan in the device scans
+	scans := make(chan merge_scan, MERGE_QUEUE*len(m.inputs))
+	fan_wg := &sync.WaitGroup{}
+	for i, in := range m.inputs {
+		in.sub = in.drv.Subscribe(m.Name, Queue, MERGE_QUEUE)
+		fan_wg.Add(1)
+		go func(idx int, sub *Subscription) {
+			defer fan_wg.Done()
+			for scan := range sub.C {
+				scans <- merge_scan{idx, scan}
+			}
+		}(i, in.sub)
+	}
+	for {
+		select {
+		case <-quit:
+			for _, in := range m.inputs {
+				in.sub.Unsubscribe()
+			}
+			// drain the fan in until the forwarders exit
+			go func() {
+				fan_wg.Wait()
+				close(scans)
+			}()
+			for scan := range scans {
+				scan.scan.Release()
+			}
+			m.lock.Lock()
+			for _, in := range m.inputs {
+				if in.pending != nil {
+					in.pending.Release()
+					in.pending = nil
+				}
+			}
+			m.lock.Unlock()
+			log.Printf("%s.Run() exit", m.Name)
+			return
+		case s := <-scans:
+			m.lock.Lock()
+			m.accept(s.idx, s.scan)
+			m.try_merge()
+			m.lock.Unlock()
+		}
+	}
+}
+
+// Status returns the merger status as (name, value) rows.
+func (m *Merger) Status() [][]string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rows := make([][]string, 0, len(m.inputs)+4)
+	rows = append(rows, []string{"point sets", fmt.Sprintf("%d", m.seq)})
+	rows = append(rows, []string{"partial", fmt.Sprintf("%d", m.partial)})
+	rows = append(rows, []string{"dropped", fmt.Sprintf("%d", m.dropped)})
+	rows = append(rows, []string{"max skew", m.MaxSkew.String()})
+	for _, in := range m.inputs {
+		val := fmt.Sprintf("%d received, %d stale", in.received, in.stale)
+		rows = append(rows, []string{"device " + in.name, val})
+	}
+	return rows
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,82 @@
+//-----------------------------------------------------------------------------
+/*
+
+Scan Merger Tests
+
+The scans have old timestamps, as they would in a replayed recording, so the
+merger must only use scan times.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// a one sample scan from t to t + 100ms
+func merge_scan_at(t time.Time) *Scan2D {
+	return &Scan2D{
+		Start:   t,
+		End:     t.Add(100 * time.Millisecond),
+		Samples: []Sample2D{{Distance: 1.0, Good: true, TS: t}},
+	}
+}
+
+// the merged point set, or nil if nothing was merged
+func merged(m *Merger) *PointSet {
+	select {
+	case ps := <-m.C:
+		return ps
+	default:
+		return nil
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_Merger_Replay(t *testing.T) {
+	m := NewMerger("test")
+	m.Add("a", nil)
+	m.Add("b", nil)
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// aligned scans are merged
+	m.accept(0, merge_scan_at(t0))
+	m.try_merge()
+	if merged(m) != nil {
+		t.Fatal("merged without waiting for b")
+	}
+	m.accept(1, merge_scan_at(t0.Add(20*time.Millisecond)))
+	m.try_merge()
+	ps := merged(m)
+	if ps == nil || len(ps.Points) != 2 || len(ps.Missing) != 0 {
+		t.Fatalf("aligned merge %v", ps)
+	}
+
+	// b stops, a is merged alone once b has timed out in scan time
+	dt := 100 * time.Millisecond
+	n := 0
+	for i := 1; i <= 10; i++ {
+		m.accept(0, merge_scan_at(t0.Add(time.Duration(i)*dt)))
+		m.try_merge()
+		if ps := merged(m); ps != nil {
+			if len(ps.Missing) != 1 || ps.Missing[0] != "b" {
+				t.Errorf("missing %v", ps.Missing)
+			}
+			if n == 0 && time.Duration(i)*dt <= m.Timeout {
+				t.Errorf("merged after %s, before the timeout", time.Duration(i)*dt)
+			}
+			n += 1
+		}
+	}
+	if n == 0 {
+		t.Error("no partial merges")
+	}
+}
+
+//-----------------------------------------------------------------------------
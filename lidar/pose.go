@@ -0,0 +1,214 @@
+//-----------------------------------------------------------------------------
+/*
+
+2D Poses and Pose Sources
+
+A pose source gives the pose of the robot at any time within a scan. It only
+needs to be consistent over the duration of a scan, so the origin is arbitrary.
+
+* ConstantVelocity: a constant twist, E.g. from wheel odometry or the
+  difference between the last two scan matching estimates.
+* PoseHistory: interpolation between timestamped poses, E.g. from odometry
+  or scan matching.
+
+Poses are in meters and radians. Theta is counter-clockwise from the x-axis.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// Pose2D is a 2D position and heading.
+type Pose2D struct {
+	X, Y  float64 // position (meters)
+	Theta float64 // heading (radians)
+}
+
+// wrap an angle to [-pi, pi)
+func wrap_pi(a float64) float64 {
+	return a - 2.0*math.Pi*math.Floor((a+math.Pi)/(2.0*math.Pi))
+}
+
+// Compose returns the pose q (relative to p) in the frame of p.
+func (p Pose2D) Compose(q Pose2D) Pose2D {
+	c, s := math.Cos(p.Theta), math.Sin(p.Theta)
+	return Pose2D{
+		X:     p.X + c*q.X - s*q.Y,
+		Y:     p.Y + s*q.X + c*q.Y,
+		Theta: wrap_pi(p.Theta + q.Theta),
+	}
+}
+
+// Inverse returns the inverse of the pose.
+func (p Pose2D) Inverse() Pose2D {
+	c, s := math.Cos(p.Theta), math.Sin(p.Theta)
+	return Pose2D{
+		X:     -c*p.X - s*p.Y,
+		Y:     s*p.X - c*p.Y,
+		Theta: wrap_pi(-p.Theta),
+	}
+}
+
+// Transform returns a point (relative to p) in the frame of p.
+func (p Pose2D) Transform(x, y float64) (float64, float64) {
+	c, s := math.Cos(p.Theta), math.Sin(p.Theta)
+	return p.X + c*x - s*y, p.Y + s*x + c*y
+}
+
+// Interpolate returns the pose a fraction k of the way from p to q.
+func (p Pose2D) Interpolate(q Pose2D, k float64) Pose2D {
+	return Pose2D{
+		X:     p.X + k*(q.X-p.X),
+		Y:     p.Y + k*(q.Y-p.Y),
+		Theta: wrap_pi(p.Theta + k*wrap_pi(q.Theta-p.Theta)),
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// PoseSource gives the pose of the robot at a time.
+type PoseSource interface {
+	Pose(t time.Time) (Pose2D, error)
+}
+
+//-----------------------------------------------------------------------------
+// Constant Velocity
+
+// ConstantVelocity is a constant twist in the robot frame.
+type ConstantVelocity struct {
+	VX, VY float64   // linear velocity (m/s)
+	W      float64   // angular velocity (rad/s)
+	T0     time.Time // time of the origin pose
+}
+
+// NewConstantVelocity returns the constant velocity that moves from pose p0 at t0 to pose p1 at t1.
+func NewConstantVelocity(p0 Pose2D, t0 time.Time, p1 Pose2D, t1 time.Time) (*ConstantVelocity, error) {
+	dt := t1.Sub(t0).Seconds()
+	if dt <= 0 {
+		return nil, errors.New("poses are not in time order")
+	}
+	// the motion in the frame of p0
+	d := p0.Inverse().Compose(p1)
+	w := d.Theta / dt
+	// invert the arc integration in Pose()
+	vx, vy := d.X/dt, d.Y/dt
+	if wt := d.Theta; math.Abs(wt) > 1e-9 {
+		a := math.Sin(wt) / wt
+		b := (1.0 - math.Cos(wt)) / wt
+		det := a*a + b*b
+		vx = (a*d.X + b*d.Y) / (det * dt)
+		vy = (a*d.Y - b*d.X) / (det * dt)
+	}
+	return &ConstantVelocity{VX: vx, VY: vy, W: w, T0: t0}, nil
+}
+
+func (v *ConstantVelocity) String() string {
+	return fmt.Sprintf("vx %.2f m/s vy %.2f m/s w %.1f deg/s", v.VX, v.VY, v.W*180.0/math.Pi)
+}
+
+// Pose returns the pose at time t relative to the pose at T0.
+func (v *ConstantVelocity) Pose(t time.Time) (Pose2D, error) {
+	dt := t.Sub(v.T0).Seconds()
+	wt := v.W * dt
+	if math.Abs(wt) < 1e-9 {
+		return Pose2D{X: v.VX * dt, Y: v.VY * dt, Theta: wt}, nil
+	}
+	// integrate the velocity along the arc
+	s := math.Sin(wt) / v.W
+	c := (1.0 - math.Cos(wt)) / v.W
+	return Pose2D{
+		X:     v.VX*s - v.VY*c,
+		Y:     v.VX*c + v.VY*s,
+		Theta: wrap_pi(wt),
+	}, nil
+}
+
+//-----------------------------------------------------------------------------
+// Pose History
+
+const POSE_HISTORY_SIZE = 256                   // default number of poses to keep
+const POSE_EXTRAPOLATE = 100 * time.Millisecond // maximum extrapolation past the ends
+
+type timed_pose struct {
+	t    time.Time
+	pose Pose2D
+}
+
+// PoseHistory interpolates between timestamped poses.
+type PoseHistory struct {
+	Size        int           // number of poses to keep
+	Extrapolate time.Duration // maximum extrapolation past the ends of the history
+
+	lock  sync.Mutex // lock for access to the poses
+	poses []timed_pose
+}
+
+// NewPoseHistory returns an empty pose history.
+func NewPoseHistory() *PoseHistory {
+	return &PoseHistory{
+		Size:        POSE_HISTORY_SIZE,
+		Extrapolate: POSE_EXTRAPOLATE,
+	}
+}
+
+// Add a pose to the history. Poses older than the newest pose are inserted in time order.
+func (h *PoseHistory) Add(t time.Time, pose Pose2D) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	i := sort.Search(len(h.poses), func(i int) bool { return h.poses[i].t.After(t) })
+	h.poses = append(h.poses, timed_pose{})
+	copy(h.poses[i+1:], h.poses[i:])
+	h.poses[i] = timed_pose{t, pose}
+	if len(h.poses) > h.Size {
+		h.poses = append(h.poses[:0], h.poses[len(h.poses)-h.Size:]...)
+	}
+}
+
+// Pose returns the pose at time t, interpolated from the history.
+func (h *PoseHistory) Pose(t time.Time) (Pose2D, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	n := len(h.poses)
+	if n == 0 {
+		return Pose2D{}, errors.New("no pose history")
+	}
+	if n == 1 {
+		if d := t.Sub(h.poses[0].t); d < -h.Extrapolate || d > h.Extrapolate {
+			return Pose2D{}, errors.New("time is outside the pose history")
+		}
+		return h.poses[0].pose, nil
+	}
+	// find the bracketing poses, using the end poses to extrapolate
+	i := sort.Search(n, func(i int) bool { return h.poses[i].t.After(t) })
+	if i == 0 {
+		if h.poses[0].t.Sub(t) > h.Extrapolate {
+			return Pose2D{}, errors.New("time is before the pose history")
+		}
+		i = 1
+	} else if i == n {
+		if t.Sub(h.poses[n-1].t) > h.Extrapolate {
+			return Pose2D{}, errors.New("time is after the pose history")
+		}
+		i = n - 1
+	}
+	p0, p1 := h.poses[i-1], h.poses[i]
+	dt := p1.t.Sub(p0.t).Seconds()
+	if dt <= 0 {
+		return p1.pose, nil
+	}
+	k := t.Sub(p0.t).Seconds() / dt
+	return p0.pose.Interpolate(p1.pose, k), nil
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,82 @@
+//-----------------------------------------------------------------------------
+/*
+
+Linux Pseudo-Terminals
+
+Used to present a simulated device as a serial port.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+//-----------------------------------------------------------------------------
+
+func ioctl(fd, req, arg uintptr) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// set raw mode on a terminal
+func set_raw(f *os.File) error {
+	var t syscall.Termios
+	err := ioctl(f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	return ioctl(f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+}
+
+// open_pty opens a raw mode pseudo-terminal.
+// It returns the master and slave files and the slave device name.
+func open_pty() (*os.File, *os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	// get the slave number
+	var n uint32
+	err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	if err != nil {
+		master.Close()
+		return nil, nil, "", err
+	}
+	// unlock the slave
+	var unlock int32
+	err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	if err != nil {
+		master.Close()
+		return nil, nil, "", err
+	}
+	// open the slave
+	name := fmt.Sprintf("/dev/pts/%d", n)
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, "", err
+	}
+	err = set_raw(slave)
+	if err != nil {
+		slave.Close()
+		master.Close()
+		return nil, nil, "", err
+	}
+	return master, slave, name, nil
+}
+
+//-----------------------------------------------------------------------------
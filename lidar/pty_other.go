@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+//-----------------------------------------------------------------------------
+/*
+
+Pseudo-Terminals (non-Linux)
+
+The simulated devices use Linux pseudo-terminals.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"errors"
+	"os"
+)
+
+//-----------------------------------------------------------------------------
+
+// open_pty is not supported on this platform.
+func open_pty() (*os.File, *os.File, string, error) {
+	return nil, nil, "", errors.New("pseudo-terminals are only supported on linux")
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,225 @@
+//-----------------------------------------------------------------------------
+/*
+
+Record and Replay Raw LIDAR Serial Streams
+
+A recording is the sequence of timestamped byte chunks read from the serial
+port. Replaying a recording feeds those chunks back into the frame decoder,
+so a problem seen in the field can be reproduced without the hardware.
+
+Recording File Format:
+Each chunk is stored as
+
+<timestamp> int64, unix time in nanoseconds, little-endian
+<length> uint32, little-endian
+<data> length bytes
+
+Replay Speed:
+1.0 replays in real time, 2.0 at twice real time, etc.
+0.0 replays in single step mode, one chunk per call to Step().
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+const RECORD_HDR_SIZE = 12          // chunk header size
+const RECORD_MAX_CHUNK = 128 * 1024 // sanity limit on the chunk size
+
+//-----------------------------------------------------------------------------
+// Recording
+
+type Recorder struct {
+	Name     string // user name for this recorder
+	FileName string // recording filename
+	Chunks   uint   // chunks written
+	Bytes    uint   // data bytes written
+
+	f *os.File
+	w *bufio.Writer
+}
+
+func NewRecorder(name, filename string) (*Recorder, error) {
+	r := Recorder{
+		Name:     name,
+		FileName: filename,
+	}
+	log.Printf("NewRecorder() %s %s", r.Name, r.FileName)
+	f, err := os.Create(r.FileName)
+	if err != nil {
+		log.Printf("%s: unable to create %s", r.Name, r.FileName)
+		return nil, err
+	}
+	r.f = f
+	r.w = bufio.NewWriter(f)
+	return &r, nil
+}
+
+// Write a timestamped chunk to the recording.
+func (r *Recorder) Write(buf []byte, ts time.Time) error {
+	var hdr [RECORD_HDR_SIZE]byte
+	binary.LittleEndian.PutUint64(hdr[0:], uint64(ts.UnixNano()))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(buf)))
+	_, err := r.w.Write(hdr[:])
+	if err != nil {
+		return err
+	}
+	_, err = r.w.Write(buf)
+	if err != nil {
+		return err
+	}
+	r.Chunks += 1
+	r.Bytes += uint(len(buf))
+	return nil
+}
+
+func (r *Recorder) Close() error {
+	log.Printf("%s.Close() %d chunks, %d bytes", r.Name, r.Chunks, r.Bytes)
+	err := r.w.Flush()
+	if err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+//-----------------------------------------------------------------------------
+// Replay
+
+type Player struct {
+	Name     string  // user name for this player
+	FileName string  // recording filename
+	Speed    float64 // replay speed
+	Chunks   uint    // chunks replayed
+
+	f    *os.File
+	r    *bufio.Reader
+	step chan int  // single step requests
+	stop chan bool // stop the replay
+}
+
+func NewPlayer(name, filename string, speed float64) (*Player, error) {
+	if speed < 0 {
+		return nil, errors.New("invalid replay speed")
+	}
+	p := Player{
+		Name:     name,
+		FileName: filename,
+		Speed:    speed,
+	}
+	log.Printf("NewPlayer() %s %s", p.Name, p.FileName)
+	f, err := os.Open(p.FileName)
+	if err != nil {
+		log.Printf("%s: unable to open %s", p.Name, p.FileName)
+		return nil, err
+	}
+	p.f = f
+	p.r = bufio.NewReader(f)
+	p.step = make(chan int, 16)
+	p.stop = make(chan bool)
+	return &p, nil
+}
+
+// read the next chunk from the recording
+func (p *Player) read_chunk() ([]byte, time.Time, error) {
+	var hdr [RECORD_HDR_SIZE]byte
+	_, err := io.ReadFull(p.r, hdr[:])
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	ts := time.Unix(0, int64(binary.LittleEndian.Uint64(hdr[0:])))
+	n := binary.LittleEndian.Uint32(hdr[8:])
+	if n > RECORD_MAX_CHUNK {
+		return nil, time.Time{}, errors.New("bad chunk length")
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(p.r, buf)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return buf, ts, nil
+}
+
+// Step the replay by n chunks (single step mode).
+func (p *Player) Step(n int) {
+	select {
+	case p.step <- n:
+	default:
+		log.Printf("%s: step request dropped", p.Name)
+	}
+}
+
+// Stop the replay.
+func (p *Player) Stop() {
+	close(p.stop)
+}
+
+// Run the replay, passing each chunk to the rx function.
+// The recorded timestamps are shifted to the replay start time, but not scaled by
+// the replay speed, so the time between chunks matches the rotation of the LIDAR.
+// Returns nil at the end of the recording or when the replay is stopped.
+func (p *Player) Run(rx func(buf []byte, ts time.Time)) error {
+	log.Printf("%s.Run() enter", p.Name)
+	defer p.f.Close()
+
+	var rec_t0, t0 time.Time
+	steps := 0
+
+	for {
+		buf, ts, err := p.read_chunk()
+		if err == io.EOF {
+			log.Printf("%s.Run() end of recording (%d chunks)", p.Name, p.Chunks)
+			return nil
+		}
+		if err != nil {
+			log.Printf("%s: error reading %s", p.Name, p.FileName)
+			return err
+		}
+
+		if p.Chunks == 0 {
+			rec_t0 = ts
+			t0 = time.Now()
+		}
+		rx_ts := t0.Add(ts.Sub(rec_t0))
+
+		if p.Speed == 0 {
+			// single step mode - wait for a step request
+			for steps == 0 {
+				select {
+				case <-p.stop:
+					log.Printf("%s.Run() stopped", p.Name)
+					return nil
+				case n := <-p.step:
+					steps += n
+				}
+			}
+			steps -= 1
+		} else {
+			// wait until the chunk is due
+			ofs := time.Duration(float64(ts.Sub(rec_t0)) / p.Speed)
+			select {
+			case <-p.stop:
+				log.Printf("%s.Run() stopped", p.Name)
+				return nil
+			case <-time.After(time.Until(t0.Add(ofs))):
+			}
+		}
+
+		rx(buf, rx_ts)
+		p.Chunks += 1
+	}
+}
+
+//-----------------------------------------------------------------------------
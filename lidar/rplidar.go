@@ -0,0 +1,632 @@
+//-----------------------------------------------------------------------------
+/*
+
+Driver for Slamtec RPLIDAR A1/A2 Units
+
+* Query the device info and health
+* Start/stop standard or express scanning
+* Read the serial stream from the LIDAR and repackage it as range data
+
+Serial Port:
+115200 baud, 8N1
+
+Motor:
+The A1/A2 motor is not controlled by the serial protocol. An optional motor
+driver can be given, in which case it is set to a fixed duty cycle while
+scanning. Otherwise the motor is assumed to be powered externally.
+
+Protocol:
+Requests are sent as <0xa5> <cmd> [<size> <payload> <checksum>]
+The checksum is the XOR of all the preceding request bytes.
+
+Responses start with a 7 byte descriptor:
+<0xa5> <0x5a> <length:30 bits, mode:2 bits, little-endian> <type>
+The descriptor is followed by one (single response) or more (multiple
+response) data packets of the given length.
+
+Standard Scan Packet (5 bytes):
+byte 0 : <quality 5:0> <!S> <S>
+byte 1 : <angle_q6 6:0> <C>
+byte 2 : <angle_q6 14:7>
+byte 3 : <distance_q2 7:0>
+byte 4 : <distance_q2 15:8>
+
+S is set on the first sample of a new scan, C is always 1.
+angle_q6 is degrees * 64, distance_q2 is mm * 4.
+
+Express Scan Packet (84 bytes):
+byte 0 : <sync1 = 0xa> <checksum 3:0>
+byte 1 : <sync2 = 0x5> <checksum 7:4>
+byte 2 : <start_angle_q6 7:0>
+byte 3 : <S> <start_angle_q6 14:8>
+bytes 4..83 : 16 cabins of 5 bytes
+
+Each cabin holds 2 samples:
+byte 0,1 : <distance1 13:0> <dtheta1 5:4> (little-endian, distance in mm)
+byte 2,3 : <distance2 13:0> <dtheta2 5:4>
+byte 4 : <dtheta2 3:0> <dtheta1 3:0>
+
+The checksum is the XOR of bytes 2..83. The sample angles are interpolated
+between the start angles of consecutive packets, so decoding a packet needs
+the start angle of the following packet. dtheta is an angle correction in
+units of 1/8 degree.
+
+See: Slamtec RPLIDAR Interface Protocol and Application Notes
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/deadsy/slamx/motor"
+	"github.com/deadsy/slamx/util"
+	"github.com/tarm/serial"
+)
+
+//-----------------------------------------------------------------------------
+
+const RPLIDAR_SYNC1 = 0xa5
+const RPLIDAR_SYNC2 = 0x5a
+
+// commands
+const RPLIDAR_CMD_STOP = 0x25
+const RPLIDAR_CMD_RESET = 0x40
+const RPLIDAR_CMD_SCAN = 0x20
+const RPLIDAR_CMD_EXPRESS_SCAN = 0x82
+const RPLIDAR_CMD_GET_INFO = 0x50
+const RPLIDAR_CMD_GET_HEALTH = 0x52
+
+// response types
+const RPLIDAR_RESP_INFO = 0x04
+const RPLIDAR_RESP_HEALTH = 0x06
+const RPLIDAR_RESP_SCAN = 0x81
+const RPLIDAR_RESP_EXPRESS_SCAN = 0x82
+
+// response lengths
+const RPLIDAR_DESC_SIZE = 7
+const RPLIDAR_INFO_SIZE = 20
+const RPLIDAR_HEALTH_SIZE = 3
+const RPLIDAR_SCAN_SIZE = 5
+const RPLIDAR_EXPRESS_SIZE = 84
+
+const RPLIDAR_MOTOR_DUTY = 0.6                      // motor duty cycle while scanning
+const RPLIDAR_TIMEOUT = 1000 * time.Millisecond     // request response timeout
+const RPLIDAR_RESET_DELAY = 2000 * time.Millisecond // wait time after a reset
+const RPLIDAR_SCAN_SAMPLES = 400                    // initial samples per scan allocation
+
+//-----------------------------------------------------------------------------
+
+type RPLIDAR struct {
+	Name        string       // user name for this device
+	PortName    string       // serial port name
+	Motor       *motor.Motor // motor driver (nil if none)
+	Express     bool         // use express scan mode
+	Ctrl        chan Ctrl    // control channel
+	*ScanBus                 // scan delivery
+	Model       uint8        // device model
+	Firmware    uint16       // firmware version (major.minor)
+	Hardware    uint8        // hardware version
+	SerialNo    string       // device serial number
+	Health      uint8        // health status (0 = good, 1 = warning, 2 = error)
+	ErrorCode   uint16       // health error code
+	Running     bool         // is the device scanning? (written under rx_lock)
+	GoodPackets uint         // good packets rx-ed
+	BadPackets  uint         // bad packets rx-ed (sync or checksum errors)
+
+	port      *serial.Port
+	rx_lock   sync.Mutex // lock for access to the receive state
+	rx_buf    []byte     // received bytes
+	desc_type uint8      // response type of the current descriptor (0 = no descriptor)
+	desc_len  int        // response length of the current descriptor
+	prev      []byte     // previous express scan packet
+	prev_ts   time.Time  // timestamp of the previous express scan packet
+	scan      *Scan2D    // current scan data
+	done      []*Scan2D  // completed scans
+	seq       uint       // scan sequence number
+	scan_ts   time.Time  // timestamp of the previous scan
+	rpm       float32    // rpm measured from the scan rate
+}
+
+//-----------------------------------------------------------------------------
+// Requests and Responses
+
+// send a request to the device
+func (l *RPLIDAR) request(cmd uint8, payload []byte) error {
+	req := []byte{RPLIDAR_SYNC1, cmd}
+	if len(payload) != 0 {
+		req = append(req, uint8(len(payload)))
+		req = append(req, payload...)
+		var cs uint8
+		for _, c := range req {
+			cs ^= c
+		}
+		req = append(req, cs)
+	}
+	_, err := l.port.Write(req)
+	return err
+}
+
+// read n bytes from a serial port, with a timeout
+// The YDLIDAR uses the same command and response descriptor protocol.
+func read_port(port io.Reader, n int, timeout time.Duration) ([]byte, error) {
+	buf := make([]byte, n)
+	deadline := time.Now().Add(timeout)
+	i := 0
+	for i < n {
+		if time.Now().After(deadline) {
+			return nil, errors.New("response timeout")
+		}
+		k, err := port.Read(buf[i:])
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		i += k
+	}
+	return buf, nil
+}
+
+// decode a response descriptor, return the response type and length
+func rplidar_descriptor(buf []byte) (uint8, int, error) {
+	if buf[0] != RPLIDAR_SYNC1 || buf[1] != RPLIDAR_SYNC2 {
+		return 0, 0, errors.New("bad response descriptor")
+	}
+	n := int(buf[2]) + (int(buf[3]) << 8) + (int(buf[4]) << 16) + (int(buf[5]&0x3f) << 24)
+	return buf[6], n, nil
+}
+
+// send a request and read a single response
+func (l *RPLIDAR) command(cmd uint8, resp_type uint8, resp_len int) ([]byte, error) {
+	err := l.request(cmd, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := read_port(l.port, RPLIDAR_DESC_SIZE, RPLIDAR_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	t, n, err := rplidar_descriptor(buf)
+	if err != nil {
+		return nil, err
+	}
+	if t != resp_type || n != resp_len {
+		return nil, fmt.Errorf("unexpected response type 0x%02x length %d", t, n)
+	}
+	return read_port(l.port, n, RPLIDAR_TIMEOUT)
+}
+
+// get the device information
+func (l *RPLIDAR) get_info() error {
+	buf, err := l.command(RPLIDAR_CMD_GET_INFO, RPLIDAR_RESP_INFO, RPLIDAR_INFO_SIZE)
+	if err != nil {
+		return err
+	}
+	l.Model = buf[0]
+	l.Firmware = (uint16(buf[2]) << 8) + uint16(buf[1])
+	l.Hardware = buf[3]
+	l.SerialNo = ""
+	for _, c := range buf[4:20] {
+		l.SerialNo += fmt.Sprintf("%02X", c)
+	}
+	return nil
+}
+
+// get the device health
+func (l *RPLIDAR) get_health() error {
+	buf, err := l.command(RPLIDAR_CMD_GET_HEALTH, RPLIDAR_RESP_HEALTH, RPLIDAR_HEALTH_SIZE)
+	if err != nil {
+		return err
+	}
+	l.Health = buf[0]
+	l.ErrorCode = uint16(buf[1]) + (uint16(buf[2]) << 8)
+	return nil
+}
+
+// Reset the device.
+func (l *RPLIDAR) reset() error {
+	log.Printf("%s.reset()", l.Name)
+	err := l.request(RPLIDAR_CMD_RESET, nil)
+	if err != nil {
+		return err
+	}
+	// the device prints a boot banner after a reset - discard it
+	time.Sleep(RPLIDAR_RESET_DELAY)
+	return l.port.Flush()
+}
+
+//-----------------------------------------------------------------------------
+// Scan Decoding
+
+// allocate a new scan
+func (l *RPLIDAR) new_scan(n int) {
+	l.scan = l.NewScan(n)
+	l.scan.Device = l.Name
+	l.scan.Seq = l.seq
+	l.seq += 1
+}
+
+// add a sample to the current scan, report the scan at the start of a new scan
+func (l *RPLIDAR) add_sample(start bool, angle_q6, dist_q2 int, quality uint8, ts time.Time) {
+	if start && len(l.scan.Samples) != 0 {
+		if !l.scan_ts.IsZero() {
+			l.rpm = float32(60.0 / ts.Sub(l.scan_ts).Seconds())
+		}
+		l.scan_ts = ts
+		l.scan.RPM = l.rpm
+		l.scan.interpolate()
+		log.Printf("%s: scan complete (%.1f rpm)", l.Name, l.rpm)
+		l.done = append(l.done, l.scan)
+		l.new_scan(len(l.scan.Samples))
+	}
+	l.scan.Samples = append(l.scan.Samples, Sample2D{
+		Good:            dist_q2 != 0,
+		Angle:           util.DtoR(float32(angle_q6) / 64.0),
+		Distance:        float32(dist_q2) / 4000.0,
+		Signal_Strength: float32(quality),
+		TS:              ts,
+	})
+}
+
+// process a standard scan packet, return false if the packet is invalid
+func (l *RPLIDAR) scan_packet(buf []byte, ts time.Time) bool {
+	s := buf[0] & 1
+	ns := (buf[0] >> 1) & 1
+	c := buf[1] & 1
+	if s == ns || c != 1 {
+		return false
+	}
+	angle_q6 := (int(buf[1]) >> 1) + (int(buf[2]) << 7)
+	dist_q2 := int(buf[3]) + (int(buf[4]) << 8)
+	l.add_sample(s == 1, angle_q6, dist_q2, buf[0]>>2, ts)
+	l.scan.Packets += 1
+	return true
+}
+
+// process an express scan packet, return false if the packet is invalid
+func (l *RPLIDAR) express_packet(buf []byte, ts time.Time) bool {
+	if buf[0]>>4 != 0xa || buf[1]>>4 != 0x5 {
+		return false
+	}
+	var cs uint8
+	for _, c := range buf[2:] {
+		cs ^= c
+	}
+	if cs != (buf[0]&0xf)|(buf[1]<<4) {
+		return false
+	}
+	if buf[3]>>7 != 0 {
+		// first packet after starting an express scan
+		l.prev = nil
+	}
+	if l.prev != nil {
+		// the samples were measured before the previous packet was sent
+		l.express_decode(l.prev, buf, l.prev_ts)
+		l.scan.Packets += 1
+	}
+	l.prev = append(l.prev[:0], buf...)
+	l.prev_ts = ts
+	return true
+}
+
+// decode an express scan packet, using the start angle of the next packet
+func (l *RPLIDAR) express_decode(buf, next []byte, ts time.Time) {
+	const full_q6 = 360 << 6
+	const full_q16 = 360 << 16
+	start_q8 := ((int(buf[2]) + (int(buf[3]&0x7f) << 8)) << 2)
+	next_q8 := ((int(next[2]) + (int(next[3]&0x7f) << 8)) << 2)
+	diff_q8 := next_q8 - start_q8
+	if diff_q8 < 0 {
+		diff_q8 += 360 << 8
+	}
+	inc_q16 := diff_q8 << 3
+	angle_q16 := start_q8 << 8
+	for i := 0; i < 16; i++ {
+		cabin := buf[4+(i*5) : 9+(i*5)]
+		d1 := int(cabin[0]) + (int(cabin[1]) << 8)
+		d2 := int(cabin[2]) + (int(cabin[3]) << 8)
+		dtheta := [2]int{
+			(int(cabin[4]) & 0xf) | ((d1 & 3) << 4),
+			(int(cabin[4]) >> 4) | ((d2 & 3) << 4),
+		}
+		dist := [2]int{d1 & 0xfffc, d2 & 0xfffc}
+		for k := 0; k < 2; k++ {
+			angle_q6 := (angle_q16 - (dtheta[k] << 13)) >> 10
+			start := (angle_q16%full_q16 < inc_q16)
+			angle_q16 += inc_q16
+			if angle_q6 < 0 {
+				angle_q6 += full_q6
+			}
+			if angle_q6 >= full_q6 {
+				angle_q6 -= full_q6
+			}
+			l.add_sample(start, angle_q6, dist[k], 0, ts)
+		}
+	}
+}
+
+// receive bytes from the serial port, return any completed scans
+func (l *RPLIDAR) rx(buf []byte, ts time.Time) []*Scan2D {
+	l.rx_lock.Lock()
+	defer l.rx_lock.Unlock()
+	l.rx_buf = append(l.rx_buf, buf...)
+	l.done = nil
+	for {
+		if l.desc_type == 0 {
+			// looking for a response descriptor
+			if len(l.rx_buf) < RPLIDAR_DESC_SIZE {
+				return l.done
+			}
+			t, n, err := rplidar_descriptor(l.rx_buf)
+			if err != nil {
+				l.rx_buf = l.rx_buf[1:]
+				continue
+			}
+			l.desc_type = t
+			l.desc_len = n
+			l.rx_buf = l.rx_buf[RPLIDAR_DESC_SIZE:]
+			continue
+		}
+		// reading response packets
+		if len(l.rx_buf) < l.desc_len {
+			return l.done
+		}
+		pkt := l.rx_buf[:l.desc_len]
+		// back date the packet by the bytes received after it
+		pkt_ts := ts.Add(-time.Duration(len(l.rx_buf)-l.desc_len) * byte_time(115200))
+		var ok bool
+		switch {
+		case l.desc_type == RPLIDAR_RESP_SCAN && l.desc_len == RPLIDAR_SCAN_SIZE:
+			ok = l.scan_packet(pkt, pkt_ts)
+		case l.desc_type == RPLIDAR_RESP_EXPRESS_SCAN && l.desc_len == RPLIDAR_EXPRESS_SIZE:
+			ok = l.express_packet(pkt, pkt_ts)
+		default:
+			log.Printf("%s: unexpected response type 0x%02x length %d", l.Name, l.desc_type, l.desc_len)
+			l.desc_type = 0
+			continue
+		}
+		if ok {
+			l.GoodPackets += 1
+			l.rx_buf = l.rx_buf[l.desc_len:]
+		} else {
+			// resync on the next byte
+			l.BadPackets += 1
+			l.rx_buf = l.rx_buf[1:]
+		}
+	}
+}
+
+// Read the serial port and process the packets
+func (l *RPLIDAR) read_serial(quit <-chan bool, wg *sync.WaitGroup) {
+	log.Printf("%s.read_serial() enter", l.Name)
+	defer wg.Done()
+	buf := make([]byte, 1024)
+	for {
+		select {
+		case <-quit:
+			log.Printf("%s.read_serial() exit", l.Name)
+			return
+		default:
+			n, err := l.port.Read(buf)
+			if n > 0 && err == nil {
+				for _, scan := range l.rx(buf[:n], time.Now()) {
+					l.Publish(scan)
+				}
+			}
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// NewRPLIDAR creates a new RPLIDAR device.
+// The motor driver is optional (nil if the motor is powered externally).
+func NewRPLIDAR(name, port_name string, motor *motor.Motor) (*RPLIDAR, error) {
+	l := RPLIDAR{
+		Name:     name,
+		PortName: port_name,
+		Motor:    motor,
+	}
+	log.Printf("NewRPLIDAR() %s", l.Name)
+	l.Ctrl = make(chan Ctrl)
+	l.ScanBus = NewScanBus(l.Name)
+	l.new_scan(RPLIDAR_SCAN_SAMPLES)
+	return &l, nil
+}
+
+// Open the serial port and query the device.
+func (l *RPLIDAR) Open() error {
+	log.Printf("%s.Open()", l.Name)
+	cfg := &serial.Config{Name: l.PortName, Baud: 115200, ReadTimeout: 100 * time.Millisecond}
+	port, err := serial.OpenPort(cfg)
+	if err != nil {
+		log.Printf("%s: unable to open serial port %s", l.Name, l.PortName)
+		return err
+	}
+	l.port = port
+
+	// stop any scanning in progress
+	err = l.request(RPLIDAR_CMD_STOP, nil)
+	if err != nil {
+		log.Printf("%s: unable to stop scanning", l.Name)
+		return err
+	}
+	time.Sleep(10 * time.Millisecond)
+	l.port.Flush()
+
+	// check the health, reset on error
+	err = l.get_health()
+	if err != nil {
+		log.Printf("%s: unable to get health", l.Name)
+		return err
+	}
+	if l.Health == 2 {
+		log.Printf("%s: health error 0x%04x, resetting", l.Name, l.ErrorCode)
+		err = l.reset()
+		if err != nil {
+			return err
+		}
+		err = l.get_health()
+		if err != nil {
+			return err
+		}
+		if l.Health == 2 {
+			return fmt.Errorf("device health error 0x%04x", l.ErrorCode)
+		}
+	}
+
+	// get the device information
+	err = l.get_info()
+	if err != nil {
+		log.Printf("%s: unable to get device info", l.Name)
+		return err
+	}
+	log.Printf("%s: model %d firmware %d.%02d hardware %d serial %s", l.Name, l.Model, l.Firmware>>8, l.Firmware&0xff, l.Hardware, l.SerialNo)
+	return nil
+}
+
+func (l *RPLIDAR) Close() error {
+	log.Printf("%s.Close()", l.Name)
+	if l.port == nil {
+		return nil
+	}
+	l.stop()
+	err := l.port.Close()
+	if err != nil {
+		log.Printf("%s: error closing serial port", l.Name)
+		return err
+	}
+	return nil
+}
+
+// Start scanning.
+func (l *RPLIDAR) Start() {
+	l.Ctrl <- Start
+}
+
+// Stop scanning.
+func (l *RPLIDAR) Stop() {
+	l.Ctrl <- Stop
+}
+
+// Status returns the LIDAR status as (name, value) rows.
+func (l *RPLIDAR) Status() [][]string {
+	mode := "standard"
+	if l.Express {
+		mode = "express"
+	}
+	health := []string{"good", "warning", "error"}[l.Health%3]
+	motor := "external"
+	if l.Motor != nil {
+		motor = l.Motor.Name
+	}
+	l.rx_lock.Lock()
+	good, bad, rpm, running := l.GoodPackets, l.BadPackets, l.rpm, l.Running
+	l.rx_lock.Unlock()
+	rows := make([][]string, 0, 10)
+	rows = append(rows, []string{"name", l.Name})
+	rows = append(rows, []string{"type", "rplidar"})
+	rows = append(rows, []string{"serial port", l.PortName})
+	rows = append(rows, []string{"motor", motor})
+	rows = append(rows, []string{"model", fmt.Sprintf("%d", l.Model)})
+	rows = append(rows, []string{"firmware", fmt.Sprintf("%d.%02d", l.Firmware>>8, l.Firmware&0xff)})
+	rows = append(rows, []string{"hardware", fmt.Sprintf("%d", l.Hardware)})
+	rows = append(rows, []string{"serial number", l.SerialNo})
+	rows = append(rows, []string{"health", fmt.Sprintf("%s (0x%04x)", health, l.ErrorCode)})
+	rows = append(rows, []string{"mode", mode})
+	rows = append(rows, []string{"running", fmt.Sprintf("%t", running)})
+	rows = append(rows, []string{"rpm", fmt.Sprintf("%f", rpm)})
+	rows = append(rows, []string{"good packets", fmt.Sprintf("%d", good)})
+	rows = append(rows, []string{"bad packets", fmt.Sprintf("%d", bad)})
+	rows = append(rows, l.BusStatus()...)
+	return rows
+}
+
+func (l *RPLIDAR) start() {
+	if l.Running {
+		log.Printf("%s.Start() already running", l.Name)
+		return
+	}
+	log.Printf("%s.Start()", l.Name)
+	if l.Motor != nil {
+		l.Motor.Set(RPLIDAR_MOTOR_DUTY)
+	}
+	// reset the receive state
+	l.rx_lock.Lock()
+	l.rx_buf = l.rx_buf[:0]
+	l.desc_type = 0
+	l.prev = nil
+	l.new_scan(RPLIDAR_SCAN_SAMPLES)
+	l.rx_lock.Unlock()
+	var err error
+	if l.Express {
+		err = l.request(RPLIDAR_CMD_EXPRESS_SCAN, []byte{0, 0, 0, 0, 0})
+	} else {
+		err = l.request(RPLIDAR_CMD_SCAN, nil)
+	}
+	if err != nil {
+		log.Printf("%s: unable to start scanning", l.Name)
+		return
+	}
+	l.rx_lock.Lock()
+	l.Running = true
+	l.rx_lock.Unlock()
+}
+
+func (l *RPLIDAR) stop() {
+	if !l.Running {
+		log.Printf("%s.Stop() already stopped", l.Name)
+		return
+	}
+	log.Printf("%s.Stop()", l.Name)
+	err := l.request(RPLIDAR_CMD_STOP, nil)
+	if err != nil {
+		log.Printf("%s: unable to stop scanning", l.Name)
+	}
+	if l.Motor != nil {
+		l.Motor.Set(0)
+	}
+	l.rx_lock.Lock()
+	l.Running = false
+	l.rx_lock.Unlock()
+}
+
+//-----------------------------------------------------------------------------
+
+func (l *RPLIDAR) Process(quit <-chan bool, wg *sync.WaitGroup) {
+	log.Printf("%s.Process() enter", l.Name)
+	defer wg.Done()
+
+	lidar_wg := &sync.WaitGroup{}
+
+	// start serial port reading
+	lidar_wg.Add(1)
+	go l.read_serial(quit, lidar_wg)
+
+	for {
+		select {
+		case ctrl := <-l.Ctrl:
+			switch ctrl {
+			case Start:
+				l.start()
+			case Stop:
+				l.stop()
+			default:
+				log.Printf("%s.Process() unknown ctrl %d", l.Name, ctrl)
+			}
+		case <-quit:
+			lidar_wg.Wait()
+			l.Close()
+			log.Printf("%s.Process() exit", l.Name)
+			return
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,184 @@
+//-----------------------------------------------------------------------------
+/*
+
+RPLIDAR Decoder Tests
+
+The packets are built from the layouts in the protocol notes (rplidar.go) and
+fed through the receive path, as they would arrive from the serial port.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// multiple response descriptor
+func rplidar_desc(n int, t uint8) []byte {
+	return []byte{RPLIDAR_SYNC1, RPLIDAR_SYNC2, uint8(n), uint8(n >> 8), uint8(n >> 16), uint8(n>>24) | 0x40, t}
+}
+
+// express scan packet: 32 samples of dist (mm) and dtheta (1/8 degree)
+func express_pkt(start_q6 int, s bool, dist, dtheta [32]int) []byte {
+	buf := make([]byte, RPLIDAR_EXPRESS_SIZE)
+	buf[2] = uint8(start_q6)
+	buf[3] = uint8(start_q6>>8) & 0x7f
+	if s {
+		buf[3] |= 0x80
+	}
+	for i := 0; i < 16; i++ {
+		cabin := buf[4+(i*5) : 9+(i*5)]
+		d1 := (dist[2*i] << 2) | ((dtheta[2*i] >> 4) & 3)
+		d2 := (dist[2*i+1] << 2) | ((dtheta[2*i+1] >> 4) & 3)
+		cabin[0], cabin[1] = uint8(d1), uint8(d1>>8)
+		cabin[2], cabin[3] = uint8(d2), uint8(d2>>8)
+		cabin[4] = uint8(dtheta[2*i]&0xf) | uint8(dtheta[2*i+1]&0xf)<<4
+	}
+	var cs uint8
+	for _, c := range buf[2:] {
+		cs ^= c
+	}
+	buf[0] = 0xa0 | (cs & 0xf)
+	buf[1] = 0x50 | (cs >> 4)
+	return buf
+}
+
+// standard scan packet
+func scan_pkt(s bool, angle_q6, dist_q2 int, quality uint8) []byte {
+	b0 := quality << 2
+	if s {
+		b0 |= 1
+	} else {
+		b0 |= 2
+	}
+	return []byte{b0, uint8(angle_q6<<1) | 1, uint8(angle_q6 >> 7), uint8(dist_q2), uint8(dist_q2 >> 8)}
+}
+
+func new_test_rplidar(t *testing.T) *RPLIDAR {
+	l, err := NewRPLIDAR("test", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func near(a, b, tol float64) bool {
+	return math.Abs(a-b) <= tol
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_RPLIDAR_Standard(t *testing.T) {
+	l := new_test_rplidar(t)
+	buf := rplidar_desc(RPLIDAR_SCAN_SIZE, RPLIDAR_RESP_SCAN)
+	// two revolutions of 4 samples
+	for rev := 0; rev < 2; rev++ {
+		for i := 0; i < 4; i++ {
+			buf = append(buf, scan_pkt(i == 0, i*90*64, (1000+i)*4, 47)...)
+		}
+	}
+	// a bad packet (S == !S) and the start of the third revolution
+	buf = append(buf, 0x03, 0x01, 0x00, 0x00, 0x00)
+	buf = append(buf, scan_pkt(true, 0, 4000, 47)...)
+	scans := l.rx(buf, time.Now())
+	if len(scans) != 2 {
+		t.Fatalf("%d scans, expected 2", len(scans))
+	}
+	for _, scan := range scans {
+		if len(scan.Samples) != 4 {
+			t.Fatalf("%d samples, expected 4", len(scan.Samples))
+		}
+		for i, s := range scan.Samples {
+			if !near(float64(s.Angle), float64(i)*math.Pi/2, 1e-4) || !near(float64(s.Distance), float64(1000+i)/1000.0, 1e-6) {
+				t.Errorf("sample %d: angle %f distance %f", i, s.Angle, s.Distance)
+			}
+			if s.Signal_Strength != 47 {
+				t.Errorf("sample %d: quality %f", i, s.Signal_Strength)
+			}
+		}
+	}
+	if l.GoodPackets != 9 || l.BadPackets == 0 {
+		t.Errorf("good %d bad %d packets", l.GoodPackets, l.BadPackets)
+	}
+}
+
+func Test_RPLIDAR_Express(t *testing.T) {
+	l := new_test_rplidar(t)
+	var dist, dtheta, zero [32]int
+	for i := range dist {
+		dist[i] = 500 + i
+		// a 1 degree correction on the odd samples
+		dtheta[i] = 8 * (i & 1)
+	}
+	buf := rplidar_desc(RPLIDAR_EXPRESS_SIZE, RPLIDAR_RESP_EXPRESS_SCAN)
+	// start angles 10 and 21.25 degrees, the third packet completes the second
+	buf = append(buf, express_pkt(10*64, true, dist, dtheta)...)
+	buf = append(buf, express_pkt(21*64+16, false, zero, zero)...)
+	buf = append(buf, express_pkt(32*64+32, false, zero, zero)...)
+	l.rx(buf, time.Now())
+	samples := l.scan.Samples
+	if len(samples) != 64 {
+		t.Fatalf("%d samples, expected 64", len(samples))
+	}
+	inc := 11.25 / 32.0
+	for i, s := range samples[:32] {
+		angle := 10.0 + float64(i)*inc - float64(dtheta[i])/8.0
+		if !near(float64(s.Angle)*180.0/math.Pi, angle, 0.02) {
+			t.Errorf("sample %d: angle %f, expected %f", i, float64(s.Angle)*180.0/math.Pi, angle)
+		}
+		if !near(float64(s.Distance), float64(dist[i])/1000.0, 1e-6) {
+			t.Errorf("sample %d: distance %f, expected %f", i, s.Distance, float64(dist[i])/1000.0)
+		}
+	}
+	if l.GoodPackets != 3 || l.scan.Packets != 2 {
+		t.Errorf("good %d packets, %d decoded", l.GoodPackets, l.scan.Packets)
+	}
+}
+
+func Test_RPLIDAR_Express_Wrap(t *testing.T) {
+	l := new_test_rplidar(t)
+	var dist, zero [32]int
+	for i := range dist {
+		dist[i] = 1000
+	}
+	buf := rplidar_desc(RPLIDAR_EXPRESS_SIZE, RPLIDAR_RESP_EXPRESS_SCAN)
+	// 355 to 5 degrees crosses the start of a new scan
+	buf = append(buf, express_pkt(355*64, true, dist, zero)...)
+	buf = append(buf, express_pkt(5*64, false, dist, zero)...)
+	scans := l.rx(buf, time.Now())
+	if len(scans) != 1 {
+		t.Fatalf("%d scans, expected 1", len(scans))
+	}
+	// the samples up to 360 degrees end the first scan
+	n := len(scans[0].Samples)
+	if n != 16 {
+		t.Errorf("%d samples before the wrap, expected 16", n)
+	}
+	if len(l.scan.Samples) != 32-n {
+		t.Errorf("%d samples after the wrap, expected %d", len(l.scan.Samples), 32-n)
+	}
+	a := float64(l.scan.Samples[0].Angle) * 180.0 / math.Pi
+	if a > 0.4 {
+		t.Errorf("first angle after the wrap %f", a)
+	}
+}
+
+func Test_RPLIDAR_Express_Checksum(t *testing.T) {
+	l := new_test_rplidar(t)
+	var dist [32]int
+	pkt := express_pkt(0, true, dist, dist)
+	pkt[10] ^= 0x01
+	buf := append(rplidar_desc(RPLIDAR_EXPRESS_SIZE, RPLIDAR_RESP_EXPRESS_SCAN), pkt...)
+	l.rx(buf, time.Now())
+	if l.GoodPackets != 0 || l.BadPackets == 0 {
+		t.Errorf("good %d bad %d packets", l.GoodPackets, l.BadPackets)
+	}
+}
+
+//-----------------------------------------------------------------------------
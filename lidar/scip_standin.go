@@ -0,0 +1,380 @@
+//-----------------------------------------------------------------------------
+/*
+
+Hokuyo SCIP 2.0 Stand-In Device
+
+* Answers VV/PP/II/BM/QT/RS/SCIP2.0 with canned responses
+* Generates MD/MS continuous scans and GD/GS single scans
+* Range data comes from ray casting into a simulated room (if any)
+
+This allows the Hokuyo driver to be exercised with no hardware, either over
+a TCP socket (ListenAndServe) or over one end of a pipe (Serve).
+
+E.g.
+  a, b := net.Pipe()
+  go NewSCIPStandIn("standin", nil).Serve(a)
+  l, _ := NewHokuyoPort("hokuyo", b)
+
+The default parameters are those of a URG-04LX.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+type SCIPStandIn struct {
+	Name    string
+	Room    *Room    // the simulated room (nil for a constant range)
+	Version []string // VV response "KEY:VALUE" lines
+	Model   string   // PP MODL
+	DMin    int      // minimum distance (mm)
+	DMax    int      // maximum distance (mm)
+	ARes    int      // steps per revolution
+	AMin    int      // first valid step
+	AMax    int      // last valid step
+	AFrt    int      // front step
+	RPM     int      // scan rate
+}
+
+// scip_conn is the state of a single stand-in connection.
+type scip_conn struct {
+	s     *SCIPStandIn
+	w     io.Writer
+	out   chan []byte   // output buffer, so a blocked writer doesn't stall the reader
+	done  chan struct{} // closed when the connection is done
+	lock  sync.Mutex    // lock for the laser/scan state
+	laser bool          // is the laser on?
+	seq   int           // scan sequence number (for cancelling MD/MS)
+	ts    time.Time     // connection start time
+}
+
+// NewSCIPStandIn returns a stand-in with URG-04LX parameters.
+func NewSCIPStandIn(name string, room *Room) *SCIPStandIn {
+	log.Printf("NewSCIPStandIn() %s", name)
+	return &SCIPStandIn{
+		Name: name,
+		Room: room,
+		Version: []string{
+			"VEND:Hokuyo Automatic Co.,Ltd.",
+			"PROD:SOKUIKI Sensor URG-04LX",
+			"FIRM:3.3.00,08/04/16(20-4095[mm],240[deg],44-725[step],600[rpm])",
+			"PROT:SCIP 2.0",
+			"SERI:H0000000",
+		},
+		Model: "URG-04LX",
+		DMin:  20,
+		DMax:  5600,
+		ARes:  1024,
+		AMin:  44,
+		AMax:  725,
+		AFrt:  384,
+		RPM:   600,
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// write a response block
+func (c *scip_conn) write(echo, status string, lines []string) {
+	var sb strings.Builder
+	sb.WriteString(echo + "\n")
+	sb.WriteString(status + string(scip_sum(status)) + "\n")
+	for _, l := range lines {
+		sb.WriteString(l + "\n")
+	}
+	sb.WriteString("\n")
+	select {
+	case c.out <- []byte(sb.String()):
+	case <-c.done:
+	}
+}
+
+// write the output buffer to the connection
+func (c *scip_conn) writer() {
+	for {
+		select {
+		case buf := <-c.out:
+			c.w.Write(buf)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// return "KEY:VALUE;<sum>" info lines
+func info_lines(kv []string) []string {
+	lines := make([]string, len(kv))
+	for i, s := range kv {
+		lines[i] = s + ";" + string(scip_sum(s))
+	}
+	return lines
+}
+
+// return the range (mm) for a step
+func (s *SCIPStandIn) distance(step int) int {
+	if s.Room == nil {
+		return 1000
+	}
+	theta := 2.0 * math.Pi * float64(step-s.AFrt) / float64(s.ARes)
+	d, ok := s.Room.Range(theta)
+	if !ok {
+		return 0
+	}
+	mm := int(d * 1000.0)
+	if mm > s.DMax {
+		return 0
+	}
+	return mm
+}
+
+// return the timestamp and data lines for a scan
+func (c *scip_conn) scan_lines(start, end, cluster, enc int) []string {
+	s := c.s
+	ms := int(time.Since(c.ts) / time.Millisecond)
+	t := scip_encode(ms&0xffffff, 4)
+	lines := []string{t + string(scip_sum(t))}
+	var sb strings.Builder
+	for step := start; step <= end; step += cluster {
+		// report the minimum range of the cluster
+		dist := 0
+		for i := step; i < step+cluster && i <= end; i++ {
+			d := s.distance(i)
+			if d >= s.DMin && (dist == 0 || d < dist) {
+				dist = d
+			}
+		}
+		sb.WriteString(scip_encode(dist, enc))
+	}
+	data := sb.String()
+	for len(data) > 0 {
+		n := HOKUYO_DATA_LINE
+		if len(data) < n {
+			n = len(data)
+		}
+		lines = append(lines, data[:n]+string(scip_sum(data[:n])))
+		data = data[n:]
+	}
+	return lines
+}
+
+// parse the scan command parameters
+func (c *scip_conn) scan_params(cmd string, n int) (start, end, cluster int, ok bool) {
+	if len(cmd) != n {
+		return 0, 0, 0, false
+	}
+	var err [3]error
+	start, err[0] = strconv.Atoi(cmd[2:6])
+	end, err[1] = strconv.Atoi(cmd[6:10])
+	cluster, err[2] = strconv.Atoi(cmd[10:12])
+	if err[0] != nil || err[1] != nil || err[2] != nil {
+		return 0, 0, 0, false
+	}
+	if start < c.s.AMin || end > c.s.AMax || start > end {
+		return 0, 0, 0, false
+	}
+	if cluster == 0 {
+		cluster = 1
+	}
+	return start, end, cluster, true
+}
+
+// generate continuous scans
+func (c *scip_conn) stream(cmd string, start, end, cluster, interval, count int, seq int) {
+	enc := 3
+	if cmd[1] == 'S' {
+		enc = 2
+	}
+	period := time.Minute / time.Duration(c.s.RPM)
+	for i := 0; count == 0 || i < count; i++ {
+		select {
+		case <-time.After(period * time.Duration(interval+1)):
+		case <-c.done:
+			return
+		}
+		c.lock.Lock()
+		cancelled := c.seq != seq || !c.laser
+		c.lock.Unlock()
+		if cancelled {
+			return
+		}
+		// the echo has the remaining number of scans
+		echo := cmd[:13]
+		if count != 0 {
+			echo += fmt.Sprintf("%02d", count-i-1)
+		} else {
+			echo += "00"
+		}
+		c.write(echo, "99", c.scan_lines(start, end, cluster, enc))
+	}
+}
+
+// handle a command
+func (c *scip_conn) command(cmd string) {
+	s := c.s
+	switch {
+	case cmd == "VV":
+		c.write(cmd, "00", info_lines(s.Version))
+	case cmd == "PP":
+		c.write(cmd, "00", info_lines([]string{
+			"MODL:" + s.Model,
+			fmt.Sprintf("DMIN:%d", s.DMin),
+			fmt.Sprintf("DMAX:%d", s.DMax),
+			fmt.Sprintf("ARES:%d", s.ARes),
+			fmt.Sprintf("AMIN:%d", s.AMin),
+			fmt.Sprintf("AMAX:%d", s.AMax),
+			fmt.Sprintf("AFRT:%d", s.AFrt),
+			fmt.Sprintf("SCAN:%d", s.RPM),
+		}))
+	case cmd == "II":
+		c.lock.Lock()
+		lasr := "OFF"
+		if c.laser {
+			lasr = "ON"
+		}
+		c.lock.Unlock()
+		ms := int(time.Since(c.ts) / time.Millisecond)
+		c.write(cmd, "00", info_lines([]string{
+			"MODL:" + s.Model,
+			"LASR:" + lasr,
+			fmt.Sprintf("SCSP:Initial(%d[rpm])", s.RPM),
+			"MESM:Measuring by Normal Mode",
+			"SBPS:USB only(12[Mbps])",
+			"TIME:" + scip_encode(ms&0xffffff, 4),
+			"STAT:Sensor works well.",
+		}))
+	case cmd == "SCIP2.0":
+		c.write(cmd, "0E", nil)
+	case cmd == "BM":
+		c.lock.Lock()
+		status := "00"
+		if c.laser {
+			status = "02"
+		}
+		c.laser = true
+		c.lock.Unlock()
+		c.write(cmd, status, nil)
+	case cmd == "QT" || cmd == "RS":
+		c.lock.Lock()
+		c.laser = false
+		c.seq += 1
+		c.lock.Unlock()
+		c.write(cmd, "00", nil)
+	case strings.HasPrefix(cmd, "GD") || strings.HasPrefix(cmd, "GS"):
+		start, end, cluster, ok := c.scan_params(cmd, 12)
+		if !ok {
+			c.write(cmd, "10", nil)
+			return
+		}
+		c.lock.Lock()
+		laser := c.laser
+		c.lock.Unlock()
+		if !laser {
+			c.write(cmd, "10", nil)
+			return
+		}
+		enc := 3
+		if cmd[1] == 'S' {
+			enc = 2
+		}
+		c.write(cmd, "00", c.scan_lines(start, end, cluster, enc))
+	case strings.HasPrefix(cmd, "MD") || strings.HasPrefix(cmd, "MS"):
+		if len(cmd) != 15 {
+			c.write(cmd, "10", nil)
+			return
+		}
+		start, end, cluster, ok := c.scan_params(cmd[:12], 12)
+		if !ok {
+			c.write(cmd, "10", nil)
+			return
+		}
+		interval, err0 := strconv.Atoi(cmd[12:13])
+		count, err1 := strconv.Atoi(cmd[13:15])
+		if err0 != nil || err1 != nil {
+			c.write(cmd, "10", nil)
+			return
+		}
+		c.lock.Lock()
+		c.laser = true
+		c.seq += 1
+		seq := c.seq
+		c.lock.Unlock()
+		c.write(cmd, "00", nil)
+		go c.stream(cmd, start, end, cluster, interval, count, seq)
+	default:
+		c.write(cmd, "0E", nil)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// Serve handles commands on a connection until it is closed.
+func (s *SCIPStandIn) Serve(rw io.ReadWriter) error {
+	log.Printf("%s.Serve() enter", s.Name)
+	c := &scip_conn{
+		s:    s,
+		w:    rw,
+		out:  make(chan []byte, 16),
+		done: make(chan struct{}),
+		ts:   time.Now(),
+	}
+	go c.writer()
+	r := bufio.NewReader(rw)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			// stop the writer and any streaming
+			close(c.done)
+			log.Printf("%s.Serve() exit", s.Name)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		if cmd == "" {
+			continue
+		}
+		c.command(cmd)
+	}
+}
+
+// ListenAndServe listens on a TCP address (E.g. "localhost:10940") and serves each connection.
+// It returns the listener, close it to stop serving.
+func (s *SCIPStandIn) ListenAndServe(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("%s: unable to listen on %s", s.Name, addr)
+		return nil, err
+	}
+	log.Printf("%s: listening on %s", s.Name, ln.Addr())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				s.Serve(conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln, nil
+}
+
+//-----------------------------------------------------------------------------
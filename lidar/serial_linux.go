@@ -0,0 +1,76 @@
+//-----------------------------------------------------------------------------
+/*
+
+Linux Serial Ports with Arbitrary Baud Rates
+
+Some LIDARs use non-standard baud rates (E.g. YDLIDAR X4 @ 128000 baud).
+These can't be set with the standard termios Bxxx rates, so we use the
+termios2 interface with BOTHER to set the baud rate directly.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//-----------------------------------------------------------------------------
+
+// from asm-generic/ioctls.h and asm-generic/termbits.h
+const tcgets2 = 0x802c542a
+const tcsets2 = 0x402c542b
+const cbaud = 0010017
+const bother = 0010000
+const crtscts = 020000000000
+
+type termios2 struct {
+	Iflag  uint32
+	Oflag  uint32
+	Cflag  uint32
+	Lflag  uint32
+	Line   uint8
+	Cc     [19]uint8
+	Ispeed uint32
+	Ospeed uint32
+}
+
+// open_serial opens a raw 8N1 serial port at any baud rate.
+// Reads return after the timeout (rounded to 100 ms) if no data is available.
+func open_serial(name string, baud int, timeout time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	var t termios2
+	err = ioctl(f.Fd(), tcgets2, uintptr(unsafe.Pointer(&t)))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.Iflag = syscall.IGNPAR
+	t.Oflag = 0
+	t.Lflag = 0
+	t.Cflag &^= cbaud | syscall.CSIZE | syscall.PARENB | syscall.CSTOPB | crtscts
+	t.Cflag |= bother | syscall.CS8 | syscall.CREAD | syscall.CLOCAL
+	t.Ispeed = uint32(baud)
+	t.Ospeed = uint32(baud)
+	vtime := timeout / (100 * time.Millisecond)
+	if vtime < 1 {
+		vtime = 1
+	}
+	t.Cc[syscall.VMIN] = 0
+	t.Cc[syscall.VTIME] = uint8(vtime)
+	err = ioctl(f.Fd(), tcsets2, uintptr(unsafe.Pointer(&t)))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+//-----------------------------------------------------------------------------
+/*
+
+Serial Ports with Arbitrary Baud Rates (non-Linux)
+
+Setting arbitrary baud rates uses the Linux termios2 interface.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// open_serial is not supported on this platform.
+func open_serial(name string, baud int, timeout time.Duration) (*os.File, error) {
+	return nil, errors.New("arbitrary baud rate serial ports are only supported on linux")
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,231 @@
+//-----------------------------------------------------------------------------
+/*
+
+XV11 Rolling Statistics
+
+The decoder accumulates frame, scan and rpm statistics into 1 second buckets.
+A snapshot combines the buckets of a sliding window into rates, means and
+standard deviations, plus histograms of the bad and missing frames by frame
+index (a consistently bad index points at a dirty or damaged sensor window).
+
+The statistics belong to the decoder, so they're protected by whatever lock
+protects the decoder.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+const STATS_BUCKET = time.Second       // bucket duration
+const STATS_BUCKETS = 10               // buckets in the sliding window
+const STATS_MAX_INTERVAL = time.Second // longest packet interval included in the jitter
+
+type stats_bucket struct {
+	start   time.Time             // start of the bucket (zero if unused)
+	first   time.Time             // time of the first event in the bucket
+	good    uint                  // good frames
+	bad     uint                  // bad frames
+	scans   uint                  // scans emitted
+	rpm     moments               // rpm of each frame
+	dt      moments               // packet intervals (seconds)
+	bad_idx [FRAMES_PER_SCAN]uint // bad frames by index
+	missing [FRAMES_PER_SCAN]uint // missing frames by index
+}
+
+// count, sum and sum of squares
+type moments struct {
+	n       uint
+	sum, sq float64
+}
+
+func (m *moments) add(x float64) {
+	m.n += 1
+	m.sum += x
+	m.sq += x * x
+}
+
+func (m *moments) merge(x *moments) {
+	m.n += x.n
+	m.sum += x.sum
+	m.sq += x.sq
+}
+
+// return the mean and standard deviation
+func (m *moments) stats() (float64, float64) {
+	if m.n == 0 {
+		return 0, 0
+	}
+	n := float64(m.n)
+	mean := m.sum / n
+	v := m.sq/n - mean*mean
+	if v < 0 {
+		v = 0
+	}
+	return mean, math.Sqrt(v)
+}
+
+type rolling_stats struct {
+	buckets  [STATS_BUCKETS]stats_bucket
+	cur      int       // current bucket
+	frame_ts time.Time // time of the previous good frame
+}
+
+// return the bucket for a time
+func (r *rolling_stats) bucket(ts time.Time) *stats_bucket {
+	start := ts.Truncate(STATS_BUCKET)
+	b := &r.buckets[r.cur]
+	if start.After(b.start) {
+		// start a new bucket
+		r.cur = (r.cur + 1) % STATS_BUCKETS
+		b = &r.buckets[r.cur]
+		*b = stats_bucket{start: start, first: ts}
+	}
+	return b
+}
+
+// record a good frame or v2.1 block
+func (r *rolling_stats) frame(ts time.Time, rpm float32) {
+	b := r.bucket(ts)
+	b.good += 1
+	if rpm > 0 {
+		b.rpm.add(float64(rpm))
+	}
+	if !r.frame_ts.IsZero() {
+		dt := ts.Sub(r.frame_ts)
+		if dt > 0 && dt < STATS_MAX_INTERVAL {
+			b.dt.add(dt.Seconds())
+		}
+	}
+	r.frame_ts = ts
+}
+
+// record a bad frame
+func (r *rolling_stats) bad(ts time.Time, idx int) {
+	b := r.bucket(ts)
+	b.bad += 1
+	if idx >= 0 && idx < FRAMES_PER_SCAN {
+		b.bad_idx[idx] += 1
+	}
+}
+
+// record a scan and its missing frames
+func (r *rolling_stats) scan(ts time.Time, scan *Scan2D, emitted bool) {
+	b := r.bucket(ts)
+	if emitted {
+		b.scans += 1
+	}
+	if scan.Packets >= FRAMES_PER_SCAN {
+		return
+	}
+	for i := range b.missing {
+		if scan.Samples[4*i].TS.IsZero() {
+			b.missing[i] += 1
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// Stats is a snapshot of the XV11 statistics over a sliding window.
+type Stats struct {
+	Window         time.Duration         // time covered by the window
+	GoodFrames     uint                  // good frames (all time)
+	BadFrames      uint                  // bad frames (all time)
+	FrameRate      float64               // good frames (or v2.1 blocks) per second
+	ErrorRate      float64               // fraction of frames with bad checksums
+	ScanRate       float64               // scans per second
+	RPMMean        float64               // mean rpm
+	RPMStdDev      float64               // rpm standard deviation
+	Interval       time.Duration         // mean packet interval
+	Jitter         time.Duration         // packet interval standard deviation
+	BadByIndex     [FRAMES_PER_SCAN]uint // bad frames by frame index
+	MissingByIndex [FRAMES_PER_SCAN]uint // missing frames by frame index
+}
+
+// snapshot the window ending at time now
+func (r *rolling_stats) snapshot(now time.Time) Stats {
+	var s Stats
+	var total stats_bucket
+	oldest := now
+	limit := now.Truncate(STATS_BUCKET).Add(-(STATS_BUCKETS - 1) * STATS_BUCKET)
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		if b.start.IsZero() || b.start.Before(limit) {
+			continue
+		}
+		if b.first.Before(oldest) {
+			oldest = b.first
+		}
+		total.good += b.good
+		total.bad += b.bad
+		total.scans += b.scans
+		total.rpm.merge(&b.rpm)
+		total.dt.merge(&b.dt)
+		for j := range b.bad_idx {
+			s.BadByIndex[j] += b.bad_idx[j]
+			s.MissingByIndex[j] += b.missing[j]
+		}
+	}
+	s.Window = now.Sub(oldest)
+	if secs := s.Window.Seconds(); secs > 0 {
+		s.FrameRate = float64(total.good) / secs
+		s.ScanRate = float64(total.scans) / secs
+	}
+	if n := total.good + total.bad; n != 0 {
+		s.ErrorRate = float64(total.bad) / float64(n)
+	}
+	s.RPMMean, s.RPMStdDev = total.rpm.stats()
+	dt, jitter := total.dt.stats()
+	s.Interval = time.Duration(dt * float64(time.Second))
+	s.Jitter = time.Duration(jitter * float64(time.Second))
+	return s
+}
+
+// Stats returns a snapshot of the decoder statistics.
+func (d *XV11Decoder) Stats() Stats {
+	s := d.stats.snapshot(time.Now())
+	s.GoodFrames = d.GoodFrames + d.Blocks
+	s.BadFrames = d.BadFrames
+	return s
+}
+
+// return the non-zero entries of a histogram as "index:count" pairs
+func histogram_string(h []uint) string {
+	var x []string
+	for i, n := range h {
+		if n != 0 {
+			x = append(x, fmt.Sprintf("%d:%d", i, n))
+		}
+	}
+	if len(x) == 0 {
+		return "none"
+	}
+	return strings.Join(x, " ")
+}
+
+// Rows returns the statistics as (name, value) rows.
+func (s *Stats) Rows() [][]string {
+	rows := make([][]string, 0, 11)
+	rows = append(rows, []string{"window", s.Window.Truncate(time.Millisecond).String()})
+	rows = append(rows, []string{"good frames", fmt.Sprintf("%d", s.GoodFrames)})
+	rows = append(rows, []string{"bad frames", fmt.Sprintf("%d", s.BadFrames)})
+	rows = append(rows, []string{"frame rate", fmt.Sprintf("%.1f/s", s.FrameRate)})
+	rows = append(rows, []string{"error rate", fmt.Sprintf("%.2f%%", s.ErrorRate*100.0)})
+	rows = append(rows, []string{"scan rate", fmt.Sprintf("%.2f/s", s.ScanRate)})
+	rows = append(rows, []string{"rpm", fmt.Sprintf("%.2f (stddev %.2f)", s.RPMMean, s.RPMStdDev)})
+	rows = append(rows, []string{"packet interval", fmt.Sprintf("%s (jitter %s)", s.Interval.Truncate(time.Microsecond), s.Jitter.Truncate(time.Microsecond))})
+	rows = append(rows, []string{"bad by index", histogram_string(s.BadByIndex[:])})
+	rows = append(rows, []string{"missing by index", histogram_string(s.MissingByIndex[:])})
+	return rows
+}
+
+//-----------------------------------------------------------------------------
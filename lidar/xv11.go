@@ -29,12 +29,16 @@ Motor Speed:
 300 rpm is a good target speed giving a 5 Hz 360 degree scan.
 Experimentally 3.11V @ 100% gives about 300 rpm.
 Other voltages/duty cycles can be guessed at from that.
+The motor speed model (see motor/model.go) gives a feedforward duty cycle for
+the target rpm at the motor supply voltage, so the PID only trims the error.
 The motor spins counter-clockwise as viewed from above.
 
 Compatability:
 This driver has been tested against a v2.6 unit.
 It probably works with v2.4 units.
-It won't work with v2.1 units.
+v2.1 units use a different format, which is selected from the boot banner
+or detected from the byte stream (see xv11_v21.go).
+The firmware version is read from the boot banner and shown in the status.
 
 XV11 LIDAR Boot Output:
 """
@@ -55,50 +59,71 @@ Runtime V2.6.15295
 package lidar
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"runtime"
 	"sync"
 	"time"
 
 	"github.com/deadsy/slamx/motor"
 	"github.com/deadsy/slamx/pid"
-	"github.com/deadsy/slamx/util"
 	"github.com/tarm/serial"
 )
 
 //-----------------------------------------------------------------------------
 
 type LIDAR struct {
-	Name       string       // user name for this device
-	PortName   string       // serial port name
-	Motor      *motor.Motor // motor driver
-	Ctrl       chan Ctrl    // control channel
-	Scan       chan Scan2D  // scan data channel
-	RPM        float32      // measured rpm
-	Running    bool         // is the PID turned on?
-	GoodFrames uint         // good frames rx-ed
-	BadFrames  uint         // bad frames rx-ed (invalid checksum)
-
-	port     *serial.Port
-	pid      *pid.PID
-	rpm_lock sync.Mutex  // lock for access to rpm
-	frame    LIDAR_frame // frame being read from serial
-	ofs      int         // offset into frame data
-	scan_idx int         // current scan index
-	scan     Scan2D      // current scan data
+	Name     string         // user name for this device
+	PortName string         // serial port name
+	Motor    *motor.Motor   // motor driver
+	Ctrl     chan Ctrl      // control channel
+	*ScanBus                // scan delivery
+	Partial  *ScanBus       // partial scan delivery, streamed as packets arrive
+	RPM      float32        // measured rpm
+	Health   *HealthMonitor // health state machine
+	Decoder  *XV11Decoder   // frame decoder
+
+	port      *serial.Port
+	pid_lock  sync.Mutex    // lock for access to the pid
+	pid       *pid.PID      // motor speed controller
+	tune_lock sync.Mutex    // lock for access to the autotune request
+	tune      *tune_request // autotune relay experiment (nil if none)
+	rpm_lock  sync.Mutex    // lock for access to rpm
+	rx_lock   sync.Mutex    // lock for access to the decoder
+	done      []*Scan2D     // scans completed by the decoder
+	rec_lock  sync.Mutex    // lock for access to the recorder and player
+	recorder  *Recorder     // recording of the serial stream
+	player    *Player       // replay of a recorded serial stream
+	partial   *Scan2D       // partial scan being collected
+	partials  []*Scan2D     // partial scans to publish
+
+	rd_lock     sync.Mutex    // lock for access to the reader state
+	latency     time.Duration // read latency target
+	reads       uint          // reads with data
+	read_bytes  uint          // bytes read
+	read_errors uint          // read errors
+	last_error  string        // last read error
+	cpu         float32       // reader cpu usage (fraction of a cpu)
 }
 
 //-----------------------------------------------------------------------------
 // Motor Speed Control
 
-const LIDAR_RPM = 300.0          // target rpm
-const LIDAR_RPM_SHUTDOWN = 330.0 // shutdown limit
-const LIDAR_MOTOR_PERIOD = 200   // update the motor pwm every N ms
+const LIDAR_RPM = 300.0           // target rpm
+const LIDAR_RPM_OVERSPEED = 330.0 // overspeed limit
+const LIDAR_MOTOR_PERIOD = 200    // update the motor pwm every N ms
 
 // PID parameters
+// The gains are placeholders. They are Tyreus-Luyben for a relay autotune of
+// the simulator (Ku 0.0075, Pu 1.2 s), whose motor is an assumed model and not
+// a measured XV11 motor. Replace them with "pid autotune" on real hardware and
+// save the result.
 const PID_PERIOD = float32(LIDAR_MOTOR_PERIOD) / 1000.0
-const PID_KP = 0.0
-const PID_KI = 0.0
-const PID_KD = 0.0
+const PID_KP = 0.0034
+const PID_KI = 0.0013
+const PID_KD = 0.00065
 const PID_IMIN = -1.0
 const PID_IMAX = 1.0
 const PID_OMIN = 0.0
@@ -122,241 +147,481 @@ func (l *LIDAR) get_rpm_pv() float32 {
 	return rpm
 }
 
+// return the good and bad frame counts
+func (l *LIDAR) frame_counts() (good, bad uint) {
+	l.rx_lock.Lock()
+	defer l.rx_lock.Unlock()
+	return l.Decoder.GoodFrames + l.Decoder.Blocks, l.Decoder.BadFrames
+}
+
+// Stats returns a snapshot of the frame, scan and rpm statistics.
+func (l *LIDAR) Stats() Stats {
+	l.rx_lock.Lock()
+	defer l.rx_lock.Unlock()
+	return l.Decoder.Stats()
+}
+
 // Update the PWM value using the PID
+// The health monitor decides if the motor should be driven.
 func (l *LIDAR) motor_control(quit <-chan bool, wg *sync.WaitGroup) {
 	log.Printf("%s.motor_control() enter", l.Name)
 	defer wg.Done()
 	// perform pid/pwm updates at the LIDAR_MOTOR_PERIOD
 	tick := time.NewTicker(LIDAR_MOTOR_PERIOD * time.Millisecond)
+	motor_on := false
 	for {
 		select {
 		case <-quit:
 			log.Printf("%s.motor_control() exit", l.Name)
 			tick.Stop()
 			return
-		case <-tick.C:
+		case now := <-tick.C:
 			rpm := l.get_rpm_pv()
-			// prevent motor burnout during pid tuning
-			if rpm > LIDAR_RPM_SHUTDOWN {
-				log.Printf("%s: max motor rpm exceeded %f > %f", l.Name, rpm, LIDAR_RPM_SHUTDOWN)
-				l.Motor.Set(0.0)
-				l.Running = false
+			good, bad := l.frame_counts()
+			state := l.Health.Update(now, rpm, good, bad)
+			if l.tune_step(now, state, rpm) {
+				// the autotune relay is driving the motor, restart the pid afterwards
+				motor_on = false
+				continue
 			}
-			if l.Running {
-				l.Motor.Set(l.pid.Update(rpm))
+			if state.MotorOn() {
+				l.pid_lock.Lock()
+				if !motor_on {
+					// (re)start the pid
+					l.pid.Reset()
+					l.pid.Set(LIDAR_RPM)
+					motor_on = true
+				}
+				l.pid.SetFeedforward(l.Motor.Feedforward(LIDAR_RPM))
+				out := l.pid.Update(rpm)
+				l.pid_lock.Unlock()
+				l.Motor.Set(out)
+			} else if motor_on {
+				l.Motor.Set(0)
+				motor_on = false
 			}
 		}
 	}
 }
 
+// PIDConfig returns the motor pid configuration.
+func (l *LIDAR) PIDConfig() pid.Config {
+	l.pid_lock.Lock()
+	defer l.pid_lock.Unlock()
+	return l.pid.Config()
+}
+
+// SetPIDConfig sets the motor pid configuration. The change is bumpless.
+// The period is fixed by the motor control loop.
+func (l *LIDAR) SetPIDConfig(c pid.Config) error {
+	l.pid_lock.Lock()
+	defer l.pid_lock.Unlock()
+	c.Period = PID_PERIOD
+	err := l.pid.SetConfig(c)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s: pid %+v", l.Name, c)
+	return nil
+}
+
+// PIDMode returns true and the duty cycle if the motor pid is in manual mode.
+func (l *LIDAR) PIDMode() (bool, float32) {
+	l.pid_lock.Lock()
+	defer l.pid_lock.Unlock()
+	return l.pid.Manual()
+}
+
+// SetPIDManual puts the motor pid in manual or auto mode. In manual mode the
+// duty cycle is fixed at *out, or held at the current output if out is nil.
+// The transfers are bumpless.
+func (l *LIDAR) SetPIDManual(manual bool, out *float32) {
+	l.pid_lock.Lock()
+	defer l.pid_lock.Unlock()
+	if !manual {
+		l.pid.SetAuto()
+		log.Printf("%s: pid auto", l.Name)
+		return
+	}
+	duty := l.pid.Output()
+	if out != nil {
+		duty = *out
+	}
+	l.pid.SetManual(duty)
+	_, duty = l.pid.Manual()
+	log.Printf("%s: pid manual %.3f", l.Name, duty)
+}
+
 //-----------------------------------------------------------------------------
-// Samples and Scans
 
-const SAMPLES_PER_SCAN = 360
+// Serial Port Reading
 
-func (l *LIDAR) alloc_scan() {
-	l.scan_idx = 0
-	l.scan = make([]Sample2D, SAMPLES_PER_SCAN)
+const LIDAR_LATENCY = 10 * time.Millisecond       // default read latency target
+const LIDAR_READ_SIZE = 1024                      // read buffer size
+const LIDAR_BACKOFF_MIN = 10 * time.Millisecond   // initial wait after a read error
+const LIDAR_BACKOFF_MAX = 1000 * time.Millisecond // maximum wait after a read error
+const LIDAR_CPU_PERIOD = 1000 * time.Millisecond  // reader cpu usage measurement period
+
+// SetLatency sets the read latency target (0 = process data as soon as it arrives).
+func (l *LIDAR) SetLatency(latency time.Duration) {
+	l.rd_lock.Lock()
+	l.latency = latency
+	l.rd_lock.Unlock()
 }
 
-func (scan Scan2D) add_sample(f *LIDAR_frame, base, idx int) {
-	ofs := LIDAR_SAMPLE_OFS + (idx * LIDAR_SAMPLE_SIZE)
-	b0 := f.data[ofs]
-	b1 := f.data[ofs+1]
-	b2 := f.data[ofs+2]
-	b3 := f.data[ofs+3]
+// handle a read error, return the time to wait before the next read
+func (l *LIDAR) read_error(err error, backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		backoff = LIDAR_BACKOFF_MIN
+	} else if backoff < LIDAR_BACKOFF_MAX {
+		backoff *= 2
+	}
+	l.rd_lock.Lock()
+	l.read_errors += 1
+	l.last_error = err.Error()
+	l.rd_lock.Unlock()
+	log.Printf("%s: read error %s (retry in %s)", l.Name, err, backoff)
+	return backoff
+}
+
+// Read the serial port and process the frames.
+// Reads block until data arrives, so there's no polling. After a short read we
+// wait out the rest of the latency target and let data accumulate in the serial
+// driver. There's a tradeoff here between data latency and cpu usage, a smaller
+// latency target gives lower latency and more cpu consumption.
+// 300 rpm = 200 ms/rev, so 10 ms is 1/20 revolution (about 4 frames).
+func (l *LIDAR) read_serial(quit <-chan bool, wg *sync.WaitGroup) {
+	log.Printf("%s.read_serial() enter", l.Name)
+	defer wg.Done()
+
+	// lock to the OS thread so we can measure our own cpu usage
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	cpu_t0 := time.Now()
+	cpu0, _ := thread_cpu()
+
+	buf := make([]byte, LIDAR_READ_SIZE)
+	var backoff time.Duration
+	for {
+		select {
+		case <-quit:
+			log.Printf("%s.read_serial() exit", l.Name)
+			return
+		default:
+		}
+
+		start := time.Now()
+		n, err := l.port.Read(buf)
+		if n == 0 && err == io.EOF {
+			// read timeout
+			err = nil
+		}
+		if err != nil {
+			backoff = l.read_error(err, backoff)
+			select {
+			case <-quit:
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+
+		if n > 0 {
+			l.rx(buf[:n], time.Now(), false)
+		}
 
-	idx += base
-	s := &scan[idx]
-	s.Good = (b1>>7)&1 == 0
-	s.Too_Close = (b1>>6)&1 != 0
-	s.Angle = util.DtoR(float32(idx))
+		l.rd_lock.Lock()
+		if n > 0 {
+			l.reads += 1
+			l.read_bytes += uint(n)
+		}
+		latency := l.latency
+		if dt := time.Since(cpu_t0); dt >= LIDAR_CPU_PERIOD {
+			cpu, err := thread_cpu()
+			if err == nil {
+				l.cpu = float32(cpu-cpu0) / float32(dt)
+				cpu0 = cpu
+			}
+			cpu_t0 = time.Now()
+		}
+		l.rd_lock.Unlock()
 
-	dist := ((int(b1) & 0x3f) << 8) + int(b0)
-	ss := (int(b3) << 8) + int(b2)
+		if n > 0 && n < len(buf) {
+			time.Sleep(latency - time.Since(start))
+		}
+	}
+}
 
-	s.Distance = float32(dist) / 1000.0
-	s.Signal_Strength = float32(ss)
+// ReadStatus returns the serial reader status as (name, value) rows.
+func (l *LIDAR) ReadStatus() [][]string {
+	l.rd_lock.Lock()
+	defer l.rd_lock.Unlock()
+	bytes_per_read := 0.0
+	if l.reads != 0 {
+		bytes_per_read = float64(l.read_bytes) / float64(l.reads)
+	}
+	rows := make([][]string, 0, 5)
+	rows = append(rows, []string{"read latency", l.latency.String()})
+	rows = append(rows, []string{"reads", fmt.Sprintf("%d (%.1f bytes/read)", l.reads, bytes_per_read)})
+	rows = append(rows, []string{"read errors", fmt.Sprintf("%d", l.read_errors)})
+	rows = append(rows, []string{"last read error", l.last_error})
+	rows = append(rows, []string{"reader cpu", fmt.Sprintf("%.2f%%", 100.0*l.cpu)})
+	return rows
 }
 
 //-----------------------------------------------------------------------------
-/*
-LIDAR Frame
-
-A full revolution will yield 90 packets, containing 4 consecutive readings each.
-This amounts to a total of 360 readings (1 per degree)
-The length of a packet is 22 bytes.
+// Record and Replay
+
+// rx passes a received chunk to the recorder and frame decoder.
+// Serial port data is ignored while a replay is running.
+func (l *LIDAR) rx(buf []byte, ts time.Time, replay bool) {
+	l.rec_lock.Lock()
+	if replay != (l.player != nil) {
+		l.rec_lock.Unlock()
+		return
+	}
+	if l.recorder != nil && !replay {
+		err := l.recorder.Write(buf, ts)
+		if err != nil {
+			log.Printf("%s: recording error %s", l.Name, err)
+			l.recorder.Close()
+			l.recorder = nil
+		}
+	}
+	l.rec_lock.Unlock()
+	l.rx_lock.Lock()
+	l.done = nil
+	l.partials = nil
+	l.Decoder.Decode(buf, ts)
+	l.end_partial()
+	scans, partials := l.done, l.partials
+	l.rx_lock.Unlock()
+	for _, scan := range partials {
+		l.Partial.Publish(scan)
+	}
+	for _, scan := range scans {
+		l.Publish(scan)
+	}
+}
 
-Each packet is organized as follows:
-<start> <index> <speed_L> <speed_H> [Data 0] [Data 1] [Data 2] [Data 3] <checksum_L> <checksum_H>
+// collect the samples of a frame into a partial scan
+func (l *LIDAR) packet(scan *Scan2D, samples []Sample2D) {
+	if l.partial != nil && l.partial.Seq != scan.Seq {
+		// the frame is from the next scan
+		l.end_partial()
+	}
+	if l.partial == nil {
+		l.partial = l.Partial.NewScan(SAMPLES_PER_SCAN / 4)
+		l.partial.Device = l.Name
+		l.partial.Seq = scan.Seq
+	}
+	l.partial.Samples = append(l.partial.Samples, samples...)
+	l.partial.Packets += 1
+}
 
-<start> is always 0xFA
-<index >is the index byte in the 90 packets, going from 0xA0 (packet 0, readings 0 to 3) to 0xF9 (packet 89, readings 356 to 359).
-<speed> is a two-byte information, little-endian. It represents the speed, in 64th of RPM (aka value in RPM represented in fixed point, with 6 bits used for the decimal part).
-<data n> are the 4 readings. Each one is 4 bytes long, and organized as follows:
+// end the current partial scan
+func (l *LIDAR) end_partial() {
+	p := l.partial
+	if p == nil {
+		return
+	}
+	p.RPM = l.get_rpm_pv()
+	p.interpolate()
+	l.partials = append(l.partials, p)
+	l.partial = nil
+}
 
-byte 0 : <distance 7:0>
-byte 1 : <"invalid data" flag> <"strength warning" flag> <distance 13:8>
-byte 2 : <signal strength 7:0>
-byte 3 : <signal strength 15:8>
-*/
+// SetExtrinsics sets the LIDAR mounting for the complete and partial scans.
+func (l *LIDAR) SetExtrinsics(e Extrinsics) {
+	l.ScanBus.SetExtrinsics(e)
+	l.Partial.SetExtrinsics(e)
+}
 
-const LIDAR_FRAME_SIZE = 22
-const LIDAR_SAMPLE_SIZE = 4
+//-----------------------------------------------------------------------------
+// Gap Policy
 
-const LIDAR_SOF_DELIMITER = 0xfa
-const LIDAR_MIN_INDEX = 0xa0
-const LIDAR_MAX_INDEX = 0xf9
+// SetGapPolicy sets what to do with scans that have missing frames.
+func (l *LIDAR) SetGapPolicy(p GapPolicy) {
+	l.rx_lock.Lock()
+	l.Decoder.Policy = p
+	l.rx_lock.Unlock()
+}
 
-const LIDAR_START_OFS = 0
-const LIDAR_INDEX_OFS = 1
-const LIDAR_RPM_OFS = 2
-const LIDAR_SAMPLE_OFS = 4
-const LIDAR_CHECKSUM_OFS = 20
-const LIDAR_END_OFS = 21
+// GapStatus returns the gap policy and counters as (name, value) rows.
+func (l *LIDAR) GapStatus() [][]string {
+	l.rx_lock.Lock()
+	d := *l.Decoder
+	l.rx_lock.Unlock()
+	rows := make([][]string, 0, 5)
+	rows = append(rows, []string{"gap policy", d.Policy.String()})
+	rows = append(rows, []string{"missing frames", fmt.Sprintf("%d", d.Missing)})
+	rows = append(rows, []string{"incomplete scans", fmt.Sprintf("%d", d.Incomplete)})
+	rows = append(rows, []string{"dropped scans", fmt.Sprintf("%d", d.Dropped)})
+	rows = append(rows, []string{"rollovers", fmt.Sprintf("%d", d.Rollovers)})
+	return rows
+}
 
-type LIDAR_frame struct {
-	ts   time.Time               // timestamp
-	data [LIDAR_FRAME_SIZE]uint8 // frame data
+//-----------------------------------------------------------------------------
+// Firmware
+
+// SetFirmwarePolicy sets what to do with unsupported firmware.
+func (l *LIDAR) SetFirmwarePolicy(p FirmwarePolicy) {
+	l.rx_lock.Lock()
+	l.Decoder.Firmware = p
+	if p == FirmwareWarn {
+		l.Decoder.Refused = false
+	} else if !l.Decoder.supported() {
+		l.Decoder.Refused = true
+	}
+	l.rx_lock.Unlock()
 }
 
-// return the uint16 at an offset in the frame
-func (frame *LIDAR_frame) get_uint16(ofs int) uint16 {
-	return uint16(frame.data[ofs]) + (uint16(frame.data[ofs+1]) << 8)
+// SetFormat sets the frame format (auto to detect).
+func (l *LIDAR) SetFormat(f XV11Format) {
+	l.rx_lock.Lock()
+	l.Decoder.SetFormat(f)
+	if l.Decoder.Firmware == FirmwareRefuse {
+		l.Decoder.Refused = !l.Decoder.supported()
+	}
+	l.rx_lock.Unlock()
 }
 
-// return the checksum of a frame
-func (frame *LIDAR_frame) checksum() uint16 {
-	var cs uint32
-	for i := 0; i < LIDAR_CHECKSUM_OFS; i += 2 {
-		cs = (cs << 1) + uint32(frame.get_uint16(i))
+// FirmwareStatus returns the device identity and firmware policy as (name, value) rows.
+func (l *LIDAR) FirmwareStatus() [][]string {
+	l.rx_lock.Lock()
+	d := l.Decoder
+	id := d.Identity
+	firmware := d.FirmwareStatus()
+	policy := d.Firmware
+	format := d.FormatStatus()
+	blocks, speed := d.Blocks, d.BlockSpeed
+	l.rx_lock.Unlock()
+	rows := make([][]string, 0, 9)
+	rows = append(rows, []string{"firmware", firmware})
+	rows = append(rows, []string{"firmware policy", policy.String()})
+	rows = append(rows, []string{"frame format", format})
+	if blocks != 0 {
+		rows = append(rows, []string{"v2.1 blocks", fmt.Sprintf("%d (speed %d)", blocks, speed)})
+	}
+	if id.Serial != "" {
+		rows = append(rows, []string{"serial number", id.Serial})
+		rows = append(rows, []string{"loader", id.Loader})
+		rows = append(rows, []string{"cpu", id.CPU})
+		rows = append(rows, []string{"last cal", id.LastCal})
 	}
-	cs = ((cs & 0x7fff) + (cs >> 15)) & 0x7fff
-	return uint16(cs)
+	return rows
 }
 
-// return the rpm of the LIDAR
-func (frame *LIDAR_frame) rpm() float32 {
-	return float32(frame.get_uint16(LIDAR_RPM_OFS)) / 64.0
+//-----------------------------------------------------------------------------
+// Record and Replay Control
+
+// Record starts recording the serial stream to a file.
+func (l *LIDAR) Record(filename string) error {
+	l.rec_lock.Lock()
+	defer l.rec_lock.Unlock()
+	if l.recorder != nil {
+		return errors.New("already recording")
+	}
+	r, err := NewRecorder(l.Name+"_rec", filename)
+	if err != nil {
+		return err
+	}
+	l.recorder = r
+	return nil
 }
 
-// return the base angle of the samples
-func (frame *LIDAR_frame) angle() int {
-	return 4 * (int(frame.data[LIDAR_INDEX_OFS]) - LIDAR_MIN_INDEX)
+// StopRecord stops recording the serial stream.
+func (l *LIDAR) StopRecord() error {
+	l.rec_lock.Lock()
+	defer l.rec_lock.Unlock()
+	if l.recorder == nil {
+		return errors.New("not recording")
+	}
+	err := l.recorder.Close()
+	l.recorder = nil
+	return err
 }
 
-// process a received lidar frame
-func (l *LIDAR) process_frame() {
-	f := &l.frame
-	// set rpm for the PID process value
-	l.set_rpm_pv(f.rpm())
-	// add the frame samples to the current scan
-	idx := f.angle()
-	if idx < l.scan_idx {
-		// report the scan
-		log.Printf("%s: scan complete (%.1f rpm)", l.Name, f.rpm())
-		l.Scan <- l.scan
-		// alocate the next scan
-		l.alloc_scan()
-	}
-	// add the 4 samples
-	l.scan.add_sample(f, idx, 0)
-	l.scan.add_sample(f, idx, 1)
-	l.scan.add_sample(f, idx, 2)
-	l.scan.add_sample(f, idx, 3)
-	l.scan_idx = idx + 4
-}
-
-// receive a lidar frame from a buffer
-func (l *LIDAR) rx_frame(buf []byte, ts time.Time) {
-	// We look for a start of frame and a valid index to mark a frame.
-	// We may get some false positives, but they will be weeded out with bad checksums.
-	// Once we sync with the frame cadence we should be good.
-	f := &l.frame
-	for _, c := range buf {
-		f.data[l.ofs] = c
-		if l.ofs == LIDAR_START_OFS {
-			// looking for start of frame
-			if c == LIDAR_SOF_DELIMITER {
-				// ok - set the timestamp
-				f.ts = ts
-				// now read the index
-				l.ofs += 1
-			}
-		} else if l.ofs == LIDAR_INDEX_OFS {
-			// looking for a valid index
-			if c >= LIDAR_MIN_INDEX && c <= LIDAR_MAX_INDEX {
-				// ok - now read the frame body
-				l.ofs += 1
-			} else {
-				// not a frame - keep looking
-				l.ofs = LIDAR_START_OFS
-			}
-		} else if l.ofs == LIDAR_END_OFS {
-			// validate checksum
-			calc_cs := f.checksum()
-			frame_cs := f.get_uint16(LIDAR_CHECKSUM_OFS)
-			if calc_cs == frame_cs {
-				// good frame - process it
-				l.GoodFrames += 1
-				l.process_frame()
-			} else {
-				// bad frame
-				l.BadFrames += 1
-			}
-			// reset for the next frame
-			l.ofs = LIDAR_START_OFS
-		} else {
-			// reading the frame body
-			l.ofs += 1
+// Replay starts replaying a recorded serial stream.
+func (l *LIDAR) Replay(filename string, speed float64) error {
+	l.rec_lock.Lock()
+	defer l.rec_lock.Unlock()
+	if l.player != nil {
+		return errors.New("already replaying")
+	}
+	p, err := NewPlayer(l.Name+"_play", filename, speed)
+	if err != nil {
+		return err
+	}
+	l.player = p
+	go func() {
+		err := p.Run(func(buf []byte, ts time.Time) {
+			l.rx(buf, ts, true)
+		})
+		if err != nil {
+			log.Printf("%s: replay error %s", l.Name, err)
+		}
+		l.rec_lock.Lock()
+		if l.player == p {
+			l.player = nil
 		}
+		l.rec_lock.Unlock()
+	}()
+	return nil
+}
+
+// StopReplay stops a running replay.
+func (l *LIDAR) StopReplay() error {
+	l.rec_lock.Lock()
+	p := l.player
+	l.player = nil
+	l.rec_lock.Unlock()
+	if p == nil {
+		return errors.New("not replaying")
+	}
+	p.Stop()
+	return nil
+}
+
+// Step a single step replay by n chunks.
+func (l *LIDAR) Step(n int) error {
+	l.rec_lock.Lock()
+	defer l.rec_lock.Unlock()
+	if l.player == nil || l.player.Speed != 0 {
+		return errors.New("not replaying in single step mode")
 	}
+	l.player.Step(n)
+	return nil
 }
 
-// Read the serial port and process the frames
-func (l *LIDAR) read_serial(quit <-chan bool, wg *sync.WaitGroup) {
-	log.Printf("%s.read_serial() enter", l.Name)
-	defer wg.Done()
-	for {
-		select {
-		case <-quit:
-			log.Printf("%s.read_serial() exit", l.Name)
-			return
-		default:
-			buf := make([]byte, 1024)
-			n, err := l.port.Read(buf)
-			if err == nil {
-				l.rx_frame(buf[:n], time.Now())
-				// Wait a while - there's a tradeoff here between data latency and cpu usage.
-				// A smaller wait time gives lower latency and more cpu consumption.
-				// 300 rpm = 200 ms/rev, so 50 ms is 1/4 revolution
-				time.Sleep(50 * time.Millisecond)
-			}
-		}
+// RecordStatus returns the current recording and replay filenames.
+func (l *LIDAR) RecordStatus() (record, replay string) {
+	l.rec_lock.Lock()
+	defer l.rec_lock.Unlock()
+	if l.recorder != nil {
+		record = l.recorder.FileName
 	}
+	if l.player != nil {
+		replay = l.player.FileName
+	}
+	return
 }
 
 //-----------------------------------------------------------------------------
 
+// NewLIDAR creates a new XV11 LIDAR device.
+// An empty port name gives a device with no serial port, for replay only.
+// The serial port is opened by Open().
 func NewLIDAR(name, port_name string, motor *motor.Motor) (*LIDAR, error) {
 
 	l := LIDAR{
 		Name:     name,
 		PortName: port_name,
 		Motor:    motor,
-		Running:  false,
+		latency:  LIDAR_LATENCY,
 	}
 	log.Printf("NewLidar() %s", l.Name)
 
-	// open the serial port
-	cfg := &serial.Config{Name: l.PortName, Baud: 115200, ReadTimeout: 500 * time.Millisecond}
-	port, err := serial.OpenPort(cfg)
-	if err != nil {
-		log.Printf("%s: unable to open serial port %s", l.Name, l.PortName)
-		return nil, err
-	}
-	l.port = port
-
 	// Initialise the PID
 	pid, err := pid.Init(PID_PERIOD, PID_KP, PID_KI, PID_KD, PID_IMIN, PID_IMAX, PID_OMIN, PID_OMAX)
 	if err != nil {
@@ -364,21 +629,54 @@ func NewLIDAR(name, port_name string, motor *motor.Motor) (*LIDAR, error) {
 		return nil, err
 	}
 	l.pid = pid
-
-	// allocate the initial scan
-	l.alloc_scan()
+	l.Health = NewHealthMonitor(l.Name+".health", LIDAR_RPM, LIDAR_RPM_OVERSPEED)
 
 	// setup lidar channels
 	l.Ctrl = make(chan Ctrl)
-	l.Scan = make(chan Scan2D)
+	l.ScanBus = NewScanBus(l.Name)
+	l.Partial = NewScanBus(l.Name + ".partial")
+
+	// setup the frame decoder
+	l.Decoder = NewXV11Decoder(l.Name)
+	l.Decoder.ByteTime = byte_time(115200)
+	l.Decoder.Alloc = l.NewScan
+	// set rpm for the PID process value
+	l.Decoder.Speed = l.set_rpm_pv
+	l.Decoder.Scan = func(scan *Scan2D) {
+		l.done = append(l.done, scan)
+	}
+	l.Decoder.Packet = l.packet
 
 	return &l, nil
 }
 
+// Open the LIDAR serial port.
+func (l *LIDAR) Open() error {
+	log.Printf("%s.Open()", l.Name)
+	if l.PortName == "" {
+		// no serial port
+		return nil
+	}
+	cfg := &serial.Config{Name: l.PortName, Baud: 115200, ReadTimeout: 500 * time.Millisecond}
+	port, err := serial.OpenPort(cfg)
+	if err != nil {
+		log.Printf("%s: unable to open serial port %s", l.Name, l.PortName)
+		return err
+	}
+	l.port = port
+	return nil
+}
+
 func (l *LIDAR) Close() error {
 	log.Printf("%s.Close()", l.Name)
 
-	l.Stop()
+	l.stop()
+	l.StopRecord()
+	l.StopReplay()
+
+	if l.port == nil {
+		return nil
+	}
 
 	err := l.port.Flush()
 	if err != nil {
@@ -395,21 +693,55 @@ func (l *LIDAR) Close() error {
 	return nil
 }
 
+// Start scanning.
 func (l *LIDAR) Start() {
-	if !l.Running {
+	l.Ctrl <- Start
+}
+
+// Stop scanning.
+func (l *LIDAR) Stop() {
+	l.Ctrl <- Stop
+}
+
+// Status returns the LIDAR status as (name, value) rows.
+func (l *LIDAR) Status() [][]string {
+	rows := make([][]string, 0, 10)
+	rows = append(rows, []string{"name", l.Name})
+	rows = append(rows, []string{"type", "xv11"})
+	rows = append(rows, []string{"serial port", l.PortName})
+	rows = append(rows, []string{"motor", l.Motor.Name})
+	rows = append(rows, []string{"rpm", fmt.Sprintf("%f", l.get_rpm_pv())})
+	rows = append(rows, []string{"feedforward", fmt.Sprintf("%.3f", l.Motor.Feedforward(LIDAR_RPM))})
+	rows = append(rows, l.Health.Status()...)
+	rows = append(rows, l.FirmwareStatus()...)
+	good, bad := l.frame_counts()
+	rows = append(rows, []string{"good frames", fmt.Sprintf("%d", good)})
+	rows = append(rows, []string{"bad frames", fmt.Sprintf("%d", bad)})
+	rows = append(rows, l.GapStatus()...)
+	rows = append(rows, l.ReadStatus()...)
+	record, replay := l.RecordStatus()
+	rows = append(rows, []string{"recording", record})
+	rows = append(rows, []string{"replaying", replay})
+	rows = append(rows, l.BusStatus()...)
+	for _, row := range l.Partial.BusStatus() {
+		rows = append(rows, []string{"partial " + row[0], row[1]})
+	}
+	return rows
+}
+
+func (l *LIDAR) start() {
+	if l.Health.State() == Idle {
 		log.Printf("%s.Start()", l.Name)
-		l.pid.Set(LIDAR_RPM)
-		l.Running = true
+		l.Health.Enable(true)
 	} else {
 		log.Printf("%s.Start() already running", l.Name)
 	}
 }
 
-func (l *LIDAR) Stop() {
-	if l.Running {
+func (l *LIDAR) stop() {
+	if l.Health.State() != Idle {
 		log.Printf("%s.Stop()", l.Name)
-		l.Running = false
-		l.pid.Reset()
+		l.Health.Enable(false)
 		l.Motor.Set(0)
 	} else {
 		log.Printf("%s.Stop() already stopped", l.Name)
@@ -429,17 +761,19 @@ func (l *LIDAR) Process(quit <-chan bool, wg *sync.WaitGroup) {
 	go l.motor_control(quit, lidar_wg)
 
 	// start serial port reading
-	lidar_wg.Add(1)
-	go l.read_serial(quit, lidar_wg)
+	if l.port != nil {
+		lidar_wg.Add(1)
+		go l.read_serial(quit, lidar_wg)
+	}
 
 	for {
 		select {
 		case ctrl := <-l.Ctrl:
 			switch ctrl {
 			case Start:
-				l.Start()
+				l.start()
 			case Stop:
-				l.Stop()
+				l.stop()
 			default:
 				log.Printf("%s.Process() unknown ctrl %d", l.Name, ctrl)
 			}
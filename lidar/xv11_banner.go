@@ -0,0 +1,232 @@
+//-----------------------------------------------------------------------------
+/*
+
+Neato XV11 LIDAR Boot Banner
+
+The XV11 prints a text banner when it powers up, before it starts streaming
+frames. The decoder picks the banner lines out of the byte stream, so the
+device identity is known without sending any commands to the LIDAR.
+
+"""
+Piccolo Laser Distance Scanner
+Copyright (c) 2009-2011 Neato Robotics, Inc.
+All Rights Reserved
+
+Loader  V2.5.15295
+CPU     F2802x/c001
+Serial  KSH34313AA-0140063
+LastCal [5371726C]
+Runtime V2.6.15295
+"""
+
+Firmware:
+The v2.4 and later firmware sends 22 byte frames, the v2.1 firmware sends a
+block per revolution. With the frame format set to auto the banner selects
+the format. If the format is set explicitly and doesn't match the firmware
+(or the firmware is older than v2.1) the frames would only show up as bad
+frames. The firmware policy decides what to do about that.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+
+// XV11Identity is the device identity from the XV11 boot banner.
+type XV11Identity struct {
+	Loader  string // boot loader version
+	CPU     string // cpu type
+	Serial  string // serial number
+	LastCal string // last calibration
+	Runtime string // runtime firmware version
+}
+
+const XV11_BANNER = "Piccolo Laser Distance Scanner"
+const XV11_LINE_SIZE = 80 // maximum banner line length
+
+// minimum supported runtime firmware version
+const XV11_MIN_MAJOR = 2
+const XV11_MIN_MINOR = 1
+
+// first runtime firmware version with the v2.4 frame format
+const XV11_FRAME_MAJOR = 2
+const XV11_FRAME_MINOR = 4
+
+// warn when this many bad frames have been seen and no good frames
+const XV11_BAD_FRAME_WARNING = 100
+
+// parse a "V2.6.15295" version string
+func parse_version(s string) (major, minor int, ok bool) {
+	var build int
+	n, _ := fmt.Sscanf(strings.TrimPrefix(s, "V"), "%d.%d.%d", &major, &minor, &build)
+	return major, minor, n >= 2
+}
+
+// Supported returns true if the runtime firmware version is supported.
+// Unknown versions are assumed to be supported.
+func (id *XV11Identity) Supported() bool {
+	if id.Runtime == "" {
+		return true
+	}
+	major, minor, ok := parse_version(id.Runtime)
+	if !ok {
+		return true
+	}
+	return major > XV11_MIN_MAJOR || (major == XV11_MIN_MAJOR && minor >= XV11_MIN_MINOR)
+}
+
+// Format returns the frame format for the runtime firmware version.
+// Unknown versions return auto.
+func (id *XV11Identity) Format() XV11Format {
+	major, minor, ok := parse_version(id.Runtime)
+	if !ok {
+		return XV11FormatAuto
+	}
+	if major > XV11_FRAME_MAJOR || (major == XV11_FRAME_MAJOR && minor >= XV11_FRAME_MINOR) {
+		return XV11Format24
+	}
+	return XV11Format21
+}
+
+// supported returns true if the firmware is supported with the decoder frame format.
+func (d *XV11Decoder) supported() bool {
+	id := &d.Identity
+	if !id.Supported() {
+		return false
+	}
+	f := id.Format()
+	return d.Format == XV11FormatAuto || f == XV11FormatAuto || f == d.Format
+}
+
+//-----------------------------------------------------------------------------
+
+// FirmwarePolicy is what to do with unsupported firmware.
+type FirmwarePolicy int
+
+const (
+	FirmwareWarn   FirmwarePolicy = iota // warn and keep decoding
+	FirmwareRefuse                       // stop decoding frames
+)
+
+var firmware_policy_names = map[FirmwarePolicy]string{
+	FirmwareWarn:   "warn",
+	FirmwareRefuse: "refuse",
+}
+
+func (p FirmwarePolicy) String() string {
+	if s, ok := firmware_policy_names[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", int(p))
+}
+
+// ParseFirmwarePolicy returns the firmware policy for a name (warn, refuse).
+func ParseFirmwarePolicy(name string) (FirmwarePolicy, error) {
+	for p, s := range firmware_policy_names {
+		if s == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown firmware policy \"%s\"", name)
+}
+
+//-----------------------------------------------------------------------------
+
+// accumulate banner text, a line at a time
+func (d *XV11Decoder) banner_byte(c byte) {
+	if c == '\r' || c == '\n' {
+		if len(d.line) != 0 {
+			d.banner_line(string(d.line))
+		}
+		d.line = d.line[:0]
+		return
+	}
+	if (c < ' ' && c != '\t') || c > '~' || len(d.line) >= XV11_LINE_SIZE {
+		// not text
+		d.line = d.line[:0]
+		return
+	}
+	d.line = append(d.line, c)
+}
+
+// process a line of banner text
+func (d *XV11Decoder) banner_line(line string) {
+	if strings.HasPrefix(line, XV11_BANNER) {
+		// the lidar has (re)booted
+		log.Printf("%s: boot banner", d.Name)
+		d.Identity = XV11Identity{}
+		d.in_banner = true
+		d.Refused = false
+		if d.Format == XV11FormatAuto {
+			// detect the format again
+			d.lock_format(XV11FormatAuto)
+		}
+		return
+	}
+	if !d.in_banner {
+		return
+	}
+	x := strings.Fields(line)
+	if len(x) < 2 {
+		return
+	}
+	val := strings.Join(x[1:], " ")
+	switch x[0] {
+	case "Loader":
+		d.Identity.Loader = val
+	case "CPU":
+		d.Identity.CPU = val
+	case "Serial":
+		d.Identity.Serial = val
+	case "LastCal":
+		d.Identity.LastCal = val
+	case "Runtime":
+		// the last line of the banner
+		d.Identity.Runtime = val
+		d.in_banner = false
+		d.check_firmware()
+	}
+}
+
+// check the firmware version against the firmware policy
+func (d *XV11Decoder) check_firmware() {
+	id := &d.Identity
+	log.Printf("%s: runtime %s, serial %s", d.Name, id.Runtime, id.Serial)
+	if d.supported() {
+		if d.Format == XV11FormatAuto && id.Format() != XV11FormatAuto {
+			d.lock_format(id.Format())
+		}
+		return
+	}
+	if d.Firmware == FirmwareRefuse {
+		log.Printf("%s: unsupported firmware %s, not decoding frames", d.Name, id.Runtime)
+		d.Refused = true
+		return
+	}
+	log.Printf("%s: warning: unsupported firmware %s, frames may not decode", d.Name, id.Runtime)
+}
+
+// FirmwareStatus returns the device identity and firmware state.
+func (d *XV11Decoder) FirmwareStatus() string {
+	id := &d.Identity
+	switch {
+	case d.Refused:
+		return fmt.Sprintf("%s (unsupported, refused)", id.Runtime)
+	case !d.supported():
+		return fmt.Sprintf("%s (unsupported)", id.Runtime)
+	case id.Runtime != "":
+		return id.Runtime
+	case d.GoodFrames == 0 && d.Blocks == 0 && d.BadFrames >= XV11_BAD_FRAME_WARNING:
+		return "unknown (no good frames, unsupported firmware?)"
+	}
+	return "unknown (no banner)"
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,56 @@
+//-----------------------------------------------------------------------------
+/*
+
+XV11 Motor Characterisation
+
+Runs a characterisation sweep (see motor/characterize.go) on the spin motor.
+The sweep drives the motor in place of the PID, stepping the duty cycle and
+measuring the rpm from the frames at each step. The fitted model can be
+applied to the motor, where it gives the PID feedforward and the dynamics
+for model based tuning (see xv11_tune.go).
+
+The sweep should stay above the deadband: the XV11 sends no frames when the
+motor stops, and the health monitor turns the motor off.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"github.com/deadsy/slamx/motor"
+)
+
+//-----------------------------------------------------------------------------
+
+// Characterize runs a sweep of the spin motor duty cycle from..to in delta
+// steps and fits a motor model. The model is applied to the motor if apply
+// is true. The LIDAR must be running. It blocks until the sweep is over.
+// If the fit fails the steps are still returned for the report.
+func (l *LIDAR) Characterize(from, to, delta float32, apply bool) (*motor.Characterization, error) {
+	sweep, err := motor.NewSweep(from, to, delta, l.Motor.Vbat(), LIDAR_RPM_OVERSPEED)
+	if err != nil {
+		return nil, err
+	}
+	var c *motor.Characterization
+	end := func(err error) error {
+		if err != nil {
+			return err
+		}
+		c, err = sweep.Result()
+		if err != nil {
+			return err
+		}
+		if apply {
+			err = l.Motor.SetModel(c.Model)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = l.run_experiment("characterize", sweep, sweep.Timeout(), end)
+	return c, err
+}
+
+//-----------------------------------------------------------------------------
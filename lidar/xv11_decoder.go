@@ -0,0 +1,407 @@
+//-----------------------------------------------------------------------------
+/*
+
+Neato XV11 LIDAR Frame Decoder
+
+* Sync to the frame cadence of an XV11 byte stream
+* Validate frame checksums
+* Assemble the frame samples into complete scans
+* Timestamp the samples from the frame times and the rotation rate
+* Track the frames received for each scan and apply a policy to scans with gaps
+* Parse the boot banner for the device identity (see xv11_banner.go)
+* Decode the v2.4 frame format or the v2.1 block format (see xv11_v21.go)
+* Keep rolling frame, scan and rpm statistics (see stats.go)
+
+Revolutions:
+A new revolution normally starts when the frame index goes backwards. If the
+frames at the end of a revolution and the start of the next are lost, the index
+can keep going forwards into the next revolution. The frame times and the rpm
+are used to predict the rotation angle to catch this.
+
+The decoder has no knowledge of where the bytes come from. They can be
+written to it from a serial port, a file, a pipe or a network connection.
+Decoded frames and complete scans are reported using callbacks.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"github.com/deadsy/slamx/util"
+)
+
+//-----------------------------------------------------------------------------
+
+type XV11Decoder struct {
+	Name       string                                 // user name for this decoder
+	Frame      func(f *LIDAR_frame)                   // called for each good frame
+	Speed      func(rpm float32)                      // called with the rpm of each frame or block
+	Scan       func(scan *Scan2D)                     // called for each complete scan
+	Alloc      func(n int) *Scan2D                    // scan allocator (nil to allocate with make)
+	Packet     func(scan *Scan2D, samples []Sample2D) // called with the samples of each frame
+	ByteTime   time.Duration                          // time per byte, used to back date frames within a buffer (0 = none)
+	Policy     GapPolicy                              // what to do with scans that have missing frames
+	GoodFrames uint                                   // good frames rx-ed
+	BadFrames  uint                                   // bad frames rx-ed (invalid checksum)
+	Missing    uint                                   // frames missing from scans
+	Incomplete uint                                   // scans with missing frames
+	Dropped    uint                                   // incomplete scans dropped by the gap policy
+	Rollovers  uint                                   // revolutions detected by time rather than frame index
+	Identity   XV11Identity                           // device identity from the boot banner
+	Firmware   FirmwarePolicy                         // what to do with unsupported firmware
+	Refused    bool                                   // frames are not decoded (unsupported firmware)
+	Format     XV11Format                             // frame format (auto to detect)
+	Blocks     uint                                   // v2.1 blocks rx-ed
+	BlockSpeed uint16                                 // raw speed of the last v2.1 block
+
+	frame     LIDAR_frame           // frame being read from the stream
+	ofs       int                   // offset into frame data
+	scan_idx  int                   // current scan index
+	scan      *Scan2D               // current scan data
+	seq       uint                  // scan sequence number
+	rpm_sum   float32               // sum of the frame rpms for the current scan
+	last_ts   time.Time             // timestamp of the previous frame
+	line      []byte                // banner line being read from the stream
+	in_banner bool                  // reading the boot banner
+	active    XV11Format            // format being decoded (auto until detected)
+	blk       [XV11_BLOCK_SIZE]byte // v2.1 block being read from the stream
+	blk_ofs   int                   // offset into the block data
+	blk_skip  uint                  // bytes skipped looking for the block header
+	blk_chain int                   // number of contiguous blocks
+	stats     rolling_stats         // rolling statistics
+}
+
+//-----------------------------------------------------------------------------
+// Samples and Scans
+
+const SAMPLES_PER_SCAN = 360
+const FRAMES_PER_SCAN = SAMPLES_PER_SCAN / 4
+
+func (d *XV11Decoder) alloc_scan() {
+	d.scan_idx = 0
+	d.rpm_sum = 0
+	if d.Alloc != nil {
+		d.scan = d.Alloc(SAMPLES_PER_SCAN)
+	} else {
+		d.scan = &Scan2D{Samples: make([]Sample2D, 0, SAMPLES_PER_SCAN)}
+	}
+	d.scan.Device = d.Name
+	d.scan.Seq = d.seq
+	d.scan.Samples = d.scan.Samples[:SAMPLES_PER_SCAN]
+	d.seq += 1
+	// samples for missing frames have an angle but no data
+	for i := range d.scan.Samples {
+		d.scan.Samples[i] = Sample2D{Angle: util.DtoR(float32(i))}
+	}
+}
+
+func (scan *Scan2D) add_sample(f *LIDAR_frame, base, idx int) {
+	ofs := LIDAR_SAMPLE_OFS + (idx * LIDAR_SAMPLE_SIZE)
+	scan.set_sample(base+idx, f.data[ofs:ofs+LIDAR_SAMPLE_SIZE], f.ts)
+}
+
+// set the sample at an index (degrees) from its 4 data bytes
+func (scan *Scan2D) set_sample(idx int, b []byte, ts time.Time) {
+	b0 := b[0]
+	b1 := b[1]
+	b2 := b[2]
+	b3 := b[3]
+
+	s := &scan.Samples[idx]
+	s.Good = (b1>>7)&1 == 0
+	s.Too_Close = (b1>>6)&1 != 0
+	s.Angle = util.DtoR(float32(idx))
+
+	dist := ((int(b1) & 0x3f) << 8) + int(b0)
+	ss := (int(b3) << 8) + int(b2)
+
+	s.Distance = float32(dist) / 1000.0
+	s.Signal_Strength = float32(ss)
+	s.TS = ts
+}
+
+//-----------------------------------------------------------------------------
+/*
+LIDAR Frame
+
+A full revolution will yield 90 packets, containing 4 consecutive readings each.
+This amounts to a total of 360 readings (1 per degree)
+The length of a packet is 22 bytes.
+
+Each packet is organized as follows:
+<start> <index> <speed_L> <speed_H> [Data 0] [Data 1] [Data 2] [Data 3] <checksum_L> <checksum_H>
+
+<start> is always 0xFA
+<index >is the index byte in the 90 packets, going from 0xA0 (packet 0, readings 0 to 3) to 0xF9 (packet 89, readings 356 to 359).
+<speed> is a two-byte information, little-endian. It represents the speed, in 64th of RPM (aka value in RPM represented in fixed point, with 6 bits used for the decimal part).
+<data n> are the 4 readings. Each one is 4 bytes long, and organized as follows:
+
+byte 0 : <distance 7:0>
+byte 1 : <"invalid data" flag> <"strength warning" flag> <distance 13:8>
+byte 2 : <signal strength 7:0>
+byte 3 : <signal strength 15:8>
+*/
+
+const LIDAR_FRAME_SIZE = 22
+const LIDAR_SAMPLE_SIZE = 4
+
+const LIDAR_SOF_DELIMITER = 0xfa
+const LIDAR_MIN_INDEX = 0xa0
+const LIDAR_MAX_INDEX = 0xf9
+
+const LIDAR_START_OFS = 0
+const LIDAR_INDEX_OFS = 1
+const LIDAR_RPM_OFS = 2
+const LIDAR_SAMPLE_OFS = 4
+const LIDAR_CHECKSUM_OFS = 20
+const LIDAR_END_OFS = 21
+
+type LIDAR_frame struct {
+	ts   time.Time               // timestamp
+	data [LIDAR_FRAME_SIZE]uint8 // frame data
+}
+
+// return the uint16 at an offset in the frame
+func (frame *LIDAR_frame) get_uint16(ofs int) uint16 {
+	return uint16(frame.data[ofs]) + (uint16(frame.data[ofs+1]) << 8)
+}
+
+// return the checksum of a frame
+func (frame *LIDAR_frame) checksum() uint16 {
+	var cs uint32
+	for i := 0; i < LIDAR_CHECKSUM_OFS; i += 2 {
+		cs = (cs << 1) + uint32(frame.get_uint16(i))
+	}
+	cs = ((cs & 0x7fff) + (cs >> 15)) & 0x7fff
+	return uint16(cs)
+}
+
+// RPM returns the rpm of the LIDAR
+func (frame *LIDAR_frame) RPM() float32 {
+	return float32(frame.get_uint16(LIDAR_RPM_OFS)) / 64.0
+}
+
+// return the base angle of the samples
+func (frame *LIDAR_frame) angle() int {
+	return 4 * (int(frame.data[LIDAR_INDEX_OFS]) - LIDAR_MIN_INDEX)
+}
+
+// Index returns the packet index (0..89) of the frame
+func (frame *LIDAR_frame) Index() int {
+	return int(frame.data[LIDAR_INDEX_OFS]) - LIDAR_MIN_INDEX
+}
+
+// Time returns the timestamp of the frame
+func (frame *LIDAR_frame) Time() time.Time {
+	return frame.ts
+}
+
+// Bytes returns the raw frame data
+func (frame *LIDAR_frame) Bytes() []byte {
+	return frame.data[:]
+}
+
+//-----------------------------------------------------------------------------
+
+// does the frame start a new revolution?
+func (d *XV11Decoder) rollover(f *LIDAR_frame, idx int) bool {
+	if d.scan.Packets == 0 {
+		return false
+	}
+	if idx < d.scan_idx {
+		return true
+	}
+	// predict the angle from the previous frame, the elapsed time and the rpm
+	dt := f.ts.Sub(d.last_ts).Seconds()
+	rpm := f.RPM()
+	if dt <= 0 || rpm <= 0 {
+		return false
+	}
+	angle := float64(d.scan_idx-4) + dt*float64(rpm)*6.0
+	if angle-float64(idx) > 180.0 {
+		// closer to this index on the next revolution
+		d.Rollovers += 1
+		return true
+	}
+	return false
+}
+
+// end the current scan, report it according to the gap policy
+func (d *XV11Decoder) end_scan() {
+	scan := d.scan
+	if scan.Packets != 0 {
+		scan.RPM = d.rpm_sum / float32(scan.Packets)
+	}
+	d.alloc_scan()
+	if scan.Packets == 0 {
+		return
+	}
+	scan.interpolate()
+	missing := FRAMES_PER_SCAN - scan.Packets
+	if missing > 0 {
+		d.Missing += uint(missing)
+		d.Incomplete += 1
+		switch d.Policy {
+		case GapMark:
+			scan.Incomplete = true
+		case GapDrop:
+			log.Printf("%s: scan dropped (%d missing frames)", d.Name, missing)
+			d.Dropped += 1
+			d.stats.scan(scan.End, scan, false)
+			return
+		}
+	}
+	d.stats.scan(scan.End, scan, true)
+	log.Printf("%s: scan complete (%.1f rpm)", d.Name, scan.RPM)
+	if d.Scan != nil {
+		d.Scan(scan)
+	}
+}
+
+// process a received lidar frame
+func (d *XV11Decoder) process_frame() {
+	f := &d.frame
+	// report the frame
+	if d.Frame != nil {
+		d.Frame(f)
+	}
+	if d.Speed != nil {
+		d.Speed(f.RPM())
+	}
+	d.stats.frame(f.ts, f.RPM())
+	// add the frame samples to the current scan
+	idx := f.angle()
+	if d.rollover(f, idx) {
+		d.end_scan()
+	}
+	d.last_ts = f.ts
+	d.scan.Packets += 1
+	d.rpm_sum += f.RPM()
+	// add the 4 samples
+	d.scan.add_sample(f, idx, 0)
+	d.scan.add_sample(f, idx, 1)
+	d.scan.add_sample(f, idx, 2)
+	d.scan.add_sample(f, idx, 3)
+	d.scan_idx = idx + 4
+	// report the packet samples
+	if d.Packet != nil {
+		d.Packet(d.scan, d.scan.Samples[idx:idx+4])
+	}
+}
+
+// return the time of a byte received with n bytes after it in a buffer received at time ts
+func (d *XV11Decoder) byte_ts(ts time.Time, n int) time.Time {
+	return ts.Add(-time.Duration(n) * d.ByteTime)
+}
+
+// decode a byte of a v2.4 frame
+func (d *XV11Decoder) decode24(c byte, ts time.Time, after int) {
+	// We look for a start of frame and a valid index to mark a frame.
+	// We may get some false positives, but they will be weeded out with bad checksums.
+	// Once we sync with the frame cadence we should be good.
+	f := &d.frame
+	f.data[d.ofs] = c
+	if d.ofs == LIDAR_START_OFS {
+		// looking for start of frame
+		if c == LIDAR_SOF_DELIMITER {
+			// now read the index
+			d.ofs += 1
+		}
+	} else if d.ofs == LIDAR_INDEX_OFS {
+		// looking for a valid index
+		if c >= LIDAR_MIN_INDEX && c <= LIDAR_MAX_INDEX {
+			// ok - now read the frame body
+			d.ofs += 1
+		} else {
+			// not a frame - keep looking
+			d.ofs = LIDAR_START_OFS
+		}
+	} else if d.ofs == LIDAR_END_OFS {
+		// timestamp the frame with the time of its last byte
+		f.ts = d.byte_ts(ts, after)
+		// validate checksum
+		calc_cs := f.checksum()
+		frame_cs := f.get_uint16(LIDAR_CHECKSUM_OFS)
+		// reset for the next frame
+		d.ofs = LIDAR_START_OFS
+		if calc_cs == frame_cs {
+			// good frame - process it
+			if d.active == XV11FormatAuto {
+				d.lock_format(XV11Format24)
+			}
+			d.GoodFrames += 1
+			d.process_frame()
+		} else {
+			// bad frame
+			d.BadFrames += 1
+			d.stats.bad(f.ts, f.Index())
+			if d.GoodFrames == 0 && d.Blocks == 0 && d.BadFrames == XV11_BAD_FRAME_WARNING {
+				log.Printf("%s: warning: %d bad frames and no good frames, unsupported firmware?", d.Name, d.BadFrames)
+			}
+		}
+	} else {
+		// reading the frame body
+		d.ofs += 1
+	}
+}
+
+// Decode a buffer of bytes received at time ts.
+func (d *XV11Decoder) Decode(buf []byte, ts time.Time) {
+	for i, c := range buf {
+		d.banner_byte(c)
+		if d.Refused {
+			continue
+		}
+		// bytes after this one, used to back date the frame times
+		after := len(buf) - 1 - i
+		if d.active != XV11Format21 {
+			d.decode24(c, ts, after)
+		}
+		if d.active != XV11Format24 {
+			d.decode21(c, ts, after)
+		}
+	}
+}
+
+// ReadFrom decodes the byte stream from a reader until EOF or error.
+// Each buffer read is timestamped with the time it was read.
+func (d *XV11Decoder) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			d.Decode(buf[:n], time.Now())
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func NewXV11Decoder(name string) *XV11Decoder {
+	d := XV11Decoder{
+		Name:     name,
+		Policy:   GapMark,
+		Firmware: FirmwareWarn,
+		Format:   XV11FormatAuto,
+		line:     make([]byte, 0, XV11_LINE_SIZE),
+	}
+	log.Printf("NewXV11Decoder() %s", d.Name)
+	// allocate the initial scan
+	d.alloc_scan()
+	return &d
+}
+
+//-----------------------------------------------------------------------------
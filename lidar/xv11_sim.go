@@ -0,0 +1,293 @@
+//-----------------------------------------------------------------------------
+/*
+
+Neato XV11 LIDAR Simulator
+
+* Presents a pseudo-terminal that looks like the XV11 serial port
+* Generates valid XV11 frames from ray casting into a 2D room
+* Models the spin motor so the rpm follows the motor PWM duty cycle
+* Prints a boot banner before the frames
+* Sends v2.4 frames or v2.1 blocks
+
+This allows the LIDAR driver and the motor PID loop to be exercised on a
+PC build with no LIDAR hardware.
+
+Motor Model:
+The XV11 motor gives about 300 rpm at 3.11V. With a 7.2V motor supply
+that's a duty cycle of about 0.43. The motor is modelled as a deadband
+followed by a first order lag.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Simulated Room
+
+// Wall is a line segment in the room (meters).
+type Wall struct {
+	X0, Y0, X1, Y1 float64
+}
+
+// Room is a set of walls with the LIDAR at (X, Y).
+type Room struct {
+	X, Y  float64 // LIDAR position
+	Theta float64 // LIDAR zero angle (radians)
+	Walls []Wall
+}
+
+// NewRoom returns a rectangular w x h room with the LIDAR at (x, y).
+// The room has a 0.5m square pillar in the middle.
+func NewRoom(w, h, x, y float64) (*Room, error) {
+	if w <= 0 || h <= 0 || x <= 0 || x >= w || y <= 0 || y >= h {
+		return nil, errors.New("invalid room dimensions")
+	}
+	r := Room{X: x, Y: y}
+	r.Walls = []Wall{
+		{0, 0, w, 0},
+		{w, 0, w, h},
+		{w, h, 0, h},
+		{0, h, 0, 0},
+	}
+	// the pillar
+	cx, cy, d := w/2, h/2, 0.25
+	if math.Abs(x-cx) > 2*d || math.Abs(y-cy) > 2*d {
+		r.Walls = append(r.Walls, []Wall{
+			{cx - d, cy - d, cx + d, cy - d},
+			{cx + d, cy - d, cx + d, cy + d},
+			{cx + d, cy + d, cx - d, cy + d},
+			{cx - d, cy + d, cx - d, cy - d},
+		}...)
+	}
+	return &r, nil
+}
+
+// Mount returns a copy of the room with the LIDAR moved to its mounting on a
+// robot at (X, Y) facing along the x-axis. The simulated LIDAR is counter
+// clockwise, so the direction of the mounting is ignored.
+func (r *Room) Mount(e Extrinsics) *Room {
+	m := *r
+	c, s := math.Cos(r.Theta), math.Sin(r.Theta)
+	m.X = r.X + c*e.X - s*e.Y
+	m.Y = r.Y + s*e.X + c*e.Y
+	m.Theta = r.Theta + e.Yaw
+	return &m
+}
+
+// Range returns the distance to the nearest wall along a ray at angle theta.
+// Returns false if there is no wall along the ray.
+func (r *Room) Range(theta float64) (float64, bool) {
+	dx, dy := math.Cos(r.Theta+theta), math.Sin(r.Theta+theta)
+	d := math.Inf(1)
+	for _, w := range r.Walls {
+		// solve (X,Y) + t(dx,dy) = (X0,Y0) + u(X1-X0,Y1-Y0)
+		ex, ey := w.X1-w.X0, w.Y1-w.Y0
+		den := dx*ey - dy*ex
+		if den == 0 {
+			continue
+		}
+		qx, qy := w.X0-r.X, w.Y0-r.Y
+		t := (qx*ey - qy*ex) / den
+		u := (qx*dy - qy*dx) / den
+		if t > 0 && u >= 0 && u <= 1 && t < d {
+			d = t
+		}
+	}
+	return d, !math.IsInf(d, 1)
+}
+
+//-----------------------------------------------------------------------------
+
+const SIM_PERIOD = 10 * time.Millisecond // simulation time step
+const SIM_RPM_PER_DUTY = 694.0           // steady state rpm per unit duty cycle
+const SIM_DEADBAND = 0.05                // duty cycle needed to start the motor
+const SIM_TAU = 0.5                      // motor time constant (seconds)
+const SIM_MAX_RANGE = 6.0                // maximum range (meters)
+const SIM_NOISE = 0.005                  // range noise (meters)
+
+// boot banner
+const SIM_BANNER = "Piccolo Laser Distance Scanner\r\n" +
+	"Copyright (c) 2009-2011 Neato Robotics, Inc.\r\n" +
+	"All Rights Reserved\r\n\r\n" +
+	"Loader\tV2.5.15295\r\n" +
+	"CPU\tF2802x/c001\r\n" +
+	"Serial\tSIM00000AA-0000000\r\n" +
+	"LastCal\t[00000000]\r\n"
+
+// runtime firmware versions for the frame formats
+const SIM_RUNTIME_24 = "Runtime\tV2.6.15295\r\n"
+const SIM_RUNTIME_21 = "Runtime\tV2.1.15295\r\n"
+
+type XV11Sim struct {
+	Name     string         // user name for this simulator
+	PortName string         // serial port name for the LIDAR driver
+	Room     *Room          // the simulated room
+	Duty     func() float32 // motor duty cycle source
+	Format   XV11Format     // frame format to send (v2.1, otherwise v2.4)
+
+	master *os.File
+	slave  *os.File
+	lock   sync.Mutex // lock for access to rpm
+	rpm    float64    // simulated rpm
+	angle  float64    // rotation angle (degrees)
+}
+
+func NewXV11Sim(name string, room *Room, duty func() float32) (*XV11Sim, error) {
+	s := XV11Sim{
+		Name: name,
+		Room: room,
+		Duty: duty,
+	}
+	log.Printf("NewXV11Sim() %s", s.Name)
+	master, slave, port_name, err := open_pty()
+	if err != nil {
+		log.Printf("%s: unable to open pseudo-terminal", s.Name)
+		return nil, err
+	}
+	s.master = master
+	s.slave = slave
+	s.PortName = port_name
+	log.Printf("%s: serial port is %s", s.Name, s.PortName)
+	return &s, nil
+}
+
+func (s *XV11Sim) Close() {
+	log.Printf("%s.Close()", s.Name)
+	s.master.Close()
+	s.slave.Close()
+}
+
+// RPM returns the simulated rpm.
+func (s *XV11Sim) RPM() float32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return float32(s.rpm)
+}
+
+// update the motor model by dt seconds
+func (s *XV11Sim) motor(dt float64) {
+	duty := float64(s.Duty())
+	rpm_ss := 0.0
+	if duty > SIM_DEADBAND {
+		rpm_ss = (duty - SIM_DEADBAND) * SIM_RPM_PER_DUTY / (1.0 - SIM_DEADBAND)
+	}
+	s.lock.Lock()
+	s.rpm += (rpm_ss - s.rpm) * dt / SIM_TAU
+	s.lock.Unlock()
+}
+
+// build the 4 data bytes of the sample at an angle (degrees)
+func (s *XV11Sim) sample(angle int, b []byte) {
+	theta := float64(angle) * math.Pi / 180.0
+	d, ok := s.Room.Range(theta)
+	var b1 uint8
+	var dist, ss int
+	if ok && d < SIM_MAX_RANGE {
+		d += SIM_NOISE * rand.NormFloat64()
+		dist = int(d * 1000.0)
+		ss = int(2000.0 / (1.0 + d))
+		if d < 0.6 {
+			// strength warning
+			b1 = 0x40
+		}
+	} else {
+		// invalid data
+		b1 = 0x80
+	}
+	b[0] = uint8(dist)
+	b[1] = b1 | uint8(dist>>8)&0x3f
+	b[2] = uint8(ss)
+	b[3] = uint8(ss >> 8)
+}
+
+// build a v2.1 block for a revolution
+func (s *XV11Sim) block() []byte {
+	b := make([]byte, XV11_BLOCK_SIZE)
+	copy(b, xv11_block_header[:])
+	speed := uint16(s.rpm * 64.0)
+	b[XV11_BLOCK_SPEED_OFS] = uint8(speed)
+	b[XV11_BLOCK_SPEED_OFS+1] = uint8(speed >> 8)
+	for i := 0; i < SAMPLES_PER_SCAN; i++ {
+		ofs := XV11_BLOCK_SAMPLE_OFS + (i * LIDAR_SAMPLE_SIZE)
+		s.sample(i, b[ofs:ofs+LIDAR_SAMPLE_SIZE])
+	}
+	return b
+}
+
+// build the frame for a packet index
+func (s *XV11Sim) frame(idx int) *LIDAR_frame {
+	var f LIDAR_frame
+	f.data[LIDAR_START_OFS] = LIDAR_SOF_DELIMITER
+	f.data[LIDAR_INDEX_OFS] = uint8(LIDAR_MIN_INDEX + idx)
+	speed := uint16(s.rpm * 64.0)
+	f.data[LIDAR_RPM_OFS] = uint8(speed)
+	f.data[LIDAR_RPM_OFS+1] = uint8(speed >> 8)
+	for i := 0; i < 4; i++ {
+		ofs := LIDAR_SAMPLE_OFS + (i * LIDAR_SAMPLE_SIZE)
+		s.sample(4*idx+i, f.data[ofs:ofs+LIDAR_SAMPLE_SIZE])
+	}
+	cs := f.checksum()
+	f.data[LIDAR_CHECKSUM_OFS] = uint8(cs)
+	f.data[LIDAR_CHECKSUM_OFS+1] = uint8(cs >> 8)
+	return &f
+}
+
+// Run the simulation.
+func (s *XV11Sim) Run(quit <-chan bool, wg *sync.WaitGroup) {
+	log.Printf("%s.Run() enter", s.Name)
+	defer wg.Done()
+	tick := time.NewTicker(SIM_PERIOD)
+	dt := SIM_PERIOD.Seconds()
+	buf := make([]byte, 0, 1024)
+	banner := SIM_BANNER + SIM_RUNTIME_24
+	if s.Format == XV11Format21 {
+		banner = SIM_BANNER + SIM_RUNTIME_21
+	}
+	_, err := s.master.Write([]byte(banner))
+	if err != nil {
+		log.Printf("%s: write error %s", s.Name, err)
+	}
+	for {
+		select {
+		case <-quit:
+			log.Printf("%s.Run() exit", s.Name)
+			tick.Stop()
+			return
+		case <-tick.C:
+			s.motor(dt)
+			// advance the rotation, emitting a frame for each 4 degrees
+			buf = buf[:0]
+			angle := s.angle + s.rpm*6.0*dt
+			if s.Format == XV11Format21 {
+				// a block at the end of each revolution
+				if angle >= 360.0 {
+					buf = append(buf, s.block()...)
+				}
+			} else {
+				for idx := int(s.angle / 4); idx < int(angle/4); idx++ {
+					buf = append(buf, s.frame(idx % 90).data[:]...)
+				}
+			}
+			s.angle = math.Mod(angle, 360.0)
+			if len(buf) > 0 {
+				_, err := s.master.Write(buf)
+				if err != nil {
+					log.Printf("%s: write error %s", s.Name, err)
+				}
+			}
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,267 @@
+//-----------------------------------------------------------------------------
+/*
+
+XV11 Decoder Tests
+
+The frames and blocks are built from the layouts in xv11_decoder.go and
+xv11_v21.go, and fed to the decoder one frame at a time with the times they
+would arrive at 300 rpm.
+
+Recordings of v2.1 units ("lidar record") in testdata/xv11_v21*.rec are
+decoded to check the v2.1 block layout against real data. The test is skipped
+if there are none.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+const test_rpm = 300.0
+
+// time per frame at 300 rpm
+const test_frame_time = time.Minute / (test_rpm * FRAMES_PER_SCAN)
+
+// the test distance (mm) of a sample on a revolution
+func test_dist(rev, angle int) int {
+	return 1000 + 10*rev + angle
+}
+
+// build a v2.4 frame for a packet index on a revolution
+func xv11_frame(rev, idx int) []byte {
+	var f LIDAR_frame
+	f.data[LIDAR_START_OFS] = LIDAR_SOF_DELIMITER
+	f.data[LIDAR_INDEX_OFS] = uint8(LIDAR_MIN_INDEX + idx)
+	speed := uint16(test_rpm * 64.0)
+	f.data[LIDAR_RPM_OFS] = uint8(speed)
+	f.data[LIDAR_RPM_OFS+1] = uint8(speed >> 8)
+	for i := 0; i < 4; i++ {
+		ofs := LIDAR_SAMPLE_OFS + (i * LIDAR_SAMPLE_SIZE)
+		dist := test_dist(rev, 4*idx+i)
+		f.data[ofs] = uint8(dist)
+		f.data[ofs+1] = uint8(dist>>8) & 0x3f
+		f.data[ofs+2] = 100
+	}
+	cs := f.checksum()
+	f.data[LIDAR_CHECKSUM_OFS] = uint8(cs)
+	f.data[LIDAR_CHECKSUM_OFS+1] = uint8(cs >> 8)
+	return f.data[:]
+}
+
+// decoder that collects the scans
+func test_decoder(policy GapPolicy) (*XV11Decoder, *[]*Scan2D) {
+	d := NewXV11Decoder("test")
+	d.Policy = policy
+	scans := &[]*Scan2D{}
+	d.Scan = func(scan *Scan2D) {
+		*scans = append(*scans, scan)
+	}
+	return d, scans
+}
+
+// feed revolutions of frames to the decoder, skip returns true for frames to leave out
+func feed_frames(d *XV11Decoder, revs int, skip func(rev, idx int) bool) {
+	t := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for rev := 0; rev < revs; rev++ {
+		for idx := 0; idx < FRAMES_PER_SCAN; idx++ {
+			t = t.Add(test_frame_time)
+			if skip != nil && skip(rev, idx) {
+				continue
+			}
+			d.Decode(xv11_frame(rev, idx), t)
+		}
+	}
+	// the first frame of the next revolution ends the last one
+	d.Decode(xv11_frame(revs, 0), t.Add(test_frame_time))
+}
+
+// check the samples of a scan, the samples of missing frames aren't good
+func check_scan(t *testing.T, scan *Scan2D, rev int, missing func(idx int) bool) {
+	if len(scan.Samples) != SAMPLES_PER_SCAN {
+		t.Fatalf("%d samples", len(scan.Samples))
+	}
+	for i, s := range scan.Samples {
+		if missing != nil && missing(i/4) {
+			if s.Good {
+				t.Errorf("revolution %d sample %d: missing frame is good", rev, i)
+			}
+			continue
+		}
+		if !s.Good || !near(float64(s.Distance), float64(test_dist(rev, i))/1000.0, 1e-6) {
+			t.Errorf("revolution %d sample %d: good %t distance %f", rev, i, s.Good, s.Distance)
+			return
+		}
+	}
+	if !near(float64(scan.RPM), test_rpm, 0.1) {
+		t.Errorf("revolution %d: %f rpm", rev, scan.RPM)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_XV11_Frames(t *testing.T) {
+	d, scans := test_decoder(GapMark)
+	feed_frames(d, 2, nil)
+	if len(*scans) != 2 {
+		t.Fatalf("%d scans, expected 2", len(*scans))
+	}
+	for rev, scan := range *scans {
+		check_scan(t, scan, rev, nil)
+		if scan.Incomplete || scan.Packets != FRAMES_PER_SCAN || scan.Seq != uint(rev) {
+			t.Errorf("revolution %d: incomplete %t, %d packets, seq %d", rev, scan.Incomplete, scan.Packets, scan.Seq)
+		}
+	}
+	if d.GoodFrames != 2*FRAMES_PER_SCAN+1 || d.BadFrames != 0 {
+		t.Errorf("good %d bad %d frames", d.GoodFrames, d.BadFrames)
+	}
+}
+
+func Test_XV11_Checksum(t *testing.T) {
+	d, scans := test_decoder(GapMark)
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for idx := 0; idx < FRAMES_PER_SCAN; idx++ {
+		f := xv11_frame(0, idx)
+		if idx == 10 {
+			// corrupt a distance
+			f[LIDAR_SAMPLE_OFS] ^= 0x01
+		}
+		d.Decode(f, t0.Add(time.Duration(idx)*test_frame_time))
+	}
+	d.Decode(xv11_frame(1, 0), t0.Add(FRAMES_PER_SCAN*test_frame_time))
+	if d.BadFrames != 1 || d.GoodFrames != FRAMES_PER_SCAN {
+		t.Errorf("good %d bad %d frames", d.GoodFrames, d.BadFrames)
+	}
+	if len(*scans) != 1 {
+		t.Fatalf("%d scans, expected 1", len(*scans))
+	}
+	scan := (*scans)[0]
+	check_scan(t, scan, 0, func(idx int) bool { return idx == 10 })
+	if !scan.Incomplete || d.Missing != 1 {
+		t.Errorf("incomplete %t, %d missing frames", scan.Incomplete, d.Missing)
+	}
+}
+
+func Test_XV11_Missing(t *testing.T) {
+	// lose frames in the middle of the first revolution
+	lost := func(rev, idx int) bool { return rev == 0 && idx >= 40 && idx < 45 }
+	d, scans := test_decoder(GapMark)
+	feed_frames(d, 2, lost)
+	if len(*scans) != 2 {
+		t.Fatalf("%d scans, expected 2", len(*scans))
+	}
+	check_scan(t, (*scans)[0], 0, func(idx int) bool { return lost(0, idx) })
+	check_scan(t, (*scans)[1], 1, nil)
+	if !(*scans)[0].Incomplete || (*scans)[1].Incomplete || d.Missing != 5 || d.Incomplete != 1 {
+		t.Errorf("incomplete %t %t, %d missing frames", (*scans)[0].Incomplete, (*scans)[1].Incomplete, d.Missing)
+	}
+
+	// the drop policy doesn't deliver the incomplete scan
+	d, scans = test_decoder(GapDrop)
+	feed_frames(d, 2, lost)
+	if len(*scans) != 1 || d.Dropped != 1 {
+		t.Fatalf("%d scans, %d dropped", len(*scans), d.Dropped)
+	}
+	check_scan(t, (*scans)[0], 1, nil)
+}
+
+func Test_XV11_Rollover(t *testing.T) {
+	// lose the end of the first revolution and the start of the second,
+	// so the frame index keeps going forwards into the second revolution
+	lost := func(rev, idx int) bool { return (rev == 0 && idx > 60) || (rev == 1 && idx < 70) }
+	d, scans := test_decoder(GapMark)
+	feed_frames(d, 2, lost)
+	if len(*scans) != 2 || d.Rollovers != 1 {
+		t.Fatalf("%d scans, %d rollovers", len(*scans), d.Rollovers)
+	}
+	check_scan(t, (*scans)[0], 0, func(idx int) bool { return lost(0, idx) })
+	check_scan(t, (*scans)[1], 1, func(idx int) bool { return lost(1, idx) })
+}
+
+func Test_XV11_Blocks(t *testing.T) {
+	d, scans := test_decoder(GapMark)
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for rev := 0; rev < 3; rev++ {
+		b := make([]byte, XV11_BLOCK_SIZE)
+		copy(b, xv11_block_header[:])
+		for i := 0; i < SAMPLES_PER_SCAN; i++ {
+			ofs := XV11_BLOCK_SAMPLE_OFS + (i * LIDAR_SAMPLE_SIZE)
+			dist := test_dist(rev, i)
+			b[ofs] = uint8(dist)
+			b[ofs+1] = uint8(dist>>8) & 0x3f
+		}
+		d.Decode(b, t0.Add(time.Duration(rev)*FRAMES_PER_SCAN*test_frame_time))
+	}
+	// two contiguous blocks select the v2.1 format
+	if d.FormatStatus() != "auto (v2.1)" {
+		t.Errorf("format %s", d.FormatStatus())
+	}
+	if len(*scans) != 2 {
+		t.Fatalf("%d scans, expected 2", len(*scans))
+	}
+	for i, scan := range *scans {
+		rev := i + 1
+		for k, s := range scan.Samples {
+			if !s.Good || !near(float64(s.Distance), float64(test_dist(rev, k))/1000.0, 1e-6) {
+				t.Errorf("block %d sample %d: good %t distance %f", rev, k, s.Good, s.Distance)
+				break
+			}
+		}
+	}
+	if !near(float64((*scans)[1].RPM), test_rpm, 0.1) {
+		t.Errorf("%f rpm", (*scans)[1].RPM)
+	}
+}
+
+func Test_XV11_Capture(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "xv11_v21*.rec"))
+	if len(files) == 0 {
+		t.Skip("no v2.1 recordings in testdata")
+	}
+	for _, name := range files {
+		p, err := NewPlayer("test", name, 1.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, scans := test_decoder(GapMark)
+		for {
+			buf, ts, err := p.read_chunk()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			d.Decode(buf, ts)
+		}
+		p.f.Close()
+		// the block layout is right if contiguous blocks select the v2.1 format
+		if d.FormatStatus() != "auto (v2.1)" {
+			t.Errorf("%s: format %s", name, d.FormatStatus())
+		}
+		if len(*scans) < 2 {
+			t.Errorf("%s: %d scans", name, len(*scans))
+			continue
+		}
+		for i, scan := range (*scans)[1:] {
+			good := 0
+			for _, s := range scan.Samples {
+				if s.Good {
+					good += 1
+				}
+			}
+			if len(scan.Samples) != SAMPLES_PER_SCAN || good < SAMPLES_PER_SCAN/2 || scan.RPM < 200 || scan.RPM > 400 {
+				t.Errorf("%s: scan %d: %d samples, %d good, %f rpm", name, i+1, len(scan.Samples), good, scan.RPM)
+			}
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,240 @@
+//-----------------------------------------------------------------------------
+/*
+
+XV11 Motor PID Autotuning
+
+Runs a relay feedback experiment (see pid/autotune.go) on the spin motor.
+While the experiment runs the relay drives the motor in place of the PID,
+switching the duty cycle between high and low levels around the target rpm.
+The rpm is measured from the frames, as for the PID.
+
+The relay levels are the feedforward duty cycle for the target rpm (from the
+motor model and supply voltage) +/- TUNE_AMPLITUDE, clamped to the PID output
+range. The high level is also kept below the model duty cycle for the
+overspeed limit. If the feedforward is outside the PID output range (E.g. the
+supply voltage is too low) the relay can't straddle the target rpm, so the
+experiment isn't run.
+
+The experiment is aborted if the rpm exceeds the overspeed limit, or if the
+health monitor turns the motor off. When it's done the PID takes over again,
+with the proposed gains if they are applied.
+
+Gains can also be proposed from the motor model measured by a characterisation
+sweep (see xv11_characterize.go). The model's ultimate gain and period are
+used with the same tuning rules.
+
+Both are experiments: the motor control loop runs one at a time in place of
+the PID, with the health monitor rpm lock checks suspended.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/deadsy/slamx/pid"
+)
+
+//-----------------------------------------------------------------------------
+
+const TUNE_AMPLITUDE = 0.1        // relay duty cycle amplitude around the feedforward
+const TUNE_WAIT = 5 * time.Second // extra time to wait for the result after the experiment timeout
+
+// Autotuning is the result of an autotune run or a model tuning.
+type Autotuning struct {
+	Tuning     *pid.Tuning // ultimate gain and period
+	Rule       pid.Rule    // tuning rule
+	Kp, Ki, Kd float32     // proposed gains
+	Applied    bool        // the gains have been applied to the PID
+}
+
+func (a *Autotuning) String() string {
+	s := fmt.Sprintf("%s, %s kp %.5f ki %.5f kd %.5f", a.Tuning, a.Rule, a.Kp, a.Ki, a.Kd)
+	if a.Applied {
+		s += " (applied)"
+	}
+	return s
+}
+
+// experiment drives the motor in place of the PID.
+type experiment interface {
+	Update(now time.Time, pv float32) (out float32, done bool, err error)
+}
+
+// tune_request is an experiment run by the motor control loop.
+type tune_request struct {
+	name string            // experiment name
+	exp  experiment        // the experiment
+	end  func(error) error // called by the control loop when the experiment is over
+	done chan error
+}
+
+//-----------------------------------------------------------------------------
+
+// run_experiment runs an experiment on the spin motor. The LIDAR must be running.
+// It blocks until the experiment is over, and returns the error from end.
+func (l *LIDAR) run_experiment(name string, exp experiment, timeout time.Duration, end func(error) error) error {
+	if !l.Health.State().MotorOn() {
+		return errors.New("lidar is not running")
+	}
+	t := &tune_request{
+		name: name,
+		exp:  exp,
+		end:  end,
+		done: make(chan error, 1),
+	}
+	l.tune_lock.Lock()
+	if l.tune != nil {
+		l.tune_lock.Unlock()
+		return fmt.Errorf("%s is already running", l.tune.name)
+	}
+	l.tune = t
+	l.Health.Experiment(true)
+	l.tune_lock.Unlock()
+	log.Printf("%s: %s started", l.Name, name)
+
+	select {
+	case err := <-t.done:
+		return err
+	case <-time.After(timeout + TUNE_WAIT):
+		l.tune_lock.Lock()
+		if l.tune == t {
+			l.tune = nil
+			l.Health.Experiment(false)
+		}
+		l.tune_lock.Unlock()
+		return fmt.Errorf("%s timed out", name)
+	}
+}
+
+// finish an experiment
+func (l *LIDAR) end_tune(t *tune_request, err error) {
+	l.tune = nil
+	l.Health.Experiment(false)
+	err = t.end(err)
+	if err != nil {
+		log.Printf("%s: %s failed %s", l.Name, t.name, err)
+	}
+	t.done <- err
+}
+
+// tune_step runs a step of an experiment from the motor control loop.
+// It returns true if the experiment is driving the motor.
+func (l *LIDAR) tune_step(now time.Time, state Health, rpm float32) bool {
+	l.tune_lock.Lock()
+	defer l.tune_lock.Unlock()
+	t := l.tune
+	if t == nil {
+		return false
+	}
+	if !state.MotorOn() {
+		l.Motor.Set(0)
+		l.end_tune(t, fmt.Errorf("lidar health is %s", state))
+		return true
+	}
+	out, done, err := t.exp.Update(now, rpm)
+	l.Motor.Set(out)
+	if done {
+		l.end_tune(t, err)
+	}
+	return true
+}
+
+//-----------------------------------------------------------------------------
+
+// relay_levels returns the relay duty cycles around the feedforward for the target rpm
+func (l *LIDAR) relay_levels() (high, low float32, err error) {
+	ff := l.Motor.Feedforward(LIDAR_RPM)
+	if ff <= PID_OMIN || ff >= PID_OMAX {
+		err = fmt.Errorf("feedforward %.3f is outside the pid output range %.3f..%.3f (motor vbat %.2f V)",
+			ff, PID_OMIN, PID_OMAX, l.Motor.Vbat())
+		return
+	}
+	high = ff + TUNE_AMPLITUDE
+	if high > PID_OMAX {
+		high = PID_OMAX
+	}
+	if limit := l.Motor.Feedforward(LIDAR_RPM_OVERSPEED); high > limit {
+		high = limit
+	}
+	low = ff - TUNE_AMPLITUDE
+	if low < PID_OMIN {
+		low = PID_OMIN
+	}
+	return
+}
+
+// Autotune runs a relay experiment on the spin motor and proposes PID gains
+// using a tuning rule. The gains are applied to the PID if apply is true.
+// The LIDAR must be running. It blocks until the experiment is over.
+func (l *LIDAR) Autotune(rule pid.Rule, apply bool) (*Autotuning, error) {
+	high, low, err := l.relay_levels()
+	if err != nil {
+		return nil, err
+	}
+	relay, err := pid.NewRelay(LIDAR_RPM, high, low, LIDAR_RPM_OVERSPEED)
+	if err != nil {
+		return nil, err
+	}
+	var a *Autotuning
+	end := func(err error) error {
+		if err != nil {
+			return err
+		}
+		tuning, err := relay.Tuning()
+		if err != nil {
+			return err
+		}
+		a, err = l.propose(tuning, rule, apply)
+		return err
+	}
+	err = l.run_experiment("autotune", relay, relay.Timeout, end)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ModelTune proposes PID gains from the motor model (see motor characterize)
+// using a tuning rule. The gains are applied to the PID if apply is true.
+func (l *LIDAR) ModelTune(rule pid.Rule, apply bool) (*Autotuning, error) {
+	m := l.Motor.Model()
+	if m.Tau == 0.0 {
+		return nil, errors.New("the motor model has no dynamics, characterize the motor")
+	}
+	f := pid.FOPDT{
+		K:   float64(m.Gain * l.Motor.Vbat()),
+		Tau: float64(m.Tau),
+		// the sample and hold of the control loop adds half a period of dead time
+		Delay: float64(m.Delay + PID_PERIOD/2.0),
+	}
+	tuning, err := f.Ultimate()
+	if err != nil {
+		return nil, err
+	}
+	return l.propose(tuning, rule, apply)
+}
+
+// propose gains for a tuning, optionally applying them to the PID
+func (l *LIDAR) propose(tuning *pid.Tuning, rule pid.Rule, apply bool) (*Autotuning, error) {
+	a := &Autotuning{Tuning: tuning, Rule: rule}
+	a.Kp, a.Ki, a.Kd = tuning.Gains(rule)
+	if apply {
+		l.pid_lock.Lock()
+		err := l.pid.SetGains(a.Kp, a.Ki, a.Kd)
+		l.pid_lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		a.Applied = true
+	}
+	log.Printf("%s: tuning %s", l.Name, a)
+	return a, nil
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,202 @@
+//-----------------------------------------------------------------------------
+/*
+
+Neato XV11 LIDAR Firmware v2.1 Block Decoder
+
+The v2.1 firmware sends a whole revolution as a single block:
+
+<0x5a> <0xa5> <0x00> <0xc0> <speed_L> <speed_H> [Data 0] ... [Data 359]
+
+There is no per packet index or checksum. Each sample is 4 bytes with the same
+layout as the v2.4 frame samples, starting at 0 degrees. That's 1446 bytes per
+revolution.
+
+The layout is from the firmware 2.1 notes on the LIDAR Sensor page of the
+xv11hacking wiki. The 1980 bytes per revolution sometimes quoted for v2.1 is
+the size of a v2.4 revolution (90 x 22 byte frames). The block layout hasn't
+been checked against a capture from a v2.1 unit. A recording of one ("lidar
+record") saved as testdata/xv11_v21*.rec is decoded by the tests. If it
+disagrees, the block size is XV11_BLOCK_SIZE and the sample offset is
+XV11_BLOCK_SAMPLE_OFS.
+
+Speed:
+The units of the speed field aren't known, so it's reported raw and the rpm
+is measured from the interval between blocks.
+
+Timestamps:
+The samples of a block are back dated from the time of the last byte of the
+block using the rpm, as if the block was sent as the revolution completed.
+
+Format Detection:
+With the format set to auto the decoder runs the v2.4 and v2.1 decoders side
+by side until one of them locks. A good v2.4 checksum or a v2.1 firmware
+banner selects that format. Without a banner, two consecutive v2.1 blocks with
+no bytes between them select the v2.1 format.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// XV11Format is the XV11 frame format.
+type XV11Format int
+
+const (
+	XV11FormatAuto XV11Format = iota // detect the format from the banner or the byte stream
+	XV11Format24                     // v2.4 and later: 22 byte frames with an index and checksum
+	XV11Format21                     // v2.1: a 1446 byte block per revolution
+)
+
+var xv11_format_names = map[XV11Format]string{
+	XV11FormatAuto: "auto",
+	XV11Format24:   "v2.4",
+	XV11Format21:   "v2.1",
+}
+
+func (f XV11Format) String() string {
+	if s, ok := xv11_format_names[f]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", int(f))
+}
+
+// ParseXV11Format returns the frame format for a name (auto, v2.4, v2.1).
+func ParseXV11Format(name string) (XV11Format, error) {
+	for f, s := range xv11_format_names {
+		if s == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown xv11 format \"%s\"", name)
+}
+
+//-----------------------------------------------------------------------------
+
+var xv11_block_header = [...]byte{0x5a, 0xa5, 0x00, 0xc0}
+
+const XV11_BLOCK_SPEED_OFS = 4
+const XV11_BLOCK_SAMPLE_OFS = 6
+const XV11_BLOCK_SIZE = XV11_BLOCK_SAMPLE_OFS + (SAMPLES_PER_SCAN * LIDAR_SAMPLE_SIZE)
+const XV11_BLOCK_TIMEOUT = time.Second // longest block interval used to measure the rpm
+
+// SetFormat sets the frame format and restarts the format detection.
+func (d *XV11Decoder) SetFormat(f XV11Format) {
+	d.Format = f
+	d.lock_format(f)
+}
+
+// lock the decoder to a frame format
+func (d *XV11Decoder) lock_format(f XV11Format) {
+	if f != XV11FormatAuto {
+		log.Printf("%s: %s frame format", d.Name, f)
+	}
+	d.active = f
+	d.ofs = LIDAR_START_OFS
+	d.blk_ofs = 0
+	d.blk_skip = 0
+	d.blk_chain = 0
+	if d.scan.Packets != 0 {
+		d.alloc_scan()
+	}
+}
+
+// FormatStatus returns the frame format and the detected format.
+func (d *XV11Decoder) FormatStatus() string {
+	if d.Format == XV11FormatAuto {
+		if d.active == XV11FormatAuto {
+			return "auto (detecting)"
+		}
+		return fmt.Sprintf("auto (%s)", d.active)
+	}
+	return d.Format.String()
+}
+
+//-----------------------------------------------------------------------------
+
+// decode a byte of a v2.1 block
+func (d *XV11Decoder) decode21(c byte, ts time.Time, after int) {
+	if d.blk_ofs < len(xv11_block_header) {
+		// looking for the block header
+		if c == xv11_block_header[d.blk_ofs] {
+			d.blk_ofs += 1
+			return
+		}
+		d.blk_skip += uint(d.blk_ofs)
+		d.blk_ofs = 0
+		if c == xv11_block_header[0] {
+			d.blk_ofs = 1
+		} else {
+			d.blk_skip += 1
+		}
+		return
+	}
+	// reading the block body
+	d.blk[d.blk_ofs] = c
+	d.blk_ofs += 1
+	if d.blk_ofs < XV11_BLOCK_SIZE {
+		return
+	}
+	// a complete block - is it contiguous with the previous block?
+	if d.blk_skip == 0 && d.blk_chain > 0 {
+		d.blk_chain += 1
+	} else {
+		if d.active == XV11Format21 && d.blk_chain > 0 {
+			// lost sync with the block cadence
+			d.BadFrames += 1
+			d.stats.bad(d.byte_ts(ts, after), -1)
+		}
+		d.blk_chain = 1
+	}
+	d.blk_ofs = 0
+	d.blk_skip = 0
+	if d.active == XV11FormatAuto {
+		if d.blk_chain < 2 {
+			return
+		}
+		d.lock_format(XV11Format21)
+		d.blk_chain = 2
+	}
+	d.process_block(d.byte_ts(ts, after))
+}
+
+// process a received v2.1 block
+func (d *XV11Decoder) process_block(ts time.Time) {
+	d.Blocks += 1
+	d.BlockSpeed = uint16(d.blk[XV11_BLOCK_SPEED_OFS]) + (uint16(d.blk[XV11_BLOCK_SPEED_OFS+1]) << 8)
+	// measure the rpm from the block interval
+	var rpm float32
+	if !d.last_ts.IsZero() {
+		dt := ts.Sub(d.last_ts)
+		if dt > 0 && dt < XV11_BLOCK_TIMEOUT {
+			rpm = float32(60.0 / dt.Seconds())
+		}
+	}
+	d.last_ts = ts
+	d.stats.frame(ts, rpm)
+	if rpm > 0 && d.Speed != nil {
+		d.Speed(rpm)
+	}
+	// the block is a complete revolution
+	scan := d.scan
+	for i := 0; i < SAMPLES_PER_SCAN; i++ {
+		ofs := XV11_BLOCK_SAMPLE_OFS + (i * LIDAR_SAMPLE_SIZE)
+		scan.set_sample(i, d.blk[ofs:ofs+LIDAR_SAMPLE_SIZE], ts)
+	}
+	scan.Packets = FRAMES_PER_SCAN
+	d.rpm_sum = rpm * FRAMES_PER_SCAN
+	d.scan_idx = SAMPLES_PER_SCAN
+	if d.Packet != nil {
+		d.Packet(scan, scan.Samples)
+	}
+	d.end_scan()
+}
+
+//-----------------------------------------------------------------------------
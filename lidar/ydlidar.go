@@ -0,0 +1,522 @@
+//-----------------------------------------------------------------------------
+/*
+
+Driver for YDLIDAR X4/X2 Units
+
+* Start/stop scanning (X4 only, the X2 scans whenever it is powered)
+* Query the device info and health (X4 only)
+* Read the serial stream from the LIDAR and repackage it as range data
+
+Serial Port:
+X4: 128000 baud, 8N1
+X2: 115200 baud, 8N1
+
+Motor:
+The motor speed is set by the M_CTR voltage. An optional motor driver can
+be given, in which case it is set to a fixed duty cycle while scanning.
+Otherwise the motor is assumed to be powered externally.
+
+Commands (X4):
+Commands are sent as <0xa5> <cmd>
+Responses start with a 7 byte descriptor, as for the RPLIDAR:
+<0xa5> <0x5a> <length:30 bits, mode:2 bits, little-endian> <type>
+
+Scan Packet:
+<PH_L> <PH_H> <CT> <LSN> <FSA_L> <FSA_H> <LSA_L> <LSA_H> <CS_L> <CS_H> [S1] .. [Sn]
+
+PH is the packet header, 0x55aa (little-endian)
+CT is the packet type, bit 0 is set for the first packet of a new scan
+LSN is the number of samples in the packet
+FSA, LSA are the start and end angles: angle = (xSA >> 1) / 64 degrees
+CS is the check code: the XOR of the 16-bit words PH, FSA, S1..Sn, CT|LSN, LSA
+Si is a sample: distance = Si / 4 mm
+
+The angles of the samples between FSA and LSA are linearly interpolated.
+Each sample angle then has a distance dependent correction applied:
+
+AngCorrect = atan(21.8 * (155.3 - distance) / (155.3 * distance)) degrees
+
+The X4/X2 has no signal strength data.
+
+See: YDLIDAR X4/X2 Development Manuals
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/deadsy/slamx/motor"
+	"github.com/deadsy/slamx/util"
+)
+
+//-----------------------------------------------------------------------------
+
+// YDLIDAR models
+const (
+	YDLIDAR_X4 = iota
+	YDLIDAR_X2
+)
+
+const YDLIDAR_SYNC1 = 0xa5
+
+// commands
+const YDLIDAR_CMD_SCAN = 0x60
+const YDLIDAR_CMD_STOP = 0x65
+const YDLIDAR_CMD_GET_INFO = 0x90
+const YDLIDAR_CMD_GET_HEALTH = 0x91
+
+// response types and lengths
+const YDLIDAR_DESC_SIZE = 7
+const YDLIDAR_RESP_INFO = 0x04
+const YDLIDAR_INFO_SIZE = 20
+const YDLIDAR_RESP_HEALTH = 0x06
+const YDLIDAR_HEALTH_SIZE = 3
+
+// scan packets
+const YDLIDAR_PH = 0x55aa
+const YDLIDAR_HDR_SIZE = 10
+const YDLIDAR_CT_OFS = 2
+const YDLIDAR_LSN_OFS = 3
+const YDLIDAR_FSA_OFS = 4
+const YDLIDAR_LSA_OFS = 6
+const YDLIDAR_CS_OFS = 8
+const YDLIDAR_SAMPLE_OFS = 10
+
+const YDLIDAR_MOTOR_DUTY = 0.6                  // motor duty cycle while scanning
+const YDLIDAR_TIMEOUT = 1000 * time.Millisecond // request response timeout
+const YDLIDAR_SCAN_SAMPLES = 800                // initial samples per scan allocation
+
+//-----------------------------------------------------------------------------
+
+type YDLIDAR struct {
+	Name        string       // user name for this device
+	PortName    string       // serial port name
+	Model       int          // device model (X4 or X2)
+	Motor       *motor.Motor // motor driver (nil if none)
+	Ctrl        chan Ctrl    // control channel
+	*ScanBus                 // scan delivery
+	DevModel    uint8        // device model number (X4 only)
+	Firmware    uint16       // firmware version (X4 only)
+	Hardware    uint8        // hardware version (X4 only)
+	SerialNo    string       // device serial number (X4 only)
+	Health      uint8        // health status (0 = good)
+	ErrorCode   uint16       // health error code
+	Running     bool         // is the device scanning? (written under rx_lock)
+	GoodPackets uint         // good packets rx-ed
+	BadPackets  uint         // bad packets rx-ed (checksum errors)
+
+	port    *os.File
+	rx_lock sync.Mutex    // lock for access to the receive state
+	rx_buf  []byte        // received bytes
+	scan    *Scan2D       // current scan data
+	done    []*Scan2D     // completed scans
+	seq     uint          // scan sequence number
+	byte_dt time.Duration // time per byte at the baud rate
+	scan_ts time.Time     // timestamp of the previous scan
+	rpm     float32       // rpm measured from the scan rate
+}
+
+//-----------------------------------------------------------------------------
+// Commands
+
+// send a command to the device
+func (l *YDLIDAR) request(cmd uint8) error {
+	_, err := l.port.Write([]byte{YDLIDAR_SYNC1, cmd})
+	return err
+}
+
+// send a command and read a single response
+func (l *YDLIDAR) command(cmd uint8, resp_type uint8, resp_len int) ([]byte, error) {
+	err := l.request(cmd)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := read_port(l.port, YDLIDAR_DESC_SIZE, YDLIDAR_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	// the descriptor is the same as the RPLIDAR's
+	t, n, err := rplidar_descriptor(buf)
+	if err != nil {
+		return nil, err
+	}
+	if t != resp_type || n != resp_len {
+		return nil, fmt.Errorf("unexpected response type 0x%02x length %d", t, n)
+	}
+	return read_port(l.port, n, YDLIDAR_TIMEOUT)
+}
+
+// get the device information
+func (l *YDLIDAR) get_info() error {
+	buf, err := l.command(YDLIDAR_CMD_GET_INFO, YDLIDAR_RESP_INFO, YDLIDAR_INFO_SIZE)
+	if err != nil {
+		return err
+	}
+	l.DevModel = buf[0]
+	l.Firmware = (uint16(buf[2]) << 8) + uint16(buf[1])
+	l.Hardware = buf[3]
+	l.SerialNo = ""
+	for _, c := range buf[4:20] {
+		l.SerialNo += fmt.Sprintf("%d", c)
+	}
+	return nil
+}
+
+// get the device health
+func (l *YDLIDAR) get_health() error {
+	buf, err := l.command(YDLIDAR_CMD_GET_HEALTH, YDLIDAR_RESP_HEALTH, YDLIDAR_HEALTH_SIZE)
+	if err != nil {
+		return err
+	}
+	l.Health = buf[0]
+	l.ErrorCode = uint16(buf[1]) + (uint16(buf[2]) << 8)
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// Scan Decoding
+
+// return the uint16 at an offset in the buffer
+func ydlidar_uint16(buf []byte, ofs int) uint16 {
+	return uint16(buf[ofs]) + (uint16(buf[ofs+1]) << 8)
+}
+
+// return the check code of a scan packet
+func ydlidar_checksum(buf []byte) uint16 {
+	n := int(buf[YDLIDAR_LSN_OFS])
+	cs := uint16(YDLIDAR_PH)
+	cs ^= ydlidar_uint16(buf, YDLIDAR_FSA_OFS)
+	for i := 0; i < n; i++ {
+		cs ^= ydlidar_uint16(buf, YDLIDAR_SAMPLE_OFS+(2*i))
+	}
+	cs ^= ydlidar_uint16(buf, YDLIDAR_CT_OFS)
+	cs ^= ydlidar_uint16(buf, YDLIDAR_LSA_OFS)
+	return cs
+}
+
+// return the distance dependent angle correction (degrees)
+func ydlidar_correction(dist float64) float64 {
+	if dist == 0 {
+		return 0
+	}
+	return math.Atan(21.8*(155.3-dist)/(155.3*dist)) * 180.0 / math.Pi
+}
+
+// allocate a new scan
+func (l *YDLIDAR) new_scan(n int) {
+	l.scan = l.NewScan(n)
+	l.scan.Device = l.Name
+	l.scan.Seq = l.seq
+	l.seq += 1
+}
+
+// process a scan packet
+func (l *YDLIDAR) scan_packet(buf []byte, ts time.Time) {
+	if buf[YDLIDAR_CT_OFS]&1 != 0 && len(l.scan.Samples) != 0 {
+		// start of a new scan - report the current scan
+		if !l.scan_ts.IsZero() {
+			l.rpm = float32(60.0 / ts.Sub(l.scan_ts).Seconds())
+		}
+		l.scan_ts = ts
+		l.scan.RPM = l.rpm
+		l.scan.interpolate()
+		log.Printf("%s: scan complete (%.1f rpm)", l.Name, l.rpm)
+		l.done = append(l.done, l.scan)
+		l.new_scan(len(l.scan.Samples))
+	}
+	l.scan.Packets += 1
+	n := int(buf[YDLIDAR_LSN_OFS])
+	fsa := float64(ydlidar_uint16(buf, YDLIDAR_FSA_OFS)>>1) / 64.0
+	lsa := float64(ydlidar_uint16(buf, YDLIDAR_LSA_OFS)>>1) / 64.0
+	diff := lsa - fsa
+	if diff < 0 {
+		diff += 360.0
+	}
+	for i := 0; i < n; i++ {
+		dist := float64(ydlidar_uint16(buf, YDLIDAR_SAMPLE_OFS+(2*i))) / 4.0
+		angle := fsa
+		if n > 1 {
+			angle += diff * float64(i) / float64(n-1)
+		}
+		angle = math.Mod(angle+ydlidar_correction(dist)+360.0, 360.0)
+		l.scan.Samples = append(l.scan.Samples, Sample2D{
+			Good:     dist != 0,
+			Angle:    util.DtoR(float32(angle)),
+			Distance: float32(dist / 1000.0),
+			TS:       ts,
+		})
+	}
+}
+
+// receive bytes from the serial port, return any completed scans
+func (l *YDLIDAR) rx(buf []byte, ts time.Time) []*Scan2D {
+	l.rx_lock.Lock()
+	defer l.rx_lock.Unlock()
+	l.rx_buf = append(l.rx_buf, buf...)
+	l.done = nil
+	for {
+		// look for the packet header
+		if len(l.rx_buf) < YDLIDAR_HDR_SIZE {
+			return l.done
+		}
+		if ydlidar_uint16(l.rx_buf, 0) != YDLIDAR_PH {
+			l.rx_buf = l.rx_buf[1:]
+			continue
+		}
+		// read the packet
+		n := YDLIDAR_HDR_SIZE + 2*int(l.rx_buf[YDLIDAR_LSN_OFS])
+		if len(l.rx_buf) < n {
+			return l.done
+		}
+		pkt := l.rx_buf[:n]
+		if ydlidar_checksum(pkt) == ydlidar_uint16(pkt, YDLIDAR_CS_OFS) {
+			l.GoodPackets += 1
+			// back date the packet by the bytes received after it
+			l.scan_packet(pkt, ts.Add(-time.Duration(len(l.rx_buf)-n)*l.byte_dt))
+			l.rx_buf = l.rx_buf[n:]
+		} else {
+			// resync on the next byte
+			l.BadPackets += 1
+			l.rx_buf = l.rx_buf[1:]
+		}
+	}
+}
+
+// Read the serial port and process the packets
+func (l *YDLIDAR) read_serial(quit <-chan bool, wg *sync.WaitGroup) {
+	log.Printf("%s.read_serial() enter", l.Name)
+	defer wg.Done()
+	buf := make([]byte, 1024)
+	for {
+		select {
+		case <-quit:
+			log.Printf("%s.read_serial() exit", l.Name)
+			return
+		default:
+			n, err := l.port.Read(buf)
+			if n > 0 && err == nil {
+				for _, scan := range l.rx(buf[:n], time.Now()) {
+					l.Publish(scan)
+				}
+			}
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// NewYDLIDAR creates a new YDLIDAR device.
+// The motor driver is optional (nil if the motor is powered externally).
+func NewYDLIDAR(name, port_name string, model int, motor *motor.Motor) (*YDLIDAR, error) {
+	if model != YDLIDAR_X4 && model != YDLIDAR_X2 {
+		return nil, errors.New("unknown ydlidar model")
+	}
+	l := YDLIDAR{
+		Name:     name,
+		PortName: port_name,
+		Model:    model,
+		Motor:    motor,
+	}
+	log.Printf("NewYDLIDAR() %s", l.Name)
+	l.Ctrl = make(chan Ctrl)
+	l.ScanBus = NewScanBus(l.Name)
+	l.new_scan(YDLIDAR_SCAN_SAMPLES)
+	return &l, nil
+}
+
+// Open the serial port and query the device.
+func (l *YDLIDAR) Open() error {
+	log.Printf("%s.Open()", l.Name)
+	baud := 128000
+	if l.Model == YDLIDAR_X2 {
+		baud = 115200
+	}
+	l.byte_dt = byte_time(baud)
+	port, err := open_serial(l.PortName, baud, 100*time.Millisecond)
+	if err != nil {
+		log.Printf("%s: unable to open serial port %s", l.Name, l.PortName)
+		return err
+	}
+	l.port = port
+
+	if l.Model == YDLIDAR_X2 {
+		// the X2 has no commands
+		return nil
+	}
+
+	// stop any scanning in progress
+	err = l.request(YDLIDAR_CMD_STOP)
+	if err != nil {
+		log.Printf("%s: unable to stop scanning", l.Name)
+		return err
+	}
+	// discard any scan data
+	time.Sleep(10 * time.Millisecond)
+	buf := make([]byte, 1024)
+	for {
+		n, _ := l.port.Read(buf)
+		if n == 0 {
+			break
+		}
+	}
+
+	err = l.get_health()
+	if err != nil {
+		log.Printf("%s: unable to get health", l.Name)
+		return err
+	}
+	if l.Health != 0 {
+		log.Printf("%s: health error 0x%04x", l.Name, l.ErrorCode)
+	}
+
+	err = l.get_info()
+	if err != nil {
+		log.Printf("%s: unable to get device info", l.Name)
+		return err
+	}
+	log.Printf("%s: model %d firmware %d.%d hardware %d serial %s", l.Name, l.DevModel, l.Firmware>>8, l.Firmware&0xff, l.Hardware, l.SerialNo)
+	return nil
+}
+
+func (l *YDLIDAR) Close() error {
+	log.Printf("%s.Close()", l.Name)
+	if l.port == nil {
+		return nil
+	}
+	l.stop()
+	err := l.port.Close()
+	if err != nil {
+		log.Printf("%s: error closing serial port", l.Name)
+		return err
+	}
+	return nil
+}
+
+// Start scanning.
+func (l *YDLIDAR) Start() {
+	l.Ctrl <- Start
+}
+
+// Stop scanning.
+func (l *YDLIDAR) Stop() {
+	l.Ctrl <- Stop
+}
+
+// Status returns the LIDAR status as (name, value) rows.
+func (l *YDLIDAR) Status() [][]string {
+	model := []string{"x4", "x2"}[l.Model]
+	motor := "external"
+	if l.Motor != nil {
+		motor = l.Motor.Name
+	}
+	l.rx_lock.Lock()
+	good, bad, rpm, running := l.GoodPackets, l.BadPackets, l.rpm, l.Running
+	l.rx_lock.Unlock()
+	rows := make([][]string, 0, 10)
+	rows = append(rows, []string{"name", l.Name})
+	rows = append(rows, []string{"type", "ydlidar " + model})
+	rows = append(rows, []string{"serial port", l.PortName})
+	rows = append(rows, []string{"motor", motor})
+	if l.Model == YDLIDAR_X4 {
+		rows = append(rows, []string{"model", fmt.Sprintf("%d", l.DevModel)})
+		rows = append(rows, []string{"firmware", fmt.Sprintf("%d.%d", l.Firmware>>8, l.Firmware&0xff)})
+		rows = append(rows, []string{"hardware", fmt.Sprintf("%d", l.Hardware)})
+		rows = append(rows, []string{"serial number", l.SerialNo})
+		rows = append(rows, []string{"health", fmt.Sprintf("0x%02x (0x%04x)", l.Health, l.ErrorCode)})
+	}
+	rows = append(rows, []string{"running", fmt.Sprintf("%t", running)})
+	rows = append(rows, []string{"rpm", fmt.Sprintf("%f", rpm)})
+	rows = append(rows, []string{"good packets", fmt.Sprintf("%d", good)})
+	rows = append(rows, []string{"bad packets", fmt.Sprintf("%d", bad)})
+	rows = append(rows, l.BusStatus()...)
+	return rows
+}
+
+func (l *YDLIDAR) start() {
+	if l.Running {
+		log.Printf("%s.Start() already running", l.Name)
+		return
+	}
+	log.Printf("%s.Start()", l.Name)
+	if l.Motor != nil {
+		l.Motor.Set(YDLIDAR_MOTOR_DUTY)
+	}
+	// reset the receive state
+	l.rx_lock.Lock()
+	l.rx_buf = l.rx_buf[:0]
+	l.new_scan(YDLIDAR_SCAN_SAMPLES)
+	l.rx_lock.Unlock()
+	if l.Model == YDLIDAR_X4 {
+		err := l.request(YDLIDAR_CMD_SCAN)
+		if err != nil {
+			log.Printf("%s: unable to start scanning", l.Name)
+			return
+		}
+	}
+	l.rx_lock.Lock()
+	l.Running = true
+	l.rx_lock.Unlock()
+}
+
+func (l *YDLIDAR) stop() {
+	if !l.Running {
+		log.Printf("%s.Stop() already stopped", l.Name)
+		return
+	}
+	log.Printf("%s.Stop()", l.Name)
+	if l.Model == YDLIDAR_X4 {
+		err := l.request(YDLIDAR_CMD_STOP)
+		if err != nil {
+			log.Printf("%s: unable to stop scanning", l.Name)
+		}
+	}
+	if l.Motor != nil {
+		l.Motor.Set(0)
+	}
+	l.rx_lock.Lock()
+	l.Running = false
+	l.rx_lock.Unlock()
+}
+
+//-----------------------------------------------------------------------------
+
+func (l *YDLIDAR) Process(quit <-chan bool, wg *sync.WaitGroup) {
+	log.Printf("%s.Process() enter", l.Name)
+	defer wg.Done()
+
+	lidar_wg := &sync.WaitGroup{}
+
+	// start serial port reading
+	lidar_wg.Add(1)
+	go l.read_serial(quit, lidar_wg)
+
+	for {
+		select {
+		case ctrl := <-l.Ctrl:
+			switch ctrl {
+			case Start:
+				l.start()
+			case Stop:
+				l.stop()
+			default:
+				log.Printf("%s.Process() unknown ctrl %d", l.Name, ctrl)
+			}
+		case <-quit:
+			lidar_wg.Wait()
+			l.Close()
+			log.Printf("%s.Process() exit", l.Name)
+			return
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
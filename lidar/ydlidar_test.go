@@ -0,0 +1,118 @@
+//-----------------------------------------------------------------------------
+/*
+
+YDLIDAR Decoder Tests
+
+The packets are built from the layout in the protocol notes (ydlidar.go) and
+fed through the receive path, as they would arrive from the serial port.
+
+*/
+//-----------------------------------------------------------------------------
+
+package lidar
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// scan packet: start and end angles (degrees) and sample distances (mm * 4)
+func ydlidar_pkt(start bool, fsa, lsa float64, dist []int) []byte {
+	buf := make([]byte, YDLIDAR_HDR_SIZE+2*len(dist))
+	put := func(ofs, x int) {
+		buf[ofs] = uint8(x)
+		buf[ofs+1] = uint8(x >> 8)
+	}
+	put(0, YDLIDAR_PH)
+	if start {
+		buf[YDLIDAR_CT_OFS] = 1
+	}
+	buf[YDLIDAR_LSN_OFS] = uint8(len(dist))
+	put(YDLIDAR_FSA_OFS, (int(fsa*64.0)<<1)|1)
+	put(YDLIDAR_LSA_OFS, (int(lsa*64.0)<<1)|1)
+	for i, d := range dist {
+		put(YDLIDAR_SAMPLE_OFS+(2*i), d)
+	}
+	put(YDLIDAR_CS_OFS, int(ydlidar_checksum(buf)))
+	return buf
+}
+
+func new_test_ydlidar(t *testing.T) *YDLIDAR {
+	l, err := NewYDLIDAR("test", "", YDLIDAR_X4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// sample angle in degrees
+func sample_degrees(s Sample2D) float64 {
+	return float64(s.Angle) * 180.0 / math.Pi
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_YDLIDAR_Checksum(t *testing.T) {
+	// PH 0x55aa, CT|LSN 0x0200, FSA 0x0501, LSA 0x0a01, S1 0x0fa0, S2 0x0fa4
+	pkt := ydlidar_pkt(false, 10, 20, []int{4000, 4004})
+	if cs := ydlidar_checksum(pkt); cs != 0x58ae {
+		t.Errorf("checksum 0x%04x, expected 0x58ae", cs)
+	}
+	// a corrupted packet is dropped and the receiver resyncs
+	l := new_test_ydlidar(t)
+	pkt[YDLIDAR_SAMPLE_OFS] ^= 0x01
+	buf := append(pkt, ydlidar_pkt(false, 10, 20, []int{4000, 4004})...)
+	l.rx(buf, time.Now())
+	if l.GoodPackets != 1 || l.BadPackets == 0 || len(l.scan.Samples) != 2 {
+		t.Errorf("good %d bad %d packets, %d samples", l.GoodPackets, l.BadPackets, len(l.scan.Samples))
+	}
+}
+
+func Test_YDLIDAR_Correction(t *testing.T) {
+	// atan(21.8 * (155.3 - d) / (155.3 * d)) degrees
+	for _, x := range []struct{ dist, angle float64 }{
+		{0, 0},
+		{155.3, 0},
+		{100, 4.43877},
+		{500, -5.52750},
+		{1000, -6.76219},
+	} {
+		if a := ydlidar_correction(x.dist); !near(a, x.angle, 1e-4) {
+			t.Errorf("%f mm: correction %f, expected %f", x.dist, a, x.angle)
+		}
+	}
+}
+
+func Test_YDLIDAR_Angles(t *testing.T) {
+	l := new_test_ydlidar(t)
+	// no distance: no correction, the angles are interpolated from 10 to 20 degrees
+	buf := ydlidar_pkt(true, 10, 20, []int{0, 0, 0})
+	// 1000 mm at 30 degrees is corrected by -6.762 degrees
+	buf = append(buf, ydlidar_pkt(false, 30, 30, []int{4000})...)
+	// 350 to 10 degrees wraps through 0
+	buf = append(buf, ydlidar_pkt(false, 350, 10, []int{0, 0, 0})...)
+	// the start of the next scan ends this one
+	buf = append(buf, ydlidar_pkt(true, 0, 0, []int{0})...)
+	scans := l.rx(buf, time.Now())
+	if len(scans) != 1 {
+		t.Fatalf("%d scans, expected 1", len(scans))
+	}
+	want := []float64{10, 15, 20, 23.23781, 350, 0, 10}
+	samples := scans[0].Samples
+	if len(samples) != len(want) {
+		t.Fatalf("%d samples, expected %d", len(samples), len(want))
+	}
+	for i, s := range samples {
+		if !near(sample_degrees(s), want[i], 1e-3) {
+			t.Errorf("sample %d: angle %f, expected %f", i, sample_degrees(s), want[i])
+		}
+	}
+	if samples[0].Good || !samples[3].Good || !near(float64(samples[3].Distance), 1.0, 1e-6) {
+		t.Errorf("good %t %t, distance %f", samples[0].Good, samples[3].Good, samples[3].Distance)
+	}
+}
+
+//-----------------------------------------------------------------------------
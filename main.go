@@ -5,15 +5,26 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/deadsy/go-cli"
+	"github.com/deadsy/slamx/feature"
 	"github.com/deadsy/slamx/gpio"
+	"github.com/deadsy/slamx/landmark"
 	"github.com/deadsy/slamx/lidar"
 	"github.com/deadsy/slamx/motor"
+	"github.com/deadsy/slamx/pid"
+	"github.com/deadsy/slamx/view"
 )
 
 //-----------------------------------------------------------------------------
@@ -43,44 +54,930 @@ var cmd_exit = cli.Leaf{
 //-----------------------------------------------------------------------------
 // LIDAR menu
 
+var lidar_start_help = []cli.Help{
+	{"[all]", "start the selected lidar (or all lidars)"},
+}
+
 var lidar_start = cli.Leaf{
 	Descr: "start lidar scanning",
 	F: func(c *cli.CLI, args []string) {
 		app := c.User.(*slam)
-		app.lidar.Ctrl <- lidar.Start
+		for _, l := range app.selected(c, args) {
+			l.Start()
+		}
 	},
 }
 
+var lidar_status_help = []cli.Help{
+	{"[name]", "lidar name (default: the selected lidar)"},
+}
+
 var lidar_status = cli.Leaf{
 	Descr: "show lidar status",
 	F: func(c *cli.CLI, args []string) {
 		app := c.User.(*slam)
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
 		l := app.lidar
-		rows := make([][]string, 0, 10)
-		rows = append(rows, []string{"name", l.Name})
-		rows = append(rows, []string{"serial port", l.PortName})
-		rows = append(rows, []string{"motor", l.Motor.Name})
-		rows = append(rows, []string{"running", fmt.Sprintf("%t", l.Running)})
-		rows = append(rows, []string{"rpm", fmt.Sprintf("%f", l.RPM)})
-		rows = append(rows, []string{"good frames", fmt.Sprintf("%d", l.GoodFrames)})
-		rows = append(rows, []string{"bad frames", fmt.Sprintf("%d", l.BadFrames)})
+		if len(args) == 1 {
+			d := app.find(args[0])
+			if d == nil {
+				c.Put(fmt.Sprintf("unknown lidar \"%s\"\n", args[0]))
+				return
+			}
+			l = d.drv
+		}
+		rows := l.Status()
 		c.Put(cli.TableString(rows, []int{10, 10}, 1) + "\n")
 	},
 }
 
+var lidar_list = cli.Leaf{
+	Descr: "list the lidar devices",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		rows := make([][]string, 0, len(app.lidars))
+		for _, l := range app.lidars {
+			name := l.cfg.name
+			if l.drv == app.lidar {
+				name += " *"
+			}
+			rows = append(rows, []string{name, l.cfg.kind, l.cfg.port, l.drv.Extrinsics().String()})
+		}
+		c.Put(cli.TableString(rows, []int{10, 10, 10, 10}, 1) + "\n")
+	},
+}
+
+var lidar_use_help = []cli.Help{
+	{"<name>", "lidar used by the lidar commands"},
+}
+
+var lidar_use = cli.Leaf{
+	Descr: "select a lidar device",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if len(args) != 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		err := app.use(args[0])
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
+var lidar_merge = cli.Leaf{
+	Descr: "show the scan merger status",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		c.Put(cli.TableString(app.merger.Status(), []int{10, 10}, 1) + "\n")
+	},
+}
+
+var lidar_stats = cli.Leaf{
+	Descr: "show lidar statistics",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		stats := l.Stats()
+		c.Put(cli.TableString(stats.Rows(), []int{10, 10}, 1) + "\n")
+	},
+}
+
+var lidar_stop_help = []cli.Help{
+	{"[all]", "stop the selected lidar (or all lidars)"},
+}
+
 var lidar_stop = cli.Leaf{
 	Descr: "stop lidar scanning",
 	F: func(c *cli.CLI, args []string) {
 		app := c.User.(*slam)
-		app.lidar.Ctrl <- lidar.Stop
+		for _, l := range app.selected(c, args) {
+			l.Stop()
+		}
+	},
+}
+
+var lidar_record_help = []cli.Help{
+	{"<file>", "start recording the serial stream to a file"},
+	{"off", "stop recording"},
+}
+
+var lidar_record = cli.Leaf{
+	Descr: "record the lidar serial stream",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		if len(args) != 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		var err error
+		if args[0] == "off" {
+			err = l.StopRecord()
+		} else {
+			err = l.Record(args[0])
+		}
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
+var lidar_replay_help = []cli.Help{
+	{"<file> [speed]", "replay a recording (speed 1.0 is real time, default)"},
+	{"<file> step", "replay a recording in single step mode"},
+	{"off", "stop the replay"},
+}
+
+var lidar_replay = cli.Leaf{
+	Descr: "replay a recorded lidar serial stream",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		if len(args) < 1 || len(args) > 2 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		if args[0] == "off" {
+			err := l.StopReplay()
+			if err != nil {
+				c.Put(fmt.Sprintf("%s\n", err))
+			}
+			return
+		}
+		speed := 1.0
+		if len(args) == 2 {
+			if args[1] == "step" {
+				speed = 0.0
+			} else {
+				var err error
+				speed, err = strconv.ParseFloat(args[1], 64)
+				if err != nil || speed <= 0 {
+					c.Put(fmt.Sprintf("bad speed \"%s\"\n", args[1]))
+					return
+				}
+			}
+		}
+		err := l.Replay(args[0], speed)
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
+var lidar_step_help = []cli.Help{
+	{"[n]", "number of chunks to step (default 1)"},
+}
+
+var lidar_step = cli.Leaf{
+	Descr: "step a single step replay",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		n := 1
+		if len(args) == 1 {
+			var err error
+			n, err = strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				c.Put(fmt.Sprintf("bad step count \"%s\"\n", args[0]))
+				return
+			}
+		}
+		err := l.Step(n)
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
+var lidar_gaps_help = []cli.Help{
+	{"", "show the gap policy and counters"},
+	{"emit", "emit scans with missing frames as is"},
+	{"mark", "emit scans with missing frames marked as incomplete"},
+	{"drop", "drop scans with missing frames"},
+}
+
+var lidar_gaps = cli.Leaf{
+	Descr: "show/set the policy for scans with missing frames",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		if len(args) == 1 {
+			p, err := lidar.ParseGapPolicy(args[0])
+			if err != nil {
+				c.Put(fmt.Sprintf("%s\n", err))
+				return
+			}
+			l.SetGapPolicy(p)
+		}
+		c.Put(cli.TableString(l.GapStatus(), []int{10, 10}, 1) + "\n")
+	},
+}
+
+var lidar_firmware_help = []cli.Help{
+	{"", "show the firmware version and policy"},
+	{"warn", "warn about unsupported firmware and keep decoding"},
+	{"refuse", "stop decoding frames from unsupported firmware"},
+}
+
+var lidar_firmware = cli.Leaf{
+	Descr: "show/set the policy for unsupported firmware",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		if len(args) == 1 {
+			p, err := lidar.ParseFirmwarePolicy(args[0])
+			if err != nil {
+				c.Put(fmt.Sprintf("%s\n", err))
+				return
+			}
+			l.SetFirmwarePolicy(p)
+		}
+		c.Put(cli.TableString(l.FirmwareStatus(), []int{10, 10}, 1) + "\n")
+	},
+}
+
+var lidar_format_help = []cli.Help{
+	{"", "show the frame format"},
+	{"auto", "detect the frame format from the boot banner or the byte stream"},
+	{"v2.4", "decode v2.4 (and later) firmware frames"},
+	{"v2.1", "decode v2.1 firmware blocks"},
+}
+
+var lidar_format = cli.Leaf{
+	Descr: "show/set the xv11 frame format",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		if len(args) == 1 {
+			f, err := lidar.ParseXV11Format(args[0])
+			if err != nil {
+				c.Put(fmt.Sprintf("%s\n", err))
+				return
+			}
+			l.SetFormat(f)
+		}
+		c.Put(cli.TableString(l.FirmwareStatus(), []int{10, 10}, 1) + "\n")
+	},
+}
+
+var lidar_latency_help = []cli.Help{
+	{"<ms>", "serial read latency target in ms (0 = process data as it arrives)"},
+}
+
+var lidar_latency = cli.Leaf{
+	Descr: "set the serial read latency target",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		if len(args) != 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		ms, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || ms < 0 {
+			c.Put(fmt.Sprintf("bad latency \"%s\"\n", args[0]))
+			return
+		}
+		l.SetLatency(time.Duration(ms * float64(time.Millisecond)))
+	},
+}
+
+var lidar_filter_help = []cli.Help{
+	{"", "show the filter chain and rejection counters"},
+	{"add range <min> <max>", "reject samples outside min..max meters"},
+	{"add signal <min>", "reject samples with signal strength < min"},
+	{"add tooclose", "reject samples with the too close flag set"},
+	{"add median <window> <dev>", "reject samples > dev meters from the median of their neighbours"},
+	{"add veiling <deg> <window>", "reject mixed pixels at object edges"},
+	{"remove <n>", "remove filter n from the chain"},
+	{"clear", "remove all filters"},
+}
+
+var lidar_filter = cli.Leaf{
+	Descr: "show/set the scan filter chain",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		filters := app.lidar.Filters()
+		if len(args) >= 1 {
+			switch args[0] {
+			case "add":
+				if len(args) < 2 {
+					c.Put("bad number of arguments\n")
+					return
+				}
+				f, err := lidar.NewFilter(args[1], args[2:])
+				if err != nil {
+					c.Put(fmt.Sprintf("%s\n", err))
+					return
+				}
+				filters.Add(f)
+			case "remove":
+				if len(args) != 2 {
+					c.Put("bad number of arguments\n")
+					return
+				}
+				i, err := strconv.Atoi(args[1])
+				if err == nil {
+					err = filters.Remove(i)
+				}
+				if err != nil {
+					c.Put(fmt.Sprintf("bad filter index \"%s\"\n", args[1]))
+					return
+				}
+			case "clear":
+				filters.Clear()
+			default:
+				c.Put(fmt.Sprintf("unknown filter command \"%s\"\n", args[0]))
+				return
+			}
+		}
+		rows := filters.Status()
+		if len(rows) == 0 {
+			c.Put("no filters\n")
+			return
+		}
+		c.Put(cli.TableString(rows, []int{10, 10}, 1) + "\n")
+	},
+}
+
+var lidar_mount_help = []cli.Help{
+	{"", "show the lidar mounting"},
+	{"<x> <y> <yaw> [cw|ccw]", "set the lidar position (m), zero angle (deg) and direction"},
+}
+
+var lidar_mount = cli.Leaf{
+	Descr: "show/set the lidar mounting in the robot frame",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if len(args) != 0 && len(args) != 3 && len(args) != 4 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		if len(args) >= 3 {
+			var v [3]float64
+			for i := range v {
+				var err error
+				v[i], err = strconv.ParseFloat(args[i], 64)
+				if err != nil {
+					c.Put(fmt.Sprintf("bad value \"%s\"\n", args[i]))
+					return
+				}
+			}
+			e := app.lidar.Extrinsics()
+			e.X = v[0]
+			e.Y = v[1]
+			e.Yaw = v[2] * math.Pi / 180.0
+			if len(args) == 4 {
+				cw, err := lidar.ParseDirection(args[3])
+				if err != nil {
+					c.Put(fmt.Sprintf("%s\n", err))
+					return
+				}
+				e.CW = cw
+			}
+			app.lidar.SetExtrinsics(e)
+		}
+		c.Put(fmt.Sprintf("%s\n", app.lidar.Extrinsics()))
+	},
+}
+
+var lidar_deskew_help = []cli.Help{
+	{"<vx> <vy> <w>", "de-skew scans with a constant robot velocity (m/s, m/s, deg/s)"},
+	{"off", "don't de-skew scans"},
+}
+
+var lidar_deskew = cli.Leaf{
+	Descr: "de-skew scans for the robot motion",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if len(args) == 1 && args[0] == "off" {
+			app.lidar.SetDeskew(nil)
+			c.Put("deskew off\n")
+			return
+		}
+		if len(args) != 3 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		var v [3]float64
+		for i := range v {
+			var err error
+			v[i], err = strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				c.Put(fmt.Sprintf("bad value \"%s\"\n", args[i]))
+				return
+			}
+		}
+		src := &lidar.ConstantVelocity{VX: v[0], VY: v[1], W: v[2] * math.Pi / 180.0, T0: time.Now()}
+		app.lidar.SetDeskew(src)
+		c.Put(fmt.Sprintf("deskew %s\n", src))
+	},
+}
+
+var lidar_calibrate_help = []cli.Help{
+	{"<normal> [window]", "wall normal direction and selection half-width in degrees (default 20)"},
+}
+
+var lidar_calibrate = cli.Leaf{
+	Descr: "calibrate the lidar yaw from a straight wall",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if len(args) < 1 || len(args) > 2 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		v := []float64{0, 20}
+		for i := range args {
+			var err error
+			v[i], err = strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				c.Put(fmt.Sprintf("bad angle \"%s\"\n", args[i]))
+				return
+			}
+		}
+		// wait for a scan taken with the current extrinsics
+		e := app.lidar.Extrinsics()
+		scan := app.next_scan(c, "calibrate")
+		if scan == nil {
+			return
+		}
+		yaw, rms, err := lidar.CalibrateYaw(scan, e, v[0]*math.Pi/180.0, v[1]*math.Pi/180.0)
+		scan.Release()
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		c.Put(fmt.Sprintf("yaw %.2f -> %.2f deg (wall rms %.1f mm)\n", e.Yaw*180.0/math.Pi, yaw*180.0/math.Pi, rms*1000.0))
+		e.Yaw = yaw
+		app.lidar.SetExtrinsics(e)
 	},
 }
 
 // lidar submenu items
 var lidar_menu = cli.Menu{
-	{"start", lidar_start},
-	{"status", lidar_status},
-	{"stop", lidar_stop},
+	{"calibrate", lidar_calibrate, lidar_calibrate_help},
+	{"deskew", lidar_deskew, lidar_deskew_help},
+	{"filter", lidar_filter, lidar_filter_help},
+	{"firmware", lidar_firmware, lidar_firmware_help},
+	{"format", lidar_format, lidar_format_help},
+	{"gaps", lidar_gaps, lidar_gaps_help},
+	{"latency", lidar_latency, lidar_latency_help},
+	{"list", lidar_list},
+	{"merge", lidar_merge},
+	{"mount", lidar_mount, lidar_mount_help},
+	{"record", lidar_record, lidar_record_help},
+	{"replay", lidar_replay, lidar_replay_help},
+	{"start", lidar_start, lidar_start_help},
+	{"stats", lidar_stats},
+	{"status", lidar_status, lidar_status_help},
+	{"step", lidar_step, lidar_step_help},
+	{"stop", lidar_stop, lidar_stop_help},
+	{"use", lidar_use, lidar_use_help},
+}
+
+//-----------------------------------------------------------------------------
+// Landmarks
+
+var landmark_list = cli.Leaf{
+	Descr: "list the landmark tracks",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		tracks := app.landmarks.Tracks()
+		if len(tracks) == 0 {
+			c.Put("no landmarks\n")
+			return
+		}
+		rows := make([][]string, len(tracks))
+		for i := range tracks {
+			t := &tracks[i]
+			state := "tentative"
+			if t.Confirmed {
+				state = "confirmed"
+			}
+			rows[i] = []string{fmt.Sprintf("%d", t.ID), state, t.String()}
+		}
+		c.Put(cli.TableString(rows, []int{10, 10, 10}, 1) + "\n")
+	},
+}
+
+var landmark_signal_help = []cli.Help{
+	{"<min>", "minimum signal strength of a landmark sample"},
+}
+
+var landmark_signal = cli.Leaf{
+	Descr: "set the landmark signal strength threshold",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if len(args) != 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		min, err := strconv.ParseFloat(args[0], 32)
+		if err != nil || min < 0 {
+			c.Put(fmt.Sprintf("bad signal strength \"%s\"\n", args[0]))
+			return
+		}
+		app.landmarks.SetMinSignal(float32(min))
+	},
+}
+
+var landmark_status = cli.Leaf{
+	Descr: "show the landmark detector status",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		c.Put(cli.TableString(app.landmarks.Status(), []int{10, 10}, 1) + "\n")
+	},
+}
+
+// landmark submenu items
+var landmark_menu = cli.Menu{
+	{"list", landmark_list},
+	{"signal", landmark_signal, landmark_signal_help},
+	{"status", landmark_status},
+}
+
+//-----------------------------------------------------------------------------
+// Features
+
+// parse an optional line extraction method argument
+func feature_method(c *cli.CLI, args []string) (feature.Method, bool) {
+	if len(args) == 0 {
+		return feature.SplitMerge, true
+	}
+	method, err := feature.ParseMethod(args[0])
+	if err != nil {
+		c.Put(fmt.Sprintf("%s\n", err))
+		return 0, false
+	}
+	return method, true
+}
+
+// extract the features of the next scan, with an optional method argument
+func extract_features(c *cli.CLI, args []string) *feature.Features {
+	app := c.User.(*slam)
+	method, ok := feature_method(c, args)
+	if !ok {
+		return nil
+	}
+	scan := app.next_scan(c, "feature")
+	if scan == nil {
+		return nil
+	}
+	defer scan.Release()
+	return feature.NewExtractor(method).Extract(scan)
+}
+
+var feature_extract_help = []cli.Help{
+	{"[splitmerge|ransac]", "line extraction method (default splitmerge)"},
+}
+
+var feature_extract = cli.Leaf{
+	Descr: "extract the features of a scan",
+	F: func(c *cli.CLI, args []string) {
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		f := extract_features(c, args)
+		if f == nil {
+			return
+		}
+		rows := f.Rows()
+		if len(rows) == 0 {
+			c.Put("no features\n")
+			return
+		}
+		c.Put(cli.TableString(rows, []int{10, 10}, 1) + "\n")
+	},
+}
+
+var feature_export_help = []cli.Help{
+	{"<file> [splitmerge|ransac]", "write the features of a scan to a csv file"},
+}
+
+var feature_export = cli.Leaf{
+	Descr: "export the features of a scan",
+	F: func(c *cli.CLI, args []string) {
+		if len(args) < 1 || len(args) > 2 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		f := extract_features(c, args[1:])
+		if f == nil {
+			return
+		}
+		file, err := os.Create(args[0])
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		defer file.Close()
+		err = f.WriteCSV(file)
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		c.Put(fmt.Sprintf("%d lines, %d corners, %d circles\n", len(f.Lines), len(f.Corners), len(f.Circles)))
+	},
+}
+
+var feature_view_help = []cli.Help{
+	{"[splitmerge|ransac]", "line extraction method (default splitmerge)"},
+}
+
+var feature_view = cli.Leaf{
+	Descr: "draw the scans and their features until the window is closed",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		method, ok := feature_method(c, args)
+		if !ok {
+			return
+		}
+		// sdl calls are made from the cli (main) thread
+		v, err := view.Open("view")
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		defer v.Close()
+		scans := app.lidar.Subscribe("view", lidar.LatestWins, 1)
+		defer scans.Unsubscribe()
+		e := feature.NewExtractor(method)
+		for v.Events() {
+			select {
+			case scan := <-scans.C:
+				v.RenderFeatures(scan, e.Extract(scan))
+				scan.Release()
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	},
+}
+
+// feature submenu items
+var feature_menu = cli.Menu{
+	{"export", feature_export, feature_export_help},
+	{"extract", feature_extract, feature_extract_help},
+	{"view", feature_view, feature_view_help},
+}
+
+//-----------------------------------------------------------------------------
+// PID tuning
+
+var pid_autotune_help = []cli.Help{
+	{"[rule] [apply]", "relay autotune the motor pid, optionally applying the gains"},
+	{"", "rules: zn, zn-pi (ziegler-nichols), tl, tl-pi (tyreus-luyben, default)"},
+}
+
+// parse the [rule] [apply] arguments of the tuning commands
+func tune_args(c *cli.CLI, args []string) (pid.Rule, bool, bool) {
+	rule := pid.TyreusLuyben
+	apply := false
+	if len(args) > 2 {
+		c.Put("bad number of arguments\n")
+		return rule, apply, false
+	}
+	for _, arg := range args {
+		if arg == "apply" {
+			apply = true
+			continue
+		}
+		var err error
+		rule, err = pid.ParseRule(arg)
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+			return rule, apply, false
+		}
+	}
+	return rule, apply, true
+}
+
+var pid_autotune = cli.Leaf{
+	Descr: "autotune the lidar motor pid",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		rule, apply, ok := tune_args(c, args)
+		if !ok {
+			return
+		}
+		c.Put("running relay experiment...\n")
+		a, err := l.Autotune(rule, apply)
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		c.Put(fmt.Sprintf("%s\n", a))
+	},
+}
+
+var pid_model_help = []cli.Help{
+	{"[rule] [apply]", "tune the motor pid from the motor model, optionally applying the gains"},
+	{"", "rules: as for autotune"},
+}
+
+var pid_model = cli.Leaf{
+	Descr: "tune the lidar motor pid from the motor model",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		rule, apply, ok := tune_args(c, args)
+		if !ok {
+			return
+		}
+		a, err := l.ModelTune(rule, apply)
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		c.Put(fmt.Sprintf("%s\n", a))
+	},
+}
+
+var pid_show = cli.Leaf{
+	Descr: "show the lidar motor pid configuration",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		cfg := l.PIDConfig()
+		rows := cfg.Rows()
+		mode := "auto"
+		if manual, out := l.PIDMode(); manual {
+			mode = fmt.Sprintf("manual %.3f", out)
+		}
+		rows = append(rows, []string{"mode", mode})
+		c.Put(cli.TableString(rows, []int{10, 10}, 1) + "\n")
+	},
+}
+
+var pid_manual_help = []cli.Help{
+	{"[duty]", "duty cycle (default: hold the current output)"},
+}
+
+var pid_manual = cli.Leaf{
+	Descr: "put the lidar motor pid in manual mode",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		if len(args) == 0 {
+			l.SetPIDManual(true, nil)
+			return
+		}
+		duty, err := strconv.ParseFloat(args[0], 32)
+		if err != nil {
+			c.Put(fmt.Sprintf("bad duty cycle \"%s\"\n", args[0]))
+			return
+		}
+		out := float32(duty)
+		l.SetPIDManual(true, &out)
+	},
+}
+
+var pid_auto = cli.Leaf{
+	Descr: "put the lidar motor pid in auto mode",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		l.SetPIDManual(false, nil)
+	},
+}
+
+var pid_set_help = []cli.Help{
+	{"<name> <value> ...", "set kp, ki (/s), kd (s), imin, imax, omin or omax"},
+	{"", "b, c: proportional and derivative setpoint weights"},
+	{"", "dmeas: derivative on measurement (true/false), tf: derivative filter (s)"},
+	{"", "windup: limit, clamp or backcalc, kt: backcalc tracking gain (/s)"},
+}
+
+var pid_set = cli.Leaf{
+	Descr: "set the lidar motor pid configuration",
+	F: func(c *cli.CLI, args []string) {
+		l := c.User.(*slam).xv11(c)
+		if l == nil {
+			return
+		}
+		if len(args) == 0 || len(args)%2 != 0 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		cfg := l.PIDConfig()
+		for i := 0; i < len(args); i += 2 {
+			err := cfg.Set(args[i], args[i+1])
+			if err != nil {
+				c.Put(fmt.Sprintf("%s\n", err))
+				return
+			}
+		}
+		err := l.SetPIDConfig(cfg)
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
+var pid_file_help = []cli.Help{
+	{"[file]", "pid configuration file (default " + pid_file + ")"},
+}
+
+var pid_save = cli.Leaf{
+	Descr: "save the lidar motor pid configurations",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		filename := pid_file
+		if len(args) == 1 {
+			filename = args[0]
+		}
+		err := app.save_pid(filename)
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
+var pid_load = cli.Leaf{
+	Descr: "load the lidar motor pid configurations",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		filename := pid_file
+		if len(args) == 1 {
+			filename = args[0]
+		}
+		err := app.load_pid(filename)
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
+// pid submenu items
+var pid_menu = cli.Menu{
+	{"auto", pid_auto},
+	{"autotune", pid_autotune, pid_autotune_help},
+	{"load", pid_load, pid_file_help},
+	{"manual", pid_manual, pid_manual_help},
+	{"model", pid_model, pid_model_help},
+	{"save", pid_save, pid_file_help},
+	{"set", pid_set, pid_set_help},
+	{"show", pid_show},
 }
 
 //-----------------------------------------------------------------------------
@@ -90,6 +987,10 @@ var pwm_off = cli.Leaf{
 	Descr: "turn pwm off",
 	F: func(c *cli.CLI, args []string) {
 		app := c.User.(*slam)
+		if app.motor == nil {
+			c.Put("no motor for this lidar\n")
+			return
+		}
 		app.motor.Set(0.0)
 	},
 }
@@ -98,6 +999,10 @@ var pwm_on = cli.Leaf{
 	Descr: "turn pwm on",
 	F: func(c *cli.CLI, args []string) {
 		app := c.User.(*slam)
+		if app.motor == nil {
+			c.Put("no motor for this lidar\n")
+			return
+		}
 		app.motor.Set(0.4)
 	},
 }
@@ -108,22 +1013,197 @@ var pwm_menu = cli.Menu{
 	{"on", pwm_on},
 }
 
+//-----------------------------------------------------------------------------
+// Motor model
+
+var motor_vbat_help = []cli.Help{
+	{"[volts]", "set the motor supply voltage"},
+	{"", fmt.Sprintf("it isn't measured, the default is %.1f V", motor.MOTOR_VBAT)},
+	{"", "the feedforward compensates for this voltage, so set it to the actual supply"},
+}
+
+var motor_vbat = cli.Leaf{
+	Descr: "show/set the motor supply voltage",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if app.motor == nil {
+			c.Put("no motor for this lidar\n")
+			return
+		}
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		if len(args) == 1 {
+			v, err := strconv.ParseFloat(args[0], 32)
+			if err != nil {
+				c.Put(fmt.Sprintf("bad voltage \"%s\"\n", args[0]))
+				return
+			}
+			err = app.motor.SetVbat(float32(v))
+			if err != nil {
+				c.Put(fmt.Sprintf("%s\n", err))
+				return
+			}
+		}
+		c.Put(fmt.Sprintf("%.2f V\n", app.motor.Vbat()))
+	},
+}
+
+var motor_model = cli.Leaf{
+	Descr: "show the motor speed model",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if app.motor == nil {
+			c.Put("no motor for this lidar\n")
+			return
+		}
+		m := app.motor.Model()
+		c.Put(fmt.Sprintf("%s\n", &m))
+		c.Put(fmt.Sprintf("supply %.2f V (not measured, set it with \"motor vbat\")\n", app.motor.Vbat()))
+	},
+}
+
+var motor_characterize_help = []cli.Help{
+	{"<file> [from to step] [apply]", "sweep the motor duty cycle, fit a model and write a csv report"},
+	{"", fmt.Sprintf("default sweep %.2f to %.2f in %.2f steps", motor.SWEEP_FROM, motor.SWEEP_TO, motor.SWEEP_DELTA)},
+	{"", "apply: use the model for the pid feedforward and model tuning, and save it to " + motor_file},
+}
+
+var motor_characterize = cli.Leaf{
+	Descr: "characterize the lidar motor",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		l := app.xv11(c)
+		if l == nil {
+			return
+		}
+		apply := false
+		if len(args) > 0 && args[len(args)-1] == "apply" {
+			apply = true
+			args = args[:len(args)-1]
+		}
+		if len(args) != 1 && len(args) != 4 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		sweep := []float32{motor.SWEEP_FROM, motor.SWEEP_TO, motor.SWEEP_DELTA}
+		for i, arg := range args[1:] {
+			x, err := strconv.ParseFloat(arg, 32)
+			if err != nil {
+				c.Put(fmt.Sprintf("bad duty cycle \"%s\"\n", arg))
+				return
+			}
+			sweep[i] = float32(x)
+		}
+		file, err := os.Create(args[0])
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		defer file.Close()
+		c.Put("running characterization sweep...\n")
+		ch, err := l.Characterize(sweep[0], sweep[1], sweep[2], apply)
+		if ch != nil {
+			werr := ch.WriteCSV(file)
+			if werr != nil {
+				c.Put(fmt.Sprintf("%s\n", werr))
+			}
+		}
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		s := ch.String()
+		if apply {
+			s += " (applied)"
+		}
+		c.Put(s + "\n")
+		if apply {
+			err := app.save_motor(motor_file)
+			if err != nil {
+				c.Put(fmt.Sprintf("%s\n", err))
+				return
+			}
+			c.Put(fmt.Sprintf("saved to %s\n", motor_file))
+		}
+	},
+}
+
+var motor_file_help = []cli.Help{
+	{"[file]", "motor configuration file (default " + motor_file + ")"},
+}
+
+var motor_save = cli.Leaf{
+	Descr: "save the lidar motor models and supply voltages",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		filename := motor_file
+		if len(args) == 1 {
+			filename = args[0]
+		}
+		err := app.save_motor(filename)
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
+var motor_load = cli.Leaf{
+	Descr: "load the lidar motor models and supply voltages",
+	F: func(c *cli.CLI, args []string) {
+		app := c.User.(*slam)
+		if len(args) > 1 {
+			c.Put("bad number of arguments\n")
+			return
+		}
+		filename := motor_file
+		if len(args) == 1 {
+			filename = args[0]
+		}
+		err := app.load_motor(filename)
+		if err != nil {
+			c.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
+// motor submenu items
+var motor_menu = cli.Menu{
+	{"characterize", motor_characterize, motor_characterize_help},
+	{"load", motor_load, motor_file_help},
+	{"model", motor_model},
+	{"save", motor_save, motor_file_help},
+	{"vbat", motor_vbat, motor_vbat_help},
+}
+
 //-----------------------------------------------------------------------------
 
 // root menu
 var menu_root = cli.Menu{
 	{"exit", cmd_exit},
+	{"feature", feature_menu, "feature functions"},
 	{"help", cmd_help},
 	{"history", cmd_history, cli.HistoryHelp},
+	{"landmark", landmark_menu, "landmark functions"},
 	{"lidar", lidar_menu, "lidar functions"},
+	{"motor", motor_menu, "motor functions"},
+	{"pid", pid_menu, "pid functions"},
 	{"pwm", pwm_menu, "pwm functions"},
 }
 
 //-----------------------------------------------------------------------------
 
 type slam struct {
-	lidar *lidar.LIDAR
-	motor *motor.Motor
+	lidars    []*lidar_dev        // lidar devices
+	lidar     lidar.Driver        // selected lidar device
+	motor     *motor.Motor        // motor of the selected lidar device (nil if none)
+	merger    *lidar.Merger       // merged scans of all lidar devices
+	landmarks *landmark.Landmarks // landmarks seen by the first lidar device
 }
 
 func NewSlam() *slam {
@@ -131,14 +1211,401 @@ func NewSlam() *slam {
 	return &app
 }
 
+// find returns the named lidar device, or nil if there is none.
+func (app *slam) find(name string) *lidar_dev {
+	for _, l := range app.lidars {
+		if l.cfg.name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// use selects the lidar device used by the lidar commands.
+func (app *slam) use(name string) error {
+	l := app.find(name)
+	if l == nil {
+		return fmt.Errorf("unknown lidar \"%s\"", name)
+	}
+	app.lidar = l.drv
+	app.motor = l.motor
+	return nil
+}
+
+// selected returns the selected lidar, or all lidars for an "all" argument.
+func (app *slam) selected(c *cli.CLI, args []string) []lidar.Driver {
+	if len(args) == 0 {
+		return []lidar.Driver{app.lidar}
+	}
+	if len(args) != 1 || args[0] != "all" {
+		c.Put("bad arguments\n")
+		return nil
+	}
+	drv := make([]lidar.Driver, len(app.lidars))
+	for i, l := range app.lidars {
+		drv[i] = l.drv
+	}
+	return drv
+}
+
+// next_scan waits for the next scan from the selected lidar.
+// The caller must release the scan.
+func (app *slam) next_scan(c *cli.CLI, name string) *lidar.Scan2D {
+	scans := app.lidar.Subscribe(name, lidar.LatestWins, 1)
+	defer scans.Unsubscribe()
+	select {
+	case scan := <-scans.C:
+		return scan
+	case <-time.After(2 * time.Second):
+		c.Put("no scan\n")
+		return nil
+	}
+}
+
+// xv11 returns the xv11 lidar, or nil if the lidar is not an xv11.
+func (app *slam) xv11(c *cli.CLI) *lidar.LIDAR {
+	l, ok := app.lidar.(*lidar.LIDAR)
+	if !ok {
+		c.Put("not supported for this lidar type\n")
+		return nil
+	}
+	return l
+}
+
+// default pid configuration file
+const pid_file = "pid.json"
+
+// save_pid saves the pid configuration of each xv11 lidar to a file.
+// Configurations in the file for other lidars are kept.
+func (app *slam) save_pid(filename string) error {
+	cfg, err := pid.Load(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		cfg = make(map[string]pid.Config)
+	}
+	for _, l := range app.lidars {
+		if x, ok := l.drv.(*lidar.LIDAR); ok {
+			cfg[l.cfg.name] = x.PIDConfig()
+		}
+	}
+	return pid.Save(filename, cfg)
+}
+
+// load_pid sets the pid configuration of each xv11 lidar from a file.
+func (app *slam) load_pid(filename string) error {
+	cfg, err := pid.Load(filename)
+	if err != nil {
+		return err
+	}
+	for _, l := range app.lidars {
+		x, ok := l.drv.(*lidar.LIDAR)
+		if !ok {
+			continue
+		}
+		if c, ok := cfg[l.cfg.name]; ok {
+			err := x.SetPIDConfig(c)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// default motor configuration file
+const motor_file = "motor.json"
+
+// save_motor saves the model and supply voltage of each lidar motor to a file.
+// Configurations in the file for other lidars are kept.
+func (app *slam) save_motor(filename string) error {
+	cfg, err := motor.Load(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		cfg = make(map[string]motor.Config)
+	}
+	for _, l := range app.lidars {
+		if l.motor != nil {
+			cfg[l.cfg.name] = l.motor.Config()
+		}
+	}
+	return motor.Save(filename, cfg)
+}
+
+// load_motor sets the model and supply voltage of each lidar motor from a file.
+func (app *slam) load_motor(filename string) error {
+	cfg, err := motor.Load(filename)
+	if err != nil {
+		return err
+	}
+	for _, l := range app.lidars {
+		if l.motor == nil {
+			continue
+		}
+		if c, ok := cfg[l.cfg.name]; ok {
+			err := l.motor.SetConfig(c)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (app *slam) Put(s string) {
 	fmt.Printf("%s", s)
 }
 
 //-----------------------------------------------------------------------------
 
+// lidar_device is the configuration of a lidar device (see config_*.go).
+type lidar_device struct {
+	name      string
+	kind      string  // xv11, rplidar, ydlidar-x4, ydlidar-x2, hokuyo
+	port      string  // serial port or "host:port" ("" for the default port of the type)
+	pwm, stby string  // motor driver pins ("" for no motor)
+	x, y, yaw float64 // mounting position (meters) and zero angle (degrees)
+	cw        bool    // lidar angles increase clockwise
+	express   bool    // rplidar: use express scan mode
+	polled    bool    // hokuyo: use single scans (GD/GS) rather than continuous scans (MD/MS)
+	encoding  int     // hokuyo: characters per range value (2 or 3, 0 for the default)
+}
+
+// extrinsics returns the mounting of the device in the robot frame.
+func (d *lidar_device) extrinsics() lidar.Extrinsics {
+	return lidar.Extrinsics{
+		X:   d.x,
+		Y:   d.y,
+		Yaw: d.yaw * math.Pi / 180.0,
+		CW:  d.cw,
+	}
+}
+
+// default_port returns the default port for a lidar type.
+func default_port(kind string) string {
+	switch kind {
+	case "xv11":
+		return xv11_serial
+	case "rplidar":
+		return rplidar_serial
+	case "ydlidar-x4", "ydlidar-x2":
+		return ydlidar_serial
+	case "hokuyo":
+		return hokuyo_addr
+	}
+	return ""
+}
+
+// lidar_options are the command line options for the lidar devices.
+type lidar_options struct {
+	replay    string      // recording to replay
+	speed     float64     // replay speed
+	xv11sim   bool        // simulate xv11 devices
+	scipsim   bool        // simulate hokuyo devices
+	simformat string      // xv11 simulator frame format
+	room      *lidar.Room // simulated room with the robot at (X, Y)
+}
+
+// lidar_dev is an open lidar device with its motor and simulator.
+type lidar_dev struct {
+	cfg   lidar_device
+	drv   lidar.Driver
+	pwm   *gpio.PWM
+	stby  *gpio.Output
+	motor *motor.Motor
+	sim   *lidar.XV11Sim
+	ln    net.Listener
+}
+
+// new_lidar creates and opens a lidar device.
+func new_lidar(g *gpio.GPIO, cfg *lidar_device, opt *lidar_options) (*lidar_dev, error) {
+	if opt.replay != "" && cfg.kind != "xv11" {
+		return nil, fmt.Errorf("%s: %s lidars can't replay a recording", cfg.name, cfg.kind)
+	}
+	l := &lidar_dev{cfg: *cfg}
+	if l.cfg.port == "" {
+		l.cfg.port = default_port(l.cfg.kind)
+	}
+	port := l.cfg.port
+	mount := l.cfg.extrinsics()
+	err := l.open_motor(g)
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+
+	switch l.cfg.kind {
+	case "xv11":
+		if l.motor == nil {
+			l.close()
+			return nil, fmt.Errorf("%s: xv11 lidar needs a motor", l.cfg.name)
+		}
+		if opt.replay != "" {
+			// no serial port needed for replay
+			port = ""
+		} else if opt.xv11sim {
+			l.sim, err = lidar.NewXV11Sim(l.cfg.name+"_sim", opt.room.Mount(mount), l.pwm.Get)
+			if err != nil {
+				l.close()
+				return nil, fmt.Errorf("%s: unable to create xv11 simulator", l.cfg.name)
+			}
+			l.sim.Format, err = lidar.ParseXV11Format(opt.simformat)
+			if err != nil {
+				l.close()
+				return nil, err
+			}
+			port = l.sim.PortName
+		}
+		x, err := lidar.NewLIDAR(l.cfg.name, port, l.motor)
+		if err != nil {
+			l.close()
+			return nil, fmt.Errorf("%s: unable to create xv11 lidar", l.cfg.name)
+		}
+		l.drv = x
+		if opt.replay != "" {
+			err := x.Replay(opt.replay, opt.speed)
+			if err != nil {
+				l.close()
+				return nil, fmt.Errorf("%s: unable to replay lidar recording", l.cfg.name)
+			}
+		}
+	case "rplidar":
+		x, err := lidar.NewRPLIDAR(l.cfg.name, port, l.motor)
+		if err != nil {
+			l.close()
+			return nil, fmt.Errorf("%s: unable to create rplidar lidar", l.cfg.name)
+		}
+		x.Express = l.cfg.express
+		l.drv = x
+	case "hokuyo":
+		if opt.scipsim {
+			l.ln, err = lidar.NewSCIPStandIn(l.cfg.name+"_sim", opt.room.Mount(mount)).ListenAndServe("localhost:0")
+			if err != nil {
+				l.close()
+				return nil, fmt.Errorf("%s: unable to create hokuyo stand-in", l.cfg.name)
+			}
+			port = l.ln.Addr().String()
+		}
+		x, err := lidar.NewHokuyo(l.cfg.name, port)
+		if err != nil {
+			l.close()
+			return nil, fmt.Errorf("%s: unable to create hokuyo lidar", l.cfg.name)
+		}
+		x.Polled = l.cfg.polled
+		if l.cfg.encoding != 0 {
+			x.Encoding = l.cfg.encoding
+		}
+		l.drv = x
+	case "ydlidar-x4", "ydlidar-x2":
+		model := lidar.YDLIDAR_X4
+		if l.cfg.kind == "ydlidar-x2" {
+			model = lidar.YDLIDAR_X2
+		}
+		l.drv, err = lidar.NewYDLIDAR(l.cfg.name, port, model, l.motor)
+		if err != nil {
+			l.close()
+			return nil, fmt.Errorf("%s: unable to create ydlidar lidar", l.cfg.name)
+		}
+	default:
+		l.close()
+		return nil, fmt.Errorf("%s: unknown lidar type \"%s\"", l.cfg.name, l.cfg.kind)
+	}
+
+	l.drv.SetExtrinsics(mount)
+	err = l.drv.Open()
+	if err != nil {
+		l.drv = nil
+		l.close()
+		return nil, fmt.Errorf("%s: unable to open lidar device", l.cfg.name)
+	}
+	return l, nil
+}
+
+// open_motor sets up the motor driver of a lidar device (if it has one).
+func (l *lidar_dev) open_motor(g *gpio.GPIO) error {
+	if l.cfg.pwm == "" {
+		return nil
+	}
+	var err error
+	// pwm output for motor control
+	l.pwm, err = g.NewPWM(l.cfg.pwm, 0)
+	if err != nil {
+		return fmt.Errorf("%s: unable to create pwm output", l.cfg.name)
+	}
+	// standby (on/off) control for motor driver
+	l.stby, err = g.NewOutput(l.cfg.stby, 0)
+	if err != nil {
+		return fmt.Errorf("%s: unable to create gpio output", l.cfg.name)
+	}
+	l.motor, err = motor.NewMotor(l.cfg.name+"_motor", l.pwm, l.stby)
+	if err != nil {
+		return fmt.Errorf("%s: unable to create motor control", l.cfg.name)
+	}
+	return nil
+}
+
+// close a lidar device.
+func (l *lidar_dev) close() {
+	if l.drv != nil {
+		l.drv.Close()
+	}
+	if l.sim != nil {
+		l.sim.Close()
+	}
+	if l.ln != nil {
+		l.ln.Close()
+	}
+	if l.motor != nil {
+		l.motor.Close()
+	}
+	if l.stby != nil {
+		l.stby.Close()
+	}
+	if l.pwm != nil {
+		l.pwm.Close()
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// parse a "w,h,x,y" room specification for the xv11 simulator
+func parse_room(spec string) (*lidar.Room, error) {
+	x := strings.Split(spec, ",")
+	if len(x) != 4 {
+		return nil, fmt.Errorf("bad room specification \"%s\"", spec)
+	}
+	var v [4]float64
+	for i := range v {
+		var err error
+		v[i], err = strconv.ParseFloat(x[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad room specification \"%s\"", spec)
+		}
+	}
+	return lidar.NewRoom(v[0], v[1], v[2], v[3])
+}
+
+//-----------------------------------------------------------------------------
+
 func main() {
 
+	lidar_type := flag.String("lidar", "", "use a single lidar of this type (xv11, rplidar, ydlidar-x4, ydlidar-x2, hokuyo) instead of the configured devices")
+	replay := flag.String("replay", "", "replay a lidar recording instead of using the serial port (first device, xv11 only)")
+	speed := flag.Float64("speed", 1.0, "lidar replay speed (0 for single step)")
+	xv11sim := flag.Bool("xv11sim", false, "use a simulated xv11 lidar on a pseudo-terminal")
+	room := flag.String("room", "5,4,2,1.5", "simulator room as \"width,height,x,y\" in meters (x,y is the robot position)")
+	simformat := flag.String("simformat", "v2.4", "simulator frame format (v2.4, v2.1)")
+	scipsim := flag.Bool("scipsim", false, "use a stand-in hokuyo lidar on a local tcp socket")
+	flag.Parse()
+
+	// running as slamx-xv11sim (a link to slamx) is the same as -xv11sim
+	if filepath.Base(os.Args[0]) == "slamx-xv11sim" {
+		*xv11sim = true
+	}
+
 	// open the logfile
 	logfile, err := os.OpenFile("slamx.log", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
@@ -158,43 +1625,80 @@ func main() {
 	}
 	defer gpio.Close()
 
-	// pwm output for motor control
-	pwm, err := gpio.NewPWM(xv11_pwm, 0)
-	if err != nil {
-		log.Fatal("unable to create pwm output")
+	// simulation options
+	opt := &lidar_options{
+		replay:    *replay,
+		speed:     *speed,
+		xv11sim:   *xv11sim,
+		scipsim:   *scipsim,
+		simformat: *simformat,
 	}
-	defer pwm.Close()
-
-	// standby (on/off) control for motor driver
-	stby, err := gpio.NewOutput(xv11_stby, 0)
-	if err != nil {
-		log.Fatal("unable to create gpio output")
+	if *xv11sim || *scipsim {
+		opt.room, err = parse_room(*room)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	defer stby.Close()
 
-	// setup the driver for the lidar motor
-	motor, err := motor.NewMotor("motor0", pwm, stby)
-	if err != nil {
-		log.Fatal("unable to create motor control")
+	// setup the lidar devices
+	devices := lidar_devices
+	if *lidar_type != "" {
+		// a single lidar of the given type with the first device pins and mounting
+		d := lidar_devices[0]
+		d.kind = *lidar_type
+		d.port = ""
+		devices = []lidar_device{d}
 	}
-	defer motor.Close()
+	app.merger = lidar.NewMerger("merger")
+	for i := range devices {
+		l, err := new_lidar(gpio, &devices[i], opt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer l.close()
+		app.lidars = append(app.lidars, l)
+		app.merger.Add(l.cfg.name, l.drv)
+		// only the first device replays a recording
+		opt.replay = ""
+	}
+	app.use(app.lidars[0].cfg.name)
+	app.landmarks = landmark.NewLandmarks("landmarks", app.lidars[0].drv)
 
-	// setup the xv11 lidar
-	lidar, err := lidar.NewLIDAR("lidar0", xv11_serial, motor)
-	if err != nil {
-		log.Fatal("unable to open lidar device")
+	// restore the saved pid and motor configurations
+	err = app.load_pid(pid_file)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to load pid configuration: %s", err)
+	}
+	err = app.load_motor(motor_file)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to load motor configuration: %s", err)
+	}
+	for _, l := range app.lidars {
+		if l.motor != nil {
+			// the feedforward compensates for this voltage, it's only right if it was set to match the supply
+			log.Printf("%s: motor supply %.2f V (not measured, set it with \"motor vbat\")", l.cfg.name, l.motor.Vbat())
+		}
 	}
-	defer lidar.Close()
-	app.lidar = lidar
 
 	// global quit channel for all goroutines
 	quit := make(chan bool)
 	// wait group to wait for child goroutine completion
 	wg := &sync.WaitGroup{}
 
-	// Start the LIDAR goroutine
-	wg.Add(1)
-	go app.lidar.Process(quit, wg)
+	// Start the simulator and LIDAR goroutines
+	for _, l := range app.lidars {
+		if l.sim != nil {
+			wg.Add(1)
+			go l.sim.Run(quit, wg)
+		}
+		wg.Add(1)
+		go l.drv.Process(quit, wg)
+	}
+
+	// Start the scan merger and landmark goroutines
+	wg.Add(2)
+	go app.merger.Run(quit, wg)
+	go app.landmarks.Run(quit, wg)
 
 	hpath := "history.txt"
 	c := cli.NewCLI(app)
@@ -202,12 +1706,7 @@ func main() {
 	c.SetRoot(menu_root)
 	c.SetPrompt("slamx> ")
 	for c.Running() {
-		select {
-		case scan := <-app.lidar.Scan:
-			_ = scan
-		default:
-			c.Run()
-		}
+		c.Run()
 	}
 	c.HistorySave(hpath)
 
@@ -0,0 +1,314 @@
+//-----------------------------------------------------------------------------
+/*
+
+Motor Characterisation
+
+A sweep steps the motor duty cycle from From to To and waits for the rpm to
+settle at each step. The rpm is steady when the means over the last two
+Window periods differ by less than Tolerance (or the rpm standard deviation
+if that's larger). A step that isn't steady after StepTimeout is recorded but
+isn't used for the fits. The sweep ends early if the rpm exceeds the limit.
+
+Static Gain:
+The steady state rpm of the steps is fitted by least squares to a line in the
+motor voltage (duty * vbat). The gain is the slope, and the deadband is the
+voltage where the line crosses zero rpm. Steps below SWEEP_MIN_RPM are in the
+deadband and are left out.
+
+Dynamics:
+Each step between two steady states is a step response. The two point method
+(Smith) finds the times t1 and t2 when the response has made 28.3% and 63.2%
+of the change:
+
+tau = 1.5 * (t2 - t1)
+delay = t2 - tau
+
+The first step starts from an unknown state, so it isn't used, nor are steps
+with a change that's small compared to the rpm noise. The time constant and
+dead time are averaged over the remaining steps.
+
+*/
+//-----------------------------------------------------------------------------
+
+package motor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+const SWEEP_FROM = 0.15                     // default start duty cycle
+const SWEEP_TO = 0.45                       // default end duty cycle
+const SWEEP_DELTA = 0.05                    // default duty cycle step
+const SWEEP_SETTLE = 2 * time.Second        // minimum time at each step
+const SWEEP_WINDOW = time.Second            // steady state averaging window
+const SWEEP_TOLERANCE = 2.0                 // steady state rpm tolerance
+const SWEEP_STEP_TIMEOUT = 15 * time.Second // maximum time at each step
+const SWEEP_MIN_RPM = 10.0                  // steps below this rpm are in the deadband
+const SWEEP_MIN_CHANGE = 5.0                // minimum step response change (rpm standard deviations)
+
+// Sample is an rpm measurement.
+type Sample struct {
+	T   time.Duration // time since the start of the step
+	RPM float32
+}
+
+// Step is the response to a duty cycle step.
+type Step struct {
+	Duty    float32  // duty cycle
+	Mean    float32  // mean rpm over the last window
+	Stddev  float32  // rpm standard deviation over the last window
+	Steady  bool     // the rpm reached a steady state
+	Samples []Sample // step response
+}
+
+// Sweep is a motor characterisation experiment.
+type Sweep struct {
+	From, To    float32       // duty cycle range
+	Delta       float32       // duty cycle step
+	Vbat        float32       // motor supply voltage
+	Limit       float32       // end the sweep if the rpm exceeds this
+	Settle      time.Duration // minimum time at each step
+	Window      time.Duration // steady state averaging window
+	Tolerance   float32       // steady state rpm tolerance
+	StepTimeout time.Duration // maximum time at each step
+
+	steps     []Step    // steps so far
+	t0        time.Time // start time of the current step
+	overspeed bool      // the sweep was ended by an overspeed
+}
+
+// NewSweep returns a motor characterisation experiment.
+func NewSweep(from, to, delta, vbat, limit float32) (*Sweep, error) {
+	if from < 0.0 || to > 1.0 || from >= to || delta <= 0.0 || vbat <= 0.0 || limit <= 0.0 {
+		return nil, errors.New("invalid sweep parameters")
+	}
+	return &Sweep{
+		From:        from,
+		To:          to,
+		Delta:       delta,
+		Vbat:        vbat,
+		Limit:       limit,
+		Settle:      SWEEP_SETTLE,
+		Window:      SWEEP_WINDOW,
+		Tolerance:   SWEEP_TOLERANCE,
+		StepTimeout: SWEEP_STEP_TIMEOUT,
+	}, nil
+}
+
+// Timeout returns the longest time the sweep can take.
+func (s *Sweep) Timeout() time.Duration {
+	n := int((s.To-s.From)/s.Delta) + 2
+	return time.Duration(n) * s.StepTimeout
+}
+
+// start a step
+func (s *Sweep) begin(now time.Time, duty, pv float32) {
+	s.t0 = now
+	s.steps = append(s.steps, Step{Duty: duty, Samples: []Sample{{0, pv}}})
+}
+
+// Update the sweep with a process value (rpm), return the duty cycle.
+// When done is true the sweep is over.
+func (s *Sweep) Update(now time.Time, pv float32) (out float32, done bool, err error) {
+	if s.t0.IsZero() {
+		s.begin(now, s.From, pv)
+		return s.From, false, nil
+	}
+	if pv > s.Limit {
+		s.overspeed = true
+		return 0, true, nil
+	}
+	st := &s.steps[len(s.steps)-1]
+	t := now.Sub(s.t0)
+	st.Samples = append(st.Samples, Sample{t, pv})
+	steady := s.steady(st, t)
+	if steady || t > s.StepTimeout {
+		st.Steady = steady
+		next := st.Duty + s.Delta
+		if next > s.To+1e-4 {
+			return st.Duty, true, nil
+		}
+		s.begin(now, next, pv)
+		return next, false, nil
+	}
+	return st.Duty, false, nil
+}
+
+// mean and standard deviation of the samples in the (from, to] time window
+func window_stats(samples []Sample, from, to time.Duration) (mean, stddev float32, n int) {
+	var sum, sum2 float64
+	for _, x := range samples {
+		if x.T > from && x.T <= to {
+			y := float64(x.RPM)
+			sum += y
+			sum2 += y * y
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0, 0
+	}
+	m := sum / float64(n)
+	v := math.Max(sum2/float64(n)-m*m, 0)
+	return float32(m), float32(math.Sqrt(v)), n
+}
+
+// steady returns true if the step has reached a steady state.
+// It sets the mean and standard deviation of the step over the last window.
+func (s *Sweep) steady(st *Step, t time.Duration) bool {
+	m1, sd, n1 := window_stats(st.Samples, t-s.Window, t)
+	m0, _, n0 := window_stats(st.Samples, t-2*s.Window, t-s.Window)
+	st.Mean, st.Stddev = m1, sd
+	if t < s.Settle || t < 2*s.Window || n0 == 0 || n1 < 2 {
+		return false
+	}
+	tol := s.Tolerance
+	if sd > tol {
+		tol = sd
+	}
+	return math.Abs(float64(m1-m0)) < float64(tol)
+}
+
+//-----------------------------------------------------------------------------
+
+// Characterization is the result of a sweep.
+type Characterization struct {
+	Vbat      float32 // motor supply voltage
+	Steps     []Step  // step responses
+	Model     Model   // fitted model
+	Responses int     // step responses used to fit the dynamics
+	Overspeed bool    // the sweep was ended by an overspeed
+}
+
+func (c *Characterization) String() string {
+	s := fmt.Sprintf("%d steps, %d responses, %s", len(c.Steps), c.Responses, &c.Model)
+	if c.Overspeed {
+		s += " (ended by overspeed)"
+	}
+	return s
+}
+
+// time at which a step response makes a fraction of the change dy from y0
+func crossing(samples []Sample, y0, dy, frac float32) (float64, bool) {
+	fPrev, tPrev := float32(0), 0.0
+	for i, x := range samples {
+		f := (x.RPM - y0) / dy
+		t := x.T.Seconds()
+		if f >= frac {
+			if i == 0 {
+				return t, true
+			}
+			return tPrev + float64((frac-fPrev)/(f-fPrev))*(t-tPrev), true
+		}
+		fPrev, tPrev = f, t
+	}
+	return 0, false
+}
+
+// Result fits the model to the sweep.
+func (s *Sweep) Result() (*Characterization, error) {
+	c := &Characterization{
+		Vbat:      s.Vbat,
+		Steps:     s.steps,
+		Overspeed: s.overspeed,
+	}
+
+	// static gain: least squares line of rpm against voltage
+	var n, sx, sy, sxx, sxy float64
+	for i := range s.steps {
+		st := &s.steps[i]
+		if !st.Steady || st.Mean < SWEEP_MIN_RPM {
+			continue
+		}
+		x := float64(st.Duty * s.Vbat)
+		y := float64(st.Mean)
+		n++
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	d := n*sxx - sx*sx
+	if n < 2 || d <= 0 {
+		return c, errors.New("not enough steady steps above the deadband")
+	}
+	a := (n*sxy - sx*sy) / d
+	b := (sy - a*sx) / n
+	if a <= 0 {
+		return c, errors.New("the rpm doesn't increase with the duty cycle")
+	}
+	c.Model.Gain = float32(a)
+	c.Model.Deadband = float32(math.Max(-b/a, 0))
+
+	// dynamics: two point method on the step responses
+	var tau, delay float64
+	for i := 1; i < len(s.steps); i++ {
+		prev, st := &s.steps[i-1], &s.steps[i]
+		if !prev.Steady || !st.Steady {
+			continue
+		}
+		dy := st.Mean - prev.Mean
+		noise := prev.Stddev
+		if st.Stddev > noise {
+			noise = st.Stddev
+		}
+		if math.Abs(float64(dy)) < math.Max(float64(SWEEP_MIN_CHANGE*noise), float64(s.Tolerance)) {
+			continue
+		}
+		t1, ok1 := crossing(st.Samples, prev.Mean, dy, 0.283)
+		t2, ok2 := crossing(st.Samples, prev.Mean, dy, 0.632)
+		if !ok1 || !ok2 || t2 <= t1 {
+			continue
+		}
+		x := 1.5 * (t2 - t1)
+		tau += x
+		delay += math.Max(t2-x, 0)
+		c.Responses++
+	}
+	if c.Responses != 0 {
+		c.Model.Tau = float32(tau / float64(c.Responses))
+		c.Model.Delay = float32(delay / float64(c.Responses))
+	}
+	return c, nil
+}
+
+//-----------------------------------------------------------------------------
+
+// WriteCSV writes the characterisation as comma separated values.
+//
+// model,gain,deadband,tau,delay,vbat
+// step,duty,volts,mean_rpm,stddev_rpm,steady,model_rpm
+// sample,duty,t,rpm
+func (c *Characterization) WriteCSV(w io.Writer) error {
+	m := &c.Model
+	_, err := fmt.Fprintf(w, "model,%g,%g,%g,%g,%g\n", m.Gain, m.Deadband, m.Tau, m.Delay, c.Vbat)
+	if err != nil {
+		return err
+	}
+	for i := range c.Steps {
+		st := &c.Steps[i]
+		_, err := fmt.Fprintf(w, "step,%g,%g,%g,%g,%t,%g\n",
+			st.Duty, st.Duty*c.Vbat, st.Mean, st.Stddev, st.Steady, m.RPM(st.Duty, c.Vbat))
+		if err != nil {
+			return err
+		}
+	}
+	for i := range c.Steps {
+		st := &c.Steps[i]
+		for _, x := range st.Samples {
+			_, err := fmt.Fprintf(w, "sample,%g,%g,%g\n", st.Duty, x.T.Seconds(), x.RPM)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
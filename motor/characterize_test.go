@@ -0,0 +1,107 @@
+//-----------------------------------------------------------------------------
+/*
+
+Motor Characterisation Tests
+
+The sweep is run on a simulated motor with a known model.
+
+*/
+//-----------------------------------------------------------------------------
+
+package motor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// sim_motor is a motor with FOPDT dynamics
+type sim_motor struct {
+	m     Model
+	vbat  float32
+	dt    float64   // simulation time step (seconds)
+	rpm   float64   // current rpm
+	delay []float32 // duty cycles in the dead time
+}
+
+// step the motor with a duty cycle, return the rpm
+func (s *sim_motor) step(duty float32) float64 {
+	s.delay = append(s.delay, duty)
+	duty = s.delay[0]
+	s.delay = s.delay[1:]
+	ss := float64(s.m.RPM(duty, s.vbat))
+	s.rpm += (ss - s.rpm) * s.dt / float64(s.m.Tau)
+	return s.rpm
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_Characterize(t *testing.T) {
+	want := Model{Gain: 100, Deadband: 0.8, Tau: 0.4, Delay: 0.1}
+	dt := 0.001
+	sim := &sim_motor{m: want, vbat: 7.2, dt: dt, delay: make([]float32, int(float64(want.Delay)/dt))}
+	s, err := NewSweep(0.2, 0.5, 0.05, 7.2, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var duty float32
+	rpm := 0.0
+	done := false
+	// update the sweep every 20 ms
+	for i := 0; !done; i++ {
+		if i%20 == 0 {
+			duty, done, err = s.Update(t0.Add(time.Duration(i)*time.Millisecond), float32(rpm))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		rpm = sim.step(duty)
+		if i > int(s.Timeout()/time.Millisecond) {
+			t.Fatal("sweep timeout")
+		}
+	}
+	c, err := s.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := c.Model
+	if !near(float64(m.Gain), float64(want.Gain), 2.0) || !near(float64(m.Deadband), float64(want.Deadband), 0.05) {
+		t.Errorf("static model %s, expected %s", &m, &want)
+	}
+	// the 20 ms sampling limits the accuracy of the dynamics
+	if !near(float64(m.Tau), float64(want.Tau), 0.05) || !near(float64(m.Delay), float64(want.Delay), 0.05) {
+		t.Errorf("dynamics %s, expected %s", &m, &want)
+	}
+	if c.Responses != len(c.Steps)-1 || c.Overspeed {
+		t.Errorf("%d responses for %d steps, overspeed %t", c.Responses, len(c.Steps), c.Overspeed)
+	}
+	var buf bytes.Buffer
+	err = c.WriteCSV(&buf)
+	if err != nil || !strings.HasPrefix(buf.String(), "model,") {
+		t.Errorf("csv report: %v", err)
+	}
+}
+
+func Test_Characterize_Overspeed(t *testing.T) {
+	s, err := NewSweep(0.2, 0.5, 0.05, 7.2, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s.Update(now, 0)
+	duty, done, _ := s.Update(now.Add(time.Second), 150)
+	if !done || duty != 0 {
+		t.Errorf("overspeed: duty %f done %t", duty, done)
+	}
+	c, _ := s.Result()
+	if !c.Overspeed {
+		t.Error("overspeed not reported")
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,95 @@
+//-----------------------------------------------------------------------------
+/*
+
+Motor Configuration
+
+The speed model and supply voltage of a motor as a value that can be saved to
+and loaded from a JSON file, so a measured model survives restarts. A file
+holds the configurations of several named motors, like the PID configuration
+file (see pid/config.go). Values missing from the file take the defaults.
+
+The supply voltage isn't measured, it's whatever was set with SetVbat. It
+must match the actual motor supply for the model to give the right duty cycle.
+
+*/
+//-----------------------------------------------------------------------------
+
+package motor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+//-----------------------------------------------------------------------------
+
+// Config is the configuration of a motor.
+type Config struct {
+	Model Model   `json:"model"` // speed model
+	Vbat  float32 `json:"vbat"`  // motor supply voltage
+}
+
+// defaults for the values missing from a configuration file
+func defaultConfig() Config {
+	return Config{Model: DefaultModel(), Vbat: MOTOR_VBAT}
+}
+
+// Config returns the configuration of the motor.
+func (m *Motor) Config() Config {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return Config{Model: m.model, Vbat: m.vbat}
+}
+
+// SetConfig sets the configuration of the motor.
+func (m *Motor) SetConfig(c Config) error {
+	err := c.Model.check()
+	if err != nil {
+		return err
+	}
+	if c.Vbat <= 0.0 {
+		return fmt.Errorf("invalid motor supply voltage %.2f", c.Vbat)
+	}
+	m.lock.Lock()
+	m.model = c.Model
+	m.vbat = c.Vbat
+	m.lock.Unlock()
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+// Load reads named configurations from a JSON file.
+func Load(filename string) (map[string]Config, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]json.RawMessage)
+	err = json.Unmarshal(buf, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	cfg := make(map[string]Config)
+	for name, r := range raw {
+		c := defaultConfig()
+		err = json.Unmarshal(r, &c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", filename, name, err)
+		}
+		cfg[name] = c
+	}
+	return cfg, nil
+}
+
+// Save writes the named configurations to a JSON file.
+func Save(filename string, cfg map[string]Config) error {
+	buf, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(buf, '\n'), 0666)
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,138 @@
+//-----------------------------------------------------------------------------
+/*
+
+Motor Speed Model
+
+A static model of the steady state motor speed for a duty cycle. The motor
+sees a voltage v = duty * vbat from the motor supply. Below the deadband
+voltage it doesn't turn, above it the speed is linear in the voltage:
+
+rpm = gain * (v - deadband)
+
+Modelling the voltage rather than the duty cycle compensates for the battery
+voltage: as the battery runs down the same speed needs a larger duty cycle.
+
+The dynamics are modelled as first order plus dead time (FOPDT): after a
+step in the voltage the rpm doesn't move for the dead time, then approaches
+the new steady state with the time constant.
+
+The default model is from the XV11 notes: about 300 rpm at 3.11V, with no
+deadband and unknown dynamics. A measured model is better (see characterize.go).
+
+The supply voltage isn't measured. MOTOR_VBAT is an assumed default, so set
+the voltage of the actual motor supply and save it with the model (see
+config.go).
+
+*/
+//-----------------------------------------------------------------------------
+
+package motor
+
+import (
+	"errors"
+	"fmt"
+)
+
+//-----------------------------------------------------------------------------
+
+const MODEL_GAIN = 300.0 / 3.11 // default rpm per volt
+const MODEL_DEADBAND = 0.0      // default deadband (volts)
+const MOTOR_VBAT = 7.2          // default motor supply voltage (assumed, not measured)
+
+// Model is a static model of the motor speed.
+type Model struct {
+	Gain     float32 `json:"gain"`     // rpm per volt above the deadband
+	Deadband float32 `json:"deadband"` // voltage needed to start the motor (volts)
+	Tau      float32 `json:"tau"`      // time constant (seconds, 0 if unknown)
+	Delay    float32 `json:"delay"`    // dead time (seconds)
+}
+
+// DefaultModel returns the default motor model.
+func DefaultModel() Model {
+	return Model{Gain: MODEL_GAIN, Deadband: MODEL_DEADBAND}
+}
+
+func (m *Model) String() string {
+	s := fmt.Sprintf("%.2f rpm/V, deadband %.2f V", m.Gain, m.Deadband)
+	if m.Tau > 0.0 {
+		s += fmt.Sprintf(", tau %.3f s, delay %.3f s", m.Tau, m.Delay)
+	}
+	return s
+}
+
+// check the model parameters
+func (m *Model) check() error {
+	if m.Gain <= 0.0 || m.Deadband < 0.0 || m.Tau < 0.0 || m.Delay < 0.0 {
+		return fmt.Errorf("invalid motor model (%s)", m)
+	}
+	return nil
+}
+
+// RPM returns the steady state rpm for a duty cycle and supply voltage.
+func (m *Model) RPM(duty, vbat float32) float32 {
+	v := duty*vbat - m.Deadband
+	if v <= 0.0 {
+		return 0.0
+	}
+	return m.Gain * v
+}
+
+// Duty returns the duty cycle (0..1) for a steady state rpm and supply voltage.
+func (m *Model) Duty(rpm, vbat float32) float32 {
+	if rpm <= 0.0 || vbat <= 0.0 {
+		return 0.0
+	}
+	duty := (rpm/m.Gain + m.Deadband) / vbat
+	if duty > 1.0 {
+		return 1.0
+	}
+	return duty
+}
+
+//-----------------------------------------------------------------------------
+
+// Model returns the motor model.
+func (m *Motor) Model() Model {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.model
+}
+
+// SetModel sets the motor model.
+func (m *Motor) SetModel(x Model) error {
+	err := x.check()
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	m.model = x
+	m.lock.Unlock()
+	return nil
+}
+
+// Vbat returns the motor supply voltage.
+func (m *Motor) Vbat() float32 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.vbat
+}
+
+// SetVbat sets the motor supply voltage.
+func (m *Motor) SetVbat(v float32) error {
+	if v <= 0.0 {
+		return errors.New("invalid motor supply voltage")
+	}
+	m.lock.Lock()
+	m.vbat = v
+	m.lock.Unlock()
+	return nil
+}
+
+// Feedforward returns the model duty cycle for an rpm at the current supply voltage.
+func (m *Motor) Feedforward(rpm float32) float32 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.model.Duty(rpm, m.vbat)
+}
+
+//-----------------------------------------------------------------------------
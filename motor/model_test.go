@@ -0,0 +1,34 @@
+//-----------------------------------------------------------------------------
+/*
+
+Motor Model Tests
+
+*/
+//-----------------------------------------------------------------------------
+
+package motor
+
+import (
+	"math"
+	"testing"
+)
+
+//-----------------------------------------------------------------------------
+
+func near(a, b, tol float64) bool {
+	return math.Abs(a-b) <= tol
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_Model(t *testing.T) {
+	m := Model{Gain: 100, Deadband: 1.0}
+	if m.RPM(0.1, 8.0) != 0 || !near(float64(m.RPM(0.5, 8.0)), 300, 1e-3) {
+		t.Errorf("rpm %f %f", m.RPM(0.1, 8.0), m.RPM(0.5, 8.0))
+	}
+	if !near(float64(m.Duty(300, 8.0)), 0.5, 1e-6) || m.Duty(3000, 8.0) != 1.0 {
+		t.Errorf("duty %f %f", m.Duty(300, 8.0), m.Duty(3000, 8.0))
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -8,6 +8,8 @@ https://www.sparkfun.com/products/9457
 STBY turns the board on/off
 PWM controls the speed.
 The board is wired for CCW operation.
+
+The motor has a speed model (see model.go) for feedforward control.
 */
 //-----------------------------------------------------------------------------
 
@@ -15,6 +17,7 @@ package motor
 
 import (
 	"log"
+	"sync"
 
 	"github.com/deadsy/slamx/gpio"
 )
@@ -22,16 +25,21 @@ import (
 //-----------------------------------------------------------------------------
 
 type Motor struct {
-	Name string
-	pwm  *gpio.PWM
-	stby *gpio.Output
+	Name  string
+	pwm   *gpio.PWM
+	stby  *gpio.Output
+	lock  sync.Mutex // lock for access to the model and supply voltage
+	model Model      // speed model
+	vbat  float32    // motor supply voltage
 }
 
 func NewMotor(name string, pwm *gpio.PWM, stby *gpio.Output) (*Motor, error) {
 	m := Motor{
-		Name: name,
-		pwm:  pwm,
-		stby: stby,
+		Name:  name,
+		pwm:   pwm,
+		stby:  stby,
+		model: DefaultModel(),
+		vbat:  MOTOR_VBAT,
 	}
 	log.Printf("NewMotor() %s", m.Name)
 	m.stby.Set()
@@ -0,0 +1,216 @@
+//-----------------------------------------------------------------------------
+/*
+
+Relay Feedback PID Autotuning
+
+The Astrom-Hagglund relay experiment replaces the controller with a relay:
+the output is High while the process value is below the setpoint and Low
+while it's above. Most processes settle into a limit cycle at their ultimate
+period Pu. With a relay amplitude d = (High - Low) / 2 and a process value
+oscillation amplitude a, the ultimate gain is approximately:
+
+Ku = 4.d / (pi.a)
+
+The relay has hysteresis e around the setpoint to stop noise from chattering
+the output, which makes the estimate Ku = 4.d / (pi.sqrt(a^2 - e^2)).
+
+The first cycle is discarded (it includes the spin up), the rest are
+averaged. The experiment is aborted if the process value exceeds the limit.
+
+Tuning Rules:
+Ziegler-Nichols gives fast but oscillatory control. Tyreus-Luyben is more
+conservative, with less overshoot.
+
+*/
+//-----------------------------------------------------------------------------
+
+package pid
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// Rule is a tuning rule for the ultimate gain and period.
+type Rule int
+
+const (
+	ZieglerNichols   Rule = iota // Ziegler-Nichols PID
+	ZieglerNicholsPI             // Ziegler-Nichols PI
+	TyreusLuyben                 // Tyreus-Luyben PID
+	TyreusLuybenPI               // Tyreus-Luyben PI
+)
+
+var rule_names = map[Rule]string{
+	ZieglerNichols:   "zn",
+	ZieglerNicholsPI: "zn-pi",
+	TyreusLuyben:     "tl",
+	TyreusLuybenPI:   "tl-pi",
+}
+
+func (r Rule) String() string {
+	if s, ok := rule_names[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", int(r))
+}
+
+// ParseRule returns the tuning rule for a name (zn, zn-pi, tl, tl-pi).
+func ParseRule(name string) (Rule, error) {
+	for r, s := range rule_names {
+		if s == name {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown tuning rule \"%s\"", name)
+}
+
+//-----------------------------------------------------------------------------
+
+// Tuning is the result of a relay experiment.
+type Tuning struct {
+	Ku        float64       // ultimate gain
+	Pu        time.Duration // ultimate period
+	Amplitude float64       // process value oscillation amplitude
+	Cycles    int           // cycles measured (0 for a process model)
+}
+
+func (t *Tuning) String() string {
+	if t.Cycles == 0 {
+		// from a process model (see fopdt.go)
+		return fmt.Sprintf("Ku %.5f Pu %s (model)", t.Ku, t.Pu.Truncate(time.Millisecond))
+	}
+	return fmt.Sprintf("Ku %.5f Pu %s (amplitude %.2f, %d cycles)", t.Ku, t.Pu.Truncate(time.Millisecond), t.Amplitude, t.Cycles)
+}
+
+// Gains returns the (kp, ki, kd) gains for a tuning rule.
+// ki is per second and kd is in seconds, as expected by Init.
+func (t *Tuning) Gains(r Rule) (kp, ki, kd float32) {
+	ku, pu := t.Ku, t.Pu.Seconds()
+	var p, ti, td float64
+	switch r {
+	case ZieglerNichols:
+		p, ti, td = 0.6*ku, pu/2.0, pu/8.0
+	case ZieglerNicholsPI:
+		p, ti = 0.45*ku, pu/1.2
+	case TyreusLuyben:
+		p, ti, td = ku/2.2, 2.2*pu, pu/6.3
+	case TyreusLuybenPI:
+		p, ti = ku/3.2, 2.2*pu
+	}
+	kp = float32(p)
+	if ti > 0 {
+		ki = float32(p / ti)
+	}
+	kd = float32(p * td)
+	return
+}
+
+//-----------------------------------------------------------------------------
+
+const RELAY_HYSTERESIS = 3.0           // default process value hysteresis
+const RELAY_CYCLES = 5                 // default cycles to measure
+const RELAY_TIMEOUT = 60 * time.Second // default experiment timeout
+
+// Relay is a relay feedback experiment.
+type Relay struct {
+	Setpoint   float32       // process value setpoint
+	High, Low  float32       // relay outputs
+	Hysteresis float32       // process value hysteresis
+	Limit      float32       // abort if the process value exceeds this
+	Cycles     int           // cycles to measure (after the first)
+	Timeout    time.Duration // abort if the experiment takes longer than this
+
+	start    time.Time   // experiment start time
+	high     bool        // relay output state
+	switches []time.Time // times of the low to high switches
+	max, min float32     // process value extremes in the current cycle
+	amp      []float64   // process value amplitude of each cycle
+}
+
+// NewRelay returns a relay experiment.
+func NewRelay(sp, high, low, limit float32) (*Relay, error) {
+	if high <= low || limit <= sp {
+		return nil, errors.New("invalid relay parameters")
+	}
+	return &Relay{
+		Setpoint:   sp,
+		High:       high,
+		Low:        low,
+		Hysteresis: RELAY_HYSTERESIS,
+		Limit:      limit,
+		Cycles:     RELAY_CYCLES,
+		Timeout:    RELAY_TIMEOUT,
+	}, nil
+}
+
+// Update the relay with a process value, return the control value.
+// When done is true the experiment is over, and the tuning is valid if err is nil.
+func (r *Relay) Update(now time.Time, pv float32) (out float32, done bool, err error) {
+	if r.start.IsZero() {
+		r.start = now
+		r.high = true
+		r.max, r.min = pv, pv
+	}
+	if pv > r.Limit {
+		return r.Low, true, fmt.Errorf("process value %.1f exceeded the limit %.1f", pv, r.Limit)
+	}
+	if now.Sub(r.start) > r.Timeout {
+		return r.Low, true, fmt.Errorf("no limit cycle after %s", r.Timeout)
+	}
+	if pv > r.max {
+		r.max = pv
+	}
+	if pv < r.min {
+		r.min = pv
+	}
+	if r.high && pv > r.Setpoint+r.Hysteresis {
+		r.high = false
+	} else if !r.high && pv < r.Setpoint-r.Hysteresis {
+		// a low to high switch starts a new cycle
+		r.high = true
+		if len(r.switches) != 0 {
+			r.amp = append(r.amp, float64(r.max-r.min)/2.0)
+		}
+		r.switches = append(r.switches, now)
+		r.max, r.min = pv, pv
+	}
+	out = r.Low
+	if r.high {
+		out = r.High
+	}
+	// the first switch ends the spin up, the first cycle is discarded
+	return out, len(r.switches) >= r.Cycles+2, nil
+}
+
+// Tuning returns the ultimate gain and period measured by the experiment.
+func (r *Relay) Tuning() (*Tuning, error) {
+	n := len(r.switches) - 2
+	if n < 1 {
+		return nil, errors.New("not enough relay cycles")
+	}
+	// skip the first cycle
+	pu := r.switches[n+1].Sub(r.switches[1]) / time.Duration(n)
+	var a float64
+	for _, x := range r.amp[1:] {
+		a += x
+	}
+	a /= float64(len(r.amp) - 1)
+	e := float64(r.Hysteresis)
+	if a <= e {
+		return nil, errors.New("oscillation is within the hysteresis")
+	}
+	d := float64(r.High-r.Low) / 2.0
+	return &Tuning{
+		Ku:        4.0 * d / (math.Pi * math.Sqrt(a*a-e*e)),
+		Pu:        pu,
+		Amplitude: a,
+		Cycles:    n,
+	}, nil
+}
+
+//-----------------------------------------------------------------------------
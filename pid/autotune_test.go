@@ -0,0 +1,149 @@
+//-----------------------------------------------------------------------------
+/*
+
+Autotuning and Process Model Tests
+
+The relay experiment is run on a simulated FOPDT process, and the measured
+ultimate gain and period are compared with those of the model.
+
+*/
+//-----------------------------------------------------------------------------
+
+package pid
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// fopdt_plant simulates a first order plus dead time process.
+type fopdt_plant struct {
+	m     FOPDT
+	dt    float64   // simulation time step (seconds)
+	y     float64   // process value
+	delay []float64 // inputs in the dead time
+}
+
+func new_plant(m FOPDT, dt float64) *fopdt_plant {
+	return &fopdt_plant{
+		m:     m,
+		dt:    dt,
+		delay: make([]float64, int(math.Round(m.Delay/dt))),
+	}
+}
+
+// step the process with an input, return the process value
+func (p *fopdt_plant) step(u float64) float64 {
+	if len(p.delay) != 0 {
+		p.delay = append(p.delay, u)
+		u = p.delay[0]
+		p.delay = p.delay[1:]
+	}
+	p.y += (p.m.K*u - p.y) * p.dt / (p.m.Tau + p.dt)
+	return p.y
+}
+
+func near(a, b, tol float64) bool {
+	return math.Abs(a-b) <= tol
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_FOPDT_Ultimate(t *testing.T) {
+	tn, err := (&FOPDT{1, 1, 1}).Ultimate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// atan(w) + w = pi at w = 2.0288
+	if !near(tn.Ku, 2.262, 0.001) || !near(tn.Pu.Seconds(), 3.097, 0.001) {
+		t.Errorf("Ku %f Pu %s", tn.Ku, tn.Pu)
+	}
+	// the gain scales Ku, the time scale scales Pu
+	tn, err = (&FOPDT{2, 0.5, 0.5}).Ultimate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(tn.Ku, 2.262/2.0, 0.001) || !near(tn.Pu.Seconds(), 3.097/2.0, 0.001) {
+		t.Errorf("Ku %f Pu %s", tn.Ku, tn.Pu)
+	}
+	for _, m := range []FOPDT{{0, 1, 1}, {1, -1, 1}, {1, 1, 0}} {
+		if _, err := m.Ultimate(); err == nil {
+			t.Errorf("%+v: no error", m)
+		}
+	}
+}
+
+func Test_Tuning_Gains(t *testing.T) {
+	tn := &Tuning{Ku: 2.0, Pu: time.Second}
+	for _, x := range []struct {
+		rule       Rule
+		kp, ki, kd float64
+	}{
+		{ZieglerNichols, 1.2, 2.4, 0.15},
+		{ZieglerNicholsPI, 0.9, 1.08, 0},
+		{TyreusLuyben, 2.0 / 2.2, 2.0 / (2.2 * 2.2), 2.0 / (2.2 * 6.3)},
+		{TyreusLuybenPI, 2.0 / 3.2, 2.0 / (3.2 * 2.2), 0},
+	} {
+		kp, ki, kd := tn.Gains(x.rule)
+		if !near(float64(kp), x.kp, 1e-5) || !near(float64(ki), x.ki, 1e-5) || !near(float64(kd), x.kd, 1e-5) {
+			t.Errorf("%s: kp %f ki %f kd %f", x.rule, kp, ki, kd)
+		}
+	}
+}
+
+func Test_Relay(t *testing.T) {
+	m := FOPDT{1, 1, 1}
+	plant := new_plant(m, 0.001)
+	r, err := NewRelay(0.0, 1.0, -1.0, 10.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Hysteresis = 0.01
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	u, y := 0.0, 0.0
+	done := false
+	for i := 0; !done; i++ {
+		if i%10 == 0 {
+			var out float32
+			out, done, err = r.Update(t0.Add(time.Duration(i)*time.Millisecond), float32(y))
+			if err != nil {
+				t.Fatal(err)
+			}
+			u = float64(out)
+		}
+		y = plant.step(u)
+	}
+	tn, err := r.Tuning()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the relay estimate is a describing function approximation
+	want, _ := m.Ultimate()
+	if !near(tn.Ku, want.Ku, 0.15*want.Ku) || !near(tn.Pu.Seconds(), want.Pu.Seconds(), 0.1*want.Pu.Seconds()) {
+		t.Errorf("relay %s, model %s", tn, want)
+	}
+	if tn.Cycles != r.Cycles {
+		t.Errorf("%d cycles, expected %d", tn.Cycles, r.Cycles)
+	}
+}
+
+func Test_Relay_Limit(t *testing.T) {
+	r, err := NewRelay(1.0, 1.0, 0.0, 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	r.Update(now, 0.0)
+	out, done, err := r.Update(now.Add(time.Second), 2.0)
+	if !done || err == nil || out != r.Low {
+		t.Errorf("overspeed: out %f done %t err %v", out, done, err)
+	}
+	if _, err := NewRelay(1.0, 0.0, 1.0, 2.0); err == nil {
+		t.Error("high < low accepted")
+	}
+}
+
+//-----------------------------------------------------------------------------
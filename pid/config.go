@@ -0,0 +1,206 @@
+//-----------------------------------------------------------------------------
+/*
+
+PID Configuration
+
+The gains, limits, period and modes of a PID as a value that can be saved to
+and loaded from a JSON file, so tuned values survive restarts. A file holds the
+configurations of several named controllers.
+
+The period, gains and limits must be in the file, a configuration without
+them is rejected. The other values are optional and take the defaults of
+Init if they are missing.
+
+Manual/auto is an operating mode, not configuration, so it isn't saved.
+
+*/
+//-----------------------------------------------------------------------------
+
+package pid
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+//-----------------------------------------------------------------------------
+
+// Config is the configuration of a PID controller.
+type Config struct {
+	Period float32 `json:"period"` // update period (seconds)
+	Kp     float32 `json:"kp"`     // proportional gain
+	Ki     float32 `json:"ki"`     // integral gain (per second)
+	Kd     float32 `json:"kd"`     // derivative gain (seconds)
+	IMin   float32 `json:"imin"`   // min limit on the integral term
+	IMax   float32 `json:"imax"`   // max limit on the integral term
+	OMin   float32 `json:"omin"`   // min limit on the output
+	OMax   float32 `json:"omax"`   // max limit on the output
+
+	B      float32    `json:"b"`      // proportional setpoint weight
+	C      float32    `json:"c"`      // derivative setpoint weight
+	DMeas  bool       `json:"dmeas"`  // derivative on the measurement
+	Tf     float32    `json:"tf"`     // derivative filter time constant (seconds)
+	Windup AntiWindup `json:"windup"` // anti-windup method
+	Kt     float32    `json:"kt"`     // back-calculation tracking gain (per second)
+}
+
+// values that must be in a configuration file
+var required_config = []string{"period", "kp", "ki", "kd", "imin", "imax", "omin", "omax"}
+
+// defaults for the optional values missing from a configuration file
+func defaultConfig() Config {
+	return Config{B: 1.0, C: 1.0, Windup: WindupLimit}
+}
+
+// Config returns the configuration of the PID.
+func (p *PID) Config() Config {
+	var c Config
+	c.Period = p.Period()
+	c.Kp, c.Ki, c.Kd = p.Gains()
+	c.IMin, c.IMax, c.OMin, c.OMax = p.Limits()
+	c.B, c.C = p.Weights()
+	c.DMeas, c.Tf = p.Derivative()
+	c.Windup, c.Kt = p.AntiWindup()
+	return c
+}
+
+// SetConfig sets the configuration of the PID. The PID state is kept, so the
+// change is bumpless (see SetGains). The output range must not be empty.
+func (p *PID) SetConfig(c Config) error {
+	if c.Period <= 0.0 || c.Kp < 0.0 || c.Ki < 0.0 || c.Kd < 0.0 || c.IMin > c.IMax || c.OMin >= c.OMax ||
+		c.B < 0.0 || c.C < 0.0 || c.Tf < 0.0 || c.Kt < 0.0 || (c.Windup == WindupBackCalc && c.Kt == 0.0) {
+		return fmt.Errorf("invalid PID configuration %+v", c)
+	}
+	if _, ok := windup_names[c.Windup]; !ok {
+		return fmt.Errorf("unknown anti-windup method %d", int(c.Windup))
+	}
+	p.dt = c.Period
+	p.SetLimits(c.IMin, c.IMax, c.OMin, c.OMax)
+	p.SetWeights(c.B, c.C)
+	p.SetDerivative(c.DMeas, c.Tf)
+	p.SetAntiWindup(c.Windup, c.Kt)
+	return p.SetGains(c.Kp, c.Ki, c.Kd)
+}
+
+// Rows returns the configuration as (name, value) rows.
+func (c *Config) Rows() [][]string {
+	return [][]string{
+		{"period", fmt.Sprintf("%g s", c.Period)},
+		{"kp", fmt.Sprintf("%g", c.Kp)},
+		{"ki", fmt.Sprintf("%g", c.Ki)},
+		{"kd", fmt.Sprintf("%g", c.Kd)},
+		{"imin", fmt.Sprintf("%g", c.IMin)},
+		{"imax", fmt.Sprintf("%g", c.IMax)},
+		{"omin", fmt.Sprintf("%g", c.OMin)},
+		{"omax", fmt.Sprintf("%g", c.OMax)},
+		{"b", fmt.Sprintf("%g", c.B)},
+		{"c", fmt.Sprintf("%g", c.C)},
+		{"dmeas", fmt.Sprintf("%t", c.DMeas)},
+		{"tf", fmt.Sprintf("%g s", c.Tf)},
+		{"windup", c.Windup.String()},
+		{"kt", fmt.Sprintf("%g", c.Kt)},
+	}
+}
+
+// Set sets a configuration value by name.
+// Numeric values: kp, ki, kd, imin, imax, omin, omax, b, c, tf, kt.
+// dmeas is true or false, windup is limit, clamp or backcalc.
+func (c *Config) Set(name, s string) error {
+	switch name {
+	case "dmeas":
+		x, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("bad value \"%s\"", s)
+		}
+		c.DMeas = x
+		return nil
+	case "windup":
+		x, err := ParseAntiWindup(s)
+		if err != nil {
+			return err
+		}
+		c.Windup = x
+		return nil
+	}
+	x, err := strconv.ParseFloat(s, 32)
+	if err != nil {
+		return fmt.Errorf("bad value \"%s\"", s)
+	}
+	val := float32(x)
+	switch name {
+	case "kp":
+		c.Kp = val
+	case "ki":
+		c.Ki = val
+	case "kd":
+		c.Kd = val
+	case "imin":
+		c.IMin = val
+	case "imax":
+		c.IMax = val
+	case "omin":
+		c.OMin = val
+	case "omax":
+		c.OMax = val
+	case "b":
+		c.B = val
+	case "c":
+		c.C = val
+	case "tf":
+		c.Tf = val
+	case "kt":
+		c.Kt = val
+	default:
+		return fmt.Errorf("unknown PID parameter \"%s\"", name)
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+// Load returns the named configurations from a JSON file.
+// It's an error if a configuration is missing a required value.
+func Load(filename string) (map[string]Config, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]json.RawMessage)
+	err = json.Unmarshal(buf, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	cfg := make(map[string]Config)
+	for name, r := range raw {
+		keys := make(map[string]json.RawMessage)
+		err = json.Unmarshal(r, &keys)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", filename, name, err)
+		}
+		for _, k := range required_config {
+			if _, ok := keys[k]; !ok {
+				return nil, fmt.Errorf("%s: %s: missing \"%s\"", filename, name, k)
+			}
+		}
+		c := defaultConfig()
+		err = json.Unmarshal(r, &c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", filename, name, err)
+		}
+		cfg[name] = c
+	}
+	return cfg, nil
+}
+
+// Save writes the named configurations to a JSON file.
+func Save(filename string, cfg map[string]Config) error {
+	buf, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(buf, '\n'), 0666)
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,64 @@
+//-----------------------------------------------------------------------------
+/*
+
+First Order Plus Dead Time Models
+
+A FOPDT process model has the transfer function:
+
+G(s) = K.exp(-L.s) / (1 + T.s)
+
+Its ultimate gain and period are found where the phase is -180 degrees:
+
+atan(w.T) + w.L = pi
+Ku = sqrt(1 + (w.T)^2) / K
+Pu = 2.pi / w
+
+These are what a relay experiment measures, so the tuning rules for relay
+autotuning apply to a fitted model as well.
+
+*/
+//-----------------------------------------------------------------------------
+
+package pid
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+
+// FOPDT is a first order plus dead time process model.
+type FOPDT struct {
+	K     float64 // steady state gain (process value per unit of output)
+	Tau   float64 // time constant (seconds)
+	Delay float64 // dead time (seconds)
+}
+
+// Ultimate returns the ultimate gain and period of the model.
+func (m *FOPDT) Ultimate() (*Tuning, error) {
+	if m.K <= 0.0 || m.Tau < 0.0 {
+		return nil, errors.New("invalid process model")
+	}
+	if m.Delay <= 0.0 {
+		return nil, errors.New("a process model with no dead time has no ultimate gain")
+	}
+	// bisect for the phase crossover frequency, the phase is monotonic in w
+	lo, hi := 0.0, math.Pi/m.Delay
+	for i := 0; i < 64; i++ {
+		w := (lo + hi) / 2.0
+		if math.Atan(w*m.Tau)+w*m.Delay < math.Pi {
+			lo = w
+		} else {
+			hi = w
+		}
+	}
+	w := (lo + hi) / 2.0
+	return &Tuning{
+		Ku: math.Sqrt(1.0+w*w*m.Tau*m.Tau) / m.K,
+		Pu: time.Duration(2.0 * math.Pi / w * float64(time.Second)),
+	}, nil
+}
+
+//-----------------------------------------------------------------------------
@@ -1,29 +1,109 @@
 // Package pid provides a generic PID Controller.
 //
+// The controller has:
+// setpoint weighting: the proportional term acts on b.sp - pv and the
+// derivative term on c.sp - pv, or on -pv with derivative on measurement.
+// A first order low pass filter on the derivative term.
+// Selectable integral anti-windup (see AntiWindup).
+// Manual and auto modes with bumpless transfer.
+// A feedforward term added to the output, so the feedback terms only have to
+// correct the error of a process model.
+//
+// The defaults (b = c = 1, no filter, WindupLimit, auto) are the textbook
+// controller acting on the error.
+//
 // References:
 // https://en.wikipedia.org/wiki/PID_controller
+// Astrom & Murray, Feedback Systems, chapter 10.
 package pid
 
 import (
 	"errors"
+	"fmt"
 	"log"
 )
 
 //-----------------------------------------------------------------------------
 
+// AntiWindup is the method used to stop the integral term winding up while
+// the output is saturated.
+type AntiWindup int
+
+const (
+	WindupLimit    AntiWindup = iota // limit the integral term to iMin..iMax
+	WindupClamp                      // also stop integrating while the output is saturated
+	WindupBackCalc                   // also feed the output saturation back into the integral term
+)
+
+var windup_names = map[AntiWindup]string{
+	WindupLimit:    "limit",
+	WindupClamp:    "clamp",
+	WindupBackCalc: "backcalc",
+}
+
+func (a AntiWindup) String() string {
+	if s, ok := windup_names[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown(%d)", int(a))
+}
+
+// ParseAntiWindup returns the anti-windup method for a name (limit, clamp, backcalc).
+func ParseAntiWindup(name string) (AntiWindup, error) {
+	for a, s := range windup_names {
+		if s == name {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown anti-windup method \"%s\"", name)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (a AntiWindup) MarshalText() ([]byte, error) {
+	if _, ok := windup_names[a]; !ok {
+		return nil, fmt.Errorf("unknown anti-windup method %d", int(a))
+	}
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (a *AntiWindup) UnmarshalText(text []byte) error {
+	x, err := ParseAntiWindup(string(text))
+	if err != nil {
+		return err
+	}
+	*a = x
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
 // PID controller state.
 type PID struct {
-	kp     float32 // proportional constant
-	ki     float32 // integral constant
-	kd     float32 // derivative constant
-	iMax   float32 // max limit on iTerm
-	iMin   float32 // min limit on iTerm
-	oMax   float32 // max limit on output
-	oMin   float32 // min limit on output
-	sp     float32 // set point value (target)
-	evPrev float32 // previous error value
-	iTerm  float32 // integral sum
-	dFlag  bool    // avoid spiking the derivative term on the first update
+	dt     float32    // update period (seconds)
+	kp     float32    // proportional constant
+	ki     float32    // integral constant
+	kd     float32    // derivative constant
+	iMax   float32    // max limit on iTerm
+	iMin   float32    // min limit on iTerm
+	oMax   float32    // max limit on output
+	oMin   float32    // min limit on output
+	b      float32    // proportional setpoint weight
+	c      float32    // derivative setpoint weight
+	dOnPV  bool       // derivative on the measurement
+	tf     float32    // derivative filter time constant (seconds)
+	windup AntiWindup // anti-windup method
+	kt     float32    // back-calculation tracking constant
+	manual bool       // manual mode
+	mOut   float32    // manual mode output
+	sp     float32    // set point value (target)
+	ff     float32    // feedforward term
+	spPrev float32    // previous set point value
+	pvPrev float32    // previous process value
+	iTerm  float32    // integral sum
+	dTerm  float32    // filtered derivative term
+	out    float32    // previous output
+	dFlag  bool       // avoid spiking the derivative term on the first update
 }
 
 //-----------------------------------------------------------------------------
@@ -34,31 +114,48 @@ func (p *PID) Update(pv float32) float32 {
 	ev := p.sp - pv
 
 	// proportional
-	pTerm := p.kp * ev
+	pTerm := p.kp * (p.b*p.sp - pv)
+
+	// derivative
+	d := float32(0)
+	if p.dFlag {
+		d = p.kd * (p.dInput(p.sp, pv) - p.dInput(p.spPrev, p.pvPrev))
+	}
+	// avoid spiking the dTerm on the first update
+	p.dFlag = true
+	p.spPrev = p.sp
+	p.pvPrev = pv
+	if p.tf > 0.0 {
+		// first order low pass filter
+		p.dTerm += (p.dt / (p.tf + p.dt)) * (d - p.dTerm)
+	} else {
+		p.dTerm = d
+	}
+
+	if p.manual {
+		// track the manual output for a bumpless transfer to auto
+		p.iTerm = p.clampI(p.mOut - p.ff - pTerm - p.dTerm)
+		p.out = p.mOut
+		return p.out
+	}
 
 	// integral
 	if p.ki != 0.0 {
-		p.iTerm += p.ki * ev
 		// limit the integration sum
-		if p.iTerm > p.iMax {
-			p.iTerm = p.iMax
-		}
-		if p.iTerm < p.iMin {
-			p.iTerm = p.iMin
+		i := p.clampI(p.iTerm + p.ki*ev)
+		if p.windup == WindupClamp {
+			// don't integrate further into saturation
+			u := p.ff + pTerm + i + p.dTerm
+			if (u > p.oMax && ev > 0.0) || (u < p.oMin && ev < 0.0) {
+				i = p.iTerm
+			}
 		}
+		p.iTerm = i
 	}
 
-	// derivative
-	if !p.dFlag {
-		// avoid spiking the dTerm on the first update
-		p.evPrev = ev
-		p.dFlag = true
-	}
-	dTerm := p.kd * (ev - p.evPrev)
-	p.evPrev = ev
-
 	// calculate and limit the output
-	out := pTerm + p.iTerm + dTerm
+	u := p.ff + pTerm + p.iTerm + p.dTerm
+	out := u
 	if out > p.oMax {
 		out = p.oMax
 		log.Printf("limiting max pid output %f", out)
@@ -68,9 +165,23 @@ func (p *PID) Update(pv float32) float32 {
 		log.Printf("limiting min pid output %f", out)
 	}
 
+	if p.windup == WindupBackCalc && p.ki != 0.0 {
+		// bleed off the integral term while the output is saturated
+		p.iTerm = p.clampI(p.iTerm + p.kt*(out-u))
+	}
+
+	p.out = out
 	return out
 }
 
+// dInput returns the input to the derivative term.
+func (p *PID) dInput(sp, pv float32) float32 {
+	if p.dOnPV {
+		return -pv
+	}
+	return p.c*sp - pv
+}
+
 //-----------------------------------------------------------------------------
 
 // Set the PID setpoint value.
@@ -78,11 +189,25 @@ func (p *PID) Set(sp float32) {
 	p.sp = sp
 }
 
-// Reset the PID controller state.
+// SetFeedforward sets the feedforward term, which is added to the output.
+func (p *PID) SetFeedforward(ff float32) {
+	p.ff = ff
+}
+
+// Feedforward returns the feedforward term.
+func (p *PID) Feedforward() float32 {
+	return p.ff
+}
+
+// Reset the PID controller state. The mode and configuration are kept.
 func (p *PID) Reset() {
 	p.sp = 0
-	p.evPrev = 0
+	p.ff = 0
+	p.spPrev = 0
+	p.pvPrev = 0
 	p.iTerm = 0
+	p.dTerm = 0
+	p.out = 0
 	p.dFlag = false
 }
 
@@ -93,10 +218,11 @@ func Init(dt, kp, ki, kd, iMin, iMax, oMin, oMax float32) (*PID, error) {
 
 	var p PID
 
-	if dt < 0.0 || kp < 0.0 || ki < 0.0 || kd < 0.0 || iMin > iMax || oMin > oMax {
+	if dt <= 0.0 || kp < 0.0 || ki < 0.0 || kd < 0.0 || iMin > iMax || oMin > oMax {
 		return nil, errors.New("invalid PID parameters")
 	}
 
+	p.dt = dt
 	p.kp = kp
 	p.ki = ki * dt
 	p.kd = kd / dt
@@ -107,12 +233,177 @@ func Init(dt, kp, ki, kd, iMin, iMax, oMin, oMax float32) (*PID, error) {
 	p.oMin = oMin
 	p.oMax = oMax
 
-	p.sp = 0
-	p.evPrev = 0
-	p.iTerm = 0
-	p.dFlag = false
+	p.b = 1.0
+	p.c = 1.0
+	p.windup = WindupLimit
+
+	p.Reset()
 
 	return &p, nil
 }
 
 //-----------------------------------------------------------------------------
+// Modes
+
+// SetManual puts the PID in manual mode with a fixed output.
+// The integral term tracks the output, so the transfer back to auto is bumpless.
+func (p *PID) SetManual(out float32) {
+	if out > p.oMax {
+		out = p.oMax
+	}
+	if out < p.oMin {
+		out = p.oMin
+	}
+	p.manual = true
+	p.mOut = out
+}
+
+// SetAuto puts the PID in auto mode.
+func (p *PID) SetAuto() {
+	p.manual = false
+}
+
+// Manual returns true and the output if the PID is in manual mode.
+func (p *PID) Manual() (bool, float32) {
+	return p.manual, p.mOut
+}
+
+// Output returns the previous output.
+// Switching to manual mode with this output is bumpless.
+func (p *PID) Output() float32 {
+	return p.out
+}
+
+//-----------------------------------------------------------------------------
+// Configuration
+
+// Gains returns the (kp, ki, kd) gains.
+// ki is per second and kd is in seconds, as for Init.
+func (p *PID) Gains() (kp, ki, kd float32) {
+	return p.kp, p.ki / p.dt, p.kd * p.dt
+}
+
+// SetGains sets the (kp, ki, kd) gains.
+// With integral action the change is bumpless: the integral term absorbs the
+// step in the proportional term.
+func (p *PID) SetGains(kp, ki, kd float32) error {
+	if kp < 0.0 || ki < 0.0 || kd < 0.0 {
+		return errors.New("invalid PID gains")
+	}
+	if p.dFlag && ki != 0.0 {
+		p.iTerm = p.clampI(p.iTerm + (p.kp-kp)*(p.b*p.spPrev-p.pvPrev))
+	}
+	p.kp = kp
+	p.ki = ki * p.dt
+	p.kd = kd / p.dt
+	return nil
+}
+
+// Limits returns the integral term and output limits.
+func (p *PID) Limits() (iMin, iMax, oMin, oMax float32) {
+	return p.iMin, p.iMax, p.oMin, p.oMax
+}
+
+// SetLimits sets the integral term and output limits.
+func (p *PID) SetLimits(iMin, iMax, oMin, oMax float32) error {
+	if iMin > iMax || oMin > oMax {
+		return errors.New("invalid PID limits")
+	}
+	p.iMin = iMin
+	p.iMax = iMax
+	p.oMin = oMin
+	p.oMax = oMax
+	p.iTerm = p.clampI(p.iTerm)
+	return nil
+}
+
+// Weights returns the (b, c) setpoint weights for the proportional and derivative terms.
+func (p *PID) Weights() (b, c float32) {
+	return p.b, p.c
+}
+
+// SetWeights sets the (b, c) setpoint weights for the proportional and
+// derivative terms. b < 1 reduces the overshoot on setpoint changes.
+// With integral action the change is bumpless.
+func (p *PID) SetWeights(b, c float32) error {
+	if b < 0.0 || c < 0.0 {
+		return errors.New("invalid PID setpoint weights")
+	}
+	if p.dFlag && p.ki != 0.0 {
+		p.iTerm = p.clampI(p.iTerm + p.kp*(p.b-b)*p.spPrev)
+	}
+	p.b = b
+	p.c = c
+	return nil
+}
+
+// Derivative returns the derivative mode and filter time constant (seconds).
+func (p *PID) Derivative() (onMeasurement bool, tf float32) {
+	return p.dOnPV, p.tf
+}
+
+// SetDerivative sets the derivative mode and filter time constant (seconds).
+// With onMeasurement the derivative term ignores the setpoint, so setpoint
+// changes don't kick the output. tf = 0 turns off the filter.
+func (p *PID) SetDerivative(onMeasurement bool, tf float32) error {
+	if tf < 0.0 {
+		return errors.New("invalid PID derivative filter")
+	}
+	p.dOnPV = onMeasurement
+	p.tf = tf
+	return nil
+}
+
+// AntiWindup returns the anti-windup method and tracking gain (per second).
+func (p *PID) AntiWindup() (AntiWindup, float32) {
+	return p.windup, p.kt / p.dt
+}
+
+// SetAntiWindup sets the anti-windup method. kt is the back-calculation
+// tracking gain (per second), a good start is ki/kp.
+func (p *PID) SetAntiWindup(a AntiWindup, kt float32) error {
+	if _, ok := windup_names[a]; !ok {
+		return fmt.Errorf("unknown anti-windup method %d", int(a))
+	}
+	if kt < 0.0 || (a == WindupBackCalc && kt == 0.0) {
+		return errors.New("invalid PID tracking gain")
+	}
+	p.windup = a
+	p.kt = kt * p.dt
+	return nil
+}
+
+// Period returns the update period (seconds).
+func (p *PID) Period() float32 {
+	return p.dt
+}
+
+// SetPeriod sets the update period (seconds), keeping the ki, kd and kt gains.
+func (p *PID) SetPeriod(dt float32) error {
+	if dt <= 0.0 {
+		return errors.New("invalid PID period")
+	}
+	kp, ki, kd := p.Gains()
+	_, kt := p.AntiWindup()
+	p.dt = dt
+	p.kt = kt * dt
+	return p.SetGains(kp, ki, kd)
+}
+
+// Setpoint returns the set point value.
+func (p *PID) Setpoint() float32 {
+	return p.sp
+}
+
+// limit the integral term
+func (p *PID) clampI(i float32) float32 {
+	if i > p.iMax {
+		return p.iMax
+	}
+	if i < p.iMin {
+		return p.iMin
+	}
+	return i
+}
+
+//-----------------------------------------------------------------------------
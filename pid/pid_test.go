@@ -0,0 +1,156 @@
+//-----------------------------------------------------------------------------
+/*
+
+PID Controller Tests
+
+*/
+//-----------------------------------------------------------------------------
+
+package pid
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//-----------------------------------------------------------------------------
+
+// run a closed loop on a simulated process, return the process value
+func closed_loop(p *PID, plant *fopdt_plant, steps int) float64 {
+	n := int(float64(p.Period()) / plant.dt)
+	u, y := 0.0, 0.0
+	for i := 0; i < steps*n; i++ {
+		if i%n == 0 {
+			u = float64(p.Update(float32(y)))
+		}
+		y = plant.step(u)
+	}
+	return y
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_PID_Step(t *testing.T) {
+	m := FOPDT{2, 1, 0.2}
+	tn, err := m.Ultimate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, ki, kd := tn.Gains(TyreusLuyben)
+	p, err := Init(0.05, kp, ki, kd, -10, 10, -10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Set(1.0)
+	// the integral term removes the steady state error
+	y := closed_loop(p, new_plant(m, 0.001), 600)
+	if !near(y, 1.0, 0.01) {
+		t.Errorf("process value %f, expected 1.0", y)
+	}
+}
+
+func Test_PID_Feedforward(t *testing.T) {
+	m := FOPDT{2, 1, 0.2}
+	p, err := Init(0.05, 0.5, 0, 0, -10, 10, -10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Set(1.0)
+	// with an exact feedforward the error is zero from the start
+	p.SetFeedforward(0.5)
+	y := closed_loop(p, new_plant(m, 0.001), 200)
+	if !near(y, 1.0, 0.001) {
+		t.Errorf("process value %f, expected 1.0", y)
+	}
+}
+
+func Test_PID_Bumpless(t *testing.T) {
+	p, err := Init(0.1, 0.5, 1.0, 0.0, -1, 1, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Set(10.0)
+	p.SetManual(0.4)
+	for i := 0; i < 5; i++ {
+		if out := p.Update(8.0); out != 0.4 {
+			t.Fatalf("manual output %f", out)
+		}
+	}
+	p.SetAuto()
+	// the first auto output continues from the manual output
+	out := p.Update(8.0)
+	if !near(float64(out), 0.4+float64(p.ki)*2.0, 1e-6) {
+		t.Errorf("auto output %f after manual 0.4", out)
+	}
+}
+
+func Test_PID_Limits(t *testing.T) {
+	p, err := Init(0.1, 1.0, 1.0, 0.0, -0.5, 0.5, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Set(100.0)
+	for i := 0; i < 100; i++ {
+		if out := p.Update(0.0); out > 1.0 {
+			t.Fatalf("output %f above the limit", out)
+		}
+	}
+	if p.iTerm > 0.5 {
+		t.Errorf("integral term %f above the limit", p.iTerm)
+	}
+	if _, err := Init(0.1, -1.0, 0, 0, 0, 1, 0, 1); err == nil {
+		t.Error("negative gain accepted")
+	}
+}
+
+func Test_Config(t *testing.T) {
+	p, err := Init(0.2, 0.1, 0.2, 0.3, -1, 1, 0, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "pid.json")
+	err = Save(filename, map[string]Config{"a": p.Config()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg["a"] != p.Config() {
+		t.Errorf("loaded %+v, saved %+v", cfg["a"], p.Config())
+	}
+	// missing optional values take the defaults
+	limits := `"period": 0.1, "kp": 1, "ki": 0, "kd": 0, "imin": -1, "imax": 1, "omin": 0`
+	err = os.WriteFile(filename, []byte(`{"b": {`+limits+`, "omax": 1}}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cfg["b"]
+	if c.Kp != 1 || c.OMax != 1 || c.B != 1 || c.C != 1 || c.Windup != WindupLimit {
+		t.Errorf("defaults %+v", c)
+	}
+	if p.SetConfig(c) != nil {
+		t.Errorf("unable to set %+v", c)
+	}
+	// a missing required value is an error
+	err = os.WriteFile(filename, []byte(`{"b": {`+limits+`}}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load(filename); err == nil {
+		t.Error("configuration without omax loaded")
+	}
+	// an empty output range is an error
+	c.OMax = c.OMin
+	if p.SetConfig(c) == nil {
+		t.Errorf("set %+v", c)
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -18,6 +18,7 @@ import (
 	"log"
 	"math"
 
+	"github.com/deadsy/slamx/feature"
 	"github.com/deadsy/slamx/lidar"
 	"github.com/deadsy/slamx/util"
 	"github.com/veandco/go-sdl2/sdl"
@@ -69,14 +70,14 @@ func Open(name string) (*View, error) {
 
 	err := sdl.Init(sdl.INIT_EVERYTHING)
 	if err != nil {
-		log.Printf("%s: sdl.Init() failed %s", err)
+		log.Printf("%s: sdl.Init() failed %s", view.Name, err)
 		return nil, err
 	}
 
 	// create the window
 	window, err := sdl.CreateWindow("slamx", sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED, WINDOW_X, WINDOW_Y, sdl.WINDOW_SHOWN)
 	if err != nil {
-		log.Printf("%s: sdl.CreateWindow() failed %s", err)
+		log.Printf("%s: sdl.CreateWindow() failed %s", view.Name, err)
 		return nil, err
 	}
 	view.window = window
@@ -84,7 +85,7 @@ func Open(name string) (*View, error) {
 	// create the renderer
 	renderer, err := sdl.CreateRenderer(view.window, -1, sdl.RENDERER_ACCELERATED)
 	if err != nil {
-		log.Printf("%s: sdl.CreateRenderer() failed %s", err)
+		log.Printf("%s: sdl.CreateRenderer() failed %s", view.Name, err)
 		return nil, err
 	}
 	view.renderer = renderer
@@ -138,7 +139,7 @@ func (view *View) Render2(ofs float32) {
 	view.renderer.Present()
 }
 
-func (view *View) Render(scan *lidar.Scan_2D) {
+func (view *View) Render(scan *lidar.Scan2D) {
 	// clear the background
 	view.renderer.SetDrawColor(0, 0, 0, 255)
 	view.renderer.Clear()
@@ -155,6 +156,66 @@ func (view *View) Render(scan *lidar.Scan_2D) {
 	view.renderer.Present()
 }
 
+//-----------------------------------------------------------------------------
+// Features
+
+// draw a line between two points given in world coordinates
+func (view *View) line_xy(x0, y0, x1, y1 float64) {
+	sx0, sy0 := world2screen(float32(x0), float32(y0))
+	sx1, sy1 := world2screen(float32(x1), float32(y1))
+	view.renderer.DrawLine(sx0, sy0, sx1, sy1)
+}
+
+// draw a cross of size d at a point given in world coordinates
+func (view *View) cross_xy(x, y, d float64) {
+	view.line_xy(x-d, y-d, x+d, y+d)
+	view.line_xy(x-d, y+d, x+d, y-d)
+}
+
+// draw a circle given in world coordinates
+func (view *View) circle_xy(x, y, r float64) {
+	const n = 24
+	for i := 0; i < n; i++ {
+		a0 := 2.0 * math.Pi * float64(i) / n
+		a1 := 2.0 * math.Pi * float64(i+1) / n
+		view.line_xy(x+r*math.Cos(a0), y+r*math.Sin(a0), x+r*math.Cos(a1), y+r*math.Sin(a1))
+	}
+}
+
+// RenderFeatures draws a scan with its line, corner and circle features.
+func (view *View) RenderFeatures(scan *lidar.Scan2D, f *feature.Features) {
+	// clear the background
+	view.renderer.SetDrawColor(0, 0, 0, 255)
+	view.renderer.Clear()
+	// scan samples
+	view.renderer.SetDrawColor(128, 128, 128, 255)
+	for _, s := range scan.Samples {
+		if s.Good {
+			view.plot_polar(s.Distance, s.Angle)
+		}
+	}
+	// lines
+	view.renderer.SetDrawColor(0, 255, 0, 255)
+	for i := range f.Lines {
+		l := &f.Lines[i]
+		view.line_xy(l.A.X, l.A.Y, l.B.X, l.B.Y)
+	}
+	// corners
+	view.renderer.SetDrawColor(255, 0, 0, 255)
+	for i := range f.Corners {
+		c := &f.Corners[i]
+		view.cross_xy(c.P.X, c.P.Y, 0.05)
+	}
+	// circles
+	view.renderer.SetDrawColor(0, 128, 255, 255)
+	for i := range f.Circles {
+		c := &f.Circles[i]
+		view.circle_xy(c.C.X, c.C.Y, c.R)
+	}
+	// render to the window
+	view.renderer.Present()
+}
+
 //-----------------------------------------------------------------------------
 
 func (view *View) Events() bool {